@@ -0,0 +1,195 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// The admin API is served next to the OSB API, behind the same credentials.
+// It is meant for operators, not for the platform.
+
+func (sb *crdbServiceBroker) attachAdminRoutes(router *mux.Router) {
+	r := router.PathPrefix("/admin").Subrouter()
+	r.HandleFunc("/instances/{instance_id}/operations", sb.adminListOperations).Methods("GET")
+	r.HandleFunc("/instances/{instance_id}/operations/{operation_id}", sb.adminGetOperation).Methods("GET")
+	r.HandleFunc("/instances/{instance_id}/backups", sb.adminListBackups).Methods("GET")
+	r.HandleFunc("/instances/{instance_id}/backups", sb.adminCreateBackup).Methods("POST")
+	r.HandleFunc("/instances/{instance_id}/backups/{backup_id}/restore", sb.adminRestoreBackup).Methods("POST")
+	r.HandleFunc("/tombstones", sb.adminListTombstones).Methods("GET")
+	r.HandleFunc("/tombstones/{instance_id}/restore", sb.adminRestoreTombstone).Methods("POST")
+	r.HandleFunc("/orphans", sb.adminListOrphans).Methods("GET")
+	r.HandleFunc("/orphans/drop", sb.adminDropOrphans).Methods("POST")
+	r.HandleFunc("/state/rebuild", sb.adminRebuildState).Methods("POST")
+}
+
+func adminRespond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error("encoding-admin-response", err)
+	}
+}
+
+// statusError is an error that maps to a specific HTTP status in the admin
+// API.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func newStatusError(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func adminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch e := err.(type) {
+	case *statusError:
+		status = e.status
+	default:
+		if err == errStateNotFound || err == brokerapi.ErrInstanceDoesNotExist {
+			status = http.StatusNotFound
+		}
+	}
+	adminRespond(w, status, brokerapi.ErrorResponse{Description: err.Error()})
+}
+
+func (sb *crdbServiceBroker) adminListOperations(w http.ResponseWriter, req *http.Request) {
+	ops, err := sb.state.Operations(mux.Vars(req)["instance_id"])
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, ops)
+}
+
+func (sb *crdbServiceBroker) adminGetOperation(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	op, err := sb.state.Operation(vars["instance_id"], vars["operation_id"])
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, op)
+}
+
+func (sb *crdbServiceBroker) adminListBackups(w http.ResponseWriter, req *http.Request) {
+	backups, err := sb.state.Backups(mux.Vars(req)["instance_id"])
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, backups)
+}
+
+func (sb *crdbServiceBroker) adminCreateBackup(w http.ResponseWriter, req *http.Request) {
+	op, err := sb.startBackup(mux.Vars(req)["instance_id"], false /* scheduled */)
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusAccepted, op)
+}
+
+func (sb *crdbServiceBroker) adminRestoreBackup(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	var body struct {
+		// TargetInstanceID is the instance to restore into; defaults to the
+		// instance that was backed up.
+		TargetInstanceID string `json:"target_instance_id"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			adminRespond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+	}
+	if body.TargetInstanceID == "" {
+		body.TargetInstanceID = vars["instance_id"]
+	}
+	op, err := sb.startRestore(vars["instance_id"], vars["backup_id"], body.TargetInstanceID)
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusAccepted, op)
+}
+
+func (sb *crdbServiceBroker) adminListTombstones(w http.ResponseWriter, req *http.Request) {
+	tombstones, err := sb.state.Tombstones()
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, tombstones)
+}
+
+func (sb *crdbServiceBroker) adminRestoreTombstone(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		// TargetInstanceID is the (already provisioned) instance that gets
+		// the deleted database. By default, the deleted instance is
+		// recreated.
+		TargetInstanceID string `json:"target_instance_id"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			adminRespond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+	}
+	if err := sb.restoreTombstone(mux.Vars(req)["instance_id"], body.TargetInstanceID); err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, brokerapi.EmptyResponse{})
+}
+
+func (sb *crdbServiceBroker) adminListOrphans(w http.ResponseWriter, req *http.Request) {
+	orphans, err := sb.findOrphans(time.Now())
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, orphans)
+}
+
+func (sb *crdbServiceBroker) adminDropOrphans(w http.ResponseWriter, req *http.Request) {
+	dropped, err := sb.dropOrphans(time.Now())
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, dropped)
+}
+
+func (sb *crdbServiceBroker) adminRebuildState(w http.ResponseWriter, req *http.Request) {
+	rebuilt, err := sb.rebuildState()
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	adminRespond(w, http.StatusOK, rebuilt)
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+)
+
+// newBrokerHandler returns the HTTP handler serving the Open Service Broker
+// API for the given broker, along with the broker's admin API and instance
+// dashboards. Most OSB routes are served by brokerapi; the catalog is served by
+// us so we can expose fields brokerapi doesn't know about.
+func newBrokerHandler(sb *crdbServiceBroker, credentials brokerapi.BrokerCredentials) http.Handler {
+	router := mux.NewRouter()
+	// Routes registered first take precedence over the brokerapi ones.
+	router.HandleFunc("/v2/catalog", sb.serveCatalog).Methods("GET")
+	sb.attachAdminRoutes(router)
+	brokerapi.AttachRoutes(router, sb, log)
+
+	handler := http.NewServeMux()
+	// Dashboards have their own authentication.
+	handler.HandleFunc(dashboardPath, sb.serveDashboard)
+	handler.Handle("/", withRequestContext(
+		auth.NewWrapper(credentials.Username, credentials.Password).Wrap(router),
+	))
+	return handler
+}
+
+type catalogServiceMetadata struct {
+	*brokerapi.ServiceMetadata
+	Shareable bool `json:"shareable,omitempty"`
+}
+
+type catalogService struct {
+	brokerapi.Service
+	Metadata *catalogServiceMetadata `json:"metadata,omitempty"`
+}
+
+func (sb *crdbServiceBroker) serveCatalog(w http.ResponseWriter, req *http.Request) {
+	var catalog struct {
+		Services []catalogService `json:"services"`
+	}
+	for i, s := range sb.Services(req.Context()) {
+		cs := catalogService{Service: s}
+		if s.Metadata != nil || Services[i].Shareable {
+			cs.Metadata = &catalogServiceMetadata{
+				ServiceMetadata: s.Metadata,
+				Shareable:       Services[i].Shareable,
+			}
+		}
+		catalog.Services = append(catalog.Services, cs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(catalog); err != nil {
+		log.Error("encoding-catalog", err)
+	}
+}
+
+// requestContext holds the OSB "context" object that platforms send with
+// provision, update and bind requests. The vendored brokerapi doesn't decode
+// it, so withRequestContext extracts it from the request body.
+type requestContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid"`
+	SpaceGUID        string `json:"space_guid"`
+}
+
+type requestContextKey struct{}
+
+// requestContextFrom returns the OSB context of the request being served. All
+// fields are empty if the platform didn't send one.
+func requestContextFrom(ctx context.Context) requestContext {
+	rc, _ := ctx.Value(requestContextKey{}).(requestContext)
+	return rc
+}
+
+// responseOverride is attached to the context of PUT requests to let broker
+// methods adjust the response that brokerapi writes.
+type responseOverride struct {
+	// alreadyExists turns a 201 response into a 200, as the OSB API requires
+	// when a provision or bind request is repeated. The vendored brokerapi
+	// always answers 201.
+	alreadyExists bool
+}
+
+type responseOverrideKey struct{}
+
+// markAlreadyExists records that the request being served is a repeat of one
+// that already succeeded.
+func markAlreadyExists(ctx context.Context) {
+	if o, ok := ctx.Value(responseOverrideKey{}).(*responseOverride); ok {
+		o.alreadyExists = true
+	}
+}
+
+type overrideResponseWriter struct {
+	http.ResponseWriter
+	override *responseOverride
+}
+
+func (w overrideResponseWriter) WriteHeader(status int) {
+	if status == http.StatusCreated && w.override.alreadyExists {
+		status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func withRequestContext(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body != nil && (req.Method == "PUT" || req.Method == "PATCH") {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			var parsed struct {
+				Context requestContext `json:"context"`
+			}
+			// Malformed bodies are rejected by brokerapi.
+			if json.Unmarshal(body, &parsed) == nil {
+				req = req.WithContext(
+					context.WithValue(req.Context(), requestContextKey{}, parsed.Context),
+				)
+			}
+		}
+		if req.Method == "PUT" {
+			override := &responseOverride{}
+			req = req.WithContext(context.WithValue(req.Context(), responseOverrideKey{}, override))
+			w = overrideResponseWriter{ResponseWriter: w, override: override}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
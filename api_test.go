@@ -0,0 +1,109 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestCatalogShareable(t *testing.T) {
+	defer func(s []Service) { Services = s }(Services)
+	Services = []Service{
+		{
+			Service: brokerapi.Service{
+				ID:       "svc-shared",
+				Name:     "shared",
+				Metadata: &brokerapi.ServiceMetadata{DisplayName: "Shared"},
+			},
+			Shareable: true,
+		},
+		{
+			Service: brokerapi.Service{ID: "svc-private", Name: "private"},
+		},
+	}
+
+	creds := brokerapi.BrokerCredentials{Username: "user", Password: "pass"}
+	server := httptest.NewServer(newBrokerHandler(newCRDBServiceBroker(newBrokerState(newMemKVStore())), creds))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/v2/catalog", nil)
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var catalog struct {
+		Services []struct {
+			ID       string                 `json:"id"`
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"services"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 2 {
+		t.Fatalf("expected 2 services, got %+v", catalog.Services)
+	}
+	if m := catalog.Services[0].Metadata; m["shareable"] != true || m["displayName"] != "Shared" {
+		t.Errorf("unexpected metadata for shareable service: %v", m)
+	}
+	if m := catalog.Services[1].Metadata; m != nil {
+		t.Errorf("unexpected metadata for private service: %v", m)
+	}
+
+	// The catalog still requires authentication.
+	resp, err = http.Get(server.URL + "/v2/catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	var rc requestContext
+	var body string
+	h := withRequestContext(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rc = requestContextFrom(req.Context())
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	}))
+
+	in := `{"app_guid":"app","context":{"platform":"cloudfoundry","organization_guid":"org","space_guid":"space"}}`
+	req := httptest.NewRequest("PUT", "/v2/service_instances/i/service_bindings/b", strings.NewReader(in))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := requestContext{Platform: "cloudfoundry", OrganizationGUID: "org", SpaceGUID: "space"}
+	if rc != expected {
+		t.Errorf("expected %+v, got %+v", expected, rc)
+	}
+	if body != in {
+		t.Errorf("body not preserved: %s", body)
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Backend creates and drops instances and their credentials. The broker
+// handles the requests (records, leases, operations, retention) and leaves
+// the instances' objects to the backend of their plan's isolation; see
+// backends. Instances are given by their record, which for plans with a
+// database or schema per instance may only have the ID if the broker lost it
+// (see rebuildState).
+type Backend interface {
+	// Async returns whether creating and dropping instances takes too long
+	// for a synchronous request, in which case the broker calls
+	// CreateInstance, DeleteInstance and DropInstance from operations; see
+	// instanceOperationFunc.
+	Async() bool
+	// CreateInstance creates the objects of an instance, with the given
+	// comment. It fails with brokerapi.ErrInstanceAlreadyExists if they
+	// exist but weren't created by the broker.
+	CreateInstance(ctx context.Context, instance *instanceRecord, comment *instanceComment) error
+	// DeleteInstance ends access to the objects of an instance and keeps
+	// them for the plan's deletion retention, recording a tombstone; see
+	// reap.
+	DeleteInstance(ctx context.Context, instance *instanceRecord) error
+	// DropInstance drops the objects of an instance, along with everything
+	// in them. It does nothing if they don't exist.
+	DropInstance(ctx context.Context, instance *instanceRecord) error
+	// UpdateInstance applies update to the comment of an instance.
+	UpdateInstance(ctx context.Context, instance *instanceRecord, update func(*instanceComment)) error
+	// TerminateSessions ends all the sessions that can reach the objects
+	// of an instance, including those of users the broker didn't create.
+	TerminateSessions(ctx context.Context, instance *instanceRecord) error
+	// CreateCredentials creates the user of a binding and returns its
+	// credentials.
+	CreateCredentials(ctx context.Context, instance *instanceRecord, binding *bindingRecord) (map[string]interface{}, error)
+	// RevokeCredentials drops the user of a binding, whose record may be
+	// nil if the broker doesn't have it.
+	RevokeCredentials(ctx context.Context, instance *instanceRecord, bindingID string, binding *bindingRecord) error
+	// Describe returns where an instance lives and its comment.
+	Describe(ctx context.Context, instance *instanceRecord) (*instanceDescription, error)
+	// Resize changes where the data of an instance is placed.
+	Resize(ctx context.Context, instance *instanceRecord, regions *regionConfig) error
+}
+
+// instanceDescription is what Backend.Describe reports about an instance.
+type instanceDescription struct {
+	// Cluster is the SQL address of the instance's cluster.
+	Cluster   string
+	Namespace instanceNamespace
+	// Comment is nil if the instance's database has no comment.
+	Comment *instanceComment
+}
+
+// backends maps the isolations of plans to their backends.
+var backends = map[string]func(sb *crdbServiceBroker, p *Plan) Backend{
+	isolationDatabase: func(sb *crdbServiceBroker, p *Plan) Backend { return &sqlBackend{sb: sb, plan: p} },
+	isolationSchema:   func(sb *crdbServiceBroker, p *Plan) Backend { return &sqlBackend{sb: sb, plan: p} },
+	isolationTenant: func(sb *crdbServiceBroker, p *Plan) Backend {
+		return &tenantBackend{clusterBackend{sqlBackend{sb: sb, plan: p}}}
+	},
+	isolationDedicated: func(sb *crdbServiceBroker, p *Plan) Backend {
+		return &dedicatedBackend{clusterBackend{sqlBackend{sb: sb, plan: p}}}
+	},
+	isolationCloud: func(sb *crdbServiceBroker, p *Plan) Backend {
+		return &cloudBackend{clusterBackend{sqlBackend{sb: sb, plan: p}}}
+	},
+}
+
+// backend returns the Backend of the plan's instances.
+func (sb *crdbServiceBroker) backend(plan *Plan) Backend {
+	isolation := plan.Isolation
+	if isolation == "" {
+		isolation = isolationDatabase
+	}
+	return backends[isolation](sb, plan)
+}
+
+// sqlBackend is the Backend of plans with database or schema isolation,
+// whose instances get a database or a schema on the plan's cluster, which
+// the broker manages over SQL.
+type sqlBackend struct {
+	sb   *crdbServiceBroker
+	plan *Plan
+}
+
+// Async is part of the Backend interface.
+func (b *sqlBackend) Async() bool {
+	return false
+}
+
+// CreateInstance is part of the Backend interface.
+func (b *sqlBackend) CreateInstance(ctx context.Context, instance *instanceRecord, comment *instanceComment) error {
+	plan := b.plan
+	ns := plan.namespace(instance.ID)
+	if err := ns.create(plan.crdb, comment); err != nil {
+		if isAlreadyExists(err, objectDatabase) || isAlreadyExists(err, objectSchema) {
+			// The database wasn't created by a request we know about.
+			return brokerapi.ErrInstanceAlreadyExists
+		}
+		log.Error("create-database", err)
+		if isPermissionDenied(err) {
+			return fmt.Errorf("creating database: %s (user %s needs the CREATEDB privilege)", err, plan.CRDBAdminUser)
+		}
+		return fmt.Errorf("creating database: %s", err)
+	}
+
+	if err := setRegions(plan.crdb, ns.database, nil, instance.Regions); err != nil {
+		log.Error("set-regions", err)
+		_ = ns.drop(plan.crdb)
+		return fmt.Errorf("configuring regions: %s", err)
+	}
+	return nil
+}
+
+// DeleteInstance is part of the Backend interface. Only plans with database
+// isolation support deletion retention.
+func (b *sqlBackend) DeleteInstance(ctx context.Context, instance *instanceRecord) error {
+	if err := b.sb.softDeleteDatabase(b.plan, instance.ID); err != nil {
+		return fmt.Errorf("deleting database: %s", err)
+	}
+	return nil
+}
+
+// DropInstance is part of the Backend interface.
+func (b *sqlBackend) DropInstance(ctx context.Context, instance *instanceRecord) error {
+	if err := b.plan.namespace(instance.ID).drop(b.plan.crdb); err != nil {
+		return fmt.Errorf("dropping database: %s", err)
+	}
+	// The owner role only owns objects in the database.
+	if _, err := execWithRetry(b.plan.crdb, "DROP ROLE IF EXISTS "+ownerRoleFromInstanceID(instance.ID)); err != nil {
+		return fmt.Errorf("dropping owner role: %s", err)
+	}
+	return nil
+}
+
+// UpdateInstance is part of the Backend interface.
+func (b *sqlBackend) UpdateInstance(
+	ctx context.Context, instance *instanceRecord, update func(*instanceComment),
+) error {
+	crdb, err := b.sb.instanceDB(b.plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	if err := updateDatabaseComment(crdb, b.plan.namespace(instance.ID), update); err != nil {
+		return fmt.Errorf("commenting database: %s", err)
+	}
+	return nil
+}
+
+// TerminateSessions is part of the Backend interface.
+func (b *sqlBackend) TerminateSessions(ctx context.Context, instance *instanceRecord) error {
+	crdb, err := b.sb.instanceDB(b.plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	query, args := instanceSessionsQuery(b.plan, b.plan.namespace(instance.ID))
+	if err := cancelSessions(crdb, b.plan.sessionTimeout(), query, args...); err != nil {
+		return fmt.Errorf("terminating sessions: %s", err)
+	}
+	return nil
+}
+
+// CreateCredentials is part of the Backend interface.
+func (b *sqlBackend) CreateCredentials(
+	ctx context.Context, instance *instanceRecord, binding *bindingRecord,
+) (map[string]interface{}, error) {
+	crdb, err := b.sb.instanceDB(b.plan, instance.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Create the user and grant it its role, undoing what was done if a step
+	// fails.
+	if err := b.sb.bindSaga(b.plan, crdb, binding).run(); err != nil {
+		return nil, err
+	}
+	return bindingCredentials(b.plan, instance, userNameFromBinding(instance.ID, binding.ID), binding.Password), nil
+}
+
+// RevokeCredentials is part of the Backend interface.
+func (b *sqlBackend) RevokeCredentials(
+	ctx context.Context, instance *instanceRecord, bindingID string, binding *bindingRecord,
+) error {
+	crdb, err := b.sb.instanceDB(b.plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	if binding == nil {
+		// Without a record, the binding only exists if its user does, as it
+		// does when the broker lost its state.
+		exists, err := userExists(crdb, userNameFromBinding(instance.ID, bindingID))
+		if err != nil {
+			log.Error("list-users", err)
+			return fmt.Errorf("listing users: %s", err)
+		}
+		if !exists {
+			return brokerapi.ErrBindingDoesNotExist
+		}
+	}
+	return b.sb.unbindSaga(ctx, b.plan, crdb, instance.ID, bindingID, binding).run()
+}
+
+// Describe is part of the Backend interface.
+func (b *sqlBackend) Describe(ctx context.Context, instance *instanceRecord) (*instanceDescription, error) {
+	conn := b.plan.instanceConn(instance)
+	desc := &instanceDescription{
+		Cluster:   fmt.Sprintf("%s:%s", conn.host, conn.port),
+		Namespace: b.plan.namespace(instance.ID),
+	}
+	crdb, err := b.sb.instanceDB(b.plan, instance.ID)
+	if err != nil {
+		return nil, err
+	}
+	if desc.Comment, err = databaseComment(crdb, desc.Namespace); err != nil {
+		return nil, fmt.Errorf("reading database comment: %s", err)
+	}
+	return desc, nil
+}
+
+// Resize is part of the Backend interface. It changes the regions of the
+// instance's database, which is idempotent.
+func (b *sqlBackend) Resize(ctx context.Context, instance *instanceRecord, regions *regionConfig) error {
+	if err := checkRegions(b.plan, regions); err != nil {
+		return err
+	}
+	ns := b.plan.namespace(instance.ID)
+	if err := setRegions(b.plan.crdb, ns.database, instance.Regions, regions); err != nil {
+		log.Error("set-regions", err)
+		return fmt.Errorf("configuring regions: %s", err)
+	}
+	return nil
+}
+
+// clusterBackend is what the Backends of plans that give each instance a
+// cluster of their own have in common. Bindings are managed over SQL in the
+// instance's cluster, like those of sqlBackend. Creating and dropping
+// clusters is left to tenantBackend, dedicatedBackend and cloudBackend, every
+// step of which is idempotent, so that an interrupted operation can be
+// resumed.
+type clusterBackend struct {
+	sqlBackend
+}
+
+// Async is part of the Backend interface.
+func (b *clusterBackend) Async() bool {
+	return true
+}
+
+// DeleteInstance is part of the Backend interface. Only virtual clusters
+// can be kept after their instance is deprovisioned.
+func (b *clusterBackend) DeleteInstance(ctx context.Context, instance *instanceRecord) error {
+	return fmt.Errorf("%s isolation doesn't support deletion retention", b.plan.Isolation)
+}
+
+// Resize is part of the Backend interface. The clusters of instances don't
+// support regions (see checkRegions), so there is never anything to do.
+func (b *clusterBackend) Resize(ctx context.Context, instance *instanceRecord, regions *regionConfig) error {
+	return checkRegions(b.plan, regions)
+}
+
+// commentCluster comments the database of an instance in its newly created
+// cluster.
+func (b *clusterBackend) commentCluster(instance *instanceRecord, c *instanceComment) error {
+	crdb, err := b.sb.instanceDB(b.plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	if err := setDatabaseComment(crdb, b.plan.namespace(instance.ID), c); err != nil {
+		return fmt.Errorf("commenting database: %s", err)
+	}
+	return nil
+}
+
+// tenantBackend is the Backend of plans with tenant isolation, which give
+// each instance a virtual cluster of the plan's cluster.
+type tenantBackend struct {
+	clusterBackend
+}
+
+// CreateInstance is part of the Backend interface.
+func (b *tenantBackend) CreateInstance(ctx context.Context, instance *instanceRecord, comment *instanceComment) error {
+	if err := b.sb.createTenant(b.plan, instance); err != nil {
+		return err
+	}
+	return b.commentCluster(instance, comment)
+}
+
+// DeleteInstance is part of the Backend interface.
+func (b *tenantBackend) DeleteInstance(ctx context.Context, instance *instanceRecord) error {
+	return b.sb.softDeleteTenant(b.plan, instance.ID)
+}
+
+// DropInstance is part of the Backend interface.
+func (b *tenantBackend) DropInstance(ctx context.Context, instance *instanceRecord) error {
+	b.sb.closeInstanceDB(instance.ID)
+	return b.sb.dropTenant(b.plan, instance.ID)
+}
+
+// dedicatedBackend is the Backend of plans with dedicated isolation, which
+// give each instance a cluster on Kubernetes.
+type dedicatedBackend struct {
+	clusterBackend
+}
+
+// CreateInstance is part of the Backend interface.
+func (b *dedicatedBackend) CreateInstance(ctx context.Context, instance *instanceRecord, comment *instanceComment) error {
+	if err := b.sb.createDedicated(b.plan, instance); err != nil {
+		return err
+	}
+	return b.commentCluster(instance, comment)
+}
+
+// DropInstance is part of the Backend interface.
+func (b *dedicatedBackend) DropInstance(ctx context.Context, instance *instanceRecord) error {
+	b.sb.closeInstanceDB(instance.ID)
+	return b.sb.dropDedicated(b.plan, instance.ID)
+}
+
+// cloudBackend is the Backend of plans with cloud isolation, which give each
+// instance a CockroachDB Cloud cluster, or a database in the plan's.
+type cloudBackend struct {
+	clusterBackend
+}
+
+// CreateInstance is part of the Backend interface.
+func (b *cloudBackend) CreateInstance(ctx context.Context, instance *instanceRecord, comment *instanceComment) error {
+	if err := b.sb.createCloud(b.plan, instance); err != nil {
+		return err
+	}
+	return b.commentCluster(instance, comment)
+}
+
+// DropInstance is part of the Backend interface.
+func (b *cloudBackend) DropInstance(ctx context.Context, instance *instanceRecord) error {
+	// dropCloud may need the connection to the instance's cluster.
+	defer b.sb.closeInstanceDB(instance.ID)
+	return b.sb.dropCloud(b.plan, instance)
+}
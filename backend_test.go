@@ -0,0 +1,134 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBackends(t *testing.T) {
+	testCases := []struct {
+		isolation string
+		expected  Backend
+	}{
+		{"", &sqlBackend{}},
+		{isolationDatabase, &sqlBackend{}},
+		{isolationSchema, &sqlBackend{}},
+		{isolationTenant, &tenantBackend{}},
+		{isolationDedicated, &dedicatedBackend{}},
+		{isolationCloud, &cloudBackend{}},
+	}
+	sb := newCRDBServiceBroker(newBrokerState(newMemKVStore()))
+	for _, tc := range testCases {
+		backend := sb.backend(&Plan{Isolation: tc.isolation})
+		if reflect.TypeOf(backend) != reflect.TypeOf(tc.expected) {
+			t.Errorf("%q: expected %T, got %T", tc.isolation, tc.expected, backend)
+		}
+		if clusterPerInstance := (&Plan{Isolation: tc.isolation}).clusterPerInstance(); backend.Async() != clusterPerInstance {
+			t.Errorf("%q: expected Async() to be %t", tc.isolation, clusterPerInstance)
+		}
+	}
+}
+
+func TestSQLBackend(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+	backend := b.sb.backend(b.plan)
+	instance := &instanceRecord{ID: "inst1"}
+	dbName := dbNameFromInstanceID("inst1")
+
+	if err := backend.CreateInstance(ctx, instance, &instanceComment{InstanceID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !b.cluster.databases[dbName] {
+		t.Fatalf("expected database %s", dbName)
+	}
+	if err := backend.CreateInstance(ctx, instance, nil); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Errorf("expected %v, got %v", brokerapi.ErrInstanceAlreadyExists, err)
+	}
+
+	desc, err := backend.Describe(ctx, instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Cluster != "crdb.example.com:26257" || desc.Namespace.database != dbName {
+		t.Errorf("unexpected description %+v", desc)
+	}
+	if desc.Comment == nil || desc.Comment.InstanceID != "inst1" {
+		t.Errorf("unexpected comment %+v", desc.Comment)
+	}
+
+	if err := backend.UpdateInstance(ctx, instance, func(c *instanceComment) {
+		c.DeletionProtection = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if desc, err := backend.Describe(ctx, instance); err != nil || !desc.Comment.DeletionProtection {
+		t.Errorf("expected the comment to be updated, got %+v (%v)", desc, err)
+	}
+
+	binding := &bindingRecord{
+		ID: "bind1", InstanceID: "inst1", Role: roleReadWrite, State: statePending, Password: "pass",
+	}
+	creds, err := backend.CreateCredentials(ctx, instance, binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := userNameFromBinding("inst1", "bind1")
+	if creds["username"] != user || creds["password"] != "pass" || creds["database"] != dbName {
+		t.Errorf("unexpected credentials %v", creds)
+	}
+	if !b.cluster.hasUser(user) {
+		t.Fatalf("expected user %s", user)
+	}
+	if err := backend.RevokeCredentials(ctx, instance, "bind1", binding); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.hasUser(user) {
+		t.Errorf("user %s not dropped", user)
+	}
+
+	if err := backend.DropInstance(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.databases[dbName] {
+		t.Errorf("database %s not dropped", dbName)
+	}
+	// Dropping is idempotent.
+	if err := backend.DropInstance(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterBackendResize(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.Isolation = isolationTenant
+	ctx := context.Background()
+	backend := b.sb.backend(b.plan)
+	instance := &instanceRecord{ID: "inst1"}
+
+	if err := backend.Resize(ctx, instance, nil); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if err := backend.Resize(ctx, instance, &regionConfig{PrimaryRegion: "us-east1"}); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,651 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	kindBackup = "backup"
+
+	opBackup  = "backup"
+	opRestore = "restore"
+)
+
+// backupConfig is the backup configuration of a plan.
+type backupConfig struct {
+	// URI is the external storage location under which backups are stored,
+	// e.g. nodelocal://1/backups, s3://bucket/path?AUTH=implicit or
+	// gs://bucket/path. Each instance gets its own backup collection in a
+	// subdirectory named after the instance ID.
+	URI string `json:"uri"`
+	// Interval enables scheduled backups of every instance of the plan, e.g.
+	// "24h".
+	Interval string `json:"interval,omitempty"`
+	// Retention is the number of backups of each instance to keep; older
+	// backups are deleted. Zero means keep everything. CockroachDB can't
+	// delete backups, so the broker deletes their files itself, which it
+	// can do on s3 storage with AUTH=specified and on nodelocal storage
+	// with LocalDir; see newBackupStore.
+	Retention int `json:"retention,omitempty"`
+	// LocalDir is the directory nodelocal URIs refer to (the node's
+	// --external-io-dir), for brokers that can reach it, e.g. on the host of
+	// a single-node cluster.
+	LocalDir string `json:"localDir,omitempty"`
+
+	interval time.Duration
+	store    backupStore
+}
+
+func (c *backupConfig) validate() error {
+	if c.URI == "" {
+		return errors.New("backup uri required")
+	}
+	if _, err := url.Parse(c.URI); err != nil {
+		return fmt.Errorf("invalid backup uri: %s", err)
+	}
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid backup interval: %s", err)
+		}
+		c.interval = d
+	}
+	if c.Retention < 0 {
+		return errors.New("backup retention cannot be negative")
+	}
+	if c.Retention > 0 {
+		store, err := newBackupStore(c)
+		if err != nil {
+			return err
+		}
+		c.store = store
+	}
+	return nil
+}
+
+// collection returns the URI of the backup collection of an instance.
+func (c *backupConfig) collection(instanceID string) string {
+	u, err := url.Parse(c.URI)
+	if err != nil {
+		// Validated in addPlan.
+		panic(err)
+	}
+	u.Path = path.Join("/", u.Path, instanceID)
+	return u.String()
+}
+
+// backupRecord describes one backup of an instance database.
+type backupRecord struct {
+	ID         string    `json:"id"`
+	InstanceID string    `json:"instanceID"`
+	ServiceID  string    `json:"serviceID"`
+	PlanID     string    `json:"planID"`
+	Database   string    `json:"database"`
+	Subdir     string    `json:"subdir"`
+	Created    time.Time `json:"created"`
+	Scheduled  bool      `json:"scheduled,omitempty"`
+}
+
+func (s *brokerState) Backup(instanceID, backupID string) (*backupRecord, error) {
+	var r backupRecord
+	if err := s.get(kindBackup, instanceID+"/"+backupID, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *brokerState) PutBackup(r *backupRecord) error {
+	return s.put(kindBackup, r.InstanceID+"/"+r.ID, r)
+}
+
+func (s *brokerState) DeleteBackup(r *backupRecord) error {
+	return s.kv.Delete(kindBackup, r.InstanceID+"/"+r.ID)
+}
+
+// Backups returns the backups of an instance, oldest first.
+func (s *brokerState) Backups(instanceID string) ([]*backupRecord, error) {
+	var res []*backupRecord
+	err := s.list(kindBackup, instanceID+"/", func(data []byte) error {
+		var r backupRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		res = append(res, &r)
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res, err
+}
+
+// instancePlan returns the record and the plan of a provisioned instance.
+func (sb *crdbServiceBroker) instancePlan(instanceID string) (*instanceRecord, *Plan, error) {
+	instance, err := sb.state.Instance(instanceID)
+	if err != nil {
+		if err == errStateNotFound {
+			return nil, nil, brokerapi.ErrInstanceDoesNotExist
+		}
+		return nil, nil, err
+	}
+	plan, err := findPlan(instance.ServiceID, instance.PlanID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return instance, plan, nil
+}
+
+// inProgress returns whether the instance has an operation of the given type
+// in progress.
+func (sb *crdbServiceBroker) inProgress(instanceID, opType string) (bool, error) {
+	ops, err := sb.state.Operations(instanceID)
+	if err != nil {
+		return false, err
+	}
+	for _, op := range ops {
+		if op.Type == opType && op.State == brokerapi.InProgress {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// startBackup starts an asynchronous backup of an instance's database.
+func (sb *crdbServiceBroker) startBackup(instanceID string, scheduled bool) (*operationRecord, error) {
+	instance, plan, err := sb.instancePlan(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Backups == nil {
+		return nil, newStatusError(http.StatusUnprocessableEntity, "plan '%s' does not support backups", plan.Name)
+	}
+	if busy, err := sb.inProgress(instanceID, opBackup); err != nil {
+		return nil, err
+	} else if busy {
+		return nil, newStatusError(http.StatusConflict, "a backup of this instance is already in progress")
+	}
+	return sb.startOperation(&operationRecord{
+		InstanceID: instance.ID,
+		Type:       opBackup,
+		Scheduled:  scheduled,
+	})
+}
+
+// listBackups returns the subdirectories of a backup collection.
+func listBackups(plan *Plan, collection string) (map[string]bool, error) {
+	rows, err := plan.crdb.Query("SHOW BACKUPS IN $1", collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]bool)
+	for rows.Next() {
+		var subdir string
+		if err := rows.Scan(&subdir); err != nil {
+			return nil, err
+		}
+		res[subdir] = true
+	}
+	return res, rows.Err()
+}
+
+// backup runs BACKUP DATABASE for the instance into its collection, records
+// the new backup and applies the plan's retention.
+func (sb *crdbServiceBroker) backup(
+	instance *instanceRecord, plan *Plan, scheduled bool,
+) (*backupRecord, error) {
+	dbName := dbNameFromInstanceID(instance.ID)
+	collection := plan.Backups.collection(instance.ID)
+
+	// BACKUP INTO picks the subdirectory itself and doesn't return it; find
+	// it by comparing the collection before and after.
+	before, err := listBackups(plan, collection)
+	if err != nil && !isNoBackupsError(err) {
+		return nil, fmt.Errorf("listing backups: %s", err)
+	}
+	if _, err := plan.crdb.Exec("BACKUP DATABASE "+dbName+" INTO $1", collection); err != nil {
+		return nil, fmt.Errorf("backing up database: %s", err)
+	}
+	after, err := listBackups(plan, collection)
+	if err != nil {
+		return nil, fmt.Errorf("listing backups: %s", err)
+	}
+	var subdirs []string
+	for s := range after {
+		if !before[s] {
+			subdirs = append(subdirs, s)
+		}
+	}
+	if len(subdirs) == 0 {
+		return nil, errors.New("backup not found in collection")
+	}
+	// Subdirectories are timestamps; if another backup raced with us, the
+	// latest one is ours.
+	sort.Strings(subdirs)
+
+	b := &backupRecord{
+		ID:         uuid.NewV4().String(),
+		InstanceID: instance.ID,
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		Database:   dbName,
+		Subdir:     subdirs[len(subdirs)-1],
+		Created:    time.Now().UTC(),
+		Scheduled:  scheduled,
+	}
+	if err := sb.state.PutBackup(b); err != nil {
+		return nil, fmt.Errorf("storing backup: %s", err)
+	}
+
+	if err := sb.applyRetention(plan, instance.ID); err != nil {
+		return nil, fmt.Errorf("applying retention: %s", err)
+	}
+	return b, nil
+}
+
+// noBackupsErrRegexp matches the messages of the storage providers saying
+// that a file doesn't exist.
+var noBackupsErrRegexp = regexp.MustCompile("(no such file|does not exist|not found)")
+
+// isNoBackupsError returns true if the error is due to the collection not
+// existing yet. CockroachDB reports missing files as undefined_file, but
+// most external storage failures, whether the collection is missing or the
+// credentials are wrong, come back as io_error with the storage provider's
+// message; for those, only the message tells a missing collection apart.
+func isNoBackupsError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code {
+	case codeUndefinedFile:
+		return true
+	case codeIOError:
+		return noBackupsErrRegexp.MatchString(pqErr.Message)
+	}
+	return false
+}
+
+// applyRetention deletes all but the latest backups of an instance, as many
+// as the plan's retention, from the storage and from the broker's state. The
+// files go first, so that a backup whose files couldn't be deleted is tried
+// again after the next backup.
+func (sb *crdbServiceBroker) applyRetention(plan *Plan, instanceID string) error {
+	cfg := plan.Backups
+	if cfg.Retention <= 0 {
+		return nil
+	}
+	backups, err := sb.state.Backups(instanceID)
+	if err != nil {
+		return err
+	}
+	for ; len(backups) > cfg.Retention; backups = backups[1:] {
+		b := backups[0]
+		if err := cfg.store.Delete(cfg.collection(b.InstanceID), b.Subdir); err != nil {
+			return fmt.Errorf("deleting backup %s: %s", b.ID, err)
+		}
+		if err := sb.state.DeleteBackup(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupSource returns a backup to restore and the plan of the instance that
+// was backed up.
+func (sb *crdbServiceBroker) backupSource(instanceID, backupID string) (*backupRecord, *Plan, error) {
+	b, err := sb.state.Backup(instanceID, backupID)
+	if err != nil {
+		if err == errStateNotFound {
+			return nil, nil, newStatusError(http.StatusNotFound, "unknown backup '%s'", backupID)
+		}
+		return nil, nil, err
+	}
+	srcPlan, err := findPlan(b.ServiceID, b.PlanID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if srcPlan.Backups == nil {
+		return nil, nil, newStatusError(http.StatusUnprocessableEntity, "plan '%s' does not support backups", srcPlan.Name)
+	}
+	return b, srcPlan, nil
+}
+
+// checkRestoreFrom returns an error unless a new instance of the plan can be
+// restored from the given backup, or deleted instance.
+func (sb *crdbServiceBroker) checkRestoreFrom(plan *Plan, from *restoreSource) error {
+	var err error
+	if from.BackupID == "" {
+		_, err = sb.tombstoneSource(plan, from.InstanceID)
+	} else if !plan.databasePerInstance() {
+		err = newStatusError(http.StatusUnprocessableEntity,
+			"plan '%s' doesn't give instances a database of their own to restore into", plan.Name)
+	} else {
+		_, _, err = sb.backupSource(from.InstanceID, from.BackupID)
+	}
+	if err != nil {
+		if e, ok := err.(*statusError); ok {
+			return brokerapi.NewFailureResponse(e, http.StatusBadRequest, "restore-from")
+		}
+		return err
+	}
+	return nil
+}
+
+// startRestore starts an asynchronous restore of a backup of one instance
+// into another provisioned instance (or the same one), whose database is
+// replaced by the backup. New instances are restored into by Provision; see
+// restoreNewInstance.
+func (sb *crdbServiceBroker) startRestore(
+	instanceID, backupID, targetInstanceID string,
+) (*operationRecord, error) {
+	b, _, err := sb.backupSource(instanceID, backupID)
+	if err != nil {
+		return nil, err
+	}
+	_, targetPlan, err := sb.instancePlan(targetInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if !targetPlan.databasePerInstance() {
+		return nil, newStatusError(http.StatusUnprocessableEntity,
+			"instance '%s' does not have a database of its own", targetInstanceID)
+	}
+	if busy, err := sb.inProgress(targetInstanceID, opRestore); err != nil {
+		return nil, err
+	} else if busy {
+		return nil, newStatusError(http.StatusConflict, "a restore into this instance is already in progress")
+	}
+
+	return sb.startOperation(&operationRecord{
+		InstanceID:       targetInstanceID,
+		Type:             opRestore,
+		SourceInstanceID: b.InstanceID,
+		BackupID:         b.ID,
+	})
+}
+
+// restoreTmpName returns the name a backup is restored under before it
+// becomes the database of an instance.
+func restoreTmpName(instanceID string) string {
+	return dbNameFromInstanceID(instanceID) + "_restore"
+}
+
+// restoreDatabase restores the database of a backup under a temporary name,
+// replacing what a previous attempt left there, and returns the name.
+func restoreDatabase(plan *Plan, b *backupRecord, collection, instanceID string) (string, error) {
+	tmpName := restoreTmpName(instanceID)
+	if _, err := execWithRetry(plan.crdb, "DROP DATABASE IF EXISTS "+tmpName+" CASCADE"); err != nil {
+		return "", fmt.Errorf("dropping temporary database: %s", err)
+	}
+	if _, err := plan.crdb.Exec(
+		fmt.Sprintf("RESTORE DATABASE %s FROM $1 IN $2 WITH new_db_name = '%s'", b.Database, tmpName),
+		b.Subdir, collection,
+	); err != nil {
+		return "", fmt.Errorf("restoring database: %s", err)
+	}
+	return tmpName, nil
+}
+
+// restore restores a backup under a temporary name, swaps it with the target
+// instance's database and fixes up the privileges so that exactly the target
+// instance's bindings have access.
+func (sb *crdbServiceBroker) restore(
+	b *backupRecord, collection, targetInstanceID string, plan *Plan,
+) error {
+	tmpName, err := restoreDatabase(plan, b, collection, targetInstanceID)
+	if err != nil {
+		return err
+	}
+	return sb.replaceInstanceDatabase(plan, tmpName, targetInstanceID)
+}
+
+// restoreNewInstance creates the database of an instance being provisioned
+// from the backup given by the provision operation. The database only gets
+// the instance's name once it is complete, and carries the instance's comment
+// by then, so that dropRestoredInstance can tell it apart from a database
+// that was there before.
+func (sb *crdbServiceBroker) restoreNewInstance(plan *Plan, instance *instanceRecord, op *operationRecord) error {
+	ns := plan.namespace(instance.ID)
+	if c, err := databaseComment(plan.crdb, ns); err != nil {
+		return fmt.Errorf("reading database comment: %s", err)
+	} else if c != nil && c.InstanceID == instance.ID {
+		// A previous attempt got as far as renaming the database.
+		return nil
+	} else if c != nil {
+		return fmt.Errorf("database %s exists but doesn't belong to instance %s", ns.database, instance.ID)
+	}
+
+	b, srcPlan, err := sb.backupSource(op.SourceInstanceID, op.BackupID)
+	if err != nil {
+		return err
+	}
+	tmpName, err := restoreDatabase(plan, b, srcPlan.Backups.collection(b.InstanceID), instance.ID)
+	if err != nil {
+		return err
+	}
+	if err := sb.resetGrants(plan, tmpName, instance.ID); err != nil {
+		return err
+	}
+	if err := setRegions(plan.crdb, tmpName, nil, instance.Regions); err != nil {
+		return fmt.Errorf("configuring regions: %s", err)
+	}
+	if err := setDatabaseComment(plan.crdb, instanceNamespace{database: tmpName}, op.Comment); err != nil {
+		return fmt.Errorf("commenting database: %s", err)
+	}
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", tmpName, ns.database)); err != nil {
+		return fmt.Errorf("renaming restored database: %s", err)
+	}
+	return nil
+}
+
+// dropRestoredInstance drops what restoreNewInstance created for an instance
+// whose provisioning failed. The instance's database is only dropped if its
+// comment says it belongs to the instance.
+func dropRestoredInstance(plan *Plan, instanceID string) error {
+	if _, err := execWithRetry(plan.crdb, "DROP DATABASE IF EXISTS "+restoreTmpName(instanceID)+" CASCADE"); err != nil {
+		return fmt.Errorf("dropping temporary database: %s", err)
+	}
+	ns := plan.namespace(instanceID)
+	c, err := databaseComment(plan.crdb, ns)
+	if err != nil {
+		return fmt.Errorf("reading database comment: %s", err)
+	}
+	if c == nil || c.InstanceID != instanceID {
+		return nil
+	}
+	return ns.drop(plan.crdb)
+}
+
+// replaceInstanceDatabase replaces the database of an instance with another
+// database on the same cluster, fixing up the privileges so that exactly the
+// instance's bindings have access.
+//
+// The swap is two renames, which aren't atomic: between them, the instance's
+// database doesn't exist, and connections to it fail until they are retried.
+// If the broker dies in between, the instance's previous data is under its
+// _prerestore name and the resumed operation restores the backup again,
+// dropping it.
+func (sb *crdbServiceBroker) replaceInstanceDatabase(plan *Plan, srcName, instanceID string) error {
+	dbName := dbNameFromInstanceID(instanceID)
+	oldName := dbName + "_prerestore"
+
+	if err := sb.resetGrants(plan, srcName, instanceID); err != nil {
+		return err
+	}
+	// The replacement takes over the instance's comment, which is on the
+	// old database if a previous attempt was interrupted between the
+	// renames.
+	comment, err := databaseComment(plan.crdb, instanceNamespace{database: dbName})
+	if err == nil && comment == nil {
+		comment, err = databaseComment(plan.crdb, instanceNamespace{database: oldName})
+	}
+	if err != nil {
+		return fmt.Errorf("reading database comment: %s", err)
+	}
+
+	if _, err := execWithRetry(plan.crdb, "DROP DATABASE IF EXISTS "+oldName+" CASCADE"); err != nil {
+		return fmt.Errorf("dropping old database: %s", err)
+	}
+	if _, err := plan.crdb.Exec(
+		fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", dbName, oldName),
+	); err != nil && !isNotFound(err, objectDatabase) {
+		return fmt.Errorf("renaming database: %s", err)
+	}
+	if _, err := plan.crdb.Exec(
+		fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", srcName, dbName),
+	); err != nil {
+		return fmt.Errorf("renaming restored database: %s", err)
+	}
+	if comment != nil {
+		if err := setDatabaseComment(plan.crdb, instanceNamespace{database: dbName}, comment); err != nil {
+			return fmt.Errorf("commenting database: %s", err)
+		}
+	}
+	if _, err := execWithRetry(plan.crdb, "DROP DATABASE IF EXISTS "+oldName+" CASCADE"); err != nil {
+		return fmt.Errorf("dropping old database: %s", err)
+	}
+	return nil
+}
+
+// systemGrantees are the users whose privileges are left alone by
+// revokeGrantees.
+var systemGrantees = map[string]bool{"root": true, "admin": true, "public": true}
+
+// revokeGrantees revokes the privileges of all non-system users on the
+// database and its tables.
+func revokeGrantees(plan *Plan, dbName string) error {
+	rows, err := plan.crdb.Query(
+		fmt.Sprintf("SELECT DISTINCT grantee FROM [SHOW GRANTS ON DATABASE %s]", dbName),
+	)
+	if err != nil {
+		return fmt.Errorf("listing grants: %s", err)
+	}
+	var grantees []string
+	for rows.Next() {
+		var g string
+		if err := rows.Scan(&g); err != nil {
+			rows.Close()
+			return fmt.Errorf("listing grants: %s", err)
+		}
+		grantees = append(grantees, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("listing grants: %s", err)
+	}
+	for _, g := range grantees {
+		if systemGrantees[g] || g == plan.CRDBAdminUser {
+			continue
+		}
+		if err := revokeAll(plan.crdb, dbName, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetGrants revokes the privileges that a restored database carried over
+// from the backed up instance and grants the target instance's bindings their
+// roles.
+func (sb *crdbServiceBroker) resetGrants(plan *Plan, dbName, instanceID string) error {
+	if err := revokeGrantees(plan, dbName); err != nil {
+		return err
+	}
+	for _, shared := range []bool{false, true} {
+		bindings, err := sb.state.Bindings(instanceID, shared)
+		if err != nil {
+			return err
+		}
+		for _, r := range bindings {
+			user := userNameFromBinding(instanceID, r.ID)
+			if err := grantRole(plan.crdb, dbName, user, r.Role); err != nil {
+				return fmt.Errorf("granting privileges to %s: %s", user, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runBackupScheduler starts scheduled backups for the instances of plans
+// with a backup interval, checking every checkInterval until stop is closed.
+// Only one replica schedules backups at a time; see isLeader.
+func (sb *crdbServiceBroker) runBackupScheduler(checkInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !sb.isLeader("backup-scheduler", 3*checkInterval) {
+				continue
+			}
+			if err := sb.scheduleBackups(time.Now()); err != nil {
+				log.Error("schedule-backups", err)
+			}
+		}
+	}
+}
+
+// scheduleBackups starts a backup of every instance whose last backup attempt
+// is older than its plan's backup interval.
+func (sb *crdbServiceBroker) scheduleBackups(now time.Time) error {
+	instances, err := sb.state.Instances()
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if instance.State == stateFailed {
+			continue
+		}
+		plan, err := findPlan(instance.ServiceID, instance.PlanID)
+		if err != nil || plan.Backups == nil || plan.Backups.interval == 0 {
+			continue
+		}
+		ops, err := sb.state.Operations(instance.ID)
+		if err != nil {
+			return err
+		}
+		var last time.Time
+		busy := false
+		for _, op := range ops {
+			if op.Type != opBackup {
+				continue
+			}
+			last = op.Started
+			busy = busy || op.State == brokerapi.InProgress
+		}
+		if busy || now.Sub(last) < plan.Backups.interval {
+			continue
+		}
+		if _, err := sb.startBackup(instance.ID, true /* scheduled */); err != nil {
+			log.Error("scheduled-backup", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBackupCollection(t *testing.T) {
+	testCases := []struct {
+		uri      string
+		expected string
+	}{
+		{"nodelocal://1/backups", "nodelocal://1/backups/inst"},
+		{"nodelocal://1/backups/", "nodelocal://1/backups/inst"},
+		{"s3://bucket?AUTH=implicit", "s3://bucket/inst?AUTH=implicit"},
+		{"gs://bucket/a/b?AUTH=specified&CREDENTIALS=x%2By", "gs://bucket/a/b/inst?AUTH=specified&CREDENTIALS=x%2By"},
+	}
+	for _, tc := range testCases {
+		c := backupConfig{URI: tc.uri}
+		if err := c.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if actual := c.collection("inst"); actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.uri, tc.expected, actual)
+		}
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plan := &Plan{Backups: &backupConfig{URI: "nodelocal://1/backups", Retention: 2, LocalDir: dir}}
+	if err := plan.Backups.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	sb := newCRDBServiceBroker(newBrokerState(newMemKVStore()))
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		subdir := fmt.Sprintf("/2017/01/01-%06d.00", i)
+		if err := sb.state.PutBackup(&backupRecord{
+			ID:         fmt.Sprintf("b%d", i),
+			InstanceID: "inst",
+			Subdir:     subdir,
+			Created:    start.Add(time.Duration(i) * time.Minute),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// The files of the first backup are already gone.
+		if i > 0 {
+			if err := os.MkdirAll(filepath.Join(dir, "backups", "inst", subdir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := sb.applyRetention(plan, "inst"); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := sb.state.Backups("inst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].ID != "b3" || backups[1].ID != "b4" {
+		t.Errorf("unexpected backups after retention: %+v", backups)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := os.Stat(filepath.Join(dir, "backups", "inst", fmt.Sprintf("/2017/01/01-%06d.00", i)))
+		if kept := err == nil; kept != (i >= 3) {
+			t.Errorf("backup %d: expected kept=%t, got %v", i, i >= 3, err)
+		}
+	}
+}
+
+func TestBackupRetentionStorage(t *testing.T) {
+	testCases := []struct {
+		uri, localDir string
+		ok            bool
+	}{
+		{"nodelocal://1/backups", "/extern", true},
+		{"nodelocal://1/backups", "", false},
+		{"s3://bucket/backups?AUTH=specified&AWS_ACCESS_KEY_ID=a&AWS_SECRET_ACCESS_KEY=b", "", true},
+		{"s3://bucket/backups?AUTH=implicit", "", false},
+		{"gs://bucket/backups?AUTH=implicit", "", false},
+	}
+	for _, tc := range testCases {
+		c := backupConfig{URI: tc.uri, Retention: 1, LocalDir: tc.localDir}
+		if err := c.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok=%t, got %v", tc.uri, tc.ok, err)
+		}
+		// Without retention, the broker doesn't need to delete backups.
+		c.Retention = 0
+		if err := c.validate(); err != nil {
+			t.Errorf("%s: %s", tc.uri, err)
+		}
+	}
+}
+
+// adminRequest sends a request to the admin API and decodes the response into
+// res (if not nil).
+func adminRequest(
+	t *testing.T, server *httptest.Server, method, path string, body, res interface{},
+) int {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, server.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if res != nil {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitForOperation polls the admin API until the operation is done.
+func waitForOperation(t *testing.T, server *httptest.Server, op *operationRecord) *operationRecord {
+	t.Helper()
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); {
+		var res operationRecord
+		path := fmt.Sprintf("/admin/instances/%s/operations/%s", op.InstanceID, op.ID)
+		if status := adminRequest(t, server, "GET", path, nil, &res); status != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, status)
+		}
+		if res.State != brokerapi.InProgress {
+			return &res
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for operation %s", op.ID)
+	return nil
+}
+
+func TestBackupRestore(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.Backups = &backupConfig{URI: "nodelocal://1/backups"}
+	if err := b.plan.Backups.validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	rows := func(db string) []string {
+		t.Helper()
+		b.cluster.mu.Lock()
+		defer b.cluster.mu.Unlock()
+		return b.cluster.tables[db]["t"]
+	}
+	hasGrant := func(db, user string) bool {
+		t.Helper()
+		b.cluster.mu.Lock()
+		defer b.cluster.mu.Unlock()
+		return b.cluster.grants[db][user] != "" && b.cluster.defaultPrivileges[db][user] != ""
+	}
+	bind := func(instanceID, bindingID string) string {
+		t.Helper()
+		if _, err := b.sb.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{
+			ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app-" + bindingID,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return userNameFromBinding(instanceID, bindingID)
+	}
+	provision := func(instanceID string) string {
+		t.Helper()
+		if _, err := b.sb.Provision(ctx, instanceID, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+		return dbNameFromInstanceID(instanceID)
+	}
+
+	db1 := provision("inst1")
+	b.cluster.tables[db1] = map[string][]string{"t": {"1", "2", "3"}}
+	user1 := bind("inst1", "binding1")
+
+	var op operationRecord
+	if status := adminRequest(t, b.server, "POST", "/admin/instances/inst1/backups", nil, &op); status != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+	if res := waitForOperation(t, b.server, &op); res.State != brokerapi.Succeeded {
+		t.Fatalf("backup failed: %s", res.Description)
+	}
+
+	var backups []backupRecord
+	adminRequest(t, b.server, "GET", "/admin/instances/inst1/backups", nil, &backups)
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %+v", backups)
+	}
+	restorePath := fmt.Sprintf("/admin/instances/inst1/backups/%s/restore", backups[0].ID)
+
+	// Restore into the same instance.
+	b.cluster.mu.Lock()
+	b.cluster.tables[db1]["t"] = []string{"1"}
+	b.cluster.mu.Unlock()
+	if status := adminRequest(t, b.server, "POST", restorePath, nil, &op); status != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+	if res := waitForOperation(t, b.server, &op); res.State != brokerapi.Succeeded {
+		t.Fatalf("restore failed: %s", res.Description)
+	}
+	if n := len(rows(db1)); n != 3 {
+		t.Errorf("expected 3 rows after restore, got %d", n)
+	}
+	if !hasGrant(db1, user1) {
+		t.Errorf("binding user lost its privileges after restore")
+	}
+	if c, err := databaseComment(b.plan.crdb, b.plan.namespace("inst1")); err != nil || c == nil || c.InstanceID != "inst1" {
+		t.Errorf("unexpected database comment %+v (%v)", c, err)
+	}
+
+	// Restore into another instance.
+	db2 := provision("inst2")
+	user2 := bind("inst2", "binding2")
+	body := map[string]string{"target_instance_id": "inst2"}
+	if status := adminRequest(t, b.server, "POST", restorePath, body, &op); status != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+	if res := waitForOperation(t, b.server, &op); res.State != brokerapi.Succeeded {
+		t.Fatalf("restore failed: %s", res.Description)
+	}
+	if n := len(rows(db2)); n != 3 {
+		t.Errorf("expected 3 rows after restore, got %d", n)
+	}
+	if !hasGrant(db2, user2) {
+		t.Errorf("target binding user has no privileges after restore")
+	}
+	b.cluster.mu.Lock()
+	_, granted := b.cluster.grants[db2][user1]
+	_, defaulted := b.cluster.defaultPrivileges[db2][user1]
+	b.cluster.mu.Unlock()
+	if granted || defaulted {
+		t.Errorf("source binding user has privileges on the restored instance")
+	}
+
+	// Restore into a new instance.
+	spec, err := b.sb.Provision(ctx, "inst3", b.provisionDetails(fmt.Sprintf(
+		`{"restore_from": {"instance_id": "inst1", "backup_id": %q}}`, backups[0].ID,
+	)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := waitForLastOperation(t, b.sb, "inst3", spec.OperationData); res.State != brokerapi.Succeeded {
+		t.Fatalf("provision failed: %s", res.Description)
+	}
+	if n := len(rows(dbNameFromInstanceID("inst3"))); n != 3 {
+		t.Errorf("expected 3 rows in the new instance, got %d", n)
+	}
+	if hasGrant(dbNameFromInstanceID("inst3"), user1) {
+		t.Errorf("source binding user has privileges on the new instance")
+	}
+
+	// Unknown backups and instances without backups are rejected.
+	if status := adminRequest(t, b.server, "POST", "/admin/instances/inst1/backups/nope/restore", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown backup, got %d", status)
+	}
+	if status := adminRequest(t, b.server, "POST", "/admin/instances/nope/backups", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown instance, got %d", status)
+	}
+}
+
+func TestProvisionRestoreFrom(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.Backups = &backupConfig{URI: "nodelocal://1/backups"}
+	ctx := context.Background()
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	op, err := b.sb.startBackup("inst1", false /* scheduled */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := waitForOperation(t, b.server, op); r.State != brokerapi.Succeeded {
+		t.Fatalf("backup %s: %s", r.State, r.Description)
+	}
+	backups, err := b.sb.state.Backups("inst1")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("expected a backup, got %v (%v)", backups, err)
+	}
+	params := fmt.Sprintf(`{"restore_from": {"instance_id": "inst1", "backup_id": %q}}`, backups[0].ID)
+
+	if _, err := b.sb.Provision(ctx, "inst2", b.provisionDetails(params), false); err != brokerapi.ErrAsyncRequired {
+		t.Fatalf("expected %v, got %v", brokerapi.ErrAsyncRequired, err)
+	}
+	_, err = b.sb.Provision(ctx, "inst2",
+		b.provisionDetails(`{"restore_from": {"instance_id": "inst1", "backup_id": "nope"}}`), true)
+	if e, ok := err.(*brokerapi.FailureResponse); !ok || e.ValidatedStatusCode(nil) != http.StatusBadRequest {
+		t.Fatalf("expected a bad request, got %v", err)
+	}
+
+	spec, err := b.sb.Provision(ctx, "inst2", b.provisionDetails(params), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := waitForLastOperation(t, b.sb, "inst2", spec.OperationData); res.State != brokerapi.Succeeded {
+		t.Fatalf("provision %s: %s", res.State, res.Description)
+	}
+	c, err := databaseComment(b.plan.crdb, b.plan.namespace("inst2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.InstanceID != "inst2" {
+		t.Errorf("unexpected database comment %+v", c)
+	}
+	if b.cluster.databases[restoreTmpName("inst2")] {
+		t.Error("temporary database not renamed")
+	}
+
+	// A database the broker didn't create is left alone.
+	dbName := dbNameFromInstanceID("inst3")
+	b.cluster.databases[dbName] = true
+	spec, err = b.sb.Provision(ctx, "inst3", b.provisionDetails(params), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := waitForLastOperation(t, b.sb, "inst3", spec.OperationData); res.State != brokerapi.Failed {
+		t.Fatalf("expected the provision to fail, got %+v", res)
+	}
+	if !b.cluster.databases[dbName] {
+		t.Errorf("database %s dropped", dbName)
+	}
+
+	// Plans without a database per instance can't restore into new instances.
+	b.plan.Isolation = isolationSchema
+	_, err = b.sb.Provision(ctx, "inst4", b.provisionDetails(params), true)
+	if e, ok := err.(*brokerapi.FailureResponse); !ok || e.ValidatedStatusCode(nil) != http.StatusBadRequest {
+		t.Errorf("expected a bad request, got %v", err)
+	}
+}
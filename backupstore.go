@@ -0,0 +1,299 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupStore deletes backups from a plan's backup storage, which CockroachDB
+// can't do itself. The broker needs one to apply a backup retention.
+type backupStore interface {
+	// Delete deletes the files of the backup in the given subdirectory of a
+	// collection (see backupConfig.collection). It does nothing if they are
+	// already gone.
+	Delete(collection, subdir string) error
+}
+
+// newBackupStore returns the store of a backup configuration, or an error if
+// the broker can't delete backups from its storage.
+func newBackupStore(c *backupConfig) (backupStore, error) {
+	u, err := url.Parse(c.URI)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "nodelocal":
+		if c.LocalDir == "" {
+			return nil, errors.New("backup retention with nodelocal storage requires localDir")
+		}
+		return localBackupStore(c.LocalDir), nil
+	case "s3":
+		return newS3BackupStore(u)
+	}
+	return nil, fmt.Errorf("backup retention isn't supported with %s storage; use s3 or nodelocal", u.Scheme)
+}
+
+// localBackupStore is the directory that nodelocal URIs refer to (the node's
+// --external-io-dir), for brokers that can reach it.
+type localBackupStore string
+
+// Delete is part of the backupStore interface.
+func (d localBackupStore) Delete(collection, subdir string) error {
+	u, err := url.Parse(collection)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(string(d), filepath.FromSlash(path.Join("/", u.Path, subdir)))
+	if dir == filepath.Clean(string(d)) {
+		return fmt.Errorf("invalid backup %s in %s", subdir, collection)
+	}
+	return os.RemoveAll(dir)
+}
+
+// emptySHA256 is the SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3BackupStore deletes backups from S3, or S3-compatible storage, with the
+// credentials of the backup URI (AUTH=specified).
+type s3BackupStore struct {
+	client *http.Client
+	// endpoint is AWS_ENDPOINT, for S3-compatible storage; buckets are then
+	// addressed by path.
+	endpoint                              *url.URL
+	region, accessKey, secretKey, session string
+	now                                   func() time.Time
+}
+
+func newS3BackupStore(u *url.URL) (*s3BackupStore, error) {
+	q := u.Query()
+	if q.Get("AUTH") == "implicit" {
+		return nil, errors.New("backup retention with s3 storage requires AUTH=specified")
+	}
+	s := &s3BackupStore{
+		client:    &http.Client{Timeout: time.Minute},
+		region:    q.Get("AWS_REGION"),
+		accessKey: q.Get("AWS_ACCESS_KEY_ID"),
+		secretKey: q.Get("AWS_SECRET_ACCESS_KEY"),
+		session:   q.Get("AWS_SESSION_TOKEN"),
+		now:       time.Now,
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("backup retention with s3 storage requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if e := q.Get("AWS_ENDPOINT"); e != "" {
+		var err error
+		if s.endpoint, err = url.Parse(e); err != nil {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// Delete is part of the backupStore interface.
+func (s *s3BackupStore) Delete(collection, subdir string) error {
+	u, err := url.Parse(collection)
+	if err != nil {
+		return err
+	}
+	bucket := u.Host
+	prefix := strings.TrimPrefix(path.Join(u.Path, subdir), "/") + "/"
+	if prefix == "/" {
+		return fmt.Errorf("invalid backup %s in %s", subdir, collection)
+	}
+	for token := ""; ; {
+		keys, next, err := s.list(bucket, prefix, token)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := s.do("DELETE", bucket, key, nil, nil); err != nil {
+				return fmt.Errorf("deleting %s: %s", key, err)
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	NextContinuationToken string
+}
+
+// list returns a page of the keys under prefix, and the token of the next
+// page if there is one. A missing bucket has no keys.
+func (s *s3BackupStore) list(bucket, prefix, token string) ([]string, string, error) {
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	var res s3ListResult
+	if err := s.do("GET", bucket, "", q, &res); err != nil {
+		return nil, "", fmt.Errorf("listing %s: %s", prefix, err)
+	}
+	var keys []string
+	for _, c := range res.Contents {
+		keys = append(keys, c.Key)
+	}
+	return keys, res.NextContinuationToken, nil
+}
+
+// do sends a signed request for a bucket or one of its objects, and decodes
+// the XML response into res (if not nil). Not found is not an error: the
+// backup is already gone.
+func (s *s3BackupStore) do(method, bucket, key string, query url.Values, res interface{}) error {
+	var u url.URL
+	if s.endpoint != nil {
+		u = *s.endpoint
+		u.Path = path.Join("/", s.endpoint.Path, bucket, key)
+	} else {
+		u = url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, s.region), Path: "/" + key}
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	// Send the path and query as they are signed.
+	req.URL.RawPath = s3URIEncode(req.URL.Path, false)
+	req.URL.RawQuery = s3CanonicalQuery(query)
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if res == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(res)
+}
+
+// sign adds an AWS Signature Version 4 to a request without a body.
+func (s *s3BackupStore) sign(req *http.Request) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	scope := t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if s.session != "" {
+		req.Header.Set("X-Amz-Security-Token", s.session)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes a query string the way Signature Version 4 expects
+// it: sorted, with every character but the unreserved ones escaped.
+func s3CanonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3URIEncode escapes every character of s but the unreserved ones, and
+// slashes unless encodeSlash is set.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b = append(b, c)
+		default:
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(b)
+}
@@ -16,22 +16,86 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
-	"regexp"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/dchest/uniuri"
 
 	"github.com/pivotal-cf/brokerapi"
+	uuid "github.com/satori/go.uuid"
 )
 
 type crdbServiceBroker struct {
+	state *brokerState
+	// dashboard is nil if instance dashboards are disabled.
+	dashboard *dashboardConfig
+	// cc is nil if the broker doesn't talk to the Cloud Controller.
+	cc      *ccClient
+	orphans orphanConfig
+	// leaseTimeout is how long leases last; see lockInstance.
+	leaseTimeout time.Duration
+	// replicaID identifies this broker process among the replicas sharing
+	// the broker state.
+	replicaID string
+
+	// opsMu protects running and stopping. running maps the operations that
+	// this broker is working on to the holders of their leases. stopping is
+	// set once the broker shuts down; see shutdown.
+	opsMu    sync.Mutex
+	running  map[*operationRecord]string
+	stopping bool
+	opsWG    sync.WaitGroup
+
+	// clusterMu protects clusterDBs, the connection pools of the clusters of
+	// instances that have one of their own; see instanceDB.
+	clusterMu  sync.Mutex
+	clusterDBs map[string]*sql.DB
 }
 
-func newCRDBServiceBroker() *crdbServiceBroker {
-	return &crdbServiceBroker{}
+func newCRDBServiceBroker(state *brokerState) *crdbServiceBroker {
+	return &crdbServiceBroker{
+		state:        state,
+		orphans:      orphanConfig{gracePeriod: defaultOrphanGracePeriod},
+		leaseTimeout: defaultLeaseTimeout,
+		replicaID:    uniuri.New(),
+		running:      make(map[*operationRecord]string),
+		clusterDBs:   make(map[string]*sql.DB),
+	}
+}
+
+// Roles that can be given to a binding's user.
+const (
+	roleReadWrite = "readwrite"
+	roleReadOnly  = "readonly"
+)
+
+// bindingRoles maps each role to the privileges granted on the tables of the
+// instance, including the ones created after the binding.
+var bindingRoles = map[string]string{
+	roleReadWrite: "ALL",
+	roleReadOnly:  "SELECT",
 }
 
+// databasePrivileges maps each binding role to the privileges granted on the
+// instance database. Table privileges such as SELECT can't be granted on a
+// database, so readonly users only get to connect to it; see grantTables.
+var databasePrivileges = map[string]string{
+	roleReadWrite: "ALL",
+	roleReadOnly:  "CONNECT",
+}
+
+// defaultSharedBindingRole is the role of bindings created from a space other
+// than the one owning the instance, unless the plan says otherwise. It can be
+// changed with the SHARED_BINDING_ROLE environment variable.
+var defaultSharedBindingRole = roleReadOnly
+
 // Services is part of the brokerapi.ServiceBroker interface.
 func (sb *crdbServiceBroker) Services(context context.Context) []brokerapi.Service {
 	services := make([]brokerapi.Service, len(Services))
@@ -46,9 +110,70 @@ func (sb *crdbServiceBroker) Services(context context.Context) []brokerapi.Servi
 	return services
 }
 
-var dbExistsErrRegexp = regexp.MustCompile("database .* already exists")
-var dbNotFoundErrRegexp = regexp.MustCompile("database .* does not exist")
-var noObjectMatchedRegexp = regexp.MustCompile("pq: no object matched")
+// operationProvision is the operation data returned with 202 responses to
+// provision requests.
+const operationProvision = "provision"
+
+// errConcurrentOperation is returned for requests on an instance or binding
+// that is still being created by an earlier request.
+var errConcurrentOperation = brokerapi.NewFailureResponseBuilder(
+	errors.New("another operation for this service instance is in progress"),
+	http.StatusUnprocessableEntity, "concurrent-operation",
+).WithErrorKey("ConcurrencyError").Build()
+
+// errDeletionProtected is returned by Deprovision for instances with deletion
+// protection.
+var errDeletionProtected = brokerapi.NewFailureResponse(
+	errors.New("the service instance has deletion protection enabled; disable it by updating "+
+		`the instance with the parameter {"deletion_protection": false} first`),
+	http.StatusUnprocessableEntity, "deletion-protected",
+)
+
+// provisionFingerprint identifies the attributes of a provision request, so
+// that a repeated request can be told apart from a conflicting one.
+func provisionFingerprint(details brokerapi.ProvisionDetails) (string, error) {
+	params, err := canonicalParams(details.RawParameters)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint([]interface{}{
+		details.ServiceID, details.PlanID, details.OrganizationGUID, details.SpaceGUID, params,
+	}), nil
+}
+
+// bindFingerprint is like provisionFingerprint for bind requests.
+func bindFingerprint(details brokerapi.BindDetails) (string, error) {
+	params, err := canonicalParams(details.RawParameters)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint([]interface{}{
+		details.ServiceID, details.PlanID, details.AppGUID, details.BindResource, params,
+	}), nil
+}
+
+// canonicalParams decodes request parameters so that they can be compared
+// regardless of formatting and key order. Empty parameters decode to nil.
+func canonicalParams(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var params interface{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, brokerapi.ErrRawParamsInvalid
+	}
+	if m, ok := params.(map[string]interface{}); ok && len(m) == 0 {
+		return nil, nil
+	}
+	return params, nil
+}
+
+func fingerprint(v interface{}) string {
+	// encoding/json sorts map keys, so equal values encode identically.
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
 
 // Provision is part of the brokerapi.ServiceBroker interface.
 func (sb *crdbServiceBroker) Provision(
@@ -58,19 +183,177 @@ func (sb *crdbServiceBroker) Provision(
 	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
+	fingerprint, err := provisionFingerprint(details)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	params, err := parseProvisionParameters(details.RawParameters)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	regions := plan.regionConfig().withParameters(params)
+	if err := checkRegions(plan, regions); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	if params.RestoreFrom != nil {
+		if err := sb.checkRestoreFrom(plan, params.RestoreFrom); err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+	}
+	// Clusters and restores take a while, so they are run by an operation.
+	backend := sb.backend(plan)
+	async := backend.Async() || params.RestoreFrom != nil
+	if async && !asyncAllowed {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+
+	unlock, err := sb.lockInstance(instanceID)
+	if err == errConcurrentOperation {
+		// This may be a repeat of the request holding the lease.
+		return sb.existingInstance(context, instanceID, fingerprint, asyncAllowed)
+	} else if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	defer unlock()
 
-	// Generate a database name from the instanceID.
-	dbName := dbNameFromInstanceID(instanceID)
+	// Claim the instance ID before touching the cluster, so that retries and
+	// concurrent requests for the same instance can be recognized.
+	record := &instanceRecord{
+		ID:          instanceID,
+		ServiceID:   details.ServiceID,
+		PlanID:      details.PlanID,
+		OrgGUID:     details.OrganizationGUID,
+		SpaceGUID:   details.SpaceGUID,
+		State:       statePending,
+		Fingerprint: fingerprint,
 
-	// Create database.
-	if _, err := plan.crdb.Exec("CREATE DATABASE " + dbName); err != nil {
-		if dbExistsErrRegexp.MatchString(err.Error()) {
-			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+		TerminateSessions:  params.TerminateSessions,
+		DeletionProtection: params.DeletionProtection != nil && *params.DeletionProtection,
+		Regions:            regions,
+	}
+	if async {
+		record.State = stateProvisioning
+		record.OperationID = uuid.NewV4().String()
+	}
+	if plan.clusterPerInstance() {
+		record.AdminPassword = uniuri.New()
+	}
+	if err := sb.claimInstance(record); err == errStateExists {
+		return sb.existingInstance(context, instanceID, fingerprint, asyncAllowed)
+	} else if err != nil {
+		log.Error("store-instance", err)
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("storing instance: %s", err)
+	}
+	fail := func(err error) (brokerapi.ProvisionedServiceSpec, error) {
+		if err := sb.state.DeleteInstance(instanceID); err != nil {
+			log.Error("delete-instance", err)
 		}
-		log.Error("create-database", err)
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("creating database: %s", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	created := time.Now().UTC()
+	comment := &instanceComment{
+		InstanceID:         instanceID,
+		ServiceID:          details.ServiceID,
+		PlanID:             details.PlanID,
+		Plan:               plan.Name,
+		OrgGUID:            details.OrganizationGUID,
+		SpaceGUID:          details.SpaceGUID,
+		CreatedAt:          &created,
+		Labels:             params.Labels,
+		DeletionProtection: record.DeletionProtection,
+		Regions:            regions,
 	}
-	return brokerapi.ProvisionedServiceSpec{}, nil
+
+	if async {
+		op := &operationRecord{
+			ID:         record.OperationID,
+			InstanceID: instanceID,
+			Type:       opProvision,
+			Comment:    comment,
+		}
+		if params.RestoreFrom != nil {
+			op.SourceInstanceID = params.RestoreFrom.InstanceID
+			op.BackupID = params.RestoreFrom.BackupID
+		}
+		if _, err := sb.startOperation(op); err != nil {
+			log.Error("start-operation", err)
+			return fail(fmt.Errorf("starting operation: %s", err))
+		}
+		return brokerapi.ProvisionedServiceSpec{
+			IsAsync:       true,
+			DashboardURL:  sb.dashboardURL(instanceID),
+			OperationData: record.OperationID,
+		}, nil
+	}
+
+	if err := backend.CreateInstance(context, record, comment); err != nil {
+		return fail(err)
+	}
+
+	record.State = stateReady
+	if err := sb.state.PutInstance(record); err != nil {
+		log.Error("store-instance", err)
+		_ = backend.DropInstance(context, record)
+		return fail(fmt.Errorf("storing instance: %s", err))
+	}
+	return brokerapi.ProvisionedServiceSpec{DashboardURL: sb.dashboardURL(instanceID)}, nil
+}
+
+// claimInstance stores the record of an instance being provisioned, replacing
+// the record of a failed instance. It fails with errStateExists if the
+// instance exists.
+func (sb *crdbServiceBroker) claimInstance(record *instanceRecord) error {
+	err := sb.state.InsertInstance(record)
+	if err != errStateExists {
+		return err
+	}
+	existing, err := sb.state.Instance(record.ID)
+	if err != nil || existing.State != stateFailed {
+		return errStateExists
+	}
+	// We hold the lease on the instance, so nobody else is replacing it.
+	if err := sb.state.DeleteInstance(record.ID); err != nil {
+		return err
+	}
+	return sb.state.InsertInstance(record)
+}
+
+// existingInstance answers a provision request for an instance the broker
+// already has a record of. An identical request gets the original response,
+// or 202 if the original request is still being processed; any other request
+// is a conflict.
+func (sb *crdbServiceBroker) existingInstance(
+	ctx context.Context, instanceID, fingerprint string, asyncAllowed bool,
+) (brokerapi.ProvisionedServiceSpec, error) {
+	existing, err := sb.state.Instance(instanceID)
+	if err == errStateNotFound {
+		// The instance was removed since we tried to claim it, most likely by
+		// a concurrent request that failed.
+		return brokerapi.ProvisionedServiceSpec{}, errConcurrentOperation
+	} else if err != nil {
+		log.Error("lookup-instance", err)
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("looking up instance: %s", err)
+	}
+	if existing.Fingerprint != fingerprint {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+	if existing.State == statePending || existing.State == stateProvisioning {
+		if !asyncAllowed {
+			return brokerapi.ProvisionedServiceSpec{}, errConcurrentOperation
+		}
+		operationData := operationProvision
+		if existing.OperationID != "" {
+			operationData = existing.OperationID
+		}
+		return brokerapi.ProvisionedServiceSpec{
+			IsAsync:       true,
+			DashboardURL:  sb.dashboardURL(instanceID),
+			OperationData: operationData,
+		}, nil
+	}
+	markAlreadyExists(ctx)
+	return brokerapi.ProvisionedServiceSpec{DashboardURL: sb.dashboardURL(instanceID)}, nil
 }
 
 // Deprovision is part of the brokerapi.ServiceBroker interface.
@@ -84,12 +367,63 @@ func (sb *crdbServiceBroker) Deprovision(
 	if err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
-	dbName := dbNameFromInstanceID(instanceID)
+	unlock, err := sb.lockInstance(instanceID)
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	defer unlock()
 
-	// Delete database.
-	if _, err := plan.crdb.Exec("DROP DATABASE IF EXISTS " + dbName); err != nil {
-		log.Error("drop-database", err)
-		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("dropping database: %s", err)
+	instance, err := sb.state.Instance(instanceID)
+	if err != nil && err != errStateNotFound {
+		log.Error("lookup-instance", err)
+		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("looking up instance: %s", err)
+	}
+	if instance != nil && instance.inProgress() {
+		return brokerapi.DeprovisionServiceSpec{}, errConcurrentOperation
+	}
+	backend := sb.backend(plan)
+	if backend.Async() {
+		return sb.deprovisionCluster(context, backend, instance, asyncAllowed)
+	}
+
+	// The database comment is checked too, in case the broker state was
+	// lost.
+	desc, err := backend.Describe(context, orStub(instance, instanceID))
+	if err != nil {
+		log.Error("read-database-comment", err)
+		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("checking deletion protection: %s", err)
+	}
+	if instance == nil && desc.Comment == nil {
+		// Neither the broker state nor the cluster knows the instance.
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if desc.Comment != nil && desc.Comment.DeletionProtection || instance != nil && instance.DeletionProtection {
+		return brokerapi.DeprovisionServiceSpec{}, errDeletionProtected
+	}
+
+	if sb.terminateSessions(plan, instanceID) {
+		if err := backend.TerminateSessions(context, orStub(instance, instanceID)); err != nil {
+			log.Error("cancel-sessions", err)
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	}
+
+	if plan.deletionRetention > 0 {
+		// Keep the database around for a while in case this was a mistake.
+		if err := backend.DeleteInstance(context, orStub(instance, instanceID)); err != nil {
+			log.Error("soft-delete-database", err)
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	} else {
+		if err := backend.DropInstance(context, orStub(instance, instanceID)); err != nil {
+			log.Error("drop-database", err)
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	}
+
+	if err := sb.state.DeleteInstance(instanceID); err != nil {
+		log.Error("delete-instance", err)
+		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("deleting instance: %s", err)
 	}
 
 	return brokerapi.DeprovisionServiceSpec{}, nil
@@ -103,64 +437,290 @@ func (sb *crdbServiceBroker) Bind(
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
-	dbName := dbNameFromInstanceID(instanceID)
-	user := userNameFromBinding(instanceID, bindingID)
+	fingerprint, err := bindFingerprint(details)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	unlock, err := sb.lockInstance(instanceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	defer unlock()
 	pass := uniuri.New()
 
-	if _, err := plan.crdb.Exec(
-		fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s'", user, pass),
-	); err != nil {
-		log.Error("create-user", err)
-		return brokerapi.Binding{}, fmt.Errorf("creating user: %s", err)
+	// Bindings from a space other than the one that owns the instance (i.e.
+	// from a space the instance was shared with) get the plan's shared
+	// binding role. If we don't know either space, treat the binding as a
+	// regular one.
+	record := &bindingRecord{
+		ID:          bindingID,
+		InstanceID:  instanceID,
+		AppGUID:     details.AppGUID,
+		SpaceGUID:   requestContextFrom(context).SpaceGUID,
+		Role:        roleReadWrite,
+		State:       statePending,
+		Fingerprint: fingerprint,
+		Password:    pass,
 	}
-
-	cleanup := func() {
-		_, _ = plan.crdb.Exec(fmt.Sprintf("REVOKE ALL ON TABLE %s.* FROM %s", dbName, user))
-		_, _ = plan.crdb.Exec(fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", dbName, user))
-		_, _ = plan.crdb.Exec("DROP USER %s", user)
+	instance, err := sb.state.Instance(instanceID)
+	if err != nil && err != errStateNotFound {
+		log.Error("lookup-instance", err)
+		return brokerapi.Binding{}, fmt.Errorf("looking up instance: %s", err)
+	}
+	if instance != nil && instance.inProgress() {
+		return brokerapi.Binding{}, errConcurrentOperation
+	}
+	if instance != nil && instance.SpaceGUID != "" && record.SpaceGUID != "" &&
+		instance.SpaceGUID != record.SpaceGUID {
+		record.Shared = true
+		record.Role = plan.sharedBindingRole()
 	}
 
-	if _, err := plan.crdb.Exec(
-		fmt.Sprintf("GRANT ALL ON DATABASE %s TO %s", dbName, user),
-	); err != nil {
-		cleanup()
-		if dbNotFoundErrRegexp.MatchString(err.Error()) {
-			return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+	// Claim the binding ID before touching the cluster, so that retries and
+	// concurrent requests for the same binding can be recognized.
+	if err := sb.state.InsertBinding(record); err == errStateExists {
+		return sb.existingBinding(context, plan, instanceID, bindingID, fingerprint)
+	} else if err != nil {
+		log.Error("store-binding", err)
+		return brokerapi.Binding{}, fmt.Errorf("storing binding: %s", err)
+	}
+	fail := func(err error) (brokerapi.Binding, error) {
+		if err := sb.state.DeleteBinding(record); err != nil {
+			log.Error("delete-binding", err)
 		}
-		log.Error("grant-privileges", err)
-		return brokerapi.Binding{}, fmt.Errorf("granting privileges: %s", err)
+		return brokerapi.Binding{}, err
 	}
 
-	if _, err := plan.crdb.Exec(
-		fmt.Sprintf("GRANT ALL ON TABLE %s.* TO %s", dbName, user),
-	); err != nil {
-		if dbNotFoundErrRegexp.MatchString(err.Error()) {
-			cleanup()
-			return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+	creds, err := sb.backend(plan).CreateCredentials(context, orStub(instance, instanceID), record)
+	if err != nil {
+		return fail(err)
+	}
+	return brokerapi.Binding{Credentials: creds}, nil
+}
+
+// orStub returns the record of an instance or, if the broker lost it (see
+// rebuildState), a record with only its ID. Instances with a cluster of their
+// own can't be bound or deprovisioned without their record, so only those
+// with a database or schema are ever stubs.
+func orStub(instance *instanceRecord, instanceID string) *instanceRecord {
+	if instance == nil {
+		return &instanceRecord{ID: instanceID}
+	}
+	return instance
+}
+
+// existingBinding answers a bind request for a binding the broker already has
+// a record of. An identical request gets the original credentials; any other
+// request is a conflict.
+func (sb *crdbServiceBroker) existingBinding(
+	ctx context.Context, plan *Plan, instanceID, bindingID, fingerprint string,
+) (brokerapi.Binding, error) {
+	existing, err := sb.state.Binding(instanceID, bindingID)
+	if err == errStateNotFound {
+		return brokerapi.Binding{}, errConcurrentOperation
+	} else if err != nil {
+		log.Error("lookup-binding", err)
+		return brokerapi.Binding{}, fmt.Errorf("looking up binding: %s", err)
+	}
+	if existing.Fingerprint != fingerprint {
+		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+	}
+	if existing.State == statePending {
+		return brokerapi.Binding{}, errConcurrentOperation
+	}
+	instance, err := sb.state.Instance(instanceID)
+	if err != nil && err != errStateNotFound {
+		log.Error("lookup-instance", err)
+		return brokerapi.Binding{}, fmt.Errorf("looking up instance: %s", err)
+	}
+	markAlreadyExists(ctx)
+	return brokerapi.Binding{Credentials: bindingCredentials(
+		plan, orStub(instance, instanceID), userNameFromBinding(instanceID, bindingID), existing.Password,
+	)}, nil
+}
+
+// bindingCredentials returns the credentials handed out for a binding.
+// Bindings of instances with schema isolation also get the schema, which is
+// their user's search path; those of instances with tenant isolation get the
+// virtual cluster, which their connection options route to. Bindings of
+// instances with a dedicated or Cloud cluster connect to it.
+func bindingCredentials(plan *Plan, instance *instanceRecord, user, pass string) map[string]interface{} {
+	instanceID := instance.ID
+	ns := plan.namespace(instanceID)
+	conn := plan.instanceConn(instance)
+	conn.user, conn.pass = user, pass
+	creds := map[string]interface{}{
+		"host":             conn.host,
+		"port":             conn.port,
+		"database":         ns.database,
+		"username":         user,
+		"password":         pass,
+		"uri":              conn.uri(),
+		"jdbcURL":          conn.jdbcURL(),
+		"dsn":              conn.dsn(),
+		"pgxConnString":    conn.pgx(),
+		"npgsqlConnString": conn.npgsql(),
+	}
+	if ns.schema != "" {
+		creds["schema"] = ns.schema
+	}
+	if plan.Isolation == isolationTenant {
+		creds["virtual_cluster"] = clusterNameFromInstanceID(instanceID)
+	}
+	return creds
+}
+
+// grantRole grants the privileges of the given role on the database and all
+// its tables to user.
+func grantRole(crdb *sql.DB, dbName, user, role string) error {
+	if err := grantDatabase(crdb, dbName, user, role); err != nil {
+		return err
+	}
+	return grantTables(crdb, dbName, user, role)
+}
+
+// grantDatabase grants the privileges of the given role on the database to
+// user.
+func grantDatabase(crdb *sql.DB, dbName, user, role string) error {
+	_, err := execWithRetry(crdb,
+		fmt.Sprintf("GRANT %s ON DATABASE %s TO %s", databasePrivileges[role], dbName, user),
+	)
+	return err
+}
+
+// grantTables grants the privileges of the given role on all the tables of
+// the database to user, and on the ones created later.
+func grantTables(crdb *sql.DB, dbName, user, role string) error {
+	_, err := execWithRetry(crdb,
+		fmt.Sprintf("GRANT %s ON TABLE %s.* TO %s", bindingRoles[role], dbName, user),
+	)
+	// if there are no tables we don't want to fail
+	if err := ignoreNoObjectMatched(crdb, err, user); err != nil {
+		return err
+	}
+	return grantDefaultPrivileges(crdb, dbName+".public", user, role)
+}
+
+// grantDefaultPrivileges grants the privileges of the given role on the
+// tables that anyone creates in the schema from now on to user.
+func grantDefaultPrivileges(crdb *sql.DB, schema, user, role string) error {
+	_, err := execWithRetry(crdb, fmt.Sprintf(
+		"ALTER DEFAULT PRIVILEGES FOR ALL ROLES IN SCHEMA %s GRANT %s ON TABLES TO %s",
+		schema, bindingRoles[role], user,
+	))
+	return err
+}
+
+// revokeDefaultPrivileges undoes grantDefaultPrivileges. CockroachDB refuses
+// to drop users that still have default privileges.
+func revokeDefaultPrivileges(crdb *sql.DB, schema, user string) error {
+	_, err := execWithRetry(crdb, fmt.Sprintf(
+		"ALTER DEFAULT PRIVILEGES FOR ALL ROLES IN SCHEMA %s REVOKE ALL ON TABLES FROM %s", schema, user,
+	))
+	return err
+}
+
+// ignoreNoObjectMatched returns the error of a GRANT on all the tables of a
+// namespace, unless it says there are no tables. The grantee is looked up
+// to tell that from a missing grantee, which reports the same error.
+func ignoreNoObjectMatched(crdb *sql.DB, err error, grantee string) error {
+	if err == nil || !isNoObjectMatched(err) {
+		return err
+	}
+	exists, lookupErr := userExists(crdb, grantee)
+	if lookupErr != nil {
+		return fmt.Errorf("%s; looking up %s: %s", err, grantee, lookupErr)
+	}
+	if !exists {
+		return err
+	}
+	return nil
+}
+
+// revokeAll revokes all privileges on the database and its tables from user.
+// A user or database that doesn't exist has no privileges to revoke.
+func revokeAll(crdb *sql.DB, dbName, user string) error {
+	if err := revokeTables(crdb, dbName, user); err != nil {
+		return err
+	}
+	return revokeDatabase(crdb, dbName, user)
+}
+
+// revokeTables revokes all privileges on the tables of the database, and on
+// the ones created later, from user.
+func revokeTables(crdb *sql.DB, dbName, user string) error {
+	if _, err := execWithRetry(crdb, fmt.Sprintf("REVOKE ALL ON TABLE %s.* FROM %s", dbName, user)); err != nil {
+		if isNotFound(err, objectRole) || isNotFound(err, objectDatabase) {
+			return nil
+		}
+		// if there are no tables in the database we don't want to break
+		if !isNoObjectMatched(err) {
+			return fmt.Errorf("revoking grants from tables for user: %s", err)
 		}
-		log.Error("grant-privileges", err)
+	}
+	if err := revokeDefaultPrivileges(crdb, dbName+".public", user); err != nil {
+		if isNotFound(err, objectRole) || isNotFound(err, objectDatabase) {
+			return nil
+		}
+		return fmt.Errorf("revoking default privileges for user: %s", err)
+	}
+	return nil
+}
 
-		// if there are no tables we don't want to fail the binding
-		if !noObjectMatchedRegexp.MatchString(err.Error()) {
-			cleanup()
-			return brokerapi.Binding{}, fmt.Errorf("granting privileges: %s", err)
+// revokeDatabase revokes all privileges on the database from user.
+func revokeDatabase(crdb *sql.DB, dbName, user string) error {
+	if _, err := execWithRetry(crdb, fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", dbName, user)); err != nil {
+		if isNotFound(err, objectRole) || isNotFound(err, objectDatabase) {
+			return nil
 		}
+		return fmt.Errorf("revoking grants from database for user: %s", err)
 	}
+	return nil
+}
 
-	options := make(url.Values)
-	options.Add("sslmode", "require")
+// reassignOwned transfers everything that role owns in the given database
+// (tables, views, sequences, types, schemas...) to newOwner, creating the
+// latter if needed, and drops role's remaining privileges there. It does
+// nothing if the database or role don't exist.
+func reassignOwned(ctx context.Context, crdb *sql.DB, dbName, role, newOwner string) error {
+	// REASSIGN OWNED and DROP OWNED apply to the current database, so this
+	// needs a connection of its own.
+	conn, err := crdb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	credMap := map[string]interface{}{
-		"host":     plan.CRDBHost,
-		"port":     plan.CRDBPort,
-		"database": dbName,
-		"username": user,
-		"password": pass,
-		"uri":      dbURI(plan.CRDBHost, plan.CRDBPort, user, pass, dbName, options),
-		"jdbcURL":  jdbcURL(plan.CRDBHost, plan.CRDBPort, user, pass, dbName, options),
+	var prevDB string
+	if err := conn.QueryRowContext(ctx, "SHOW database").Scan(&prevDB); err != nil {
+		return fmt.Errorf("getting current database: %s", err)
+	}
+	if _, err := conn.ExecContext(ctx, "SET database = "+dbName); err != nil {
+		if isNotFound(err, objectDatabase) {
+			return nil
+		}
+		return fmt.Errorf("switching database: %s", err)
 	}
+	defer func() {
+		// Don't leave the pooled connection in the instance's database.
+		if _, err := conn.ExecContext(ctx, "SET database = "+sqlString(prevDB)); err != nil {
+			log.Error("reset-database", err)
+		}
+	}()
 
-	return brokerapi.Binding{Credentials: credMap}, nil
+	if _, err := conn.ExecContext(ctx, "CREATE ROLE IF NOT EXISTS "+newOwner); err != nil {
+		return fmt.Errorf("creating owner role: %s", err)
+	}
+	if _, err := conn.ExecContext(
+		ctx, fmt.Sprintf("REASSIGN OWNED BY %s TO %s", role, newOwner),
+	); err != nil {
+		if isNotFound(err, objectRole) {
+			return nil
+		}
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "DROP OWNED BY "+role)
+	return err
 }
 
 // Unbind is part of the brokerapi.ServiceBroker interface.
@@ -171,33 +731,101 @@ func (sb *crdbServiceBroker) Unbind(
 	if err != nil {
 		return err
 	}
-
-	dbName := dbNameFromInstanceID(instanceID)
-	user := userNameFromBinding(instanceID, bindingID)
-
-	if _, err := plan.crdb.Exec(fmt.Sprintf("REVOKE ALL ON TABLE %s.* FROM %s", dbName, user)); err != nil {
-		log.Error("revoke-grants", err)
-		// if there are no tables in the database we don't want to break
-		if !noObjectMatchedRegexp.MatchString(err.Error()) {
-			return fmt.Errorf("revoking grants from tables for user: %s", err)
-		}
+	unlock, err := sb.lockInstance(instanceID)
+	if err != nil {
+		return err
 	}
-	if _, err := plan.crdb.Exec(fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", dbName, user)); err != nil {
-		log.Error("revoke-grants", err)
-		return fmt.Errorf("revoking grants from database for user: %s", err)
+	defer unlock()
+
+	record, err := sb.state.Binding(instanceID, bindingID)
+	if err == errStateNotFound {
+		record = nil
+	} else if err != nil {
+		log.Error("lookup-binding", err)
+		return fmt.Errorf("looking up binding: %s", err)
+	} else if record.State == statePending {
+		return errConcurrentOperation
 	}
 
-	if _, err := plan.crdb.Exec(fmt.Sprintf("DROP USER IF EXISTS %s", user)); err != nil {
-		log.Error("drop-user", err)
-		return fmt.Errorf("deleting user: %s", err)
+	instance, err := sb.state.Instance(instanceID)
+	if err != nil && err != errStateNotFound {
+		log.Error("lookup-instance", err)
+		return fmt.Errorf("looking up instance: %s", err)
 	}
-	return nil
+	return sb.backend(plan).RevokeCredentials(context, orStub(instance, instanceID), bindingID, record)
 }
 
 // Update is part of the brokerapi.ServiceBroker interface.
 func (sb *crdbServiceBroker) Update(
 	context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool,
 ) (brokerapi.UpdateServiceSpec, error) {
+	unlock, err := sb.lockInstance(instanceID)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	defer unlock()
+
+	instance, err := sb.state.Instance(instanceID)
+	if err == errStateNotFound {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		log.Error("lookup-instance", err)
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("looking up instance: %s", err)
+	}
+	if instance.inProgress() {
+		return brokerapi.UpdateServiceSpec{}, errConcurrentOperation
+	}
+	if details.PlanID != "" && details.PlanID != instance.PlanID {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+	}
+	plan, err := findPlan(instance.ServiceID, instance.PlanID)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	params, err := parseProvisionParameters(details.RawParameters)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if params.RestoreFrom != nil {
+		// Restores into existing instances go through the admin API.
+		return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(
+			errors.New("restore_from can only be given when creating an instance"),
+			http.StatusBadRequest, "restore-from",
+		)
+	}
+
+	if params.TerminateSessions != nil {
+		instance.TerminateSessions = params.TerminateSessions
+	}
+	if params.DeletionProtection != nil {
+		instance.DeletionProtection = *params.DeletionProtection
+	}
+	backend := sb.backend(plan)
+	if params.PrimaryRegion != nil || params.Regions != nil || params.SurvivalGoal != nil {
+		regions := instance.Regions.withParameters(params)
+		// Resizing is idempotent, so if the record can't be stored, the
+		// request can be retried.
+		if err := backend.Resize(context, instance, regions); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+		instance.Regions = regions
+	}
+	// Update the comment first: if storing the record fails, the instance
+	// stays protected rather than unprotected.
+	if err := backend.UpdateInstance(context, instance, func(c *instanceComment) {
+		c.DeletionProtection = instance.DeletionProtection
+		c.Regions = instance.Regions
+		if params.Labels != nil {
+			c.Labels = params.Labels
+		}
+	}); err != nil {
+		log.Error("comment-database", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if err := sb.state.PutInstance(instance); err != nil {
+		log.Error("store-instance", err)
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("storing instance: %s", err)
+	}
 	return brokerapi.UpdateServiceSpec{}, nil
 }
 
@@ -205,5 +833,33 @@ func (sb *crdbServiceBroker) Update(
 func (sb *crdbServiceBroker) LastOperation(
 	context context.Context, instanceID, operationData string,
 ) (brokerapi.LastOperation, error) {
-	return brokerapi.LastOperation{}, nil
+	// Instances with tenant isolation are provisioned and deprovisioned by
+	// operations, whose IDs are the operation data.
+	if operationData != "" && operationData != operationProvision {
+		op, err := sb.state.Operation(instanceID, operationData)
+		if err == nil {
+			return brokerapi.LastOperation{State: op.State, Description: op.Description}, nil
+		} else if err != errStateNotFound {
+			return brokerapi.LastOperation{}, err
+		}
+	}
+	// Other instances are provisioned synchronously, but a repeated
+	// provision request returns 202 while the original one is still being
+	// processed.
+	instance, err := sb.state.Instance(instanceID)
+	switch {
+	case err == errStateNotFound && operationData == operationProvision:
+		// Failed provisions are forgotten.
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: "provisioning failed"}, nil
+	case err == errStateNotFound:
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	case err != nil:
+		return brokerapi.LastOperation{}, err
+	case instance.inProgress():
+		return brokerapi.LastOperation{State: brokerapi.InProgress}, nil
+	case instance.State == stateFailed:
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: instance.FailureReason}, nil
+	default:
+		return brokerapi.LastOperation{State: brokerapi.Succeeded}, nil
+	}
 }
@@ -0,0 +1,698 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// fakeBroker is a broker whose only plan is backed by a fake cluster, served
+// over HTTP.
+type fakeBroker struct {
+	cluster *fakeCluster
+	plan    *Plan
+	sb      *crdbServiceBroker
+	server  *httptest.Server
+}
+
+func newFakeBroker() (*fakeBroker, func()) {
+	cluster, db := newFakeCluster()
+	plan, restorePlans := usePlan(db, Plan{CRDBHost: "crdb.example.com", CRDBPort: "26257"})
+	sb := newCRDBServiceBroker(newBrokerState(newMemKVStore()))
+	server := httptest.NewServer(newBrokerHandler(sb, brokerapi.BrokerCredentials{
+		Username: "user", Password: "pass",
+	}))
+	return &fakeBroker{cluster: cluster, plan: plan, sb: sb, server: server}, func() {
+		server.Close()
+		restorePlans()
+		db.Close()
+	}
+}
+
+// usePlan replaces the configured services with a single service whose only
+// plan connects through db, which is used as is; the plan's host and port are
+// only used to generate credentials. It returns the plan and a function that
+// restores the previous configuration.
+func usePlan(db *sql.DB, p Plan) (*Plan, func()) {
+	old := Services
+
+	p.ServiceID = "test-service"
+	if p.ID == "" {
+		p.ID = "test-plan"
+	}
+	if p.Name == "" {
+		p.Name = "test"
+	}
+	p.CRDBAdminUser = "root"
+	p.crdb = db
+	Services = []Service{{
+		Service: brokerapi.Service{ID: p.ServiceID, Name: "test-service"},
+		Plans:   []Plan{p},
+	}}
+	return &Services[0].Plans[0], func() { Services = old }
+}
+
+// provisionBody returns the body of a provision request for the fake broker's
+// plan, with the given parameters.
+func (b *fakeBroker) provisionBody(params map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"service_id":        b.plan.ServiceID,
+		"plan_id":           b.plan.ID,
+		"organization_guid": "org1",
+		"space_guid":        "space1",
+		"parameters":        params,
+	}
+}
+
+func (b *fakeBroker) provisionDetails(params string) brokerapi.ProvisionDetails {
+	return brokerapi.ProvisionDetails{
+		ServiceID:        b.plan.ServiceID,
+		PlanID:           b.plan.ID,
+		OrganizationGUID: "org1",
+		SpaceGUID:        "space1",
+		RawParameters:    json.RawMessage(params),
+	}
+}
+
+func TestProvisionIdempotency(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(t *testing.T, b *fakeBroker)
+		// query is appended to the provision URL.
+		query string
+		// body is the provision request; nil means the default request.
+		body           map[string]interface{}
+		expectedStatus int
+		// expectedOperation is the operation returned with a 202.
+		expectedOperation string
+		// expectRecord says whether the broker should end up with a record
+		// of the instance.
+		expectRecord bool
+	}{
+		{
+			name:           "new instance",
+			expectedStatus: http.StatusCreated,
+			expectRecord:   true,
+		},
+		{
+			name: "identical repeat",
+			setup: func(t *testing.T, b *fakeBroker) {
+				if _, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(`{"a": 1}`), false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedStatus: http.StatusOK,
+			expectRecord:   true,
+		},
+		{
+			name: "identical repeat with reordered parameters",
+			setup: func(t *testing.T, b *fakeBroker) {
+				if _, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(
+					`{"b": [1, 2], "a": 1}`,
+				), false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			body: map[string]interface{}{
+				"a": 1, "b": []int{1, 2},
+			},
+			expectedStatus: http.StatusOK,
+			expectRecord:   true,
+		},
+		{
+			name: "different parameters",
+			setup: func(t *testing.T, b *fakeBroker) {
+				if _, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(`{"a": 2}`), false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedStatus: http.StatusConflict,
+			expectRecord:   true,
+		},
+		{
+			name: "in progress, async allowed",
+			setup: func(t *testing.T, b *fakeBroker) {
+				putPendingInstance(t, b, `{"a": 1}`)
+			},
+			query:             "?accepts_incomplete=true",
+			expectedStatus:    http.StatusAccepted,
+			expectedOperation: operationProvision,
+			expectRecord:      true,
+		},
+		{
+			name: "in progress, async not allowed",
+			setup: func(t *testing.T, b *fakeBroker) {
+				putPendingInstance(t, b, `{"a": 1}`)
+			},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectRecord:   true,
+		},
+		{
+			name: "in progress with different parameters",
+			setup: func(t *testing.T, b *fakeBroker) {
+				putPendingInstance(t, b, `{"a": 2}`)
+			},
+			query:          "?accepts_incomplete=true",
+			expectedStatus: http.StatusConflict,
+			expectRecord:   true,
+		},
+		{
+			name: "database exists without record",
+			setup: func(t *testing.T, b *fakeBroker) {
+				b.cluster.databases[dbNameFromInstanceID("inst1")] = true
+			},
+			expectedStatus: http.StatusConflict,
+			expectRecord:   false,
+		},
+		{
+			name: "create database fails",
+			setup: func(t *testing.T, b *fakeBroker) {
+				b.cluster.fail = func(stmt string) error {
+					return errors.New("connection refused")
+				}
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectRecord:   false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			if tc.setup != nil {
+				tc.setup(t, b)
+			}
+			params := tc.body
+			if params == nil {
+				params = map[string]interface{}{"a": 1}
+			}
+
+			var res struct {
+				OperationData string `json:"operation"`
+				Error         string `json:"error"`
+			}
+			status := adminRequest(t, b.server, "PUT", "/v2/service_instances/inst1"+tc.query,
+				b.provisionBody(params), &res)
+			if status != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, status)
+			}
+			if res.OperationData != tc.expectedOperation {
+				t.Errorf("expected operation %q, got %q", tc.expectedOperation, res.OperationData)
+			}
+			if status == http.StatusUnprocessableEntity && res.Error != "ConcurrencyError" {
+				t.Errorf("expected ConcurrencyError, got %q", res.Error)
+			}
+			_, err := b.sb.state.Instance("inst1")
+			if hasRecord := err == nil; hasRecord != tc.expectRecord {
+				t.Errorf("expected record: %t, got %t (%v)", tc.expectRecord, hasRecord, err)
+			}
+		})
+	}
+}
+
+func putPendingInstance(t *testing.T, b *fakeBroker, params string) {
+	t.Helper()
+	fingerprint, err := provisionFingerprint(b.provisionDetails(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sb.state.PutInstance(&instanceRecord{
+		ID:          "inst1",
+		ServiceID:   b.plan.ServiceID,
+		PlanID:      b.plan.ID,
+		State:       statePending,
+		Fingerprint: fingerprint,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisionLastOperation(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	putPendingInstance(t, b, `{}`)
+	op, err := b.sb.LastOperation(ctx, "inst1", operationProvision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != brokerapi.InProgress {
+		t.Errorf("expected %q while pending, got %q", brokerapi.InProgress, op.State)
+	}
+
+	if err := b.sb.state.DeleteInstance("inst1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(`{}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if op, err = b.sb.LastOperation(ctx, "inst1", operationProvision); err != nil {
+		t.Fatal(err)
+	}
+	if op.State != brokerapi.Succeeded {
+		t.Errorf("expected %q once provisioned, got %q", brokerapi.Succeeded, op.State)
+	}
+}
+
+func TestBindIdempotency(t *testing.T) {
+	bindBody := func(b *fakeBroker, appGUID string) map[string]interface{} {
+		return map[string]interface{}{
+			"service_id": b.plan.ServiceID,
+			"plan_id":    b.plan.ID,
+			"app_guid":   appGUID,
+		}
+	}
+	bindDetails := func(b *fakeBroker, appGUID string) brokerapi.BindDetails {
+		return brokerapi.BindDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: appGUID}
+	}
+	bind := func(t *testing.T, b *fakeBroker) brokerapi.Binding {
+		binding, err := b.sb.Bind(context.Background(), "inst1", "bind1", bindDetails(b, "app1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binding
+	}
+	user := userNameFromBinding("inst1", "bind1")
+
+	testCases := []struct {
+		name  string
+		setup func(t *testing.T, b *fakeBroker) (expectedCreds map[string]interface{})
+		// appGUID is the app of the bind request.
+		appGUID        string
+		expectedStatus int
+		expectRecord   bool
+		expectUser     bool
+	}{
+		{
+			name:           "new binding",
+			appGUID:        "app1",
+			expectedStatus: http.StatusCreated,
+			expectRecord:   true,
+			expectUser:     true,
+		},
+		{
+			name: "identical repeat",
+			setup: func(t *testing.T, b *fakeBroker) map[string]interface{} {
+				return bind(t, b).Credentials.(map[string]interface{})
+			},
+			appGUID:        "app1",
+			expectedStatus: http.StatusOK,
+			expectRecord:   true,
+			expectUser:     true,
+		},
+		{
+			name: "different app",
+			setup: func(t *testing.T, b *fakeBroker) map[string]interface{} {
+				bind(t, b)
+				return nil
+			},
+			appGUID:        "app2",
+			expectedStatus: http.StatusConflict,
+			expectRecord:   true,
+			expectUser:     true,
+		},
+		{
+			name: "in progress",
+			setup: func(t *testing.T, b *fakeBroker) map[string]interface{} {
+				fingerprint, err := bindFingerprint(bindDetails(b, "app1"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := b.sb.state.PutBinding(&bindingRecord{
+					ID: "bind1", InstanceID: "inst1", State: statePending, Fingerprint: fingerprint,
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return nil
+			},
+			appGUID:        "app1",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectRecord:   true,
+			expectUser:     false,
+		},
+		{
+			// The user must not be dropped, as we don't know who created it.
+			name: "user exists without record",
+			setup: func(t *testing.T, b *fakeBroker) map[string]interface{} {
+				b.cluster.users[user] = true
+				return nil
+			},
+			appGUID:        "app1",
+			expectedStatus: http.StatusConflict,
+			expectRecord:   false,
+			expectUser:     true,
+		},
+		{
+			name: "grant fails",
+			setup: func(t *testing.T, b *fakeBroker) map[string]interface{} {
+				b.cluster.fail = func(stmt string) error {
+					if strings.HasPrefix(stmt, "GRANT") {
+						return errors.New("connection reset")
+					}
+					return nil
+				}
+				return nil
+			},
+			appGUID:        "app1",
+			expectedStatus: http.StatusInternalServerError,
+			expectRecord:   false,
+			expectUser:     false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			if _, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(""), false); err != nil {
+				t.Fatal(err)
+			}
+			var expectedCreds map[string]interface{}
+			if tc.setup != nil {
+				expectedCreds = tc.setup(t, b)
+			}
+
+			var res struct {
+				Credentials map[string]interface{} `json:"credentials"`
+				Error       string                 `json:"error"`
+			}
+			status := adminRequest(t, b.server, "PUT", "/v2/service_instances/inst1/service_bindings/bind1",
+				bindBody(b, tc.appGUID), &res)
+			if status != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, status)
+			}
+			if status == http.StatusUnprocessableEntity && res.Error != "ConcurrencyError" {
+				t.Errorf("expected ConcurrencyError, got %q", res.Error)
+			}
+			if expectedCreds != nil && !reflect.DeepEqual(res.Credentials, expectedCreds) {
+				t.Errorf("expected the original credentials %v, got %v", expectedCreds, res.Credentials)
+			}
+			_, err := b.sb.state.Binding("inst1", "bind1")
+			if hasRecord := err == nil; hasRecord != tc.expectRecord {
+				t.Errorf("expected record: %t, got %t (%v)", tc.expectRecord, hasRecord, err)
+			}
+			if hasUser := b.cluster.hasUser(user); hasUser != tc.expectUser {
+				t.Errorf("expected user: %t, got %t", tc.expectUser, hasUser)
+			}
+		})
+	}
+}
+
+func TestDeletionProtection(t *testing.T) {
+	testCases := []struct {
+		name string
+		// params are the provision parameters.
+		params string
+		// update, if set, are the parameters of an update before deprovisioning.
+		update string
+		// loseState deletes the instance record before deprovisioning.
+		loseState bool
+		expectErr error
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:      "enabled at provision",
+			params:    `{"deletion_protection": true}`,
+			expectErr: errDeletionProtected,
+		},
+		{
+			name:      "enabled by update",
+			update:    `{"deletion_protection": true}`,
+			expectErr: errDeletionProtected,
+		},
+		{
+			name:   "disabled by update",
+			params: `{"deletion_protection": true}`,
+			update: `{"deletion_protection": false}`,
+		},
+		{
+			name:   "update keeps setting",
+			params: `{"deletion_protection": true}`,
+			update: `{"terminate_sessions": true}`,
+			// The plan is given, so this checks that omitted parameters
+			// aren't reset.
+			expectErr: errDeletionProtected,
+		},
+		{
+			name:      "state lost",
+			params:    `{"deletion_protection": true}`,
+			loseState: true,
+			expectErr: errDeletionProtected,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			ctx := context.Background()
+
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(tc.params), false); err != nil {
+				t.Fatal(err)
+			}
+			if tc.update != "" {
+				if _, err := b.sb.Update(ctx, "inst1", brokerapi.UpdateDetails{
+					ServiceID:     b.plan.ServiceID,
+					PlanID:        b.plan.ID,
+					RawParameters: json.RawMessage(tc.update),
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.loseState {
+				if err := b.sb.state.DeleteInstance("inst1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := b.sb.Deprovision(ctx, "inst1", brokerapi.DeprovisionDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+			}, false)
+			if err != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if exists := b.cluster.databases[dbNameFromInstanceID("inst1")]; exists != (err != nil) {
+				t.Errorf("expected database to exist: %t, got %t", err != nil, exists)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := b.sb.Update(ctx, "inst1", brokerapi.UpdateDetails{}, false); err != brokerapi.ErrInstanceDoesNotExist {
+		t.Errorf("expected %v, got %v", brokerapi.ErrInstanceDoesNotExist, err)
+	}
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Update(ctx, "inst1", brokerapi.UpdateDetails{
+		ServiceID: b.plan.ServiceID, PlanID: "other-plan",
+	}, false); err != brokerapi.ErrPlanChangeNotSupported {
+		t.Errorf("expected %v, got %v", brokerapi.ErrPlanChangeNotSupported, err)
+	}
+	if _, err := b.sb.Update(ctx, "inst1", brokerapi.UpdateDetails{
+		RawParameters: json.RawMessage(`{"deletion_protection": 1}`),
+	}, false); err == nil {
+		t.Errorf("expected invalid parameters to fail")
+	}
+}
+
+func TestUnbindReassignsOwnership(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	bindDetails := brokerapi.BindDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1"}
+	if _, err := b.sb.Bind(ctx, "inst1", "bind1", bindDetails); err != nil {
+		t.Fatal(err)
+	}
+	db := dbNameFromInstanceID("inst1")
+	user := userNameFromBinding("inst1", "bind1")
+	owner := ownerRoleFromInstanceID("inst1")
+	// The app created some objects.
+	objects := []string{"public.albums", "public.albums_view", "public.albums_seq", "public.genre", "music"}
+	b.cluster.owners[db] = make(map[string]string)
+	for _, obj := range objects {
+		b.cluster.owners[db][obj] = user
+	}
+
+	unbindDetails := brokerapi.UnbindDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID}
+	if err := b.sb.Unbind(ctx, "inst1", "bind1", unbindDetails); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.hasUser(user) {
+		t.Errorf("user not dropped")
+	}
+	for _, obj := range objects {
+		if o := b.cluster.owners[db][obj]; o != owner {
+			t.Errorf("expected %s to be owned by %s, got %q", obj, owner, o)
+		}
+	}
+	// The binding is gone for good.
+	if err := b.sb.Unbind(ctx, "inst1", "bind1", unbindDetails); err != brokerapi.ErrBindingDoesNotExist {
+		t.Fatalf("expected %v, got %v", brokerapi.ErrBindingDoesNotExist, err)
+	}
+
+	if _, err := b.sb.Deprovision(ctx, "inst1", brokerapi.DeprovisionDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.hasUser(owner) {
+		t.Errorf("owner role not dropped")
+	}
+}
+
+func TestBindReadOnly(t *testing.T) {
+	testCases := []struct {
+		isolation string
+		// expectedPrivileges are the privileges on the instance's database
+		// or schema.
+		expectedPrivileges string
+	}{
+		{isolationDatabase, "CONNECT"},
+		{isolationSchema, "USAGE"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.isolation, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			b.plan.Isolation = tc.isolation
+			ctx := context.Background()
+
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+				t.Fatal(err)
+			}
+			// Bindings from another space are readonly.
+			bindCtx := context.WithValue(ctx, requestContextKey{}, requestContext{SpaceGUID: "space2"})
+			if _, err := b.sb.Bind(bindCtx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			ns := b.plan.namespace("inst1").String()
+			user := userNameFromBinding("inst1", "bind1")
+			if p := b.cluster.grants[ns][user]; p != tc.expectedPrivileges {
+				t.Errorf("expected %s on %s, got %q", tc.expectedPrivileges, ns, p)
+			}
+			if p := b.cluster.defaultPrivileges[ns][user]; p != "SELECT" {
+				t.Errorf("expected SELECT on the new tables of %s, got %q", ns, p)
+			}
+
+			appDB, err := sql.Open("fakecrdb", b.cluster.name+"/"+b.plan.namespace("inst1").database+"/"+user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer appDB.Close()
+			if _, err := appDB.Exec("CREATE TABLE albums (id INT PRIMARY KEY)"); err == nil {
+				t.Errorf("readonly user created a table")
+			}
+			appDB.Close()
+
+			if err := b.sb.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if b.cluster.hasUser(user) {
+				t.Errorf("binding user not dropped")
+			}
+			if _, ok := b.cluster.defaultPrivileges[ns][user]; ok {
+				t.Errorf("default privileges of the binding user left behind")
+			}
+		})
+	}
+}
+
+func TestUnbindOwnedObjects(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db := dbNameFromInstanceID("inst1")
+	user := userNameFromBinding("inst1", "bind1")
+	owner := ownerRoleFromInstanceID("inst1")
+
+	// Create one object of each kind as the binding's user.
+	appDB, err := sql.Open("fakecrdb", b.cluster.name+"/"+db+"/"+user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appDB.Close()
+	objects := []string{"music", "albums", "albums_view", "albums_seq", "genre"}
+	for _, stmt := range []string{
+		"CREATE SCHEMA music",
+		"CREATE TABLE albums (id INT PRIMARY KEY)",
+		"CREATE VIEW albums_view AS SELECT id FROM albums",
+		"CREATE SEQUENCE albums_seq",
+		"CREATE TYPE genre AS ENUM ('rock', 'jazz')",
+	} {
+		if _, err := appDB.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	appDB.Close()
+	for _, obj := range objects {
+		if o := b.cluster.owners[db][obj]; o != user {
+			t.Fatalf("expected %s to be owned by %s, got %q", obj, user, o)
+		}
+	}
+
+	if err := b.sb.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objects {
+		if o := b.cluster.owners[db][obj]; o != owner {
+			t.Errorf("expected %s to be owned by %s, got %q", obj, owner, o)
+		}
+	}
+	if _, ok := b.cluster.tables[db]["albums"]; !ok {
+		t.Errorf("table of the binding user dropped")
+	}
+	if b.cluster.hasUser(user) {
+		t.Errorf("binding user not dropped")
+	}
+}
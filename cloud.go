@@ -0,0 +1,170 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// cloudPollInterval is how often createCloud checks whether a new cluster
+// is ready; a variable for testing.
+var cloudPollInterval = 30 * time.Second
+
+// createCloud creates the Cloud cluster of an instance and waits for it to be
+// ready or, for plans with a shared Cloud cluster, the instance's database
+// in it. It then creates the instance's admin user and records how to reach
+// the cluster in the instance's record. Every step is idempotent, so that an
+// interrupted operation can be resumed.
+func (sb *crdbServiceBroker) createCloud(plan *Plan, instance *instanceRecord) error {
+	cfg := plan.Cloud
+	clusterID := cfg.ClusterID
+	if clusterID == "" {
+		cluster, err := sb.cloudCluster(plan, instance)
+		if err != nil {
+			return err
+		}
+		clusterID = cluster.ID
+	} else if err := plan.cloud.CreateDatabase(clusterID, dbNameFromInstanceID(instance.ID)); err != nil {
+		return err
+	}
+
+	// Users created through the API get the admin role, which
+	// restrictCloudAdmin takes back in shared clusters.
+	if err := plan.cloud.CreateSQLUser(
+		clusterID, adminUserFromInstanceID(instance.ID), instance.AdminPassword,
+	); err != nil {
+		return err
+	}
+	host, port, err := plan.cloud.ConnectionParams(clusterID)
+	if err != nil {
+		return err
+	}
+	instance.ClusterID, instance.ClusterHost, instance.ClusterPort = clusterID, host, port
+	if err := sb.state.PutInstance(instance); err != nil {
+		return fmt.Errorf("storing instance: %s", err)
+	}
+	if cfg.ClusterID != "" {
+		return sb.restrictCloudAdmin(plan, instance)
+	}
+	return nil
+}
+
+// restrictCloudAdmin limits the admin user of an instance of a plan with a
+// shared Cloud cluster to the instance's database: the Cloud API makes it an
+// admin of the whole cluster, which would let the instance's owner reach the
+// other instances. The user instead owns the database, can create the users
+// of the bindings and cancel their sessions, and is a member of the role
+// that owns the objects of unbound users. It stays an admin until the
+// other privileges are granted, and the statements are idempotent, so that
+// an interrupted operation can be resumed.
+func (sb *crdbServiceBroker) restrictCloudAdmin(plan *Plan, instance *instanceRecord) error {
+	crdb, err := sb.instanceDB(plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	admin := adminUserFromInstanceID(instance.ID)
+	owner := ownerRoleFromInstanceID(instance.ID)
+	for _, stmt := range []string{
+		"CREATE ROLE IF NOT EXISTS " + owner,
+		fmt.Sprintf("GRANT %s TO %s", owner, admin),
+		fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", dbNameFromInstanceID(instance.ID), admin),
+		fmt.Sprintf("ALTER ROLE %s WITH CREATEROLE CANCELQUERY VIEWACTIVITY", admin),
+		"REVOKE admin FROM " + admin,
+	} {
+		if _, err := execWithRetry(crdb, stmt); err != nil {
+			return fmt.Errorf("restricting admin user: %s", err)
+		}
+	}
+	return nil
+}
+
+// cloudCluster creates the Cloud cluster of an instance, unless it exists,
+// and waits for it to be ready.
+func (sb *crdbServiceBroker) cloudCluster(plan *Plan, instance *instanceRecord) (*cloudCluster, error) {
+	cfg := plan.Cloud
+	name := cloudClusterNameFromInstanceID(instance.ID)
+	cluster, err := plan.cloud.FindCluster(name)
+	if err == errCloudNotFound {
+		cluster, err = plan.cloud.CreateCluster(cfg.createClusterRequest(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Record the cluster right away, so that it is deleted along with the
+	// instance even if the operation is interrupted.
+	if instance.ClusterID != cluster.ID {
+		instance.ClusterID = cluster.ID
+		if err := sb.state.PutInstance(instance); err != nil {
+			return nil, fmt.Errorf("storing instance: %s", err)
+		}
+	}
+
+	for deadline := time.Now().Add(cfg.readyTimeout); ; {
+		switch cluster.State {
+		case cloudClusterCreated:
+			return cluster, nil
+		case cloudClusterCreationFailed:
+			return nil, fmt.Errorf("creating cluster %s failed", name)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cluster %s not ready after %s", name, cfg.readyTimeout)
+		}
+		time.Sleep(cloudPollInterval)
+		if cluster, err = plan.cloud.GetCluster(cluster.ID); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dropCloud deletes the Cloud cluster of an instance or, for plans with a
+// shared Cloud cluster, drops the instance's database and users in it. It
+// does nothing if they don't exist.
+func (sb *crdbServiceBroker) dropCloud(plan *Plan, instance *instanceRecord) error {
+	cfg := plan.Cloud
+	if cfg.ClusterID == "" {
+		id := instance.ClusterID
+		if id == "" {
+			cluster, err := plan.cloud.FindCluster(cloudClusterNameFromInstanceID(instance.ID))
+			if err == errCloudNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			id = cluster.ID
+		}
+		return plan.cloud.DeleteCluster(id)
+	}
+
+	if instance.ClusterHost != "" {
+		// The admin user exists, and drops the objects of the unbound users
+		// along with the database, and the role that owns them.
+		crdb, err := sb.instanceDB(plan, instance.ID)
+		if err != nil {
+			return err
+		}
+		dbName := dbNameFromInstanceID(instance.ID)
+		if _, err := execWithRetry(crdb, "DROP DATABASE IF EXISTS "+dbName+" CASCADE"); err != nil {
+			return fmt.Errorf("dropping database: %s", err)
+		}
+		if _, err := execWithRetry(crdb, "DROP ROLE IF EXISTS "+ownerRoleFromInstanceID(instance.ID)); err != nil {
+			return fmt.Errorf("dropping owner role: %s", err)
+		}
+	}
+	if err := plan.cloud.DeleteDatabase(cfg.ClusterID, dbNameFromInstanceID(instance.ID)); err != nil {
+		return err
+	}
+	return plan.cloud.DeleteSQLUser(cfg.ClusterID, adminUserFromInstanceID(instance.ID))
+}
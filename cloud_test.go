@@ -0,0 +1,585 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const fakeCloudAPIKey = "fake-api-key"
+
+// fakeCloud is a fake CockroachDB Cloud API, whose clusters are fake clusters.
+// New clusters are created after a few polls.
+type fakeCloud struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	clusters map[string]*fakeCloudCluster
+	// creationPolls is how many times new clusters are reported as being
+	// created; negative means forever.
+	creationPolls int
+	// failCreation makes the creation of clusters fail.
+	failCreation bool
+	// created records the creation requests.
+	created []*cloudCreateClusterRequest
+	nextID  int
+}
+
+type fakeCloudCluster struct {
+	cloudCluster
+	host string
+	c    *fakeCluster
+	// polls is how many more times the cluster is reported as being
+	// created.
+	polls int
+}
+
+func newFakeCloud() *fakeCloud {
+	f := &fakeCloud{clusters: make(map[string]*fakeCloudCluster), creationPolls: 2}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// addCluster adds an existing cluster to the fake API.
+func (f *fakeCloud) addCluster(name string) *fakeCloudCluster {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addClusterLocked(name, cloudClusterCreated, 0)
+}
+
+func (f *fakeCloud) addClusterLocked(name, state string, polls int) *fakeCloudCluster {
+	f.nextID++
+	cluster := &fakeCloudCluster{
+		cloudCluster: cloudCluster{ID: fmt.Sprintf("id-%d", f.nextID), Name: name, State: state},
+		host:         name + ".cockroachlabs.example",
+		c:            registerFakeCluster(),
+		polls:        polls,
+	}
+	f.clusters[cluster.ID] = cluster
+	return cluster
+}
+
+// byName returns the cluster with the given name, or nil.
+func (f *fakeCloud) byName(name string) *fakeCloudCluster {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cluster := range f.clusters {
+		if cluster.Name == name {
+			return cluster
+		}
+	}
+	return nil
+}
+
+// useCloud sets up the plan for cloud isolation on the fake API, with the
+// given configuration. The returned function restores the package's
+// variables.
+func (f *fakeCloud) useCloud(t *testing.T, plan *Plan, cfg cloudConfig) func() {
+	t.Helper()
+	cfg.APIURL, cfg.APIKey = f.URL, fakeCloudAPIKey
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	plan.Isolation = isolationCloud
+	plan.Cloud = &cfg
+	plan.cloud = newCloudREST(plan.Cloud)
+
+	oldConnect, oldInterval := instanceConnect, cloudPollInterval
+	instanceConnect = f.connect
+	cloudPollInterval = 0
+	return func() {
+		instanceConnect, cloudPollInterval = oldConnect, oldInterval
+		f.Close()
+	}
+}
+
+// connect opens a connection to the fake cluster of the URI's host, with a
+// password and checking the server's certificate.
+func (f *fakeCloud) connect(uri string) (*sql.DB, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if mode := u.Query().Get("sslmode"); mode != "verify-full" {
+		return nil, fmt.Errorf("fakecloud: connection with sslmode %q", mode)
+	}
+	if _, ok := u.User.Password(); !ok {
+		return nil, fmt.Errorf("fakecloud: no password for %s", u.User.Username())
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cluster := range f.clusters {
+		if cluster.host == u.Hostname() && u.Port() == "26257" {
+			return sql.Open("fakecrdb", fmt.Sprintf("%s%s/%s", cluster.c.name, u.Path, u.User.Username()))
+		}
+	}
+	return nil, fmt.Errorf("fakecloud: no cluster at %s", u.Host)
+}
+
+func (f *fakeCloud) writeError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+}
+
+func (f *fakeCloud) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+fakeCloudAPIKey {
+		f.writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.URL.Path == "/api/v1/clusters" && r.Method == "POST" {
+		var req cloudCreateClusterRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			f.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.createCluster(w, &req)
+		return
+	}
+	var body map[string]string
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			f.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if r.URL.Path == "/api/v1/clusters" && r.Method == "GET" {
+		// Return a page per cluster to exercise pagination.
+		var ids []string
+		for id := range f.clusters {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		page := r.URL.Query().Get("pagination.page")
+		res := map[string]interface{}{"clusters": []interface{}{}}
+		for i, id := range ids {
+			if page == "" && i == 0 || page == id {
+				res["clusters"] = []interface{}{f.clusters[id].cloudCluster}
+				if i+1 < len(ids) {
+					res["pagination"] = map[string]string{"next_page": ids[i+1]}
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/clusters/"), "/")
+	cluster, ok := f.clusters[parts[0]]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "cluster not found")
+		return
+	}
+	c := cluster.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch route := r.Method + " " + strings.Join(parts[1:], "/"); {
+	case route == "GET ":
+		if cluster.State != cloudClusterCreated && cluster.State != cloudClusterCreationFailed {
+			if cluster.polls == 0 {
+				cluster.State = cloudClusterCreated
+			} else if cluster.polls > 0 {
+				cluster.polls--
+			}
+		}
+		_ = json.NewEncoder(w).Encode(cluster.cloudCluster)
+	case route == "DELETE ":
+		delete(f.clusters, cluster.ID)
+	case route == "GET connection-string":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"connection_string": "postgresql://" + cluster.host + ":26257/defaultdb",
+			"params":            map[string]string{"host": cluster.host, "port": "26257"},
+		})
+	case route == "POST databases":
+		if c.databases[body["name"]] {
+			f.writeError(w, http.StatusConflict, "database exists")
+			return
+		}
+		c.databases[body["name"]] = true
+	case strings.HasPrefix(route, "DELETE databases/"):
+		if !c.databases[parts[2]] {
+			f.writeError(w, http.StatusNotFound, "database not found")
+			return
+		}
+		delete(c.databases, parts[2])
+	case route == "POST sql-users":
+		if c.users[body["name"]] {
+			f.writeError(w, http.StatusConflict, "user exists")
+			return
+		}
+		if body["password"] == "" {
+			f.writeError(w, http.StatusBadRequest, "password required")
+			return
+		}
+		c.users[body["name"]] = true
+		// Users created through the API are admins.
+		_ = c.grantRole("admin", body["name"])
+	case strings.HasPrefix(route, "PUT sql-users/") && len(parts) == 4 && parts[3] == "password":
+		if !c.users[parts[2]] {
+			f.writeError(w, http.StatusNotFound, "user not found")
+			return
+		}
+	case strings.HasPrefix(route, "DELETE sql-users/"):
+		if !c.users[parts[2]] {
+			f.writeError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		delete(c.users, parts[2])
+		delete(c.members["admin"], parts[2])
+	default:
+		f.writeError(w, http.StatusNotFound, "unknown route "+route)
+	}
+}
+
+// createCluster handles cluster creation requests. The caller holds f.mu.
+func (f *fakeCloud) createCluster(w http.ResponseWriter, req *cloudCreateClusterRequest) {
+	for _, cluster := range f.clusters {
+		if cluster.Name == req.Name {
+			f.writeError(w, http.StatusConflict, "cluster name taken")
+			return
+		}
+	}
+	if len(req.Name) > 20 {
+		f.writeError(w, http.StatusBadRequest, "cluster name too long")
+		return
+	}
+	f.created = append(f.created, req)
+	state := "CREATING"
+	if f.failCreation {
+		state = cloudClusterCreationFailed
+	}
+	cluster := f.addClusterLocked(req.Name, state, f.creationPolls)
+	_ = json.NewEncoder(w).Encode(cluster.cloudCluster)
+}
+
+func TestCloudIsolation(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config cloudConfig
+		shared bool
+	}{
+		{
+			name:   "serverless",
+			config: cloudConfig{Provider: "GCP", Regions: []string{"us-central1"}},
+		},
+		{
+			name: "dedicated",
+			config: cloudConfig{
+				ClusterType: cloudDedicated, Provider: "AWS", Regions: []string{"us-east-1", "eu-west-1"},
+			},
+		},
+		{
+			name:   "shared cluster",
+			shared: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			f := newFakeCloud()
+			var shared *fakeCloudCluster
+			if tc.shared {
+				shared = f.addCluster("shared")
+				tc.config.ClusterID = shared.ID
+			}
+			defer f.useCloud(t, b.plan, tc.config)()
+			ctx := context.Background()
+
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != brokerapi.ErrAsyncRequired {
+				t.Fatalf("expected %v, got %v", brokerapi.ErrAsyncRequired, err)
+			}
+			spec, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData)
+			if res.State != brokerapi.Succeeded {
+				t.Fatalf("provision %s: %s", res.State, res.Description)
+			}
+			if want := "created " + b.plan.clusterKind() + " " + b.plan.clusterName("inst1"); res.Description != want {
+				t.Errorf("expected description %q, got %q", want, res.Description)
+			}
+
+			cluster := shared
+			if !tc.shared {
+				cluster = f.byName(cloudClusterNameFromInstanceID("inst1"))
+				if cluster == nil {
+					t.Fatal("cluster not created")
+				}
+				req := f.created[0]
+				if tc.config.ClusterType == cloudDedicated {
+					if req.Spec.Dedicated == nil || req.Spec.Dedicated.RegionNodes["eu-west-1"] != defaultCloudNodesPerRegion ||
+						req.Spec.Dedicated.Hardware.MachineSpec.NumVirtualCPUs != defaultCloudVirtualCPUs {
+						t.Errorf("unexpected dedicated spec %+v", req.Spec.Dedicated)
+					}
+				} else if req.Spec.Serverless == nil || fmt.Sprint(req.Spec.Serverless.Regions) != "[us-central1]" {
+					t.Errorf("unexpected serverless spec %+v", req.Spec.Serverless)
+				}
+			}
+			instance, err := b.sb.state.Instance("inst1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if instance.ClusterID != cluster.ID || instance.ClusterHost != cluster.host {
+				t.Errorf("unexpected instance record %+v", instance)
+			}
+			admin := adminUserFromInstanceID("inst1")
+			if !cluster.c.hasUser(admin) {
+				t.Error("admin user not created")
+			}
+			// In a shared cluster, the instance's admin user only manages
+			// the instance's database.
+			if cluster.c.isMember("admin", admin) == tc.shared {
+				t.Errorf("expected admin role membership %t", !tc.shared)
+			}
+			if tc.shared {
+				cluster.c.mu.Lock()
+				owner, options := cluster.c.dbOwners[dbNameFromInstanceID("inst1")], cluster.c.roleOptions[admin]
+				cluster.c.mu.Unlock()
+				if owner != admin || !strings.Contains(options, "CREATEROLE") {
+					t.Errorf("expected %s to own the database and create roles, got owner %s and options %q",
+						admin, owner, options)
+				}
+				if !cluster.c.isMember(ownerRoleFromInstanceID("inst1"), admin) {
+					t.Error("admin user not a member of the owner role")
+				}
+			}
+			ns := b.plan.namespace("inst1")
+			if tc.shared != (ns.database == dbNameFromInstanceID("inst1")) {
+				t.Errorf("unexpected namespace %s", ns)
+			}
+			if b.cluster.databases[dbNameFromInstanceID("inst1")] {
+				t.Error("instance database created on the plan's cluster")
+			}
+
+			binding, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds := binding.Credentials.(map[string]interface{})
+			if creds["host"] != cluster.host || creds["database"] != ns.database {
+				t.Errorf("unexpected credentials %v", creds)
+			}
+			u, err := url.Parse(creds["uri"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Query().Get("sslmode") != "verify-full" {
+				t.Errorf("expected sslmode verify-full in %s", u)
+			}
+			user := userNameFromBinding("inst1", "bind1")
+			if !cluster.c.hasUser(user) {
+				t.Error("binding user not created")
+			}
+			if tc.shared && !cluster.c.isMember(user, admin) {
+				t.Error("admin user not a member of the binding user")
+			}
+			if err := b.sb.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			dspec, err := b.sb.Deprovision(ctx, "inst1", brokerapi.DeprovisionDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+			}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := waitForLastOperation(t, b.sb, "inst1", dspec.OperationData); res.State != brokerapi.Succeeded {
+				t.Fatalf("deprovision %s: %s", res.State, res.Description)
+			}
+			if tc.shared {
+				if f.byName("shared") == nil {
+					t.Error("shared cluster deleted")
+				}
+				if shared.c.databases[ns.database] || shared.c.hasUser(adminUserFromInstanceID("inst1")) {
+					t.Error("instance database or admin user not dropped")
+				}
+			} else if f.byName(cluster.Name) != nil {
+				t.Error("cluster not deleted")
+			}
+			if _, err := b.sb.state.Instance("inst1"); err != errStateNotFound {
+				t.Errorf("expected the instance to be forgotten, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCloudProvisionFailure(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(f *fakeCloud, cfg *cloudConfig)
+		err   string
+	}{
+		{"creation failed", func(f *fakeCloud, cfg *cloudConfig) { f.failCreation = true }, "failed"},
+		{"timeout", func(f *fakeCloud, cfg *cloudConfig) {
+			f.creationPolls = -1
+			cfg.ReadyTimeout = "10ms"
+		}, "not ready after 10ms"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			f := newFakeCloud()
+			cfg := cloudConfig{Provider: "GCP", Regions: []string{"us-central1"}}
+			tc.setup(f, &cfg)
+			defer f.useCloud(t, b.plan, cfg)()
+
+			spec, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(""), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData)
+			if res.State != brokerapi.Failed || !strings.Contains(res.Description, tc.err) {
+				t.Fatalf("expected the provision to fail with %q, got %+v", tc.err, res)
+			}
+			if len(f.clusters) != 0 {
+				t.Errorf("cluster not deleted")
+			}
+		})
+	}
+}
+
+// TestCloudResume checks that resuming the creation of a cluster uses the
+// cluster created before the interruption.
+func TestCloudResume(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	f := newFakeCloud()
+	defer f.useCloud(t, b.plan, cloudConfig{Provider: "GCP", Regions: []string{"us-central1"}})()
+	// Other clusters of the organization come first.
+	f.addCluster("other-cluster")
+	instance := &instanceRecord{ID: "inst1", AdminPassword: "pass"}
+	if err := b.sb.state.PutInstance(instance); err != nil {
+		t.Fatal(err)
+	}
+
+	name := cloudClusterNameFromInstanceID("inst1")
+	if _, err := b.plan.cloud.CreateCluster(b.plan.Cloud.createClusterRequest(name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sb.createCloud(b.plan, instance); err != nil {
+		t.Fatal(err)
+	}
+	// Creating the admin user again sets its password.
+	if err := b.sb.createCloud(b.plan, instance); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.created) != 1 {
+		t.Errorf("expected a single cluster creation, got %d", len(f.created))
+	}
+	if instance.ClusterID != f.byName(name).ID {
+		t.Errorf("expected cluster %s, got %s", f.byName(name).ID, instance.ClusterID)
+	}
+}
+
+func TestCloudREST(t *testing.T) {
+	f := newFakeCloud()
+	defer f.Close()
+	client := newCloudREST(&cloudConfig{APIURL: f.URL + "/", APIKey: "wrong"})
+	if _, err := client.GetCluster("id-1"); err == nil || !strings.Contains(err.Error(), "401 Unauthorized: invalid API key") {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+	client.apiKey = fakeCloudAPIKey
+	if _, err := client.GetCluster("id-1"); err != errCloudNotFound {
+		t.Errorf("expected %v, got %v", errCloudNotFound, err)
+	}
+	if _, err := client.FindCluster("missing"); err != errCloudNotFound {
+		t.Errorf("expected %v, got %v", errCloudNotFound, err)
+	}
+	if err := client.DeleteCluster("id-1"); err != nil {
+		t.Errorf("deleting a missing cluster: %v", err)
+	}
+	cluster := f.addCluster("existing")
+	if err := client.CreateDatabase(cluster.ID, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateDatabase(cluster.ID, "db"); err != nil {
+		t.Errorf("creating an existing database: %v", err)
+	}
+	if err := client.DeleteDatabase(cluster.ID, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteDatabase(cluster.ID, "db"); err != nil {
+		t.Errorf("deleting a missing database: %v", err)
+	}
+	if err := client.DeleteSQLUser(cluster.ID, "nobody"); err != nil {
+		t.Errorf("deleting a missing user: %v", err)
+	}
+	host, port, err := client.ConnectionParams(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != cluster.host || port != "26257" {
+		t.Errorf("unexpected connection parameters %s:%s", host, port)
+	}
+}
+
+func TestCloudConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config cloudConfig
+		err    string
+	}{
+		{"serverless", cloudConfig{APIKey: "k", Provider: "GCP", Regions: []string{"us-central1"}}, ""},
+		{"shared cluster", cloudConfig{APIKey: "k", ClusterID: "id"}, ""},
+		{"no key", cloudConfig{ClusterID: "id"}, "apiKey required"},
+		{"no regions", cloudConfig{APIKey: "k", Provider: "GCP"}, "provider and regions required"},
+		{"bad type", cloudConfig{APIKey: "k", ClusterType: "huge"}, "unknown cloud clusterType"},
+		{"negative", cloudConfig{APIKey: "k", Provider: "GCP", Regions: []string{"r"}, StorageGiB: -1}, "cannot be negative"},
+		{"bad timeout", cloudConfig{APIKey: "k", Provider: "GCP", Regions: []string{"r"}, ReadyTimeout: "soon"},
+			"invalid cloud readyTimeout"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.config.APIURL != defaultCloudAPIURL {
+					t.Errorf("expected the default API URL, got %q", tc.config.APIURL)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Defaults of cloudConfig.
+const (
+	defaultCloudAPIURL         = "https://cockroachlabs.cloud"
+	defaultCloudNodesPerRegion = 3
+	defaultCloudVirtualCPUs    = 4
+	defaultCloudStorageGiB     = 15
+	defaultCloudReadyTimeout   = 30 * time.Minute
+)
+
+// Types of CockroachDB Cloud clusters.
+const (
+	cloudServerless = "serverless"
+	cloudDedicated  = "dedicated"
+)
+
+// cloudConfig is the configuration of a plan with cloud isolation, whose
+// instances get a CockroachDB Cloud cluster of their own, or a database in
+// an existing one.
+type cloudConfig struct {
+	// APIURL is the URL of the CockroachDB Cloud API. Defaults to
+	// defaultCloudAPIURL.
+	APIURL string `json:"apiURL,omitempty"`
+	// APIKey is the API key of a Cloud service account, which needs to
+	// create and delete clusters or, with ClusterID, to manage the
+	// databases and SQL users of that cluster.
+	APIKey string `json:"apiKey"`
+	// ClusterID is the ID of an existing cluster in which each instance gets
+	// a database. If empty, each instance gets a cluster of its own.
+	ClusterID string `json:"clusterID,omitempty"`
+
+	// The remaining fields describe the instances' clusters. ClusterType
+	// is "serverless" (the default) or "dedicated", Provider the cloud
+	// provider, e.g. "GCP" or "AWS", and Regions their regions, e.g.
+	// "us-central1".
+	ClusterType string   `json:"clusterType,omitempty"`
+	Provider    string   `json:"provider,omitempty"`
+	Regions     []string `json:"regions,omitempty"`
+	// NodesPerRegion, VirtualCPUs (per node) and StorageGiB (per node) size
+	// dedicated clusters, and CockroachVersion, e.g. "v23.1", is their
+	// major version (Cloud's default if empty).
+	NodesPerRegion   int    `json:"nodesPerRegion,omitempty"`
+	VirtualCPUs      int    `json:"virtualCPUs,omitempty"`
+	StorageGiB       int    `json:"storageGiB,omitempty"`
+	CockroachVersion string `json:"cockroachVersion,omitempty"`
+	// ReadyTimeout is how long a new cluster may take to be created, e.g.
+	// "45m". Defaults to defaultCloudReadyTimeout.
+	ReadyTimeout string `json:"readyTimeout,omitempty"`
+
+	readyTimeout time.Duration
+}
+
+func (c *cloudConfig) validate() error {
+	if c.APIKey == "" {
+		return errors.New("cloud apiKey required")
+	}
+	if c.APIURL == "" {
+		c.APIURL = defaultCloudAPIURL
+	}
+	if c.ClusterID != "" {
+		return nil
+	}
+	switch c.ClusterType {
+	case "":
+		c.ClusterType = cloudServerless
+	case cloudServerless, cloudDedicated:
+	default:
+		return fmt.Errorf("unknown cloud clusterType '%s'", c.ClusterType)
+	}
+	if c.Provider == "" || len(c.Regions) == 0 {
+		return errors.New("cloud provider and regions required without clusterID")
+	}
+	if c.NodesPerRegion < 0 || c.VirtualCPUs < 0 || c.StorageGiB < 0 {
+		return errors.New("cloud nodesPerRegion, virtualCPUs and storageGiB cannot be negative")
+	}
+	if c.NodesPerRegion == 0 {
+		c.NodesPerRegion = defaultCloudNodesPerRegion
+	}
+	if c.VirtualCPUs == 0 {
+		c.VirtualCPUs = defaultCloudVirtualCPUs
+	}
+	if c.StorageGiB == 0 {
+		c.StorageGiB = defaultCloudStorageGiB
+	}
+	c.readyTimeout = defaultCloudReadyTimeout
+	if c.ReadyTimeout != "" {
+		d, err := time.ParseDuration(c.ReadyTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid cloud readyTimeout: %s", err)
+		}
+		c.readyTimeout = d
+	}
+	return nil
+}
+
+// createClusterRequest returns the request creating the cluster with the
+// given name.
+func (c *cloudConfig) createClusterRequest(name string) *cloudCreateClusterRequest {
+	req := &cloudCreateClusterRequest{Name: name, Provider: c.Provider}
+	if c.ClusterType == cloudDedicated {
+		spec := &cloudDedicatedSpec{RegionNodes: make(map[string]int), CockroachVersion: c.CockroachVersion}
+		for _, r := range c.Regions {
+			spec.RegionNodes[r] = c.NodesPerRegion
+		}
+		spec.Hardware.MachineSpec.NumVirtualCPUs = c.VirtualCPUs
+		spec.Hardware.StorageGiB = c.StorageGiB
+		req.Spec.Dedicated = spec
+	} else {
+		req.Spec.Serverless = &cloudServerlessSpec{Regions: c.Regions}
+	}
+	return req
+}
+
+// The parts of the CockroachDB Cloud API objects the broker uses.
+type (
+	cloudCreateClusterRequest struct {
+		Name     string `json:"name"`
+		Provider string `json:"provider"`
+		Spec     struct {
+			Serverless *cloudServerlessSpec `json:"serverless,omitempty"`
+			Dedicated  *cloudDedicatedSpec  `json:"dedicated,omitempty"`
+		} `json:"spec"`
+	}
+	cloudServerlessSpec struct {
+		Regions []string `json:"regions"`
+	}
+	cloudDedicatedSpec struct {
+		RegionNodes map[string]int `json:"region_nodes"`
+		Hardware    struct {
+			MachineSpec struct {
+				NumVirtualCPUs int `json:"num_virtual_cpus"`
+			} `json:"machine_spec"`
+			StorageGiB int `json:"storage_gib"`
+		} `json:"hardware"`
+		CockroachVersion string `json:"cockroach_version,omitempty"`
+	}
+
+	cloudCluster struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		State string `json:"state"`
+	}
+)
+
+// States of CockroachDB Cloud clusters.
+const (
+	cloudClusterCreated        = "CREATED"
+	cloudClusterCreationFailed = "CREATION_FAILED"
+)
+
+// Errors of cloudClient.
+var (
+	errCloudNotFound      = errors.New("not found in CockroachDB Cloud")
+	errCloudAlreadyExists = errors.New("already exists in CockroachDB Cloud")
+)
+
+// cloudClient is the part of the CockroachDB Cloud API the broker uses to
+// manage the clusters, databases and SQL users of instances.
+type cloudClient interface {
+	// FindCluster returns the cluster with the given name, or
+	// errCloudNotFound.
+	FindCluster(name string) (*cloudCluster, error)
+	// CreateCluster starts creating a cluster.
+	CreateCluster(req *cloudCreateClusterRequest) (*cloudCluster, error)
+	// GetCluster returns a cluster, or errCloudNotFound.
+	GetCluster(id string) (*cloudCluster, error)
+	// DeleteCluster deletes a cluster. Clusters that don't exist are
+	// ignored.
+	DeleteCluster(id string) error
+	// CreateDatabase creates a database in a cluster, unless it exists.
+	CreateDatabase(clusterID, name string) error
+	// DeleteDatabase drops a database. Databases that don't exist are
+	// ignored.
+	DeleteDatabase(clusterID, name string) error
+	// CreateSQLUser creates a SQL user with the admin role, or sets its
+	// password if it exists.
+	CreateSQLUser(clusterID, name, password string) error
+	// DeleteSQLUser drops a SQL user. Users that don't exist are ignored.
+	DeleteSQLUser(clusterID, name string) error
+	// ConnectionParams returns the SQL host and port of a cluster.
+	ConnectionParams(clusterID string) (host, port string, err error)
+}
+
+// cloudREST is a cloudClient on top of the CockroachDB Cloud REST API.
+type cloudREST struct {
+	apiURL string
+	apiKey string
+	http   *http.Client
+}
+
+func newCloudREST(c *cloudConfig) *cloudREST {
+	return &cloudREST{
+		apiURL: strings.TrimSuffix(c.APIURL, "/"),
+		apiKey: c.APIKey,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func clusterPath(id string, elems ...string) string {
+	path := "/api/v1/clusters/" + url.PathEscape(id)
+	for _, e := range elems {
+		path += "/" + url.PathEscape(e)
+	}
+	return path
+}
+
+// FindCluster is part of the cloudClient interface.
+func (c *cloudREST) FindCluster(name string) (*cloudCluster, error) {
+	page := ""
+	for {
+		var res struct {
+			Clusters   []*cloudCluster `json:"clusters"`
+			Pagination struct {
+				NextPage string `json:"next_page"`
+			} `json:"pagination"`
+		}
+		path := "/api/v1/clusters"
+		if page != "" {
+			path += "?" + url.Values{"pagination.page": {page}}.Encode()
+		}
+		if err := c.do("GET", path, nil, &res); err != nil {
+			return nil, fmt.Errorf("listing clusters: %s", err)
+		}
+		for _, cluster := range res.Clusters {
+			if cluster.Name == name {
+				return cluster, nil
+			}
+		}
+		if page = res.Pagination.NextPage; page == "" {
+			return nil, errCloudNotFound
+		}
+	}
+}
+
+// CreateCluster is part of the cloudClient interface.
+func (c *cloudREST) CreateCluster(req *cloudCreateClusterRequest) (*cloudCluster, error) {
+	var cluster cloudCluster
+	if err := c.do("POST", "/api/v1/clusters", req, &cluster); err != nil {
+		return nil, fmt.Errorf("creating cluster %s: %s", req.Name, err)
+	}
+	return &cluster, nil
+}
+
+// GetCluster is part of the cloudClient interface.
+func (c *cloudREST) GetCluster(id string) (*cloudCluster, error) {
+	var cluster cloudCluster
+	if err := c.do("GET", clusterPath(id), nil, &cluster); err == errCloudNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("getting cluster %s: %s", id, err)
+	}
+	return &cluster, nil
+}
+
+// DeleteCluster is part of the cloudClient interface.
+func (c *cloudREST) DeleteCluster(id string) error {
+	if err := c.do("DELETE", clusterPath(id), nil, nil); err != nil && err != errCloudNotFound {
+		return fmt.Errorf("deleting cluster %s: %s", id, err)
+	}
+	return nil
+}
+
+// CreateDatabase is part of the cloudClient interface.
+func (c *cloudREST) CreateDatabase(clusterID, name string) error {
+	err := c.do("POST", clusterPath(clusterID, "databases"), map[string]string{"name": name}, nil)
+	if err != nil && err != errCloudAlreadyExists {
+		return fmt.Errorf("creating database %s: %s", name, err)
+	}
+	return nil
+}
+
+// DeleteDatabase is part of the cloudClient interface.
+func (c *cloudREST) DeleteDatabase(clusterID, name string) error {
+	err := c.do("DELETE", clusterPath(clusterID, "databases", name), nil, nil)
+	if err != nil && err != errCloudNotFound {
+		return fmt.Errorf("deleting database %s: %s", name, err)
+	}
+	return nil
+}
+
+// CreateSQLUser is part of the cloudClient interface.
+func (c *cloudREST) CreateSQLUser(clusterID, name, password string) error {
+	err := c.do("POST", clusterPath(clusterID, "sql-users"),
+		map[string]string{"name": name, "password": password}, nil)
+	if err == errCloudAlreadyExists {
+		err = c.do("PUT", clusterPath(clusterID, "sql-users", name, "password"),
+			map[string]string{"password": password}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("creating SQL user %s: %s", name, err)
+	}
+	return nil
+}
+
+// DeleteSQLUser is part of the cloudClient interface.
+func (c *cloudREST) DeleteSQLUser(clusterID, name string) error {
+	err := c.do("DELETE", clusterPath(clusterID, "sql-users", name), nil, nil)
+	if err != nil && err != errCloudNotFound {
+		return fmt.Errorf("deleting SQL user %s: %s", name, err)
+	}
+	return nil
+}
+
+// ConnectionParams is part of the cloudClient interface.
+func (c *cloudREST) ConnectionParams(clusterID string) (string, string, error) {
+	var res struct {
+		Params struct {
+			Host string `json:"host"`
+			Port string `json:"port"`
+		} `json:"params"`
+	}
+	if err := c.do("GET", clusterPath(clusterID, "connection-string"), nil, &res); err != nil {
+		return "", "", fmt.Errorf("getting connection parameters: %s", err)
+	}
+	if res.Params.Host == "" || res.Params.Port == "" {
+		return "", "", fmt.Errorf("no connection parameters for cluster %s", clusterID)
+	}
+	return res.Params.Host, res.Params.Port, nil
+}
+
+// do sends a request to the API and decodes the response into out, if not
+// nil. A 404 is errCloudNotFound and a 409 errCloudAlreadyExists; other
+// errors carry the message of the API.
+func (c *cloudREST) do(method, path string, body, out interface{}) error {
+	reqBody := bytes.NewReader(nil)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.apiURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errCloudNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return errCloudAlreadyExists
+	case resp.StatusCode/100 != 2:
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &status) == nil && status.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, status.Message)
+		}
+		return errors.New(resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
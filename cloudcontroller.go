@@ -0,0 +1,162 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ccClient is a minimal client for the Cloud Controller v3 API, used to find
+// instances and bindings that the platform has forgotten about. It
+// authenticates with a UAA client that needs read access to service instances
+// and bindings (e.g. the cloud_controller.admin_read_only scope).
+type ccClient struct {
+	apiURL       string
+	clientID     string
+	clientSecret string
+	http         *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newCCClient(apiURL, clientID, clientSecret string) *ccClient {
+	return &ccClient{
+		apiURL:       strings.TrimSuffix(apiURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		http:         &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// ServiceInstanceExists reports whether the Cloud Controller knows about the
+// given service instance.
+func (c *ccClient) ServiceInstanceExists(guid string) (bool, error) {
+	return c.exists("/v3/service_instances/" + url.PathEscape(guid))
+}
+
+// ServiceBindingExists reports whether the Cloud Controller knows about the
+// given service binding.
+func (c *ccClient) ServiceBindingExists(guid string) (bool, error) {
+	return c.exists("/v3/service_credential_bindings/" + url.PathEscape(guid))
+}
+
+func (c *ccClient) exists(path string) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := c.accessToken()
+		if err != nil {
+			return false, err
+		}
+		req, err := http.NewRequest("GET", c.apiURL+path, nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Authorization", "bearer "+token)
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return false, fmt.Errorf("querying cloud controller: %s", err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true, nil
+		case http.StatusNotFound:
+			return false, nil
+		case http.StatusUnauthorized:
+			// The token may have been revoked; get a new one and try again.
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+			if attempt == 0 {
+				continue
+			}
+		}
+		return false, fmt.Errorf("querying cloud controller: GET %s: %s", path, resp.Status)
+	}
+}
+
+// accessToken returns a UAA token, fetching a new one with the client
+// credentials grant if needed.
+func (c *ccClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+
+	tokenURL, err := c.tokenURL()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.clientID, c.clientSecret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("getting UAA token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting UAA token: %s", resp.Status)
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("getting UAA token: %s", err)
+	}
+	c.token = res.AccessToken
+	// Renew the token a bit before it expires.
+	c.expiry = time.Now().Add(time.Duration(res.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// tokenURL finds the UAA token endpoint through the Cloud Controller's root
+// document.
+func (c *ccClient) tokenURL() (string, error) {
+	resp, err := c.http.Get(c.apiURL + "/")
+	if err != nil {
+		return "", fmt.Errorf("querying cloud controller: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("querying cloud controller: GET /: %s", resp.Status)
+	}
+	var root struct {
+		Links map[string]struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return "", fmt.Errorf("querying cloud controller: %s", err)
+	}
+	uaa := root.Links["uaa"].Href
+	if uaa == "" {
+		return "", fmt.Errorf("cloud controller at %s did not advertise a UAA", c.apiURL)
+	}
+	return strings.TrimSuffix(uaa, "/") + "/oauth/token", nil
+}
@@ -0,0 +1,302 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// instanceComment is stored as JSON in the comment of an instance's database
+// (COMMENT ON DATABASE), so that operators can tell which Cloud Foundry
+// instance a database belongs to, and so that the broker state can be rebuilt
+// from the cluster if it is lost.
+type instanceComment struct {
+	InstanceID string     `json:"instance_id,omitempty"`
+	ServiceID  string     `json:"service_id,omitempty"`
+	PlanID     string     `json:"plan_id,omitempty"`
+	Plan       string     `json:"plan,omitempty"`
+	OrgGUID    string     `json:"organization_guid,omitempty"`
+	SpaceGUID  string     `json:"space_guid,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	// Labels are set by users with the labels parameter.
+	Labels             map[string]string `json:"labels,omitempty"`
+	DeletionProtection bool              `json:"deletion_protection,omitempty"`
+	Regions            *regionConfig     `json:"regions,omitempty"`
+	// Bindings maps the users of the instance's bindings to the bindings.
+	// They are kept here because CockroachDB doesn't support comments on
+	// users.
+	Bindings map[string]*bindingComment `json:"bindings,omitempty"`
+}
+
+// bindingComment describes a binding in an instanceComment.
+type bindingComment struct {
+	BindingID string    `json:"binding_id"`
+	AppGUID   string    `json:"app_guid,omitempty"`
+	SpaceGUID string    `json:"space_guid,omitempty"`
+	Shared    bool      `json:"shared,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sqlString quotes s as a SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func setDatabaseComment(crdb queryer, ns instanceNamespace, c *instanceComment) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = crdb.Exec(fmt.Sprintf("COMMENT ON %s IS %s", ns.object(), sqlString(string(data))))
+	return err
+}
+
+// databaseComment returns the comment of an instance's database (or schema),
+// or nil if it doesn't exist. Comments that weren't written by the broker
+// read as empty.
+func databaseComment(crdb queryer, ns instanceNamespace) (*instanceComment, error) {
+	var raw string
+	var err error
+	if ns.schema == "" {
+		err = crdb.QueryRow(
+			"SELECT COALESCE(comment, '') FROM [SHOW DATABASES WITH COMMENT] WHERE database_name = $1", ns.database,
+		).Scan(&raw)
+	} else {
+		err = crdb.QueryRow(fmt.Sprintf(
+			"SELECT COALESCE(obj_description(oid, 'pg_namespace'), '') FROM %s.pg_catalog.pg_namespace WHERE nspname = $1",
+			ns.database,
+		), ns.schema).Scan(&raw)
+	}
+	if err == sql.ErrNoRows || ns.isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c instanceComment
+	if raw != "" {
+		// Someone else may have commented the database.
+		_ = json.Unmarshal([]byte(raw), &c)
+	}
+	return &c, nil
+}
+
+// sameComment returns whether a comment read back from a database is the
+// one written when the instance was created, c.
+func sameComment(existing, c *instanceComment) bool {
+	return c != nil && c.CreatedAt != nil && existing.InstanceID == c.InstanceID &&
+		existing.CreatedAt != nil && existing.CreatedAt.Equal(*c.CreatedAt)
+}
+
+// updateDatabaseComment applies update to the comment of an instance's
+// database (or schema). The comment is read and written in a transaction, so
+// that concurrent binds don't lose each other's updates. Nothing is done if
+// the database doesn't exist. The transaction is retried if it fails with a
+// retryable error.
+func updateDatabaseComment(crdb *sql.DB, ns instanceNamespace, update func(*instanceComment)) error {
+	return withRetry(func() error {
+		return updateDatabaseCommentTx(crdb, ns, update)
+	})
+}
+
+func updateDatabaseCommentTx(crdb *sql.DB, ns instanceNamespace, update func(*instanceComment)) error {
+	tx, err := crdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	c, err := databaseComment(tx, ns)
+	if err != nil || c == nil {
+		return err
+	}
+	update(c)
+	if err := setDatabaseComment(tx, ns, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebuiltState lists the records restored by rebuildState. Bindings are
+// listed as instance/binding.
+type rebuiltState struct {
+	Instances []string `json:"instances"`
+	Bindings  []string `json:"bindings"`
+}
+
+// rebuildState restores the instance and binding records missing from the
+// broker state using the comments of the databases (and, for plans with
+// schema isolation, the schemas) on the plans' clusters. Existing records
+// are left alone. Passwords can't be recovered, so repeated bind requests
+// for restored bindings conflict instead of returning the original
+// credentials.
+func (sb *crdbServiceBroker) rebuildState() (*rebuiltState, error) {
+	res := &rebuiltState{Instances: []string{}, Bindings: []string{}}
+	// Several plans can share a cluster.
+	clusters := make(map[string]bool)
+	for _, s := range Services {
+		for i := range s.Plans {
+			plan := &s.Plans[i]
+			// The broker can't log into a dedicated or Cloud cluster
+			// without the record of its instance.
+			if !plan.usesPlanCluster() {
+				continue
+			}
+			cluster := net.JoinHostPort(plan.CRDBHost, plan.CRDBPort)
+			if clusters[cluster] {
+				continue
+			}
+			clusters[cluster] = true
+
+			databases, err := queryStrings(plan.crdb, "SELECT database_name FROM [SHOW DATABASES]")
+			if err != nil {
+				return nil, fmt.Errorf("listing databases on %s: %s", cluster, err)
+			}
+			userList, err := queryStrings(plan.crdb, "SELECT username FROM [SHOW USERS]")
+			if err != nil {
+				return nil, fmt.Errorf("listing users on %s: %s", cluster, err)
+			}
+			users := make(map[string]bool)
+			for _, u := range userList {
+				users[u] = true
+			}
+
+			namespaces, err := instanceNamespaces(plan.crdb, databases)
+			if err != nil {
+				return nil, err
+			}
+			for _, ns := range namespaces {
+				c, err := databaseComment(plan.crdb, ns)
+				if err != nil {
+					return nil, fmt.Errorf("reading comment of %s: %s", ns, err)
+				}
+				// Deleted databases kept for recovery carry the comment of
+				// the instance they belonged to.
+				if c == nil || c.InstanceID == "" {
+					continue
+				}
+				expected := instanceNamespace{database: dbNameFromInstanceID(c.InstanceID)}
+				if ns.schema != "" {
+					expected = instanceNamespace{database: ns.database, schema: schemaNameFromInstanceID(c.InstanceID)}
+				}
+				if ns != expected {
+					continue
+				}
+				if err := sb.rebuildInstance(c, users, res); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	sort.Strings(res.Instances)
+	sort.Strings(res.Bindings)
+	return res, nil
+}
+
+// instanceNamespaces returns the namespaces among a cluster's databases that
+// can belong to instances: the cf_ databases and, in the databases shared by
+// plans with schema isolation, the cf_ schemas.
+func instanceNamespaces(crdb *sql.DB, databases []string) ([]instanceNamespace, error) {
+	sharedDatabases := make(map[string]bool)
+	for _, s := range Services {
+		for _, p := range s.Plans {
+			if p.Isolation == isolationSchema {
+				sharedDatabases[sharedDBNameFromPlanID(p.ID)] = true
+			}
+		}
+	}
+	var namespaces []instanceNamespace
+	for _, name := range databases {
+		if !strings.HasPrefix(name, "cf_") {
+			continue
+		}
+		if !sharedDatabases[name] {
+			namespaces = append(namespaces, instanceNamespace{database: name})
+			continue
+		}
+		schemas, err := queryStrings(crdb, fmt.Sprintf("SELECT schema_name FROM [SHOW SCHEMAS FROM %s]", name))
+		if err != nil {
+			return nil, fmt.Errorf("listing schemas of %s: %s", name, err)
+		}
+		for _, schema := range schemas {
+			if strings.HasPrefix(schema, "cf_") {
+				namespaces = append(namespaces, instanceNamespace{database: name, schema: schema})
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+func (sb *crdbServiceBroker) rebuildInstance(
+	c *instanceComment, users map[string]bool, res *rebuiltState,
+) error {
+	if _, err := sb.state.Instance(c.InstanceID); err == errStateNotFound {
+		if err := sb.state.PutInstance(&instanceRecord{
+			ID:                 c.InstanceID,
+			ServiceID:          c.ServiceID,
+			PlanID:             c.PlanID,
+			OrgGUID:            c.OrgGUID,
+			SpaceGUID:          c.SpaceGUID,
+			State:              stateReady,
+			DeletionProtection: c.DeletionProtection,
+			Regions:            c.Regions,
+		}); err != nil {
+			return fmt.Errorf("storing instance: %s", err)
+		}
+		res.Instances = append(res.Instances, c.InstanceID)
+	} else if err != nil {
+		return fmt.Errorf("looking up instance: %s", err)
+	}
+
+	for user, b := range c.Bindings {
+		// The user is gone if an unbind failed after dropping it.
+		if !users[user] {
+			continue
+		}
+		if _, err := sb.state.Binding(c.InstanceID, b.BindingID); err == nil {
+			continue
+		} else if err != errStateNotFound {
+			return fmt.Errorf("looking up binding: %s", err)
+		}
+		role := b.Role
+		if role == "" {
+			role = roleReadWrite
+		}
+		if err := sb.state.PutBinding(&bindingRecord{
+			ID:         b.BindingID,
+			InstanceID: c.InstanceID,
+			AppGUID:    b.AppGUID,
+			SpaceGUID:  b.SpaceGUID,
+			Shared:     b.Shared,
+			Role:       role,
+			State:      stateReady,
+		}); err != nil {
+			return fmt.Errorf("storing binding: %s", err)
+		}
+		res.Bindings = append(res.Bindings, c.InstanceID+"/"+b.BindingID)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestDatabaseComments(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(`{"labels": {"team": "a"}}`), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"bind1", "bind2"} {
+		if _, err := b.sb.Bind(ctx, "inst1", id, brokerapi.BindDetails{
+			ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app-" + id,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.sb.Unbind(ctx, "inst1", "bind2", brokerapi.UnbindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Update(ctx, "inst1", brokerapi.UpdateDetails{
+		RawParameters: json.RawMessage(`{"labels": {"team": "b"}}`),
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var c instanceComment
+	if err := json.Unmarshal([]byte(b.cluster.comments[dbNameFromInstanceID("inst1")]), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.CreatedAt == nil {
+		t.Errorf("expected creation time")
+	}
+	c.CreatedAt = nil
+	user := userNameFromBinding("inst1", "bind1")
+	if b := c.Bindings[user]; b != nil {
+		if b.CreatedAt.IsZero() {
+			t.Errorf("expected binding creation time")
+		}
+		b.CreatedAt = time.Time{}
+	}
+	expected := instanceComment{
+		InstanceID: "inst1",
+		ServiceID:  b.plan.ServiceID,
+		PlanID:     b.plan.ID,
+		Plan:       b.plan.Name,
+		OrgGUID:    "org1",
+		SpaceGUID:  "space1",
+		Labels:     map[string]string{"team": "b"},
+		Bindings: map[string]*bindingComment{
+			user: {BindingID: "bind1", AppGUID: "app-bind1", Role: roleReadWrite},
+		},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected comment %+v, got %+v", expected, c)
+	}
+}
+
+func TestRebuildState(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(`{"deletion_protection": true}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Provision(ctx, "inst2", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// A deleted database kept for recovery has the comment of its instance.
+	inst1DB := dbNameFromInstanceID("inst1")
+	b.cluster.databases[inst1DB+"_deleted"] = true
+	b.cluster.comments[inst1DB+"_deleted"] = b.cluster.comments[inst1DB]
+
+	// The broker loses its state, except for inst2.
+	inst2, err := b.sb.state.Instance("inst2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sb.state = newBrokerState(newMemKVStore())
+	if err := b.sb.state.PutInstance(inst2); err != nil {
+		t.Fatal(err)
+	}
+
+	var res rebuiltState
+	if status := adminRequest(t, b.server, "POST", "/admin/state/rebuild", nil, &res); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+	expected := rebuiltState{Instances: []string{"inst1"}, Bindings: []string{"inst1/bind1"}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v, got %+v", expected, res)
+	}
+
+	instance, err := b.sb.state.Instance("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.OrgGUID != "org1" || instance.SpaceGUID != "space1" || !instance.DeletionProtection {
+		t.Errorf("unexpected instance %+v", instance)
+	}
+	binding, err := b.sb.state.Binding("inst1", "bind1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.AppGUID != "app1" || binding.Role != roleReadWrite || binding.State != stateReady {
+		t.Errorf("unexpected binding %+v", binding)
+	}
+
+	// Nothing is left to rebuild.
+	if status := adminRequest(t, b.server, "POST", "/admin/state/rebuild", nil, &res); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+	expected = rebuiltState{Instances: []string{}, Bindings: []string{}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v, got %+v", expected, res)
+	}
+}
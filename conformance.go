@@ -0,0 +1,614 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// conformanceAPIVersion is the Open Service Broker API version the
+// conformance checks send and expect.
+const conformanceAPIVersion = "2.13"
+
+// conformanceClient talks to the broker under test.
+type conformanceClient struct {
+	url  string
+	http *http.Client
+	// pollInterval and pollTimeout govern the polling of last_operation
+	// after 202 responses.
+	pollInterval time.Duration
+	pollTimeout  time.Duration
+}
+
+// do sends a request to the broker and decodes the JSON response into res,
+// if given. Requests are authenticated unless auth is nil.
+func (c *conformanceClient) do(
+	method, path string, auth *url.Userinfo, body, res interface{},
+) (int, error) {
+	var r io.Reader
+	if raw, ok := body.(string); ok {
+		r = strings.NewReader(raw)
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Broker-API-Version", conformanceAPIVersion)
+	req.Header.Set("Content-Type", "application/json")
+	if auth != nil {
+		pass, _ := auth.Password()
+		req.SetBasicAuth(auth.Username(), pass)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if res != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, res); err != nil {
+			return resp.StatusCode, fmt.Errorf("invalid JSON response %q: %s", data, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// conformanceRun holds the state of a conformance run: what the broker
+// offers, and what the checks have created so far.
+type conformanceRun struct {
+	client *conformanceClient
+	auth   *url.Userinfo
+	// serviceID and planID are the service and plan to test, by ID or name;
+	// they are resolved from the catalog.
+	serviceID string
+	planID    string
+
+	instanceID  string
+	bindingID   string
+	provisioned bool
+	bound       bool
+	credentials map[string]interface{}
+}
+
+// conformanceCheck is a check of the broker's behavior.
+type conformanceCheck struct {
+	name string
+	// ready, if set, reports whether the check's prerequisites were met by
+	// earlier checks. Checks that aren't ready are skipped.
+	ready func() bool
+	run   func() error
+}
+
+// conformanceResult is the outcome of a check: it is skipped if it wasn't
+// run, and failed if err is set.
+type conformanceResult struct {
+	name    string
+	skipped bool
+	err     error
+}
+
+func expectStatus(status int, expected ...int) error {
+	for _, s := range expected {
+		if status == s {
+			return nil
+		}
+	}
+	if len(expected) == 1 {
+		return fmt.Errorf("expected status %d, got %d", expected[0], status)
+	}
+	return fmt.Errorf("expected status %v, got %d", expected, status)
+}
+
+// catalogNameRegexp matches the names that CLIs accept for services and
+// plans.
+var catalogNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func (r *conformanceRun) checkCatalog() error {
+	var catalog struct {
+		Services []struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Bindable    *bool  `json:"bindable"`
+			Plans       []struct {
+				ID          string `json:"id"`
+				Name        string `json:"name"`
+				Description string `json:"description"`
+			} `json:"plans"`
+		} `json:"services"`
+	}
+	status, err := r.client.do("GET", "/v2/catalog", r.auth, nil, &catalog)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(status, http.StatusOK); err != nil {
+		return err
+	}
+	if len(catalog.Services) == 0 {
+		return errors.New("the catalog has no services")
+	}
+	var problems []string
+	ids := make(map[string]bool)
+	checkID := func(kind, id string) {
+		if id == "" {
+			problems = append(problems, kind+" without id")
+		} else if ids[id] {
+			problems = append(problems, fmt.Sprintf("duplicate id %q", id))
+		}
+		ids[id] = true
+	}
+	serviceID, planID := "", ""
+	for _, s := range catalog.Services {
+		checkID("service", s.ID)
+		if !catalogNameRegexp.MatchString(s.Name) {
+			problems = append(problems, fmt.Sprintf("service %q has an invalid name %q", s.ID, s.Name))
+		}
+		if s.Description == "" {
+			problems = append(problems, fmt.Sprintf("service %q has no description", s.Name))
+		}
+		if s.Bindable == nil {
+			problems = append(problems, fmt.Sprintf("service %q doesn't say whether it is bindable", s.Name))
+		}
+		if len(s.Plans) == 0 {
+			problems = append(problems, fmt.Sprintf("service %q has no plans", s.Name))
+		}
+		for _, p := range s.Plans {
+			checkID("plan", p.ID)
+			if !catalogNameRegexp.MatchString(p.Name) {
+				problems = append(problems, fmt.Sprintf("plan %q has an invalid name %q", p.ID, p.Name))
+			}
+			if p.Description == "" {
+				problems = append(problems, fmt.Sprintf("plan %q of service %q has no description", p.Name, s.Name))
+			}
+			// Test the plan that was asked for, or the first one.
+			serviceMatches := r.serviceID == "" || r.serviceID == s.ID || r.serviceID == s.Name
+			planMatches := r.planID == "" || r.planID == p.ID || r.planID == p.Name
+			if serviceID == "" && serviceMatches && planMatches {
+				serviceID, planID = s.ID, p.ID
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	if serviceID == "" {
+		return fmt.Errorf("no plan %q of service %q in the catalog", r.planID, r.serviceID)
+	}
+	r.serviceID, r.planID = serviceID, planID
+	return nil
+}
+
+func (r *conformanceRun) instancePath(query string) string {
+	return fmt.Sprintf("/v2/service_instances/%s%s", r.instanceID, query)
+}
+
+func (r *conformanceRun) bindingPath() string {
+	return fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", r.instanceID, r.bindingID)
+}
+
+func (r *conformanceRun) deleteQuery() string {
+	return fmt.Sprintf("?accepts_incomplete=true&service_id=%s&plan_id=%s",
+		url.QueryEscape(r.serviceID), url.QueryEscape(r.planID))
+}
+
+func (r *conformanceRun) provisionBody(space string) map[string]interface{} {
+	return map[string]interface{}{
+		"service_id":        r.serviceID,
+		"plan_id":           r.planID,
+		"organization_guid": "conformance-org",
+		"space_guid":        space,
+		"context": map[string]interface{}{
+			"platform":          "cloudfoundry",
+			"organization_guid": "conformance-org",
+			"space_guid":        space,
+		},
+	}
+}
+
+// provision sends a provision request, waiting for it to finish if the broker
+// answers asynchronously. It returns the status of the response.
+func (r *conformanceRun) provision(space string) (int, error) {
+	var res struct {
+		Operation string `json:"operation"`
+	}
+	status, err := r.client.do("PUT", r.instancePath("?accepts_incomplete=true"), r.auth,
+		r.provisionBody(space), &res)
+	if err != nil || status != http.StatusAccepted {
+		return status, err
+	}
+	return status, r.waitForOperation(res.Operation, false)
+}
+
+// waitForOperation polls last_operation until the operation finishes. If
+// deleting is set, a 410 Gone means the operation succeeded.
+func (r *conformanceRun) waitForOperation(operation string, deleting bool) error {
+	query := fmt.Sprintf("?service_id=%s&plan_id=%s",
+		url.QueryEscape(r.serviceID), url.QueryEscape(r.planID))
+	if operation != "" {
+		query += "&operation=" + url.QueryEscape(operation)
+	}
+	deadline := time.Now().Add(r.client.pollTimeout)
+	for {
+		var res struct {
+			State       string `json:"state"`
+			Description string `json:"description"`
+		}
+		status, err := r.client.do("GET", r.instancePath("/last_operation")+query, r.auth, nil, &res)
+		if err != nil {
+			return err
+		}
+		if deleting && status == http.StatusGone {
+			return nil
+		}
+		if err := expectStatus(status, http.StatusOK); err != nil {
+			return fmt.Errorf("last_operation: %s", err)
+		}
+		switch res.State {
+		case "succeeded":
+			return nil
+		case "failed":
+			return fmt.Errorf("operation failed: %s", res.Description)
+		case "in progress":
+		default:
+			return fmt.Errorf("last_operation returned invalid state %q", res.State)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation still in progress after %s", r.client.pollTimeout)
+		}
+		time.Sleep(r.client.pollInterval)
+	}
+}
+
+func (r *conformanceRun) bind(appGUID string, res interface{}) (int, error) {
+	return r.client.do("PUT", r.bindingPath(), r.auth, map[string]interface{}{
+		"service_id":    r.serviceID,
+		"plan_id":       r.planID,
+		"app_guid":      appGUID,
+		"bind_resource": map[string]interface{}{"app_guid": appGUID},
+	}, res)
+}
+
+// deprovision sends a deprovision request, waiting for it to finish if the
+// broker answers asynchronously.
+func (r *conformanceRun) deprovision() (int, error) {
+	var res struct {
+		Operation string `json:"operation"`
+	}
+	status, err := r.client.do("DELETE", r.instancePath(r.deleteQuery()), r.auth, nil, &res)
+	if err != nil || status != http.StatusAccepted {
+		return status, err
+	}
+	return status, r.waitForOperation(res.Operation, true)
+}
+
+// checks returns the conformance checks, in the order they run.
+func (r *conformanceRun) checks() []conformanceCheck {
+	haveCatalog := func() bool { return r.serviceID != "" && r.planID != "" }
+	provisioned := func() bool { return r.provisioned }
+	bound := func() bool { return r.bound }
+	return []conformanceCheck{
+		{
+			name: "auth: requests without credentials are rejected with 401",
+			run: func() error {
+				status, err := r.client.do("GET", "/v2/catalog", nil, nil, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusUnauthorized)
+			},
+		},
+		{
+			name: "auth: requests with wrong credentials are rejected with 401",
+			run: func() error {
+				status, err := r.client.do("GET", "/v2/catalog",
+					url.UserPassword(r.auth.Username(), "wrong-"+uniuri.New()), nil, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusUnauthorized)
+			},
+		},
+		{
+			name: "catalog: services and plans are valid",
+			run:  r.checkCatalog,
+		},
+		{
+			name:  "provision: malformed requests are rejected with 400 or 422",
+			ready: haveCatalog,
+			run: func() error {
+				status, err := r.client.do("PUT", r.instancePath("?accepts_incomplete=true"), r.auth,
+					`{"service_id": `, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusBadRequest, http.StatusUnprocessableEntity)
+			},
+		},
+		{
+			name:  "provision: unknown plans are rejected with 400",
+			ready: haveCatalog,
+			run: func() error {
+				body := r.provisionBody("conformance-space")
+				body["plan_id"] = "unknown-" + uniuri.New()
+				status, err := r.client.do("PUT", r.instancePath("?accepts_incomplete=true"), r.auth, body, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusBadRequest)
+			},
+		},
+		{
+			name:  "last_operation: unknown instances return 410",
+			ready: haveCatalog,
+			run: func() error {
+				status, err := r.client.do("GET", r.instancePath("/last_operation"), r.auth, nil, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusGone)
+			},
+		},
+		{
+			name:  "provision: a new instance is created",
+			ready: haveCatalog,
+			run: func() error {
+				status, err := r.provision("conformance-space")
+				if err != nil {
+					return err
+				}
+				if err := expectStatus(status, http.StatusCreated, http.StatusAccepted); err != nil {
+					return err
+				}
+				r.provisioned = true
+				return nil
+			},
+		},
+		{
+			name:  "provision: an identical request returns 200",
+			ready: provisioned,
+			run: func() error {
+				status, err := r.provision("conformance-space")
+				if err != nil {
+					return err
+				}
+				// Brokers may still answer 202 if they provision
+				// asynchronously.
+				return expectStatus(status, http.StatusOK, http.StatusAccepted)
+			},
+		},
+		{
+			name:  "provision: a conflicting request returns 409",
+			ready: provisioned,
+			run: func() error {
+				status, err := r.client.do("PUT", r.instancePath("?accepts_incomplete=true"), r.auth,
+					r.provisionBody("other-space"), nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusConflict)
+			},
+		},
+		{
+			name:  "bind: a new binding returns 201 with credentials",
+			ready: provisioned,
+			run: func() error {
+				var res struct {
+					Credentials map[string]interface{} `json:"credentials"`
+				}
+				status, err := r.bind("conformance-app", &res)
+				if err != nil {
+					return err
+				}
+				if err := expectStatus(status, http.StatusCreated); err != nil {
+					return err
+				}
+				r.bound = true
+				if len(res.Credentials) == 0 {
+					return errors.New("no credentials returned")
+				}
+				r.credentials = res.Credentials
+				return nil
+			},
+		},
+		{
+			name:  "bind: an identical request returns 200 with the same credentials",
+			ready: bound,
+			run: func() error {
+				var res struct {
+					Credentials map[string]interface{} `json:"credentials"`
+				}
+				status, err := r.bind("conformance-app", &res)
+				if err != nil {
+					return err
+				}
+				if err := expectStatus(status, http.StatusOK); err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(res.Credentials, r.credentials) {
+					return errors.New("different credentials returned")
+				}
+				return nil
+			},
+		},
+		{
+			name:  "bind: a conflicting request returns 409",
+			ready: bound,
+			run: func() error {
+				status, err := r.bind("other-app", nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusConflict)
+			},
+		},
+		{
+			name:  "unbind: the binding is deleted with 200",
+			ready: bound,
+			run: func() error {
+				status, err := r.client.do("DELETE", r.bindingPath()+r.deleteQuery(), r.auth, nil, nil)
+				if err != nil {
+					return err
+				}
+				if err := expectStatus(status, http.StatusOK); err != nil {
+					return err
+				}
+				r.bound = false
+				return nil
+			},
+		},
+		{
+			name:  "unbind: unknown bindings return 410",
+			ready: provisioned,
+			run: func() error {
+				status, err := r.client.do("DELETE", r.bindingPath()+r.deleteQuery(), r.auth, nil, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusGone)
+			},
+		},
+		{
+			name:  "deprovision: the instance is deleted",
+			ready: provisioned,
+			run: func() error {
+				status, err := r.deprovision()
+				if err != nil {
+					return err
+				}
+				if err := expectStatus(status, http.StatusOK, http.StatusAccepted); err != nil {
+					return err
+				}
+				r.provisioned = false
+				return nil
+			},
+		},
+		{
+			name:  "deprovision: unknown instances return 410",
+			ready: haveCatalog,
+			run: func() error {
+				status, err := r.client.do("DELETE", r.instancePath(r.deleteQuery()), r.auth, nil, nil)
+				if err != nil {
+					return err
+				}
+				return expectStatus(status, http.StatusGone)
+			},
+		},
+	}
+}
+
+// run runs the checks in order, then deletes what the failed checks left
+// behind.
+func (r *conformanceRun) run() []conformanceResult {
+	r.instanceID = "conformance-" + strings.ToLower(uniuri.New())
+	r.bindingID = "conformance-" + strings.ToLower(uniuri.New())
+	var results []conformanceResult
+	for _, c := range r.checks() {
+		if c.ready != nil && !c.ready() {
+			results = append(results, conformanceResult{name: c.name, skipped: true})
+			continue
+		}
+		results = append(results, conformanceResult{name: c.name, err: c.run()})
+	}
+	if r.bound {
+		_, _ = r.client.do("DELETE", r.bindingPath()+r.deleteQuery(), r.auth, nil, nil)
+	}
+	if r.provisioned {
+		_, _ = r.deprovision()
+	}
+	return results
+}
+
+// printConformanceReport prints the results of a run and returns the number
+// of failed checks.
+func printConformanceReport(w io.Writer, results []conformanceResult) int {
+	passed, failed, skipped := 0, 0, 0
+	for _, res := range results {
+		switch {
+		case res.skipped:
+			skipped++
+			fmt.Fprintf(w, "SKIP  %s\n", res.name)
+		case res.err != nil:
+			failed++
+			fmt.Fprintf(w, "FAIL  %s\n      %s\n", res.name, res.err)
+		default:
+			passed++
+			fmt.Fprintf(w, "PASS  %s\n", res.name)
+		}
+	}
+	fmt.Fprintf(w, "\n%d checks: %d passed, %d failed, %d skipped\n", len(results), passed, failed, skipped)
+	return failed
+}
+
+// conformanceMain implements the conformance subcommand, which runs the Open
+// Service Broker API checks against a broker and prints a report. It returns
+// the exit status.
+func conformanceMain(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	brokerURL := flags.String("url", "", "URL of the broker to test")
+	user := flags.String("user", os.Getenv("SECURITY_USER_NAME"), "broker user name")
+	password := flags.String("password", os.Getenv("SECURITY_USER_PASSWORD"), "broker password")
+	service := flags.String("service", "", "ID or name of the service to test (default: the first one)")
+	plan := flags.String("plan", "", "ID or name of the plan to test (default: the service's first one)")
+	timeout := flags.Duration("timeout", 10*time.Minute, "how long to wait for asynchronous operations")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *brokerURL == "" || *user == "" || *password == "" {
+		fmt.Fprintln(stderr, "conformance: -url, -user and -password are required")
+		flags.Usage()
+		return 2
+	}
+
+	r := &conformanceRun{
+		client: &conformanceClient{
+			url:          *brokerURL,
+			http:         &http.Client{Timeout: time.Minute},
+			pollInterval: 5 * time.Second,
+			pollTimeout:  *timeout,
+		},
+		auth:      url.UserPassword(*user, *password),
+		serviceID: *service,
+		planID:    *plan,
+	}
+	if printConformanceReport(stdout, r.run()) > 0 {
+		return 1
+	}
+	return 0
+}
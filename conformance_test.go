@@ -0,0 +1,85 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newConformanceRun returns a conformance run against the given server, for
+// the fake broker's plan.
+func newConformanceRun(b *fakeBroker, server *httptest.Server) *conformanceRun {
+	Services[0].Description = "Test service"
+	Services[0].Bindable = true
+	b.plan.Description = "Test plan"
+	return &conformanceRun{
+		client: &conformanceClient{
+			url:          server.URL,
+			http:         server.Client(),
+			pollInterval: time.Millisecond,
+			pollTimeout:  time.Second,
+		},
+		auth: url.UserPassword("user", "pass"),
+	}
+}
+
+func TestConformance(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+
+	results := newConformanceRun(b, b.server).run()
+	var report bytes.Buffer
+	if failed := printConformanceReport(&report, results); failed > 0 || strings.Contains(report.String(), "SKIP") {
+		t.Fatalf("conformance checks failed:\n%s", report.String())
+	}
+	if len(b.cluster.comments) != 0 {
+		t.Errorf("instances left behind: %v", b.cluster.comments)
+	}
+}
+
+func TestConformanceFailures(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	// A broker that lets anyone in, and forgets to check catalog fields.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetBasicAuth("user", "pass")
+		b.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	run := newConformanceRun(b, server)
+	b.plan.Description = ""
+
+	results := run.run()
+	var report bytes.Buffer
+	printConformanceReport(&report, results)
+	for _, expected := range []string{
+		"FAIL  auth: requests without credentials are rejected with 401",
+		"FAIL  auth: requests with wrong credentials are rejected with 401",
+		"FAIL  catalog: services and plans are valid\n      plan \"test\" of service \"test-service\" has no description",
+		"SKIP  provision: a new instance is created",
+		"SKIP  bind: a new binding returns 201 with credentials",
+		"16 checks: 0 passed, 3 failed, 13 skipped",
+	} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("expected report to contain %q:\n%s", expected, report.String())
+		}
+	}
+}
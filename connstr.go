@@ -0,0 +1,234 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// connParams holds everything needed to connect to a database on a
+// CockroachDB cluster. The various methods render it as a connection string
+// for a specific client driver; user, pass, and db are optional.
+type connParams struct {
+	host    string
+	port    string
+	user    string
+	pass    string
+	db      string
+	options url.Values
+}
+
+func (p connParams) check() {
+	if p.host == "" || p.port == "" {
+		panic("host/port not passed")
+	}
+}
+
+// uri renders the parameters as a postgres:// URL, as understood by lib/pq,
+// psycopg2, node-postgres and most other libpq-compatible drivers.
+func (p connParams) uri() string {
+	p.check()
+
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(p.host, p.port),
+		Path:     p.db,
+		RawQuery: p.options.Encode(),
+	}
+
+	if p.user != "" {
+		if p.pass != "" {
+			u.User = url.UserPassword(p.user, p.pass)
+		} else {
+			u.User = url.User(p.user)
+		}
+	}
+	return u.String()
+}
+
+// pgx renders the parameters as a connection string for the Go pgx driver.
+// pgx parses URLs with net/url and takes the database from the decoded path,
+// so this is the same format as uri. It is exposed separately so pgx-only
+// runtime parameters can be added without affecting other drivers.
+func (p connParams) pgx() string {
+	u := p.uri()
+	return "postgresql" + strings.TrimPrefix(u, "postgres")
+}
+
+// jdbcURL renders the parameters as a PostgreSQL JDBC URL. pgjdbc decodes the
+// database name and every query parameter with java.net.URLDecoder, so they
+// are all escaped with form encoding (which also covers '+' and '&').
+func (p connParams) jdbcURL() string {
+	p.check()
+
+	params := make(url.Values)
+	for k, v := range p.options {
+		params[k] = v
+	}
+	if p.user != "" {
+		params.Set("user", p.user)
+		if p.pass != "" {
+			params.Set("password", p.pass)
+		}
+	}
+
+	s := "jdbc:postgresql://" + net.JoinHostPort(p.host, p.port) + "/" + url.QueryEscape(p.db)
+	if len(params) > 0 {
+		s += "?" + params.Encode()
+	}
+	return s
+}
+
+// dsn renders the parameters as a libpq keyword/value connection string.
+func (p connParams) dsn() string {
+	p.check()
+
+	var buf bytes.Buffer
+	add := func(k, v string) {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(dsnQuote(v))
+	}
+
+	add("host", p.host)
+	add("port", p.port)
+	if p.db != "" {
+		add("dbname", p.db)
+	}
+	if p.user != "" {
+		add("user", p.user)
+	}
+	if p.pass != "" {
+		add("password", p.pass)
+	}
+	for _, k := range sortedKeys(p.options) {
+		add(k, p.options.Get(k))
+	}
+	return buf.String()
+}
+
+// dsnQuote quotes a libpq keyword/value value if it is empty or contains
+// whitespace, quotes or backslashes.
+func dsnQuote(v string) string {
+	if v != "" && strings.IndexFunc(v, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\'' || r == '\\'
+	}) == -1 {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// npgsqlOptions maps libpq option names to their Npgsql equivalents. Options
+// not listed here are not understood by Npgsql and are left out.
+var npgsqlOptions = map[string]string{
+	"sslmode":          "SSL Mode",
+	"sslrootcert":      "Root Certificate",
+	"sslcert":          "SSL Certificate",
+	"sslkey":           "SSL Key",
+	"application_name": "Application Name",
+	"connect_timeout":  "Timeout",
+	"options":          "Options",
+}
+
+// npgsqlSSLModes maps libpq sslmode values to Npgsql SslMode enum names.
+var npgsqlSSLModes = map[string]string{
+	"disable":     "Disable",
+	"allow":       "Allow",
+	"prefer":      "Prefer",
+	"require":     "Require",
+	"verify-ca":   "VerifyCA",
+	"verify-full": "VerifyFull",
+}
+
+// npgsql renders the parameters as an ADO.NET connection string for Npgsql.
+func (p connParams) npgsql() string {
+	p.check()
+
+	var parts []string
+	add := func(k, v string) {
+		parts = append(parts, k+"="+npgsqlQuote(v))
+	}
+
+	add("Host", p.host)
+	add("Port", p.port)
+	if p.db != "" {
+		add("Database", p.db)
+	}
+	if p.user != "" {
+		add("Username", p.user)
+	}
+	if p.pass != "" {
+		add("Password", p.pass)
+	}
+	for _, k := range sortedKeys(p.options) {
+		name, ok := npgsqlOptions[k]
+		if !ok {
+			continue
+		}
+		v := p.options.Get(k)
+		if k == "sslmode" {
+			if m, ok := npgsqlSSLModes[v]; ok {
+				v = m
+			}
+		}
+		add(name, v)
+	}
+	return strings.Join(parts, ";")
+}
+
+// npgsqlQuote quotes a value following the rules of .NET's
+// DbConnectionStringBuilder: values that contain separators, quotes or
+// surrounding whitespace are wrapped in double quotes (or single quotes if
+// the value itself contains double quotes); embedded quote characters of the
+// chosen kind are doubled.
+func npgsqlQuote(v string) string {
+	needsQuote := v == "" || strings.TrimSpace(v) != v ||
+		strings.IndexFunc(v, func(r rune) bool {
+			return r == ';' || r == '=' || r == '\'' || r == '"' || unicode.IsControl(r)
+		}) != -1
+	switch {
+	case !needsQuote:
+		return v
+	case !strings.Contains(v, `"`):
+		return `"` + v + `"`
+	case !strings.Contains(v, `'`):
+		return `'` + v + `'`
+	default:
+		return `"` + strings.Replace(v, `"`, `""`, -1) + `"`
+	}
+}
+
+func sortedKeys(v url.Values) []string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dbURI creates a URI that can be used to connect to CockroachDB;
+// user, pass, and db are optional.
+func dbURI(host, port, user, pass, db string, options url.Values) string {
+	return connParams{host, port, user, pass, db, options}.uri()
+}
@@ -0,0 +1,259 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/lib/pq"
+)
+
+// SQLSTATE codes returned by CockroachDB that the broker handles. Unlike
+// error messages, these don't change between CockroachDB versions.
+const (
+	codeUniqueViolation       = "23505"
+	codeDuplicateDatabase     = "42P04"
+	codeDuplicateObject       = "42710"
+	codeDuplicateSchema       = "42P06"
+	codeInvalidCatalogName    = "3D000"
+	codeInvalidSchemaName     = "3F000"
+	codeUndefinedObject       = "42704"
+	codeUndefinedTable        = "42P01"
+	codeInsufficientPrivilege = "42501"
+	codeSerializationFailure  = "40001"
+	// codeStatementCompletionUnknown is returned when CockroachDB can't
+	// tell whether a transaction committed.
+	codeStatementCompletionUnknown = "40003"
+	codeAdminShutdown              = "57P01"
+	codeCannotConnectNow           = "57P03"
+	codeIOError                    = "58030"
+	codeUndefinedFile              = "58P01"
+	// classConnectionException is the class of connection errors (08xxx).
+	classConnectionException = "08"
+)
+
+// errorKind classifies the errors returned by CockroachDB.
+type errorKind int
+
+const (
+	kindOther errorKind = iota
+	kindAlreadyExists
+	kindNotFound
+	kindPermissionDenied
+	// kindRetryable errors are transient, and say that the statement didn't
+	// take effect: any statement can be tried again.
+	kindRetryable
+	// kindAmbiguous errors are transient too, but the connection broke
+	// before the result arrived, so the statement may have taken effect.
+	// Only idempotent statements can be tried again blindly.
+	kindAmbiguous
+)
+
+// Objects that can already exist or not be found.
+const (
+	objectDatabase       = "database"
+	objectRole           = "role"
+	objectSchema         = "schema"
+	objectTable          = "table"
+	objectVirtualCluster = "virtual cluster"
+)
+
+// crdbError is a CockroachDB error, classified by its SQLSTATE.
+type crdbError struct {
+	kind errorKind
+	// object is what already exists or wasn't found, if the code tells;
+	// see about.
+	object string
+	err    error
+}
+
+// about returns whether the error is of the given kind and about the given
+// object. undefined_object (42704) and duplicate_object (42710) are used for
+// roles, virtual clusters, regions and more, and for the "no object matched"
+// error of GRANT and REVOKE on db.* when the database has no tables; only
+// the statement that failed tells which, so callers name the object they
+// expect and errors with these codes are taken to be about it. Databases and
+// schemas have codes of their own.
+func (e *crdbError) about(kind errorKind, object string) bool {
+	if e == nil || e.kind != kind {
+		return false
+	}
+	if e.object == "" {
+		return object == objectRole || object == objectVirtualCluster || object == objectTable
+	}
+	return e.object == object
+}
+
+func (e *crdbError) Error() string {
+	return e.err.Error()
+}
+
+// classifyError classifies an error returned by the CockroachDB driver.
+func classifyError(err error) *crdbError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*crdbError); ok {
+		return e
+	}
+	res := &crdbError{kind: kindOther, err: err}
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		if isConnectionError(err) {
+			res.kind = kindAmbiguous
+		}
+		return res
+	}
+	switch code := string(pqErr.Code); {
+	case code == codeDuplicateDatabase:
+		res.kind, res.object = kindAlreadyExists, objectDatabase
+	case code == codeDuplicateObject:
+		res.kind = kindAlreadyExists
+	case code == codeDuplicateSchema:
+		res.kind, res.object = kindAlreadyExists, objectSchema
+	case code == codeInvalidCatalogName:
+		res.kind, res.object = kindNotFound, objectDatabase
+	case code == codeInvalidSchemaName:
+		res.kind, res.object = kindNotFound, objectSchema
+	case code == codeUndefinedObject:
+		res.kind = kindNotFound
+	case code == codeUndefinedTable:
+		res.kind, res.object = kindNotFound, objectTable
+	case code == codeInsufficientPrivilege:
+		res.kind = kindPermissionDenied
+	case code == codeSerializationFailure, code == codeAdminShutdown, code == codeCannotConnectNow:
+		res.kind = kindRetryable
+	case code == codeStatementCompletionUnknown, len(code) == 5 && code[:2] == classConnectionException:
+		res.kind = kindAmbiguous
+	}
+	return res
+}
+
+// isConnectionError returns whether err is a network error talking to
+// CockroachDB.
+func isConnectionError(err error) bool {
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+func isAlreadyExists(err error, object string) bool {
+	return classifyError(err).about(kindAlreadyExists, object)
+}
+
+func isNotFound(err error, object string) bool {
+	return classifyError(err).about(kindNotFound, object)
+}
+
+// isNoObjectMatched returns whether err is the error of a GRANT or REVOKE on
+// db.* when the database has no tables. Depending on the CockroachDB version,
+// it reports an undefined table or an undefined object, which a missing
+// grantee reports too; callers that need to tell them apart check that the
+// grantee exists.
+func isNoObjectMatched(err error) bool {
+	return isNotFound(err, objectTable)
+}
+
+func isPermissionDenied(err error) bool {
+	e := classifyError(err)
+	return e != nil && e.kind == kindPermissionDenied
+}
+
+func isRetryable(err error) bool {
+	e := classifyError(err)
+	return e != nil && e.kind == kindRetryable
+}
+
+// isAmbiguous returns whether err leaves it unknown whether the statement
+// took effect.
+func isAmbiguous(err error) bool {
+	e := classifyError(err)
+	return e != nil && e.kind == kindAmbiguous
+}
+
+// Retry parameters; variables for testing.
+var (
+	maxRetries        = 5
+	retryInitialDelay = 50 * time.Millisecond
+	retryMaxDelay     = 2 * time.Second
+	retrySleep        = time.Sleep
+)
+
+// withRetry runs fn, running it again with exponential backoff as long as it
+// fails with a retryable or ambiguous error, up to maxRetries times. As
+// connection errors are retried too, fn must be idempotent; use
+// withSafeRetry otherwise.
+func withRetry(fn func() error) error {
+	return retry(fn, func(err error) bool { return isRetryable(err) || isAmbiguous(err) })
+}
+
+// withSafeRetry is like withRetry, but only retries the errors that say fn
+// had no effect. Ambiguous errors are returned, for the caller to find out
+// whether fn took effect.
+func withSafeRetry(fn func() error) error {
+	return retry(fn, isRetryable)
+}
+
+func retry(fn func() error, retryable func(error) bool) error {
+	delay := retryInitialDelay
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i == maxRetries || !retryable(err) {
+			return err
+		}
+		log.Info("retrying", lager.Data{"error": err.Error(), "attempt": i + 1})
+		retrySleep(delay)
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// execer is implemented by *sql.DB.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// execWithRetry runs an idempotent statement with withRetry. Statements in
+// transactions shouldn't be retried on their own: retry the whole
+// transaction instead.
+func execWithRetry(db execer, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := withRetry(func() error {
+		var err error
+		res, err = db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// execWithSafeRetry runs a statement that isn't idempotent, such as CREATE
+// USER, with withSafeRetry.
+func execWithSafeRetry(db execer, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := withSafeRetry(func() error {
+		var err error
+		res, err = db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
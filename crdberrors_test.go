@@ -0,0 +1,341 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err            error
+		expectedKind   errorKind
+		expectedObject string
+	}{
+		{err: &pq.Error{Code: "42P04"}, expectedKind: kindAlreadyExists, expectedObject: objectDatabase},
+		{err: &pq.Error{Code: "42710", Message: "a role/user named foo already exists"}, expectedKind: kindAlreadyExists},
+		{err: &pq.Error{Code: "42P06"}, expectedKind: kindAlreadyExists, expectedObject: objectSchema},
+		{err: &pq.Error{Code: "3D000"}, expectedKind: kindNotFound, expectedObject: objectDatabase},
+		{err: &pq.Error{Code: "3F000"}, expectedKind: kindNotFound, expectedObject: objectSchema},
+		{err: &pq.Error{Code: "42704", Message: `role/user "foo" does not exist`}, expectedKind: kindNotFound},
+		{err: &pq.Error{Code: "42P01"}, expectedKind: kindNotFound, expectedObject: objectTable},
+		{err: &pq.Error{Code: "42501"}, expectedKind: kindPermissionDenied},
+		{err: &pq.Error{Code: "40001"}, expectedKind: kindRetryable},
+		{err: &pq.Error{Code: "57P01"}, expectedKind: kindRetryable},
+		{err: &pq.Error{Code: "57P03"}, expectedKind: kindRetryable},
+		{err: &pq.Error{Code: "08006"}, expectedKind: kindAmbiguous},
+		{err: &pq.Error{Code: "40003"}, expectedKind: kindAmbiguous},
+		{err: &pq.Error{Code: "23505"}, expectedKind: kindOther},
+		{err: &pq.Error{Code: "42601", Message: "database already exists"}, expectedKind: kindOther},
+		{err: driver.ErrBadConn, expectedKind: kindAmbiguous},
+		{err: io.ErrUnexpectedEOF, expectedKind: kindAmbiguous},
+		{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, expectedKind: kindAmbiguous},
+		{err: errors.New(`database "cf_a" does not exist`), expectedKind: kindOther},
+	}
+	for _, tc := range testCases {
+		e := classifyError(tc.err)
+		if e.kind != tc.expectedKind || e.object != tc.expectedObject {
+			t.Errorf("%v: expected %d %q, got %d %q",
+				tc.err, tc.expectedKind, tc.expectedObject, e.kind, e.object)
+		}
+		if e.Error() != tc.err.Error() {
+			t.Errorf("expected message %q, got %q", tc.err.Error(), e.Error())
+		}
+	}
+	if classifyError(nil) != nil {
+		t.Error("expected nil error to classify as nil")
+	}
+	if !isNoObjectMatched(&pq.Error{Code: "42P01"}) || !isNoObjectMatched(&pq.Error{Code: "42704", Message: "no object matched"}) {
+		t.Error("expected undefined table and no object matched errors to match no object")
+	}
+}
+
+// TestErrorObject checks that the codes that don't tell what the error is
+// about match the objects callers expect, whatever the message.
+func TestErrorObject(t *testing.T) {
+	undefined := &pq.Error{Code: "42704", Message: "anything"}
+	duplicate := &pq.Error{Code: "42710", Message: "anything"}
+	for _, object := range []string{objectRole, objectVirtualCluster, objectTable} {
+		if !isNotFound(undefined, object) || !isAlreadyExists(duplicate, object) {
+			t.Errorf("expected 42704 and 42710 to match a %s", object)
+		}
+	}
+	for _, object := range []string{objectDatabase, objectSchema} {
+		if isNotFound(undefined, object) || isAlreadyExists(duplicate, object) {
+			t.Errorf("expected 42704 and 42710 not to match a %s, which has codes of its own", object)
+		}
+	}
+	if isNotFound(&pq.Error{Code: "3D000"}, objectRole) || isAlreadyExists(&pq.Error{Code: "42P04"}, objectRole) {
+		t.Error("expected database errors not to match a role")
+	}
+	if isNotFound(duplicate, objectRole) || isAlreadyExists(undefined, objectRole) {
+		t.Error("expected the kind of the error to matter")
+	}
+}
+
+// stubRetrySleep records the delays of withRetry instead of sleeping.
+func stubRetrySleep() (*[]time.Duration, func()) {
+	var delays []time.Duration
+	prev := retrySleep
+	retrySleep = func(d time.Duration) { delays = append(delays, d) }
+	return &delays, func() { retrySleep = prev }
+}
+
+func TestWithRetry(t *testing.T) {
+	testCases := []struct {
+		name string
+		// errs are returned by successive attempts; later attempts succeed.
+		errs []error
+		// safe uses withSafeRetry.
+		safe             bool
+		expectedAttempts int
+		expectedErr      bool
+	}{
+		{name: "success", expectedAttempts: 1},
+		{
+			name:             "serialization failure",
+			errs:             []error{&pq.Error{Code: "40001"}, &pq.Error{Code: "40001"}},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "connection error",
+			errs:             []error{driver.ErrBadConn},
+			expectedAttempts: 2,
+		},
+		{
+			name:             "connection error, not idempotent",
+			errs:             []error{driver.ErrBadConn},
+			safe:             true,
+			expectedAttempts: 1,
+			expectedErr:      true,
+		},
+		{
+			name:             "serialization failure, not idempotent",
+			errs:             []error{&pq.Error{Code: "40001"}},
+			safe:             true,
+			expectedAttempts: 2,
+		},
+		{
+			name:             "not retryable",
+			errs:             []error{&pq.Error{Code: "42501"}},
+			expectedAttempts: 1,
+			expectedErr:      true,
+		},
+		{
+			name: "gives up",
+			errs: []error{
+				io.EOF, io.EOF, io.EOF, io.EOF, io.EOF, io.EOF, io.EOF, io.EOF,
+			},
+			expectedAttempts: maxRetries + 1,
+			expectedErr:      true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, restore := stubRetrySleep()
+			defer restore()
+
+			attempts := 0
+			fn := func() error {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return tc.errs[attempts-1]
+				}
+				return nil
+			}
+			var err error
+			if tc.safe {
+				err = withSafeRetry(fn)
+			} else {
+				err = withRetry(fn)
+			}
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if attempts != tc.expectedAttempts {
+				t.Fatalf("expected %d attempts, got %d", tc.expectedAttempts, attempts)
+			}
+			if len(*delays) != attempts-1 {
+				t.Fatalf("expected %d sleeps, got %v", attempts-1, *delays)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	delays, restore := stubRetrySleep()
+	defer restore()
+	prevInitial, prevMax := retryInitialDelay, retryMaxDelay
+	retryInitialDelay, retryMaxDelay = 10*time.Millisecond, 50*time.Millisecond
+	defer func() { retryInitialDelay, retryMaxDelay = prevInitial, prevMax }()
+
+	_ = withRetry(func() error { return driver.ErrBadConn })
+	expected := []time.Duration{
+		10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+		50 * time.Millisecond, 50 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(*delays, expected) {
+		t.Fatalf("expected delays %v, got %v", expected, *delays)
+	}
+}
+
+func TestProvisionErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		// err is returned by the first CREATE DATABASE.
+		err            error
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "serialization failure",
+			err:            &pq.Error{Code: "40001", Message: "restart transaction"},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "permission denied",
+			err:            &pq.Error{Code: "42501", Message: "user broker does not have CREATEDB privilege"},
+			expectedStatus: http.StatusInternalServerError,
+			expectedError:  "needs the CREATEDB privilege",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			_, restore := stubRetrySleep()
+			defer restore()
+			failed := false
+			b.cluster.fail = func(stmt string) error {
+				if !failed && strings.HasPrefix(stmt, "CREATE DATABASE") {
+					failed = true
+					return tc.err
+				}
+				return nil
+			}
+
+			var res struct {
+				Description string `json:"description"`
+			}
+			status := adminRequest(t, b.server, "PUT", "/v2/service_instances/inst1",
+				b.provisionBody(nil), &res)
+			if status != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, status)
+			}
+			if !strings.Contains(res.Description, tc.expectedError) {
+				t.Fatalf("expected error containing %q, got %q", tc.expectedError, res.Description)
+			}
+		})
+	}
+}
+
+func TestLostResults(t *testing.T) {
+	// lib/pq reports a connection lost after a statement was sent as an
+	// unexpected EOF.
+	ctx := context.Background()
+	bindDetails := func(b *fakeBroker) brokerapi.BindDetails {
+		return brokerapi.BindDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1"}
+	}
+
+	t.Run("provision", func(t *testing.T) {
+		b, cleanup := newFakeBroker()
+		defer cleanup()
+		_, restore := stubRetrySleep()
+		defer restore()
+		// The database is created and commented, but the broker doesn't
+		// hear back. The comment tells it the database is its own.
+		b.cluster.injectLostResult(`^COMMENT ON DATABASE`, io.ErrUnexpectedEOF, 1)
+		if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+		if !b.cluster.databases[dbNameFromInstanceID("inst1")] {
+			t.Fatal("database dropped")
+		}
+	})
+
+	t.Run("provision, database of another instance", func(t *testing.T) {
+		b, cleanup := newFakeBroker()
+		defer cleanup()
+		_, restore := stubRetrySleep()
+		defer restore()
+		dbName := dbNameFromInstanceID("inst1")
+		b.cluster.databases[dbName] = true
+		b.cluster.comments[dbName] = `{"instance_id":"other"}`
+		// The broker can't tell whether it created the database, and finds
+		// it isn't.
+		b.cluster.injectFault(`^CREATE DATABASE`, io.ErrUnexpectedEOF, 1)
+		if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err == nil {
+			t.Fatal("expected provision to fail")
+		}
+		if b.cluster.comments[dbName] != `{"instance_id":"other"}` {
+			t.Fatalf("comment of the other instance's database changed: %s", b.cluster.comments[dbName])
+		}
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		b, cleanup := newFakeBroker()
+		defer cleanup()
+		_, restore := stubRetrySleep()
+		defer restore()
+		if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+		user := userNameFromBinding("inst1", "bind1")
+		// Retrying CREATE USER would fail with "already exists"; the bind
+		// fails instead, and the user it may have created is dropped.
+		b.cluster.injectLostResult(`^CREATE USER`, io.ErrUnexpectedEOF, 1)
+		if _, err := b.sb.Bind(ctx, "inst1", "bind1", bindDetails(b)); err == nil {
+			t.Fatal("expected bind to fail")
+		}
+		if b.cluster.hasUser(user) {
+			t.Fatal("user not dropped")
+		}
+		if _, err := b.sb.Bind(ctx, "inst1", "bind1", bindDetails(b)); err != nil {
+			t.Fatal(err)
+		}
+		if !b.cluster.hasUser(user) {
+			t.Fatal("user not created on retry")
+		}
+	})
+}
+
+func TestGrantTablesMissingRole(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	if _, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	dbName := dbNameFromInstanceID("inst1")
+	// A database without tables isn't an error, but a missing user is.
+	b.cluster.users["user1"] = true
+	if err := grantTables(b.plan.crdb, dbName, "user1", roleReadWrite); err != nil {
+		t.Fatalf("expected no error for a database without tables, got %v", err)
+	}
+	if err := grantTables(b.plan.crdb, dbName, "missing", roleReadWrite); !isNotFound(err, objectRole) {
+		t.Fatalf("expected the missing role to be reported, got %v", err)
+	}
+}
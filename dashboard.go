@@ -0,0 +1,219 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const dashboardPath = "/dashboard/"
+
+// dashboardConfig configures the per-instance dashboards. Access to a
+// dashboard is granted by a token that is an HMAC of the instance ID, so
+// dashboard URLs can be handed out by Provision without storing anything.
+type dashboardConfig struct {
+	// baseURL is the externally visible URL of the broker.
+	baseURL string
+	secret  []byte
+}
+
+func (c *dashboardConfig) token(instanceID string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(instanceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *dashboardConfig) validToken(instanceID, token string) bool {
+	return hmac.Equal([]byte(token), []byte(c.token(instanceID)))
+}
+
+// url returns the dashboard URL of an instance.
+func (c *dashboardConfig) url(instanceID string) string {
+	return strings.TrimSuffix(c.baseURL, "/") + dashboardPath + url.PathEscape(instanceID) +
+		"?token=" + c.token(instanceID)
+}
+
+// dashboardURL returns the dashboard URL of an instance, or the empty string
+// if dashboards are disabled.
+func (sb *crdbServiceBroker) dashboardURL(instanceID string) string {
+	if sb.dashboard == nil {
+		return ""
+	}
+	return sb.dashboard.url(instanceID)
+}
+
+type dashboardTable struct {
+	Name          string
+	EstimatedRows int64
+}
+
+type dashboardData struct {
+	InstanceID string
+	Database   string
+	Cluster    string
+	Plan       string
+	// SizeBytes is only known for instances with a database of their own.
+	SizeBytes  int64
+	SharedDB   bool
+	Tables     []dashboardTable
+	Bindings   []*bindingRecord
+	ZoneConfig string
+	// Errors lists the parts of the page that could not be loaded.
+	Errors []string
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CockroachDB instance {{.InstanceID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+pre { background: #f4f4f4; padding: 1em; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<h1>CockroachDB instance</h1>
+{{range .Errors}}<p class="error">{{.}}</p>{{end}}
+<table>
+<tr><th>Instance</th><td>{{.InstanceID}}</td></tr>
+<tr><th>Database</th><td>{{.Database}}</td></tr>
+<tr><th>Cluster</th><td>{{.Cluster}}</td></tr>
+<tr><th>Plan</th><td>{{.Plan}}</td></tr>
+{{if not .SharedDB}}<tr><th>Size</th><td>{{.SizeBytes}} bytes</td></tr>{{end}}
+</table>
+<h2>Tables</h2>
+<table>
+<tr><th>Table</th><th>Estimated rows</th></tr>
+{{range .Tables}}<tr><td>{{.Name}}</td><td>{{.EstimatedRows}}</td></tr>
+{{else}}<tr><td colspan="2">No tables</td></tr>
+{{end}}</table>
+<h2>Bindings</h2>
+<table>
+<tr><th>Binding</th><th>App</th><th>Role</th><th>Shared</th></tr>
+{{range .Bindings}}<tr><td>{{.ID}}</td><td>{{.AppGUID}}</td><td>{{.Role}}</td><td>{{.Shared}}</td></tr>
+{{else}}<tr><td colspan="4">No bindings</td></tr>
+{{end}}</table>
+<h2>Zone configuration</h2>
+<pre>{{.ZoneConfig}}</pre>
+</body>
+</html>
+`))
+
+// serveDashboard serves the read-only dashboard of an instance. It is not
+// behind the broker credentials; the token in the URL grants access instead.
+func (sb *crdbServiceBroker) serveDashboard(w http.ResponseWriter, req *http.Request) {
+	if sb.dashboard == nil {
+		http.NotFound(w, req)
+		return
+	}
+	instanceID := strings.TrimPrefix(req.URL.Path, dashboardPath)
+	if instanceID == "" || strings.Contains(instanceID, "/") {
+		http.NotFound(w, req)
+		return
+	}
+	if !sb.dashboard.validToken(instanceID, req.URL.Query().Get("token")) {
+		http.Error(w, "invalid dashboard token", http.StatusForbidden)
+		return
+	}
+	instance, plan, err := sb.instancePlan(instanceID)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	data := sb.dashboardData(instance, plan)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Error("render-dashboard", err)
+	}
+}
+
+// dashboardData collects the information shown on an instance's dashboard.
+// Failures are reported on the page rather than failing the request.
+func (sb *crdbServiceBroker) dashboardData(instance *instanceRecord, plan *Plan) *dashboardData {
+	ns := plan.namespace(instance.ID)
+	conn := plan.instanceConn(instance)
+	data := &dashboardData{
+		InstanceID: instance.ID,
+		Database:   ns.String(),
+		SharedDB:   ns.schema != "",
+		Cluster:    fmt.Sprintf("%s:%s", conn.host, conn.port),
+		Plan:       plan.Name,
+	}
+	fail := func(what string, err error) {
+		log.Error("dashboard-"+what, err)
+		data.Errors = append(data.Errors, fmt.Sprintf("could not load %s: %s", what, err))
+	}
+
+	crdb, err := sb.instanceDB(plan, instance.ID)
+	if err != nil {
+		fail("database", err)
+		return data
+	}
+	if !data.SharedDB {
+		if err := crdb.QueryRow(fmt.Sprintf(
+			"SELECT COALESCE(sum(range_size), 0)::INT FROM [SHOW RANGES FROM DATABASE %s WITH DETAILS]", ns.database,
+		)).Scan(&data.SizeBytes); err != nil {
+			fail("size", err)
+		}
+	}
+
+	if rows, err := crdb.Query(fmt.Sprintf(
+		"SELECT table_name, COALESCE(estimated_row_count, 0) FROM [SHOW TABLES FROM %s] ORDER BY table_name",
+		ns,
+	)); err != nil {
+		fail("tables", err)
+	} else {
+		for rows.Next() {
+			var t dashboardTable
+			if err := rows.Scan(&t.Name, &t.EstimatedRows); err != nil {
+				fail("tables", err)
+				break
+			}
+			data.Tables = append(data.Tables, t)
+		}
+		if err := rows.Err(); err != nil {
+			fail("tables", err)
+		}
+		rows.Close()
+	}
+
+	for _, shared := range []bool{false, true} {
+		bindings, err := sb.state.Bindings(instance.ID, shared)
+		if err != nil {
+			fail("bindings", err)
+			break
+		}
+		data.Bindings = append(data.Bindings, bindings...)
+	}
+
+	if err := crdb.QueryRow(fmt.Sprintf(
+		"SELECT raw_config_sql FROM [SHOW ZONE CONFIGURATION FROM DATABASE %s]", ns.database,
+	)).Scan(&data.ZoneConfig); err != nil {
+		fail("zone configuration", err)
+	}
+	return data
+}
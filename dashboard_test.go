@@ -0,0 +1,115 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestDashboardAuth(t *testing.T) {
+	sb := newCRDBServiceBroker(newBrokerState(newMemKVStore()))
+	sb.dashboard = &dashboardConfig{baseURL: "https://broker.example.com/", secret: []byte("secret")}
+	creds := brokerapi.BrokerCredentials{Username: "user", Password: "pass"}
+	server := httptest.NewServer(newBrokerHandler(sb, creds))
+	defer server.Close()
+
+	u := sb.dashboardURL("inst1")
+	if !strings.HasPrefix(u, "https://broker.example.com/dashboard/inst1?token=") {
+		t.Fatalf("unexpected dashboard URL %s", u)
+	}
+	if sb.dashboard.validToken("inst2", sb.dashboard.token("inst1")) {
+		t.Errorf("token of one instance valid for another")
+	}
+	other := &dashboardConfig{secret: []byte("other")}
+	if sb.dashboard.validToken("inst1", other.token("inst1")) {
+		t.Errorf("token signed with another secret accepted")
+	}
+
+	get := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get("/dashboard/inst1"); status != http.StatusForbidden {
+		t.Errorf("expected 403 without token, got %d", status)
+	}
+	if status := get("/dashboard/inst1?token=" + sb.dashboard.token("inst2")); status != http.StatusForbidden {
+		t.Errorf("expected 403 with wrong token, got %d", status)
+	}
+	// The token is valid, but the broker doesn't know the instance.
+	if status := get("/dashboard/inst1?token=" + sb.dashboard.token("inst1")); status != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown instance, got %d", status)
+	}
+
+	sb.dashboard = nil
+	if u := sb.dashboardURL("inst1"); u != "" {
+		t.Errorf("expected no dashboard URL when disabled, got %s", u)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	sb := b.sb
+	sb.dashboard = &dashboardConfig{baseURL: b.server.URL, secret: []byte("secret")}
+
+	spec, err := sb.Provision(context.Background(), "inst1", b.provisionDetails(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.DashboardURL != sb.dashboardURL("inst1") {
+		t.Fatalf("unexpected dashboard URL %q", spec.DashboardURL)
+	}
+	db := dbNameFromInstanceID("inst1")
+	b.cluster.mu.Lock()
+	b.cluster.tables[db] = map[string][]string{"albums": {"1", "2"}}
+	b.cluster.mu.Unlock()
+	if err := sb.state.PutBinding(&bindingRecord{
+		ID: "binding1", InstanceID: "inst1", AppGUID: "app1", Role: roleReadWrite,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(spec.DashboardURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	for _, s := range []string{db, b.plan.Name, "albums", "app1", "num_replicas"} {
+		if !strings.Contains(string(body), s) {
+			t.Errorf("dashboard does not contain %q:\n%s", s, body)
+		}
+	}
+	if strings.Contains(string(body), "could not load") {
+		t.Errorf("dashboard reported errors:\n%s", body)
+	}
+}
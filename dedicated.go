@@ -0,0 +1,524 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Ports of the nodes of dedicated clusters.
+const (
+	dedicatedSQLPort  = "26257"
+	dedicatedHTTPPort = 8080
+)
+
+// dedicatedCertsMount is where the nodes of dedicated clusters find their
+// certificates.
+const dedicatedCertsMount = "/cockroach/certs"
+
+// dedicatedPollInterval is how often createDedicated checks whether a new
+// cluster is ready; a variable for testing.
+var dedicatedPollInterval = 10 * time.Second
+
+// dedicatedCertsDir is where the broker writes the root client certificates
+// of dedicated clusters while it bootstraps them, since lib/pq only reads
+// certificates from files; a variable for testing.
+var dedicatedCertsDir = filepath.Join(os.TempDir(), "cockroachdb-service-broker-certs")
+
+// host returns the address of the public Service of the dedicated cluster
+// with the given name, which resolves in the Kubernetes cluster.
+func (c *kubernetesConfig) host(name string) string {
+	return fmt.Sprintf("%s-public.%s.svc", name, c.Namespace)
+}
+
+// createDedicated creates the dedicated cluster of an instance, waits for it
+// to be ready and creates the instance's admin user in it. Objects that
+// exist already are kept, certificates included, so that an interrupted
+// operation can be resumed.
+func (sb *crdbServiceBroker) createDedicated(plan *Plan, instance *instanceRecord) error {
+	cfg := plan.Kubernetes
+	name := clusterNameFromInstanceID(instance.ID)
+	var objects []runtime.Object
+	if cfg.Operator {
+		// The operator generates the certificates and initializes the
+		// cluster.
+		objects = []runtime.Object{crdbClusterObject(cfg, name)}
+	} else {
+		if _, err := plan.kube.secret(name + "-certs"); apierrors.IsNotFound(err) {
+			certs, err := dedicatedCerts(cfg, name)
+			if err != nil {
+				return fmt.Errorf("generating certificates: %s", err)
+			}
+			objects = append(objects, secretObject(cfg, name, certs))
+		} else if err != nil {
+			return fmt.Errorf("reading certificates: %s", err)
+		}
+		objects = append(objects, statefulSetObjects(cfg, name)...)
+	}
+	for _, obj := range objects {
+		if err := plan.kube.create(obj); err != nil {
+			return err
+		}
+	}
+
+	for deadline := time.Now().Add(cfg.readyTimeout); ; {
+		ready, err := dedicatedReady(plan, name)
+		if err != nil {
+			return err
+		}
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cluster %s not ready after %s", name, cfg.readyTimeout)
+		}
+		time.Sleep(dedicatedPollInterval)
+	}
+
+	// The broker only knows the root user's certificate, which it uses to
+	// create the user with a password it uses from then on.
+	dir, err := writeRootCerts(plan, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error("remove-certs", err, lager.Data{"cluster": name})
+		}
+	}()
+	conn := plan.instanceConn(instance)
+	conn.user = "root"
+	conn.options = url.Values{
+		"sslmode":     {"verify-full"},
+		"sslrootcert": {filepath.Join(dir, "ca.crt")},
+		"sslcert":     {filepath.Join(dir, "client.root.crt")},
+		"sslkey":      {filepath.Join(dir, "client.root.key")},
+	}
+	bootstrap, err := instanceConnect(conn.uri())
+	if err != nil {
+		return fmt.Errorf("connecting to cluster: %s", err)
+	}
+	defer bootstrap.Close()
+	return createAdminUser(bootstrap, instance)
+}
+
+// dropDedicated deletes the Kubernetes objects of an instance's dedicated
+// cluster, including its volumes. Objects that don't exist are skipped.
+func (sb *crdbServiceBroker) dropDedicated(plan *Plan, instanceID string) error {
+	cfg := plan.Kubernetes
+	name := clusterNameFromInstanceID(instanceID)
+	type object struct{ kind, name string }
+	var objects []object
+	if cfg.Operator {
+		objects = []object{{"CrdbCluster", name}}
+	} else {
+		objects = []object{
+			{"Job", name + "-init"},
+			{"StatefulSet", name},
+			{"Service", name + "-public"},
+			{"Service", name},
+			{"Secret", name + "-certs"},
+		}
+	}
+	// StatefulSets leave their volumes behind.
+	for i := 0; i < cfg.Nodes; i++ {
+		objects = append(objects, object{"PersistentVolumeClaim", fmt.Sprintf("datadir-%s-%d", name, i)})
+	}
+	for _, o := range objects {
+		if err := plan.kube.delete(o.kind, o.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedicatedReady returns whether all the nodes of a dedicated cluster are
+// ready, which they only are once the cluster is initialized.
+func dedicatedReady(plan *Plan, name string) (bool, error) {
+	cfg := plan.Kubernetes
+	if cfg.Operator {
+		cluster, err := plan.kube.crdbCluster(name)
+		if err != nil {
+			return false, fmt.Errorf("getting CrdbCluster %s: %s", name, err)
+		}
+		conditions, _, _ := unstructured.NestedSlice(cluster.Object, "status", "conditions")
+		initialized := false
+		for _, c := range conditions {
+			c, _ := c.(map[string]interface{})
+			if c["type"] == "Initialized" && c["status"] == "True" {
+				initialized = true
+			}
+		}
+		if !initialized {
+			return false, nil
+		}
+	} else {
+		job, err := plan.kube.job(name + "-init")
+		if err != nil {
+			return false, fmt.Errorf("getting Job %s-init: %s", name, err)
+		}
+		if job.Status.Succeeded == 0 {
+			return false, nil
+		}
+	}
+	// The operator names the StatefulSet after the cluster too.
+	sts, err := plan.kube.statefulSet(name)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("getting StatefulSet %s: %s", name, err)
+	}
+	return int(sts.Status.ReadyReplicas) >= cfg.Nodes, nil
+}
+
+// writeRootCerts writes the CA certificate and the root client certificate
+// of a dedicated cluster to a new directory, which the caller removes.
+func writeRootCerts(plan *Plan, name string) (string, error) {
+	cfg := plan.Kubernetes
+	secretName, certKey, keyKey := name+"-certs", "client.root.crt", "client.root.key"
+	if cfg.Operator {
+		secretName, certKey, keyKey = name+"-root", "tls.crt", "tls.key"
+	}
+	secret, err := plan.kube.secret(secretName)
+	if err != nil {
+		return "", fmt.Errorf("reading root certificate: %s", err)
+	}
+	if err := os.MkdirAll(dedicatedCertsDir, 0700); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(dedicatedCertsDir, name)
+	if err != nil {
+		return "", err
+	}
+	for file, key := range map[string]string{
+		"ca.crt": "ca.crt", "client.root.crt": certKey, "client.root.key": keyKey,
+	} {
+		data := secret.Data[key]
+		if len(data) == 0 {
+			err = fmt.Errorf("no %s in secret %s", key, secretName)
+		} else {
+			// lib/pq refuses keys that others can read.
+			err = ioutil.WriteFile(filepath.Join(dir, file), data, 0600)
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", fmt.Errorf("writing root certificate: %s", err)
+		}
+	}
+	return dir, nil
+}
+
+// dedicatedLabels returns the labels of the objects of a dedicated cluster.
+func dedicatedLabels(name string) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       "cockroachdb",
+		"app.kubernetes.io/instance":   name,
+		"app.kubernetes.io/managed-by": kubeManager,
+	}
+}
+
+func objectMeta(cfg *kubernetesConfig, name, clusterName string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: cfg.Namespace, Labels: dedicatedLabels(clusterName)}
+}
+
+// secretObject returns the Secret holding the certificates of a dedicated
+// cluster.
+func secretObject(cfg *kubernetesConfig, name string, files map[string]string) *corev1.Secret {
+	data := make(map[string][]byte)
+	for file, contents := range files {
+		data[file] = []byte(contents)
+	}
+	return &corev1.Secret{ObjectMeta: objectMeta(cfg, name+"-certs", name), Data: data}
+}
+
+// volumeClaimSpec returns the spec of the volume of each node.
+func volumeClaimSpec(cfg *kubernetesConfig) corev1.PersistentVolumeClaimSpec {
+	spec := corev1.PersistentVolumeClaimSpec{
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Resources: corev1.ResourceRequirements{
+			// validate checked the size.
+			Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(cfg.StorageSize)},
+		},
+	}
+	if cfg.StorageClass != "" {
+		spec.StorageClassName = &cfg.StorageClass
+	}
+	return spec
+}
+
+// crdbClusterObject returns the CrdbCluster resource of a dedicated cluster
+// managed by the CockroachDB operator.
+func crdbClusterObject(cfg *kubernetesConfig, name string) *unstructured.Unstructured {
+	pvcSpec := map[string]interface{}{
+		"accessModes": []interface{}{"ReadWriteOnce"},
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{"storage": cfg.StorageSize},
+		},
+	}
+	if cfg.StorageClass != "" {
+		pvcSpec["storageClassName"] = cfg.StorageClass
+	}
+	labels := make(map[string]interface{})
+	for k, v := range dedicatedLabels(name) {
+		labels[k] = v
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": crdbClusterResource.GroupVersion().String(),
+		"kind":       "CrdbCluster",
+		"metadata":   map[string]interface{}{"name": name, "namespace": cfg.Namespace, "labels": labels},
+		"spec": map[string]interface{}{
+			"nodes":      int64(cfg.Nodes),
+			"image":      map[string]interface{}{"name": cfg.Image},
+			"tlsEnabled": true,
+			"dataStore":  map[string]interface{}{"pvc": map[string]interface{}{"spec": pvcSpec}},
+		},
+	}}
+}
+
+// statefulSetObjects returns the Services, StatefulSet and initialization
+// Job of a dedicated cluster, whose certificates are in the Secret
+// name-certs.
+func statefulSetObjects(cfg *kubernetesConfig, name string) []runtime.Object {
+	ports := []corev1.ServicePort{
+		{Name: "grpc", Port: 26257, TargetPort: intstr.FromInt(26257)},
+		{Name: "http", Port: dedicatedHTTPPort, TargetPort: intstr.FromInt(dedicatedHTTPPort)},
+	}
+	certsMode := int32(0400)
+	certsVolume := corev1.Volume{
+		Name: "certs",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: name + "-certs", DefaultMode: &certsMode},
+		},
+	}
+	certsMount := corev1.VolumeMount{Name: "certs", MountPath: dedicatedCertsMount}
+	var join []string
+	for i := 0; i < cfg.Nodes; i++ {
+		join = append(join, fmt.Sprintf("%s-%d.%s", name, i, name))
+	}
+	replicas := int32(cfg.Nodes)
+
+	return []runtime.Object{
+		&corev1.Service{
+			// The headless Service gives the nodes stable names to join.
+			ObjectMeta: objectMeta(cfg, name, name),
+			Spec: corev1.ServiceSpec{
+				ClusterIP:                "None",
+				PublishNotReadyAddresses: true,
+				Selector:                 dedicatedLabels(name),
+				Ports:                    ports,
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: objectMeta(cfg, name+"-public", name),
+			Spec:       corev1.ServiceSpec{Selector: dedicatedLabels(name), Ports: ports},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: objectMeta(cfg, name, name),
+			Spec: appsv1.StatefulSetSpec{
+				ServiceName:         name,
+				Replicas:            &replicas,
+				PodManagementPolicy: appsv1.ParallelPodManagement,
+				Selector:            &metav1.LabelSelector{MatchLabels: dedicatedLabels(name)},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: dedicatedLabels(name)},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{
+							Name:  "cockroachdb",
+							Image: cfg.Image,
+							Command: []string{
+								"/cockroach/cockroach", "start",
+								"--logtostderr",
+								"--certs-dir=" + dedicatedCertsMount,
+								"--advertise-host=$(POD_NAME)." + name,
+								"--http-addr=0.0.0.0",
+								"--join=" + strings.Join(join, ","),
+								"--cache=.25",
+								"--max-sql-memory=.25",
+							},
+							Env: []corev1.EnvVar{{
+								Name: "POD_NAME",
+								ValueFrom: &corev1.EnvVarSource{
+									FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+								},
+							}},
+							Ports: []corev1.ContainerPort{
+								{Name: "grpc", ContainerPort: 26257},
+								{Name: "http", ContainerPort: dedicatedHTTPPort},
+							},
+							// Nodes are only ready once the cluster is
+							// initialized.
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									HTTPGet: &corev1.HTTPGetAction{
+										Path:   "/health?ready=1",
+										Port:   intstr.FromString("http"),
+										Scheme: corev1.URISchemeHTTPS,
+									},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "datadir", MountPath: "/cockroach/cockroach-data"},
+								certsMount,
+							},
+						}},
+						Volumes: []corev1.Volume{certsVolume},
+					},
+				},
+				VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+					ObjectMeta: metav1.ObjectMeta{Name: "datadir"},
+					Spec:       volumeClaimSpec(cfg),
+				}},
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: objectMeta(cfg, name+"-init", name),
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						RestartPolicy: corev1.RestartPolicyOnFailure,
+						Containers: []corev1.Container{{
+							Name:  "init",
+							Image: cfg.Image,
+							Command: []string{
+								"/cockroach/cockroach", "init",
+								"--certs-dir=" + dedicatedCertsMount,
+								fmt.Sprintf("--host=%s-0.%s", name, name),
+							},
+							VolumeMounts: []corev1.VolumeMount{certsMount},
+						}},
+						Volumes: []corev1.Volume{certsVolume},
+					},
+				},
+			},
+		},
+	}
+}
+
+// dedicatedCerts generates a CA and the node and root client certificates it
+// signs for a dedicated cluster, as the files of a CockroachDB certificates
+// directory.
+func dedicatedCerts(cfg *kubernetesConfig, name string) (map[string]string, error) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"Cockroach"}, CommonName: "Cockroach CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if caTemplate.SerialNumber, err = randomSerial(); err != nil {
+		return nil, err
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	issue := func(commonName string, usage []x509.ExtKeyUsage, hosts []string) (string, string, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		template := &x509.Certificate{
+			Subject:     pkix.Name{Organization: []string{"Cockroach"}, CommonName: commonName},
+			NotBefore:   now.Add(-time.Hour),
+			NotAfter:    now.AddDate(5, 0, 0),
+			KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage: usage,
+		}
+		if template.SerialNumber, err = randomSerial(); err != nil {
+			return "", "", err
+		}
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, h)
+			}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return "", "", err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return "", "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), nil
+	}
+
+	// The nodes are reached through the public Service and, by each other,
+	// as pods of the headless one.
+	hosts := []string{"localhost", "127.0.0.1"}
+	for _, suffix := range []string{"", "." + cfg.Namespace, "." + cfg.Namespace + ".svc",
+		"." + cfg.Namespace + ".svc.cluster.local"} {
+		hosts = append(hosts, name+"-public"+suffix, name+suffix, "*."+name+suffix)
+	}
+	nodeCert, nodeKey, err := issue("node",
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, hosts)
+	if err != nil {
+		return nil, err
+	}
+	rootCert, rootKey, err := issue("root", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"ca.crt":          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		"node.crt":        nodeCert,
+		"node.key":        nodeKey,
+		"client.root.crt": rootCert,
+		"client.root.key": rootKey,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDedicatedIsolation(t *testing.T) {
+	testCases := []struct {
+		name     string
+		operator bool
+		// objects are the keys of the objects of the instance's cluster,
+		// named after NAME.
+		objects []string
+	}{
+		{
+			name: "manifests",
+			objects: []string{
+				"crdb/jobs/NAME-init",
+				"crdb/persistentvolumeclaims/datadir-NAME-0",
+				"crdb/persistentvolumeclaims/datadir-NAME-1",
+				"crdb/persistentvolumeclaims/datadir-NAME-2",
+				"crdb/secrets/NAME-certs",
+				"crdb/services/NAME",
+				"crdb/services/NAME-public",
+				"crdb/statefulsets/NAME",
+			},
+		},
+		{
+			name:     "operator",
+			operator: true,
+			objects: []string{
+				"crdb/crdbclusters/NAME",
+				"crdb/persistentvolumeclaims/datadir-NAME-0",
+				"crdb/persistentvolumeclaims/datadir-NAME-1",
+				"crdb/persistentvolumeclaims/datadir-NAME-2",
+				"crdb/secrets/NAME-root",
+				"crdb/statefulsets/NAME",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			k := newFakeKube()
+			defer k.useDedicated(t, b.plan, tc.operator)()
+			ctx := context.Background()
+			name := clusterNameFromInstanceID("inst1")
+			host := b.plan.Kubernetes.host(name)
+
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != brokerapi.ErrAsyncRequired {
+				t.Fatalf("expected %v, got %v", brokerapi.ErrAsyncRequired, err)
+			}
+			spec, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData)
+			if res.State != brokerapi.Succeeded {
+				t.Fatalf("provision %s: %s", res.State, res.Description)
+			}
+			if res.Description != "created dedicated cluster "+name {
+				t.Errorf("unexpected description %q", res.Description)
+			}
+			want := strings.Replace(fmt.Sprint(tc.objects), "NAME", name, -1)
+			if names := fmt.Sprint(k.names(t)); names != want {
+				t.Errorf("expected objects %s, got %s", want, names)
+			}
+			cluster := k.clusters[host]
+			if cluster == nil || !cluster.hasUser(adminUserFromInstanceID("inst1")) {
+				t.Fatal("admin user not created in the dedicated cluster")
+			}
+			if b.cluster.databases[dbNameFromInstanceID("inst1")] {
+				t.Error("instance database created on the plan's cluster")
+			}
+			crdb, err := b.sb.instanceDB(b.plan, "inst1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c, err := databaseComment(crdb, b.plan.namespace("inst1")); err != nil {
+				t.Fatal(err)
+			} else if c == nil || c.InstanceID != "inst1" {
+				t.Errorf("unexpected database comment %+v", c)
+			}
+
+			binding, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds := binding.Credentials.(map[string]interface{})
+			if creds["host"] != host || fmt.Sprint(creds["port"]) != dedicatedSQLPort || creds["database"] != clusterDatabase {
+				t.Errorf("unexpected credentials %v", creds)
+			}
+			if _, ok := creds["virtual_cluster"]; ok {
+				t.Errorf("unexpected virtual_cluster in credentials %v", creds)
+			}
+			u, err := url.Parse(creds["uri"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Hostname() != host {
+				t.Errorf("expected URI host %s, got %s", host, u.Hostname())
+			}
+			user := userNameFromBinding("inst1", "bind1")
+			if !cluster.hasUser(user) || b.cluster.hasUser(user) {
+				t.Error("expected the binding's user in the dedicated cluster only")
+			}
+
+			details := brokerapi.DeprovisionDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID}
+			dspec, err := b.sb.Deprovision(ctx, "inst1", details, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := waitForLastOperation(t, b.sb, "inst1", dspec.OperationData); res.State != brokerapi.Succeeded {
+				t.Fatalf("deprovision %s: %s", res.State, res.Description)
+			}
+			if names := k.names(t); len(names) != 0 {
+				t.Errorf("objects not deleted: %v", names)
+			}
+			if _, err := b.sb.state.Instance("inst1"); err != errStateNotFound {
+				t.Errorf("expected the instance to be forgotten, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDedicatedProvisionTimeout(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	k := newFakeKube()
+	defer k.useDedicated(t, b.plan, false /* operator */)()
+	b.plan.Kubernetes.readyTimeout = 10 * time.Millisecond
+	k.stuck = true
+
+	spec, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData)
+	if res.State != brokerapi.Failed || !strings.Contains(res.Description, "not ready after") {
+		t.Fatalf("expected the provision to time out, got %+v", res)
+	}
+	instance, err := b.sb.state.Instance("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.State != stateFailed {
+		t.Errorf("expected instance state %s, got %s", stateFailed, instance.State)
+	}
+	if names := k.names(t); len(names) != 0 {
+		t.Errorf("objects not deleted: %v", names)
+	}
+}
+
+// TestDedicatedCertsReused checks that resuming the creation of a cluster
+// keeps its certificates.
+func TestDedicatedCertsReused(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	k := newFakeKube()
+	defer k.useDedicated(t, b.plan, false /* operator */)()
+	instance := &instanceRecord{ID: "inst1", AdminPassword: "pass"}
+	name := clusterNameFromInstanceID("inst1")
+
+	certs := func() *corev1.Secret {
+		secret, err := b.plan.kube.secret(name + "-certs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	if err := b.sb.createDedicated(b.plan, instance); err != nil {
+		t.Fatal(err)
+	}
+	first := certs()
+	if err := b.sb.createDedicated(b.plan, instance); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(certs().Data["ca.crt"], first.Data["ca.crt"]) {
+		t.Error("certificates regenerated")
+	}
+
+	// The node certificate is valid for the public Service.
+	data := first.Data["node.crt"]
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no node certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname(b.plan.Kubernetes.host(name)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,1149 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// fakeCluster is an in-memory stand-in for a CockroachDB cluster, for tests
+// that can't start a real one. It understands the statements the broker
+// issues when provisioning and binding, and fails them with CockroachDB's
+// error messages.
+type fakeCluster struct {
+	mu sync.Mutex
+	// name is the name the cluster is opened with; see fakeDriver.Open.
+	name      string
+	databases map[string]bool
+	users     map[string]bool
+	// schemas are the user-defined schemas, as database.schema. The maps
+	// below are keyed by database, or by database.schema for what is in a
+	// user-defined schema.
+	schemas map[string]bool
+	// searchPaths maps users to the schema their tables are created in.
+	searchPaths map[string]string
+	// grants maps databases to the users that have privileges on them.
+	grants map[string]map[string]string
+	// defaultPrivileges maps databases, for their public schema, to the
+	// users that get privileges on the tables created in them later.
+	defaultPrivileges map[string]map[string]string
+	// owners maps databases to the objects created in them by users other
+	// than root, and those to their owners.
+	owners map[string]map[string]string
+	// tables maps databases to the tables created in them, and those to the
+	// values in their single column.
+	tables map[string]map[string][]string
+	// regions are the regions of the cluster's nodes.
+	regions []string
+	// dbRegions maps multi-region databases to their regions, the primary
+	// region first, and survivalGoals to their survival goals.
+	dbRegions     map[string][]string
+	survivalGoals map[string]string
+	// comments maps databases to their comments.
+	comments map[string]string
+	// members maps roles to their members, dbOwners databases to their
+	// owners, when not root, and roleOptions users to the options set by
+	// ALTER ROLE ... WITH.
+	members     map[string]map[string]bool
+	dbOwners    map[string]string
+	roleOptions map[string]string
+	// sessions maps the IDs of open sessions to them.
+	sessions map[string]fakeSession
+	// backups maps backup collections to the subdirectories of the backups
+	// in them, and backupContents collection/subdirectory to what the
+	// backups taken by BACKUP hold.
+	backups        map[string][]string
+	backupContents map[string]fakeBackup
+	// tenants maps the names of virtual clusters to the fake clusters
+	// standing in for them, and tenantsStarted to whether their SQL service
+	// is started.
+	tenants        map[string]*fakeCluster
+	tenantsStarted map[string]bool
+	// fail, if set, is called with every statement before it is executed. If
+	// it returns an error, the statement fails with it.
+	fail func(stmt string) error
+	// faults are checked before fail; see injectFault.
+	faults []*fakeFault
+}
+
+// fakeFault makes the statements matching a pattern fail.
+type fakeFault struct {
+	pattern *regexp.Regexp
+	err     error
+	// times is how many more statements fail; negative means forever.
+	times int
+	// lost makes the statements take effect before failing, as if the
+	// connection broke before their result arrived.
+	lost bool
+}
+
+// injectFault makes the next times statements matching pattern fail with err,
+// or all of them if times is negative.
+func (c *fakeCluster) injectFault(pattern string, err error, times int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = append(c.faults, &fakeFault{pattern: regexp.MustCompile(pattern), err: err, times: times})
+}
+
+// injectLostResult makes the next times statements matching pattern take
+// effect but fail with err, or all of them if times is negative.
+func (c *fakeCluster) injectLostResult(pattern string, err error, times int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = append(c.faults, &fakeFault{pattern: regexp.MustCompile(pattern), err: err, times: times, lost: true})
+}
+
+// clearFaults removes the injected faults.
+func (c *fakeCluster) clearFaults() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = nil
+}
+
+// checkFaults returns the error of the first fault matching stmt. c.mu must
+// be held.
+func (c *fakeCluster) checkFaults(stmt string) error {
+	for _, f := range c.faults {
+		if !f.lost && f.times != 0 && f.pattern.MatchString(stmt) {
+			if f.times > 0 {
+				f.times--
+			}
+			return f.err
+		}
+	}
+	if c.fail != nil {
+		return c.fail(stmt)
+	}
+	return nil
+}
+
+// checkLostResult returns the error of the first lost result fault matching
+// stmt, which has taken effect.
+func (c *fakeCluster) checkLostResult(stmt string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.faults {
+		if f.lost && f.times != 0 && f.pattern.MatchString(stmt) {
+			if f.times > 0 {
+				f.times--
+			}
+			return f.err
+		}
+	}
+	return nil
+}
+
+var fakeClusters = struct {
+	sync.Mutex
+	m map[string]*fakeCluster
+}{m: make(map[string]*fakeCluster)}
+
+func init() {
+	sql.Register("fakecrdb", fakeDriver{})
+}
+
+// newFakeCluster returns a new empty fake cluster and a connection to it.
+func newFakeCluster() (*fakeCluster, *sql.DB) {
+	c := registerFakeCluster()
+	db, err := sql.Open("fakecrdb", c.name)
+	if err != nil {
+		panic(err)
+	}
+	return c, db
+}
+
+// registerFakeCluster returns a new empty fake cluster that fakeDriver can
+// open.
+func registerFakeCluster() *fakeCluster {
+	c := &fakeCluster{
+		databases: map[string]bool{"defaultdb": true, "postgres": true, "system": true},
+		users:     map[string]bool{"root": true, "admin": true},
+		grants:    make(map[string]map[string]string),
+		owners:    make(map[string]map[string]string),
+		tables:    make(map[string]map[string][]string),
+		comments:  make(map[string]string),
+		sessions:  make(map[string]fakeSession),
+		backups:   make(map[string][]string),
+
+		backupContents:    make(map[string]fakeBackup),
+		defaultPrivileges: make(map[string]map[string]string),
+
+		dbRegions:     make(map[string][]string),
+		survivalGoals: make(map[string]string),
+
+		schemas:     make(map[string]bool),
+		searchPaths: make(map[string]string),
+
+		members:     make(map[string]map[string]bool),
+		dbOwners:    make(map[string]string),
+		roleOptions: make(map[string]string),
+
+		tenants:        make(map[string]*fakeCluster),
+		tenantsStarted: make(map[string]bool),
+	}
+	fakeClusters.Lock()
+	c.name = strconv.Itoa(len(fakeClusters.m))
+	fakeClusters.m[c.name] = c
+	fakeClusters.Unlock()
+	return c
+}
+
+func (c *fakeCluster) hasUser(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.users[name]
+}
+
+// isMember returns whether user was granted role.
+func (c *fakeCluster) isMember(role, user string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.members[role][user]
+}
+
+// grantRole makes user a member of role. c.mu must be held.
+func (c *fakeCluster) grantRole(role, user string) error {
+	for _, name := range []string{role, user} {
+		if !c.users[name] {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", name)}
+		}
+	}
+	if c.members[role] == nil {
+		c.members[role] = make(map[string]bool)
+	}
+	c.members[role][user] = true
+	return nil
+}
+
+// tableNamespace returns the key of the database or schema the connection's
+// unqualified table names refer to. c.mu must be held.
+func (c *fakeCluster) tableNamespace(conn *fakeConn) string {
+	if schema := conn.db + "." + c.searchPaths[conn.user]; c.schemas[schema] {
+		return schema
+	}
+	return conn.db
+}
+
+// inDatabase returns whether the key of a database or schema is, or is in,
+// the database db.
+func inDatabase(key, db string) bool {
+	return key == db || strings.HasPrefix(key, db+".")
+}
+
+// dropNamespace forgets everything in the database or schema with the given
+// key. c.mu must be held.
+func (c *fakeCluster) dropNamespace(key string) {
+	delete(c.grants, key)
+	delete(c.defaultPrivileges, key)
+	delete(c.owners, key)
+	delete(c.tables, key)
+	delete(c.comments, key)
+	delete(c.dbOwners, key)
+}
+
+var (
+	fakeCreateDatabase = regexp.MustCompile(`^CREATE DATABASE (\w+)$`)
+	fakeRenameDatabase = regexp.MustCompile(`^ALTER DATABASE (\w+) RENAME TO (\w+)$`)
+	fakeAlterRegion    = regexp.MustCompile(`^ALTER DATABASE (\w+) (SET PRIMARY REGION|ADD REGION IF NOT EXISTS|DROP REGION IF EXISTS) "([^"]+)"$`)
+	fakeSurvive        = regexp.MustCompile(`^ALTER DATABASE (\w+) SURVIVE (ZONE|REGION) FAILURE$`)
+	fakeDropDatabase   = regexp.MustCompile(`^DROP DATABASE IF EXISTS (\w+)( CASCADE)?$`)
+	fakeCreateUser     = regexp.MustCompile(`^CREATE USER (\w+) WITH PASSWORD '[^']*'$`)
+	fakeDropUser       = regexp.MustCompile(`^DROP (?:USER|ROLE) IF EXISTS (\w+)$`)
+	fakeCreateRole     = regexp.MustCompile(`^CREATE ROLE IF NOT EXISTS (\w+)$`)
+	fakeSetDatabase    = regexp.MustCompile(`^SET database = (?:(\w+)|'(\w*)')$`)
+	fakeReassignOwned  = regexp.MustCompile(`^REASSIGN OWNED BY (\w+) TO (\w+)$`)
+	fakeDropOwned      = regexp.MustCompile(`^DROP OWNED BY (\w+)$`)
+	fakeCommentOnDB    = regexp.MustCompile(`^COMMENT ON DATABASE (\w+) IS '((?:[^']|'')*)'$`)
+	fakeBackupDatabase = regexp.MustCompile(`^BACKUP DATABASE (\w+) INTO \$1$`)
+	fakeRestore        = regexp.MustCompile(`^RESTORE DATABASE \w+ FROM \$1 IN \$2 WITH new_db_name = '(\w+)'$`)
+	fakeCancelSession  = regexp.MustCompile(`^CANCEL SESSION IF EXISTS \$1$`)
+	fakeGrantDatabase  = regexp.MustCompile(`^GRANT (\w+) ON DATABASE (\w+) TO (\w+)$`)
+	fakeRevokeDatabase = regexp.MustCompile(`^REVOKE ALL ON DATABASE (\w+) FROM (\w+)$`)
+	fakeTablePrivilege = regexp.MustCompile(`^(GRANT \w+|REVOKE ALL) ON TABLE (\w+)\.\* (TO|FROM) (\w+)$`)
+	fakeDefaultPrivs   = regexp.MustCompile(`^ALTER DEFAULT PRIVILEGES FOR ALL ROLES IN SCHEMA (\w+)\.(\w+) (?:GRANT ([\w, ]+) ON TABLES TO|REVOKE ALL ON TABLES FROM) (\w+)$`)
+	fakeCreateTable    = regexp.MustCompile(`^CREATE TABLE (\w+) \(.*\)$`)
+	fakeCreateObject   = regexp.MustCompile(`^CREATE (SCHEMA|VIEW|SEQUENCE|TYPE) (\w+)(?: AS .*)?$`)
+	fakeInsert         = regexp.MustCompile(`^INSERT INTO (\w+) \(value\) VALUES \(\$1\)$`)
+
+	fakeCreateDatabaseIfNotExists = regexp.MustCompile(`^CREATE DATABASE IF NOT EXISTS (\w+)$`)
+	fakeRevokePublicCreate        = regexp.MustCompile(`^REVOKE CREATE ON SCHEMA (\w+)\.public FROM public$`)
+	fakeCreateSchema              = regexp.MustCompile(`^CREATE SCHEMA (\w+)\.(\w+)$`)
+	fakeDropSchema                = regexp.MustCompile(`^DROP SCHEMA IF EXISTS (\w+)\.(\w+) CASCADE$`)
+	fakeCommentOnSchema           = regexp.MustCompile(`^COMMENT ON SCHEMA (\w+)\.(\w+) IS '((?:[^']|'')*)'$`)
+	fakeGrantSchema               = regexp.MustCompile(`^GRANT (\w+) ON SCHEMA (\w+)\.(\w+) TO (\w+)$`)
+	fakeRevokeSchema              = regexp.MustCompile(`^REVOKE ALL ON SCHEMA (\w+)\.(\w+) FROM (\w+)$`)
+	fakeSchemaTablePrivilege      = regexp.MustCompile(`^(?:GRANT [\w, ]+ ON ALL TABLES IN SCHEMA (\w+)\.(\w+) TO (\w+)|REVOKE ALL ON ALL TABLES IN SCHEMA (\w+)\.(\w+) FROM (\w+))$`)
+	fakeSetSearchPath             = regexp.MustCompile(`^ALTER ROLE (\w+) SET search_path = '(\w+)'$`)
+
+	fakeCreateTenant          = regexp.MustCompile(`^CREATE VIRTUAL CLUSTER IF NOT EXISTS "([\w-]+)"$`)
+	fakeTenantService         = regexp.MustCompile(`^ALTER VIRTUAL CLUSTER "([\w-]+)" (START SERVICE SHARED|STOP SERVICE)$`)
+	fakeRenameTenant          = regexp.MustCompile(`^ALTER VIRTUAL CLUSTER "([\w-]+)" RENAME TO "([\w-]+)"$`)
+	fakeDropTenant            = regexp.MustCompile(`^DROP VIRTUAL CLUSTER IF EXISTS "([\w-]+)" IMMEDIATE$`)
+	fakeCreateUserIfNotExists = regexp.MustCompile(`^CREATE USER IF NOT EXISTS (\w+)$`)
+	fakeAlterUserPassword     = regexp.MustCompile(`^ALTER USER (\w+) WITH PASSWORD '[^']*'$`)
+	fakeGrantRole             = regexp.MustCompile(`^GRANT (\w+) TO (\w+)$`)
+	fakeRevokeRole            = regexp.MustCompile(`^REVOKE (\w+) FROM (\w+)$`)
+	fakeAlterDatabaseOwner    = regexp.MustCompile(`^ALTER DATABASE (\w+) OWNER TO (\w+)$`)
+	fakeAlterRoleOptions      = regexp.MustCompile(`^ALTER ROLE (\w+) WITH ([A-Z ]+)$`)
+)
+
+// exec runs a statement on behalf of the given connection, whose current
+// database may change.
+func (c *fakeCluster) exec(conn *fakeConn, stmt string, args []driver.Value) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkFaults(stmt); err != nil {
+		return err
+	}
+
+	if m := fakeCreateDatabase.FindStringSubmatch(stmt); m != nil {
+		if c.databases[m[1]] {
+			return &pq.Error{Code: "42P04", Message: fmt.Sprintf("database %q already exists", m[1])}
+		}
+		c.databases[m[1]] = true
+		return nil
+	}
+	if m := fakeRenameDatabase.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		if c.databases[m[2]] {
+			return &pq.Error{Code: "42P04", Message: fmt.Sprintf("database %q already exists", m[2])}
+		}
+		c.databases[m[2]], c.grants[m[2]], c.owners[m[2]], c.tables[m[2]], c.comments[m[2]] =
+			c.databases[m[1]], c.grants[m[1]], c.owners[m[1]], c.tables[m[1]], c.comments[m[1]]
+		c.defaultPrivileges[m[2]] = c.defaultPrivileges[m[1]]
+		delete(c.databases, m[1])
+		delete(c.grants, m[1])
+		delete(c.defaultPrivileges, m[1])
+		delete(c.owners, m[1])
+		delete(c.tables, m[1])
+		delete(c.comments, m[1])
+		if regions, ok := c.dbRegions[m[1]]; ok {
+			c.dbRegions[m[2]], c.survivalGoals[m[2]] = regions, c.survivalGoals[m[1]]
+			delete(c.dbRegions, m[1])
+			delete(c.survivalGoals, m[1])
+		}
+		return nil
+	}
+	if m := fakeAlterRegion.FindStringSubmatch(stmt); m != nil {
+		return c.alterRegion(m[1], m[2], m[3])
+	}
+	if m := fakeSurvive.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		regions, ok := c.dbRegions[m[1]]
+		if !ok {
+			return &pq.Error{Code: "42P12", Message: fmt.Sprintf("database %s is not multi-region enabled", m[1])}
+		}
+		if m[2] == "REGION" && len(regions) < 3 {
+			return &pq.Error{Code: "22023", Message: "at least 3 regions are required for surviving a region failure"}
+		}
+		c.survivalGoals[m[1]] = strings.ToLower(m[2])
+		return nil
+	}
+	if m := fakeDropDatabase.FindStringSubmatch(stmt); m != nil {
+		delete(c.databases, m[1])
+		c.dropNamespace(m[1])
+		for schema := range c.schemas {
+			if inDatabase(schema, m[1]) {
+				delete(c.schemas, schema)
+				c.dropNamespace(schema)
+			}
+		}
+		delete(c.dbRegions, m[1])
+		delete(c.survivalGoals, m[1])
+		return nil
+	}
+	if m := fakeCreateDatabaseIfNotExists.FindStringSubmatch(stmt); m != nil {
+		c.databases[m[1]] = true
+		return nil
+	}
+	if m := fakeRevokePublicCreate.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		return nil
+	}
+	if m := fakeCreateSchema.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		if c.schemas[m[1]+"."+m[2]] {
+			return &pq.Error{Code: "42P06", Message: fmt.Sprintf("schema %q already exists", m[2])}
+		}
+		c.schemas[m[1]+"."+m[2]] = true
+		return nil
+	}
+	if m := fakeDropSchema.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		delete(c.schemas, m[1]+"."+m[2])
+		c.dropNamespace(m[1] + "." + m[2])
+		return nil
+	}
+	if m := fakeCommentOnSchema.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkSchema(m[1], m[2]); err != nil {
+			return err
+		}
+		c.comments[m[1]+"."+m[2]] = strings.Replace(m[3], "''", "'", -1)
+		return nil
+	}
+	if m := fakeGrantSchema.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkSchemaAndUser(m[2], m[3], m[4]); err != nil {
+			return err
+		}
+		schema := m[2] + "." + m[3]
+		if c.grants[schema] == nil {
+			c.grants[schema] = make(map[string]string)
+		}
+		c.grants[schema][m[4]] = m[1]
+		return nil
+	}
+	if m := fakeRevokeSchema.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkSchemaAndUser(m[1], m[2], m[3]); err != nil {
+			return err
+		}
+		delete(c.grants[m[1]+"."+m[2]], m[3])
+		return nil
+	}
+	if m := fakeSchemaTablePrivilege.FindStringSubmatch(stmt); m != nil {
+		// The fake doesn't model table privileges.
+		return c.checkSchemaAndUser(m[1]+m[4], m[2]+m[5], m[3]+m[6])
+	}
+	if m := fakeSetSearchPath.FindStringSubmatch(stmt); m != nil {
+		if !c.users[m[1]] {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", m[1])}
+		}
+		c.searchPaths[m[1]] = m[2]
+		return nil
+	}
+	if m := fakeCreateTenant.FindStringSubmatch(stmt); m != nil {
+		if _, ok := c.tenants[m[1]]; !ok {
+			c.tenants[m[1]] = registerFakeCluster()
+		}
+		return nil
+	}
+	if m := fakeTenantService.FindStringSubmatch(stmt); m != nil {
+		if _, ok := c.tenants[m[1]]; !ok {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("virtual cluster %q does not exist", m[1])}
+		}
+		c.tenantsStarted[m[1]] = m[2] != "STOP SERVICE"
+		return nil
+	}
+	if m := fakeRenameTenant.FindStringSubmatch(stmt); m != nil {
+		tenant, ok := c.tenants[m[1]]
+		if !ok {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("virtual cluster %q does not exist", m[1])}
+		}
+		if _, ok := c.tenants[m[2]]; ok {
+			return &pq.Error{Code: "42710", Message: fmt.Sprintf("virtual cluster %q already exists", m[2])}
+		}
+		if c.tenantsStarted[m[1]] {
+			return &pq.Error{Code: "55000", Message: fmt.Sprintf(
+				"cannot rename virtual cluster %q in service mode shared", m[1],
+			)}
+		}
+		c.tenants[m[2]] = tenant
+		delete(c.tenants, m[1])
+		delete(c.tenantsStarted, m[1])
+		return nil
+	}
+	if m := fakeDropTenant.FindStringSubmatch(stmt); m != nil {
+		if c.tenantsStarted[m[1]] {
+			return &pq.Error{Code: "55000", Message: fmt.Sprintf(
+				"cannot drop virtual cluster %q in service mode shared", m[1],
+			)}
+		}
+		delete(c.tenants, m[1])
+		delete(c.tenantsStarted, m[1])
+		return nil
+	}
+	if m := fakeCreateUserIfNotExists.FindStringSubmatch(stmt); m != nil {
+		c.users[m[1]] = true
+		return nil
+	}
+	if m := fakeAlterUserPassword.FindStringSubmatch(stmt); m != nil {
+		// The fake doesn't check passwords.
+		if !c.users[m[1]] {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", m[1])}
+		}
+		return nil
+	}
+	if m := fakeGrantRole.FindStringSubmatch(stmt); m != nil {
+		// The fake records role membership, but doesn't check privileges.
+		return c.grantRole(m[1], m[2])
+	}
+	if m := fakeRevokeRole.FindStringSubmatch(stmt); m != nil {
+		for _, name := range []string{m[1], m[2]} {
+			if !c.users[name] {
+				return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", name)}
+			}
+		}
+		delete(c.members[m[1]], m[2])
+		return nil
+	}
+	if m := fakeAlterDatabaseOwner.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		if !c.users[m[2]] {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", m[2])}
+		}
+		c.dbOwners[m[1]] = m[2]
+		return nil
+	}
+	if m := fakeAlterRoleOptions.FindStringSubmatch(stmt); m != nil {
+		if !c.users[m[1]] {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", m[1])}
+		}
+		c.roleOptions[m[1]] = m[2]
+		return nil
+	}
+	if m := fakeBackupDatabase.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		collection := args[0].(string)
+		subdir := fmt.Sprintf("/2017/01/01-%06d.00", len(c.backups[collection]))
+		c.backups[collection] = append(c.backups[collection], subdir)
+		c.backupContents[collection+subdir] = fakeBackup{
+			tables:            copyTables(c.tables[m[1]]),
+			grants:            copyGrants(c.grants[m[1]]),
+			defaultPrivileges: copyGrants(c.defaultPrivileges[m[1]]),
+		}
+		return nil
+	}
+	if m := fakeRestore.FindStringSubmatch(stmt); m != nil {
+		// Backups that tests list in c.backups themselves restore into
+		// empty databases.
+		found := false
+		for _, subdir := range c.backups[args[1].(string)] {
+			found = found || subdir == args[0].(string)
+		}
+		if !found {
+			return &pq.Error{Code: "XXUUU", Message: fmt.Sprintf("backup %s not found", args[0])}
+		}
+		if c.databases[m[1]] {
+			return &pq.Error{Code: "42P04", Message: fmt.Sprintf("database %q already exists", m[1])}
+		}
+		c.databases[m[1]] = true
+		if b, ok := c.backupContents[args[1].(string)+args[0].(string)]; ok {
+			c.tables[m[1]], c.grants[m[1]] = copyTables(b.tables), copyGrants(b.grants)
+			c.defaultPrivileges[m[1]] = copyGrants(b.defaultPrivileges)
+		}
+		return nil
+	}
+	if m := fakeCommentOnDB.FindStringSubmatch(stmt); m != nil {
+		if !c.databases[m[1]] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", m[1])}
+		}
+		c.comments[m[1]] = strings.Replace(m[2], "''", "'", -1)
+		return nil
+	}
+	if m := fakeCreateUser.FindStringSubmatch(stmt); m != nil {
+		if c.users[m[1]] {
+			return &pq.Error{Code: "42710", Message: fmt.Sprintf("a role/user named %s already exists", m[1])}
+		}
+		c.users[m[1]] = true
+		return nil
+	}
+	if m := fakeDropUser.FindStringSubmatch(stmt); m != nil {
+		for db, users := range c.grants {
+			if _, ok := users[m[1]]; ok {
+				return &pq.Error{Code: "2BP01", Message: fmt.Sprintf(
+					"cannot drop role/user %s: grants still exist on %s", m[1], db,
+				)}
+			}
+		}
+		for key, users := range c.defaultPrivileges {
+			if _, ok := users[m[1]]; ok {
+				return &pq.Error{Code: "2BP01", Message: fmt.Sprintf(
+					"role %s cannot be dropped because some objects depend on it\n"+
+						"privileges for default privileges on new relations in %s", m[1], key,
+				)}
+			}
+		}
+		for db, objects := range c.owners {
+			for obj, owner := range objects {
+				if owner == m[1] {
+					return &pq.Error{Code: "2BP01", Message: fmt.Sprintf(
+						"role %s cannot be dropped because some objects depend on it\nowner of %s.%s",
+						m[1], db, obj,
+					)}
+				}
+			}
+		}
+		delete(c.users, m[1])
+		delete(c.searchPaths, m[1])
+		delete(c.members, m[1])
+		for _, members := range c.members {
+			delete(members, m[1])
+		}
+		return nil
+	}
+	if fakeCancelSession.MatchString(stmt) {
+		delete(c.sessions, args[0].(string))
+		return nil
+	}
+	if m := fakeCreateRole.FindStringSubmatch(stmt); m != nil {
+		c.users[m[1]] = true
+		return nil
+	}
+	if m := fakeSetDatabase.FindStringSubmatch(stmt); m != nil {
+		db := m[1] + m[2]
+		if db != "" && !c.databases[db] {
+			return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+		}
+		conn.db = db
+		return nil
+	}
+	if m := fakeReassignOwned.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkDatabaseAndUser(conn.db, m[1]); err != nil {
+			return err
+		}
+		if err := c.checkDatabaseAndUser(conn.db, m[2]); err != nil {
+			return err
+		}
+		for key, objects := range c.owners {
+			for obj, owner := range objects {
+				if owner == m[1] && inDatabase(key, conn.db) {
+					objects[obj] = m[2]
+				}
+			}
+		}
+		return nil
+	}
+	if m := fakeDropOwned.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkDatabaseAndUser(conn.db, m[1]); err != nil {
+			return err
+		}
+		for key, objects := range c.owners {
+			for obj, owner := range objects {
+				if owner == m[1] && inDatabase(key, conn.db) {
+					delete(objects, obj)
+					delete(c.tables[key], obj)
+				}
+			}
+		}
+		for _, privileges := range []map[string]map[string]string{c.grants, c.defaultPrivileges} {
+			for key, users := range privileges {
+				if inDatabase(key, conn.db) {
+					delete(users, m[1])
+				}
+			}
+		}
+		return nil
+	}
+	if m := fakeGrantDatabase.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkDatabaseAndUser(m[2], m[3]); err != nil {
+			return err
+		}
+		if c.grants[m[2]] == nil {
+			c.grants[m[2]] = make(map[string]string)
+		}
+		c.grants[m[2]][m[3]] = m[1]
+		return nil
+	}
+	if m := fakeRevokeDatabase.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkDatabaseAndUser(m[1], m[2]); err != nil {
+			return err
+		}
+		delete(c.grants[m[1]], m[2])
+		return nil
+	}
+	if m := fakeTablePrivilege.FindStringSubmatch(stmt); m != nil {
+		if err := c.checkDatabaseAndUser(m[2], m[4]); err != nil {
+			return err
+		}
+		// The fake doesn't model table privileges.
+		return &pq.Error{Code: "42P01", Message: "no object matched"}
+	}
+	if m := fakeDefaultPrivs.FindStringSubmatch(stmt); m != nil {
+		key := m[1] + "." + m[2]
+		if m[2] == "public" {
+			key = m[1]
+			if err := c.checkDatabaseAndUser(m[1], m[4]); err != nil {
+				return err
+			}
+		} else if err := c.checkSchemaAndUser(m[1], m[2], m[4]); err != nil {
+			return err
+		}
+		if m[3] == "" {
+			delete(c.defaultPrivileges[key], m[4])
+			return nil
+		}
+		if c.defaultPrivileges[key] == nil {
+			c.defaultPrivileges[key] = make(map[string]string)
+		}
+		c.defaultPrivileges[key][m[4]] = m[3]
+		return nil
+	}
+	if m := fakeCreateTable.FindStringSubmatch(stmt); m != nil {
+		ns := c.tableNamespace(conn)
+		if _, ok := c.tables[ns][m[1]]; ok {
+			return &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation %q already exists", m[1])}
+		}
+		if err := c.create(conn, ns, m[1]); err != nil {
+			return err
+		}
+		if c.tables[ns] == nil {
+			c.tables[ns] = make(map[string][]string)
+		}
+		c.tables[ns][m[1]] = []string{}
+		return nil
+	}
+	if m := fakeCreateObject.FindStringSubmatch(stmt); m != nil {
+		// Schemas are created in the database, the other objects in the
+		// connection's schema.
+		ns := c.tableNamespace(conn)
+		if m[1] == "SCHEMA" {
+			ns = conn.db
+		}
+		if _, ok := c.owners[ns][m[2]]; ok || c.schemas[ns+"."+m[2]] {
+			return &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation %q already exists", m[2])}
+		}
+		if err := c.create(conn, ns, m[2]); err != nil {
+			return err
+		}
+		if m[1] == "SCHEMA" {
+			c.schemas[ns+"."+m[2]] = true
+		}
+		return nil
+	}
+	if m := fakeInsert.FindStringSubmatch(stmt); m != nil {
+		ns := c.tableNamespace(conn)
+		if _, ok := c.tables[ns][m[1]]; !ok {
+			return &pq.Error{Code: "42P01", Message: fmt.Sprintf("relation %q does not exist", m[1])}
+		}
+		c.tables[ns][m[1]] = append(c.tables[ns][m[1]], args[0].(string))
+		return nil
+	}
+	return fmt.Errorf("fakecrdb: unsupported statement: %s", stmt)
+}
+
+// create checks that the connection's user may create the object name in the
+// database or schema ns, and records the user as its owner unless it is root.
+// c.mu must be held.
+func (c *fakeCluster) create(conn *fakeConn, ns, name string) error {
+	if conn.user == "root" {
+		return nil
+	}
+	if c.grants[ns][conn.user] != "ALL" {
+		return &pq.Error{Code: "42501", Message: fmt.Sprintf(
+			"user %s does not have CREATE privilege on %s", conn.user, ns,
+		)}
+	}
+	if c.owners[ns] == nil {
+		c.owners[ns] = make(map[string]string)
+	}
+	c.owners[ns][name] = conn.user
+	return nil
+}
+
+// alterRegion changes the regions of a database with SET PRIMARY REGION, ADD
+// REGION IF NOT EXISTS or DROP REGION IF EXISTS. c.mu must be held.
+func (c *fakeCluster) alterRegion(db, op, region string) error {
+	if !c.databases[db] {
+		return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+	}
+	found := false
+	for _, r := range c.regions {
+		found = found || r == region
+	}
+	if !found {
+		return &pq.Error{Code: "42602", Message: fmt.Sprintf("region %q does not exist", region)}
+	}
+	regions, multiRegion := c.dbRegions[db]
+	i := -1
+	for j, r := range regions {
+		if r == region {
+			i = j
+		}
+	}
+	switch op {
+	case "SET PRIMARY REGION":
+		if !multiRegion {
+			c.dbRegions[db] = []string{region}
+			c.survivalGoals[db] = "zone"
+		} else if i < 0 {
+			return &pq.Error{Code: "42704", Message: fmt.Sprintf(
+				"region %q has not been added to the database", region,
+			)}
+		} else {
+			regions[0], regions[i] = regions[i], regions[0]
+		}
+	case "ADD REGION IF NOT EXISTS":
+		if !multiRegion {
+			return &pq.Error{Code: "42P12", Message: fmt.Sprintf(
+				"cannot add region %q to database %s: the database must have a primary region", region, db,
+			)}
+		}
+		if i < 0 {
+			c.dbRegions[db] = append(regions, region)
+		}
+	default:
+		switch {
+		case i < 0:
+		case i == 0 && len(regions) > 1:
+			return &pq.Error{Code: "42P12", Message: fmt.Sprintf(
+				"cannot drop region %q: it is the primary region of database %s", region, db,
+			)}
+		case c.survivalGoals[db] == "region" && len(regions) <= 3:
+			return &pq.Error{Code: "22023", Message: "at least 3 regions are required for surviving a region failure"}
+		case len(regions) == 1:
+			delete(c.dbRegions, db)
+			delete(c.survivalGoals, db)
+		default:
+			c.dbRegions[db] = append(regions[:i:i], regions[i+1:]...)
+		}
+	}
+	return nil
+}
+
+var (
+	fakeShowDatabases  = regexp.MustCompile(`^SELECT database_name FROM \[SHOW DATABASES\]$`)
+	fakeShowUsers      = regexp.MustCompile(`^SELECT username FROM \[SHOW USERS\]$`)
+	fakeShowSessions   = regexp.MustCompile(`^SELECT session_id FROM \[SHOW CLUSTER SESSIONS\] WHERE user_name (=|!=) (\$1|current_user\(\))$`)
+	fakeShowDBSessions = regexp.MustCompile(`^SELECT session_id FROM crdb_internal\.cluster_sessions WHERE database = \$1 AND user_name != current_user\(\)(?: AND user_name IN \(SELECT grantee FROM \[SHOW GRANTS ON SCHEMA (\w+\.\w+)\]\))?$`)
+	fakeShowComment    = regexp.MustCompile(`^SELECT COALESCE\(comment, ''\) FROM \[SHOW DATABASES WITH COMMENT\] WHERE database_name = \$1$`)
+	fakeShowBackups    = regexp.MustCompile(`^SHOW BACKUPS IN \$1$`)
+	fakeShowGrantsFor  = regexp.MustCompile(`^SELECT DISTINCT database_name FROM \[SHOW GRANTS FOR (\w+)\]$`)
+	fakeShowGrantsOn   = regexp.MustCompile(`^SELECT DISTINCT grantee FROM \[SHOW GRANTS ON DATABASE (\w+)\]$`)
+	fakeShowRegions    = regexp.MustCompile(`^SELECT region FROM \[SHOW REGIONS FROM CLUSTER\]$`)
+	fakeSelect         = regexp.MustCompile(`^SELECT value FROM (\w+)$`)
+	fakeShowRanges     = regexp.MustCompile(`^SELECT COALESCE\(sum\(range_size\), 0\)::INT FROM \[SHOW RANGES FROM DATABASE (\w+) WITH DETAILS\]$`)
+	fakeShowZone       = regexp.MustCompile(`^SELECT raw_config_sql FROM \[SHOW ZONE CONFIGURATION FROM DATABASE (\w+)\]$`)
+	// fakeShowTables is the only query with more than one column, see
+	// showTables.
+	fakeShowTables = regexp.MustCompile(`^SELECT table_name, COALESCE\(estimated_row_count, 0\) FROM \[SHOW TABLES FROM (\w+(?:\.\w+)?)\] ORDER BY table_name$`)
+
+	fakeShowSchemaComment = regexp.MustCompile(`^SELECT COALESCE\(obj_description\(oid, 'pg_namespace'\), ''\) FROM (\w+)\.pg_catalog\.pg_namespace WHERE nspname = \$1$`)
+	fakeShowSchemas       = regexp.MustCompile(`^SELECT schema_name FROM \[SHOW SCHEMAS FROM (\w+)\]$`)
+)
+
+// query runs a query on behalf of the given connection, returning the values
+// of its single column.
+func (c *fakeCluster) query(conn *fakeConn, stmt string, args []driver.Value) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkFaults(stmt); err != nil {
+		return nil, err
+	}
+
+	var res []string
+	switch {
+	case stmt == "SHOW database":
+		res = append(res, conn.db)
+	case fakeShowDatabases.MatchString(stmt):
+		for db := range c.databases {
+			res = append(res, db)
+		}
+	case fakeShowSessions.MatchString(stmt):
+		m := fakeShowSessions.FindStringSubmatch(stmt)
+		user := conn.user
+		if m[2] == "$1" {
+			user = args[0].(string)
+		}
+		for id, s := range c.sessions {
+			if (s.user == user) == (m[1] == "=") {
+				res = append(res, id)
+			}
+		}
+	case fakeShowDBSessions.MatchString(stmt):
+		schema := fakeShowDBSessions.FindStringSubmatch(stmt)[1]
+		for id, s := range c.sessions {
+			if s.database == args[0].(string) && s.user != conn.user &&
+				(schema == "" || c.grants[schema][s.user] != "") {
+				res = append(res, id)
+			}
+		}
+	case fakeShowComment.MatchString(stmt):
+		if db := args[0].(string); c.databases[db] {
+			res = append(res, c.comments[db])
+		}
+	case fakeShowBackups.MatchString(stmt):
+		backups, ok := c.backups[args[0].(string)]
+		if !ok {
+			return nil, &pq.Error{Code: "58030", Message: "external storage: no such file or directory"}
+		}
+		res = append(res, backups...)
+	case fakeShowUsers.MatchString(stmt):
+		for user := range c.users {
+			res = append(res, user)
+		}
+	case fakeShowGrantsOn.MatchString(stmt):
+		db := fakeShowGrantsOn.FindStringSubmatch(stmt)[1]
+		if !c.databases[db] {
+			return nil, &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+		}
+		res = append(res, "admin", "root")
+		for user := range c.grants[db] {
+			res = append(res, user)
+		}
+	case fakeShowRegions.MatchString(stmt):
+		res = append(res, c.regions...)
+	case fakeShowSchemaComment.MatchString(stmt):
+		db := fakeShowSchemaComment.FindStringSubmatch(stmt)[1]
+		if !c.databases[db] {
+			return nil, &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+		}
+		if schema := db + "." + args[0].(string); c.schemas[schema] {
+			res = append(res, c.comments[schema])
+		}
+	case fakeShowSchemas.MatchString(stmt):
+		db := fakeShowSchemas.FindStringSubmatch(stmt)[1]
+		if !c.databases[db] {
+			return nil, &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+		}
+		res = append(res, "crdb_internal", "information_schema", "pg_catalog", "pg_extension", "public")
+		for schema := range c.schemas {
+			if inDatabase(schema, db) {
+				res = append(res, strings.TrimPrefix(schema, db+"."))
+			}
+		}
+	case fakeShowRanges.MatchString(stmt):
+		// Every value takes up a byte.
+		var size int
+		for ns, tables := range c.tables {
+			if inDatabase(ns, fakeShowRanges.FindStringSubmatch(stmt)[1]) {
+				for _, values := range tables {
+					size += len(values)
+				}
+			}
+		}
+		res = append(res, strconv.Itoa(size))
+	case fakeShowZone.MatchString(stmt):
+		db := fakeShowZone.FindStringSubmatch(stmt)[1]
+		if !c.databases[db] {
+			return nil, &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+		}
+		res = append(res, "ALTER DATABASE "+db+" CONFIGURE ZONE USING num_replicas = 3")
+	case fakeSelect.MatchString(stmt):
+		table := fakeSelect.FindStringSubmatch(stmt)[1]
+		values, ok := c.tables[c.tableNamespace(conn)][table]
+		if !ok {
+			return nil, &pq.Error{Code: "42P01", Message: fmt.Sprintf("relation %q does not exist", table)}
+		}
+		res = append(res, values...)
+	default:
+		m := fakeShowGrantsFor.FindStringSubmatch(stmt)
+		if m == nil {
+			return nil, fmt.Errorf("fakecrdb: unsupported query: %s", stmt)
+		}
+		for db, users := range c.grants {
+			if _, ok := users[m[1]]; ok {
+				res = append(res, db)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// showTables runs a fakeShowTables query, which lists the tables of a
+// database or schema with their row counts.
+func (c *fakeCluster) showTables(stmt string) (*fakeRows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkFaults(stmt); err != nil {
+		return nil, err
+	}
+	ns := fakeShowTables.FindStringSubmatch(stmt)[1]
+	if !c.databases[ns] && !c.schemas[ns] {
+		return nil, &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", ns)}
+	}
+	var names []string
+	for name := range c.tables[ns] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := &fakeRows{columns: []string{"table_name", "estimated_row_count"}}
+	for _, name := range names {
+		rows.rows = append(rows.rows, []driver.Value{name, int64(len(c.tables[ns][name]))})
+	}
+	return rows, nil
+}
+
+func (c *fakeCluster) checkDatabaseAndUser(db, user string) error {
+	if !c.databases[db] {
+		return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+	}
+	if !c.users[user] {
+		return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", user)}
+	}
+	return nil
+}
+
+func (c *fakeCluster) checkSchema(db, schema string) error {
+	if !c.databases[db] {
+		return &pq.Error{Code: "3D000", Message: fmt.Sprintf("database %q does not exist", db)}
+	}
+	if !c.schemas[db+"."+schema] {
+		return &pq.Error{Code: "3F000", Message: fmt.Sprintf("unknown schema %q", schema)}
+	}
+	return nil
+}
+
+func (c *fakeCluster) checkSchemaAndUser(db, schema, user string) error {
+	if err := c.checkSchema(db, schema); err != nil {
+		return err
+	}
+	if !c.users[user] {
+		return &pq.Error{Code: "42704", Message: fmt.Sprintf("role/user %s does not exist", user)}
+	}
+	return nil
+}
+
+type fakeDriver struct{}
+
+// Open connects to the cluster with the given name as root, or, if name is of
+// the form cluster/database/user, to that database as that user.
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	parts := strings.SplitN(name, "/", 3)
+	fakeClusters.Lock()
+	c, ok := fakeClusters.m[parts[0]]
+	fakeClusters.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fakecrdb: no cluster %q", parts[0])
+	}
+	if len(parts) < 3 {
+		return &fakeConn{c: c, db: "defaultdb", user: "root"}, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkDatabaseAndUser(parts[1], parts[2]); err != nil {
+		return nil, err
+	}
+	return &fakeConn{c: c, db: parts[1], user: parts[2]}, nil
+}
+
+// fakeBackup is what a backup of a fake database holds: its tables and the
+// privileges on it.
+type fakeBackup struct {
+	tables                    map[string][]string
+	grants, defaultPrivileges map[string]string
+}
+
+func copyTables(tables map[string][]string) map[string][]string {
+	res := make(map[string][]string, len(tables))
+	for name, values := range tables {
+		res[name] = append([]string(nil), values...)
+	}
+	return res
+}
+
+func copyGrants(grants map[string]string) map[string]string {
+	res := make(map[string]string, len(grants))
+	for user, privileges := range grants {
+		res[user] = privileges
+	}
+	return res
+}
+
+// fakeSession is an open session of a fake cluster.
+type fakeSession struct {
+	user, database string
+}
+
+type fakeConn struct {
+	c *fakeCluster
+	// db is the current database.
+	db   string
+	user string
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+// Begin starts a transaction. The fake has no isolation: statements take
+// effect immediately and rollbacks don't undo them.
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error { return nil }
+
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s fakeStmt) Close() error { return nil }
+
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.conn.c.exec(s.conn, s.query, args); err != nil {
+		return nil, err
+	}
+	if err := s.conn.c.checkLostResult(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if fakeShowTables.MatchString(s.query) {
+		return s.conn.c.showTables(s.query)
+	}
+	values, err := s.conn.c.query(s.conn, s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	rows := &fakeRows{columns: []string{"value"}}
+	for _, v := range values {
+		rows.rows = append(rows.rows, []driver.Value{v})
+	}
+	return rows, nil
+}
+
+// fakeRows are the results of a query.
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
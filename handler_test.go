@@ -0,0 +1,263 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestBrokerAPI drives an instance and a binding through their lifecycle with
+// the platform's requests, checking the responses and the fake cluster along
+// the way.
+func TestBrokerAPI(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	_, restore := stubRetrySleep()
+	defer restore()
+
+	dbName := dbNameFromInstanceID("inst1")
+	user := userNameFromBinding("inst1", "bind1")
+	query := fmt.Sprintf("?service_id=%s&plan_id=%s", b.plan.ServiceID, b.plan.ID)
+	bindBody := map[string]interface{}{
+		"service_id": b.plan.ServiceID,
+		"plan_id":    b.plan.ID,
+		"app_guid":   "app1",
+	}
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		// setup, if set, runs before the request.
+		setup          func()
+		expectedStatus int
+		// check, if set, checks the response and the cluster.
+		check func(res map[string]interface{}) error
+	}{
+		{
+			name:   "catalog",
+			method: "GET", path: "/v2/catalog",
+			expectedStatus: http.StatusOK,
+			check: func(res map[string]interface{}) error {
+				if services, _ := res["services"].([]interface{}); len(services) != 1 {
+					return fmt.Errorf("expected 1 service, got %v", res["services"])
+				}
+				return nil
+			},
+		},
+		{
+			name:   "provision unknown plan",
+			method: "PUT", path: "/v2/service_instances/inst1",
+			body: map[string]interface{}{
+				"service_id": b.plan.ServiceID, "plan_id": "unknown",
+				"organization_guid": "org1", "space_guid": "space1",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "provision with invalid parameters",
+			method: "PUT", path: "/v2/service_instances/inst1",
+			body:           b.provisionBody(map[string]interface{}{"deletion_protection": "yes"}),
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "provision fails on the cluster",
+			method: "PUT", path: "/v2/service_instances/inst1",
+			body: b.provisionBody(nil),
+			setup: func() {
+				b.cluster.injectFault(`^CREATE DATABASE`, errFault, 1)
+			},
+			expectedStatus: http.StatusInternalServerError,
+			check: func(res map[string]interface{}) error {
+				if b.cluster.databases[dbName] {
+					return fmt.Errorf("database created")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "provision",
+			method: "PUT", path: "/v2/service_instances/inst1",
+			body:           b.provisionBody(nil),
+			expectedStatus: http.StatusCreated,
+			check: func(res map[string]interface{}) error {
+				if !b.cluster.databases[dbName] {
+					return fmt.Errorf("database not created")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "last operation",
+			method: "GET", path: "/v2/service_instances/inst1/last_operation?operation=" + operationProvision,
+			expectedStatus: http.StatusOK,
+			check: func(res map[string]interface{}) error {
+				if res["state"] != "succeeded" {
+					return fmt.Errorf("expected succeeded, got %v", res["state"])
+				}
+				return nil
+			},
+		},
+		{
+			name:   "bind to unknown instance",
+			method: "PUT", path: "/v2/service_instances/inst2/service_bindings/bind1",
+			body:           bindBody,
+			expectedStatus: http.StatusNotFound,
+			check: func(res map[string]interface{}) error {
+				if b.cluster.hasUser(userNameFromBinding("inst2", "bind1")) {
+					return fmt.Errorf("user left behind")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "bind fails on the cluster",
+			method: "PUT", path: "/v2/service_instances/inst1/service_bindings/bind1",
+			body: bindBody,
+			setup: func() {
+				b.cluster.injectFault(`^GRANT \w+ ON DATABASE`, errFault, 1)
+			},
+			expectedStatus: http.StatusInternalServerError,
+			check: func(res map[string]interface{}) error {
+				if b.cluster.hasUser(user) {
+					return fmt.Errorf("user left behind")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "bind",
+			method: "PUT", path: "/v2/service_instances/inst1/service_bindings/bind1",
+			body:           bindBody,
+			expectedStatus: http.StatusCreated,
+			check: func(res map[string]interface{}) error {
+				creds, _ := res["credentials"].(map[string]interface{})
+				if creds["username"] != user || creds["database"] != dbName {
+					return fmt.Errorf("unexpected credentials %v", creds)
+				}
+				if b.cluster.grants[dbName][user] != "ALL" {
+					return fmt.Errorf("privileges not granted")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "bind again",
+			method: "PUT", path: "/v2/service_instances/inst1/service_bindings/bind1",
+			body:           bindBody,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "update plan",
+			method: "PATCH", path: "/v2/service_instances/inst1",
+			body: map[string]interface{}{
+				"service_id": b.plan.ServiceID, "plan_id": "other",
+				"previous_values": map[string]interface{}{"plan_id": b.plan.ID},
+			},
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "update unknown instance",
+			method: "PATCH", path: "/v2/service_instances/inst2",
+			body: map[string]interface{}{"service_id": b.plan.ServiceID, "plan_id": b.plan.ID},
+			// brokerapi answers ErrInstanceDoesNotExist with 410 here.
+			expectedStatus: http.StatusGone,
+		},
+		{
+			name:   "update",
+			method: "PATCH", path: "/v2/service_instances/inst1",
+			body: map[string]interface{}{
+				"service_id": b.plan.ServiceID, "plan_id": b.plan.ID,
+				"parameters": map[string]interface{}{"deletion_protection": true},
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "deprovision protected instance",
+			method: "DELETE", path: "/v2/service_instances/inst1" + query,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "unbind fails on the cluster",
+			method: "DELETE", path: "/v2/service_instances/inst1/service_bindings/bind1" + query,
+			setup: func() {
+				b.cluster.injectFault(`^DROP USER`, errFault, 1)
+			},
+			expectedStatus: http.StatusInternalServerError,
+			check: func(res map[string]interface{}) error {
+				if b.cluster.grants[dbName][user] != "ALL" {
+					return fmt.Errorf("privileges not granted back")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "unbind",
+			method: "DELETE", path: "/v2/service_instances/inst1/service_bindings/bind1" + query,
+			expectedStatus: http.StatusOK,
+			check: func(res map[string]interface{}) error {
+				if b.cluster.hasUser(user) {
+					return fmt.Errorf("user not dropped")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "unprotect",
+			method: "PATCH", path: "/v2/service_instances/inst1",
+			body: map[string]interface{}{
+				"service_id": b.plan.ServiceID, "plan_id": b.plan.ID,
+				"parameters": map[string]interface{}{"deletion_protection": false},
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "deprovision",
+			method: "DELETE", path: "/v2/service_instances/inst1" + query,
+			expectedStatus: http.StatusOK,
+			check: func(res map[string]interface{}) error {
+				if b.cluster.databases[dbName] {
+					return fmt.Errorf("database not dropped")
+				}
+				return nil
+			},
+		},
+		{
+			// The platform treats an instance that is gone as deprovisioned.
+			name:   "deprovision again",
+			method: "DELETE", path: "/v2/service_instances/inst1" + query,
+			expectedStatus: http.StatusGone,
+		},
+	}
+	for _, s := range steps {
+		if s.setup != nil {
+			s.setup()
+		}
+		var res map[string]interface{}
+		status := adminRequest(t, b.server, s.method, s.path, s.body, &res)
+		b.cluster.clearFaults()
+		if status != s.expectedStatus {
+			t.Fatalf("%s: expected status %d, got %d (%v)", s.name, s.expectedStatus, status, res)
+		}
+		if s.check != nil {
+			if err := s.check(res); err != nil {
+				t.Fatalf("%s: %s", s.name, err)
+			}
+		}
+	}
+}
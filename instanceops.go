@@ -0,0 +1,297 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Operations creating and dropping the clusters of instances that have one
+// of their own, which take too long for a synchronous request.
+const (
+	opProvision   = "provision"
+	opDeprovision = "deprovision"
+)
+
+// clusterDatabase is the database that bindings get privileges on in the
+// cluster of an instance that has one of its own.
+const clusterDatabase = "defaultdb"
+
+// instanceConnect opens a connection with the given URI; a variable for
+// testing.
+var instanceConnect = func(uri string) (*sql.DB, error) {
+	return sql.Open("postgres", uri)
+}
+
+// instanceDB returns the connection pool for statements on the objects of an
+// instance: the plan's, or for an instance with a cluster of its own one
+// logged into that cluster as the instance's admin user. The latter are kept
+// until closeInstanceDB.
+func (sb *crdbServiceBroker) instanceDB(plan *Plan, instanceID string) (*sql.DB, error) {
+	if !plan.clusterPerInstance() {
+		return plan.crdb, nil
+	}
+	sb.clusterMu.Lock()
+	defer sb.clusterMu.Unlock()
+	if db, ok := sb.clusterDBs[instanceID]; ok {
+		return db, nil
+	}
+	instance, err := sb.state.Instance(instanceID)
+	if err == errStateNotFound {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("looking up instance: %s", err)
+	}
+	conn := plan.instanceConn(instance)
+	conn.user, conn.pass = adminUserFromInstanceID(instanceID), instance.AdminPassword
+	db, err := instanceConnect(conn.uri())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to instance cluster: %s", err)
+	}
+	sb.clusterDBs[instanceID] = db
+	return db, nil
+}
+
+// closeInstanceDB closes the connection pool of an instance's own cluster, if
+// there is one.
+func (sb *crdbServiceBroker) closeInstanceDB(instanceID string) {
+	sb.clusterMu.Lock()
+	defer sb.clusterMu.Unlock()
+	if db, ok := sb.clusterDBs[instanceID]; ok {
+		if err := db.Close(); err != nil {
+			log.Error("close-instance-cluster", err, lager.Data{"instance-id": instanceID})
+		}
+		delete(sb.clusterDBs, instanceID)
+	}
+}
+
+// createAdminUser creates the admin user the broker uses in an instance's own
+// cluster, through a connection as a user that can.
+func createAdminUser(bootstrap *sql.DB, instance *instanceRecord) error {
+	admin := adminUserFromInstanceID(instance.ID)
+	for _, stmt := range []string{
+		"CREATE USER IF NOT EXISTS " + admin,
+		fmt.Sprintf("ALTER USER %s WITH PASSWORD %s", admin, sqlString(instance.AdminPassword)),
+		"GRANT admin TO " + admin,
+	} {
+		if _, err := execWithRetry(bootstrap, stmt); err != nil {
+			return fmt.Errorf("creating admin user: %s", err)
+		}
+	}
+	return nil
+}
+
+// clusterKind describes the clusters of the plan's instances.
+func (p *Plan) clusterKind() string {
+	switch {
+	case p.Isolation == isolationDedicated:
+		return "dedicated cluster"
+	case p.sharesCloudCluster():
+		return "CockroachDB Cloud database"
+	case p.Isolation == isolationCloud:
+		return "CockroachDB Cloud cluster"
+	}
+	return "virtual cluster"
+}
+
+// clusterName returns the name of the cluster of an instance, or of its
+// database in the plan's shared Cloud cluster.
+func (p *Plan) clusterName(instanceID string) string {
+	switch {
+	case p.sharesCloudCluster():
+		return dbNameFromInstanceID(instanceID)
+	case p.Isolation == isolationCloud:
+		return cloudClusterNameFromInstanceID(instanceID)
+	}
+	return clusterNameFromInstanceID(instanceID)
+}
+
+// deprovisionCluster starts the operation dropping the cluster of an instance
+// that has one of its own. The caller holds the lease on the instance.
+func (sb *crdbServiceBroker) deprovisionCluster(
+	ctx context.Context, backend Backend, instance *instanceRecord, asyncAllowed bool,
+) (brokerapi.DeprovisionServiceSpec, error) {
+	if instance == nil {
+		// Without the record, the broker can't log into the cluster to check
+		// its deletion protection, so leave it to the operator.
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if instance.State == stateFailed {
+		// The cluster was dropped when provisioning failed.
+		if err := sb.state.DeleteInstance(instance.ID); err != nil {
+			log.Error("delete-instance", err)
+			return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("deleting instance: %s", err)
+		}
+		return brokerapi.DeprovisionServiceSpec{}, nil
+	}
+	if !asyncAllowed {
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+
+	desc, err := backend.Describe(ctx, instance)
+	if err != nil {
+		log.Error("read-database-comment", err)
+		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("checking deletion protection: %s", err)
+	}
+	if desc.Comment != nil && desc.Comment.DeletionProtection || instance.DeletionProtection {
+		return brokerapi.DeprovisionServiceSpec{}, errDeletionProtected
+	}
+
+	// Dropping the cluster ends its sessions, so there is no need to
+	// terminate them first.
+	instance.State = stateDeprovisioning
+	instance.OperationID = uuid.NewV4().String()
+	if err := sb.state.PutInstance(instance); err != nil {
+		log.Error("store-instance", err)
+		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("storing instance: %s", err)
+	}
+	if _, err := sb.startOperation(&operationRecord{
+		ID:         instance.OperationID,
+		InstanceID: instance.ID,
+		Type:       opDeprovision,
+	}); err != nil {
+		log.Error("start-operation", err)
+		instance.State = stateReady
+		if err := sb.state.PutInstance(instance); err != nil {
+			log.Error("store-instance", err)
+		}
+		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("starting operation: %s", err)
+	}
+	return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: instance.OperationID}, nil
+}
+
+// instanceOperationFunc returns the function carrying out the provision or
+// deprovision operation of an instance with a cluster of its own, or the
+// provision operation of an instance restored from a backup. If it fails, the
+// instance is marked failed (and its cluster dropped) or ready again,
+// respectively.
+func (sb *crdbServiceBroker) instanceOperationFunc(op *operationRecord) func() (string, error) {
+	return func() (string, error) {
+		instance, plan, err := sb.instancePlan(op.InstanceID)
+		if err != nil {
+			return "", err
+		}
+		name := plan.clusterName(op.InstanceID)
+		// Operations outlive the requests that start them.
+		ctx := context.Background()
+		backend := sb.backend(plan)
+		if op.Type == opProvision && op.BackupID != "" {
+			err = sb.restoreNewInstance(plan, instance, op)
+		} else if op.Type == opProvision && op.SourceInstanceID != "" {
+			err = sb.restoreTombstoneInstance(plan, instance, op)
+		} else if op.Type == opProvision {
+			err = backend.CreateInstance(ctx, instance, op.Comment)
+		} else if plan.deletionRetention > 0 {
+			// Keep the cluster around for a while in case this was a
+			// mistake.
+			err = backend.DeleteInstance(ctx, instance)
+		} else {
+			err = backend.DropInstance(ctx, instance)
+		}
+		if err != nil {
+			if err := sb.abortInstanceOperation(plan, instance, op, err.Error()); err != nil {
+				log.Error("abort-operation", err, lager.Data{"instance-id": op.InstanceID})
+			}
+			return "", err
+		}
+
+		if op.Type == opDeprovision {
+			if err := sb.state.DeleteInstance(op.InstanceID); err != nil {
+				return "", fmt.Errorf("deleting instance: %s", err)
+			}
+			if plan.deletionRetention > 0 {
+				return fmt.Sprintf("deleted %s %s, which can be restored for %s", plan.clusterKind(), name, plan.deletionRetention), nil
+			}
+			return fmt.Sprintf("dropped %s %s", plan.clusterKind(), name), nil
+		}
+		instance.State = stateReady
+		if err := sb.state.PutInstance(instance); err != nil {
+			return "", fmt.Errorf("storing instance: %s", err)
+		}
+		if op.BackupID != "" {
+			return fmt.Sprintf("restored backup %s of instance %s", op.BackupID, op.SourceInstanceID), nil
+		} else if op.SourceInstanceID != "" {
+			return fmt.Sprintf("restored deleted instance %s", op.SourceInstanceID), nil
+		}
+		return fmt.Sprintf("created %s %s", plan.clusterKind(), name), nil
+	}
+}
+
+// abortInstanceOperation gives up on the provision or deprovision operation
+// (op, if known) of an instance. An instance being provisioned is marked
+// failed, with the given reason, after dropping what was created of its
+// cluster or restored database, or returning the database it was restoring
+// from a deleted instance; an instance being deprovisioned is ready again.
+func (sb *crdbServiceBroker) abortInstanceOperation(
+	plan *Plan, instance *instanceRecord, op *operationRecord, reason string,
+) error {
+	switch instance.State {
+	case stateProvisioning:
+		backend := sb.backend(plan)
+		drop := func(instance *instanceRecord) error { return backend.DropInstance(context.Background(), instance) }
+		if op != nil && op.SourceInstanceID != "" && op.BackupID == "" {
+			drop = func(instance *instanceRecord) error {
+				return sb.returnTombstone(plan, instance, op.SourceInstanceID)
+			}
+		} else if !backend.Async() {
+			// Instances without a cluster of their own are only provisioned
+			// by an operation when they are restored.
+			drop = func(instance *instanceRecord) error { return dropRestoredInstance(plan, instance.ID) }
+		}
+		if err := drop(instance); err != nil {
+			return err
+		}
+		instance.State = stateFailed
+		instance.FailureReason = reason
+	case stateDeprovisioning:
+		instance.State = stateReady
+	default:
+		return nil
+	}
+	return sb.state.PutInstance(instance)
+}
+
+// recoverInstanceOperation aborts the operation of an instance being
+// provisioned or deprovisioned if the operation is over without having
+// finished its work, i.e. if the broker gave up on it.
+func (sb *crdbServiceBroker) recoverInstanceOperation(instanceID string) error {
+	instance, plan, err := sb.instancePlan(instanceID)
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if instance.State != stateProvisioning && instance.State != stateDeprovisioning {
+		return nil
+	}
+	op, err := sb.state.Operation(instanceID, instance.OperationID)
+	reason := interruptedProvisionReason
+	if err == nil {
+		if op.State == brokerapi.InProgress {
+			return nil
+		}
+		reason = op.Description
+	} else if err != errStateNotFound {
+		return err
+	}
+	log.Info("interrupted-operation", lager.Data{"instance-id": instanceID, "state": instance.State})
+	return sb.abortInstanceOperation(plan, instance, op, reason)
+}
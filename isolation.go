@@ -0,0 +1,293 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+)
+
+// Isolation modes of plans.
+const (
+	// isolationDatabase gives each instance a database of its own.
+	isolationDatabase = "database"
+	// isolationSchema gives each instance a schema in a database shared by
+	// the plan's instances, which is much cheaper for small instances.
+	isolationSchema = "schema"
+	// isolationTenant gives each instance a virtual cluster of its own.
+	isolationTenant = "tenant"
+	// isolationDedicated gives each instance a CockroachDB cluster of its
+	// own, created on Kubernetes.
+	isolationDedicated = "dedicated"
+	// isolationCloud gives each instance a CockroachDB Cloud cluster of its
+	// own, or a database in an existing one, created through the Cloud API.
+	isolationCloud = "cloud"
+)
+
+// schemaPrivileges maps each binding role to the privileges granted on the
+// instance's schema under schema isolation.
+var schemaPrivileges = map[string]string{
+	roleReadWrite: "ALL",
+	roleReadOnly:  "USAGE",
+}
+
+// instanceNamespace is where the objects of an instance live: a database of
+// its own, or a schema of the database shared by its plan's instances.
+type instanceNamespace struct {
+	database string
+	// schema is empty for instances with a database of their own.
+	schema string
+}
+
+// clusterPerInstance returns whether the plan gives each instance a cluster
+// of its own (virtual, dedicated or in CockroachDB Cloud) that the broker
+// logs into as a user of the instance's. Those take a while to create, so
+// they are created and dropped by operations; see instanceOperationFunc.
+// Plans with a shared Cloud cluster count too: their instances get a
+// database in it, along with the broker's user.
+func (p *Plan) clusterPerInstance() bool {
+	return p.Isolation == isolationTenant || p.Isolation == isolationDedicated || p.Isolation == isolationCloud
+}
+
+// usesPlanCluster returns whether the plan's instances live on the cluster
+// at CRDBHost, which the broker connects to as CRDBAdminUser. The clusters
+// of plans with dedicated or cloud isolation are created and reached through
+// an API instead.
+func (p *Plan) usesPlanCluster() bool {
+	return p.Isolation != isolationDedicated && p.Isolation != isolationCloud
+}
+
+// sharesCloudCluster returns whether the plan gives each instance a database
+// in the plan's CockroachDB Cloud cluster, where the instance's admin user
+// only manages that database; see restrictCloudAdmin.
+func (p *Plan) sharesCloudCluster() bool {
+	return p.Isolation == isolationCloud && p.Cloud.ClusterID != ""
+}
+
+// databasePerInstance returns whether the plan gives each instance a database
+// of its own on the plan's cluster, which restores need.
+func (p *Plan) databasePerInstance() bool {
+	return p.Isolation != isolationSchema && !p.clusterPerInstance()
+}
+
+// namespace returns the namespace of an instance of the plan.
+func (p *Plan) namespace(instanceID string) instanceNamespace {
+	if p.sharesCloudCluster() {
+		return instanceNamespace{database: dbNameFromInstanceID(instanceID)}
+	}
+	if p.clusterPerInstance() {
+		// The database is in the instance's cluster; see instanceDB.
+		return instanceNamespace{database: clusterDatabase}
+	}
+	if p.Isolation == isolationSchema {
+		return instanceNamespace{
+			database: sharedDBNameFromPlanID(p.ID),
+			schema:   schemaNameFromInstanceID(instanceID),
+		}
+	}
+	return instanceNamespace{database: dbNameFromInstanceID(instanceID)}
+}
+
+// instanceConn returns the connection parameters, without user and password,
+// of the namespace of an instance of the plan: on the plan's cluster, or on
+// the instance's own virtual, dedicated or Cloud cluster.
+func (p *Plan) instanceConn(instance *instanceRecord) connParams {
+	options := make(url.Values)
+	options.Add("sslmode", "require")
+	conn := connParams{p.CRDBHost, p.CRDBPort, "" /* user */, "" /* pass */, p.namespace(instance.ID).database, options}
+	switch p.Isolation {
+	case isolationTenant:
+		conn.options = tenantOptions(clusterNameFromInstanceID(instance.ID))
+	case isolationDedicated:
+		conn.host, conn.port = p.Kubernetes.host(clusterNameFromInstanceID(instance.ID)), dedicatedSQLPort
+	case isolationCloud:
+		// Cloud clusters have certificates signed by public CAs.
+		conn.host, conn.port = instance.ClusterHost, instance.ClusterPort
+		conn.options = url.Values{"sslmode": {"verify-full"}}
+	}
+	return conn
+}
+
+// String returns the qualified name of the namespace.
+func (ns instanceNamespace) String() string {
+	if ns.schema == "" {
+		return ns.database
+	}
+	return ns.database + "." + ns.schema
+}
+
+// object returns the namespace as COMMENT ON refers to it.
+func (ns instanceNamespace) object() string {
+	if ns.schema == "" {
+		return "DATABASE " + ns.database
+	}
+	return "SCHEMA " + ns.String()
+}
+
+// create creates the namespace, and the shared database if needed, and
+// comments it with c. It fails with an already-exists error if the namespace
+// exists.
+//
+// The namespace is created and commented in one transaction, which can't be
+// repeated blindly: if its result is lost with the connection, the comment
+// tells whether it committed, as a namespace commented with c (down to its
+// creation time) can only be the one this call created.
+func (ns instanceNamespace) create(crdb *sql.DB, c *instanceComment) error {
+	if ns.schema != "" {
+		if _, err := execWithRetry(crdb, "CREATE DATABASE IF NOT EXISTS "+ns.database); err != nil {
+			return err
+		}
+		// Bindings can only create objects in their instance's schema.
+		if _, err := execWithRetry(crdb,
+			fmt.Sprintf("REVOKE CREATE ON SCHEMA %s.public FROM public", ns.database),
+		); err != nil {
+			return err
+		}
+	}
+	err := withSafeRetry(func() error { return ns.createTx(crdb, c) })
+	if !isAmbiguous(err) {
+		return err
+	}
+	existing, cerr := databaseComment(crdb, ns)
+	if cerr != nil {
+		log.Error("check-created-namespace", cerr)
+		return err
+	}
+	if existing != nil && sameComment(existing, c) {
+		return nil
+	}
+	return err
+}
+
+func (ns instanceNamespace) createTx(crdb *sql.DB, c *instanceComment) error {
+	tx, err := crdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	stmt := "CREATE DATABASE " + ns.database
+	if ns.schema != "" {
+		stmt = "CREATE SCHEMA " + ns.String()
+	}
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+	if c != nil {
+		if err := setDatabaseComment(tx, ns, c); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// drop drops the namespace and everything in it, if it exists. The shared
+// database is left alone.
+func (ns instanceNamespace) drop(crdb execer) error {
+	if ns.schema == "" {
+		_, err := execWithRetry(crdb, "DROP DATABASE IF EXISTS "+ns.database+" CASCADE")
+		return err
+	}
+	_, err := execWithRetry(crdb, "DROP SCHEMA IF EXISTS "+ns.String()+" CASCADE")
+	if isNotFound(err, objectDatabase) {
+		return nil
+	}
+	return err
+}
+
+// isNotFound returns whether err says that the namespace doesn't exist.
+func (ns instanceNamespace) isNotFound(err error) bool {
+	return isNotFound(err, objectDatabase) || ns.schema != "" && isNotFound(err, objectSchema)
+}
+
+// grantRole grants the privileges of the given role on the namespace and all
+// its tables to user.
+func (ns instanceNamespace) grantRole(crdb *sql.DB, user, role string) error {
+	if err := ns.grant(crdb, user, role); err != nil {
+		return err
+	}
+	return ns.grantTables(crdb, user, role)
+}
+
+// grant grants the privileges of the given role on the namespace to user.
+// Under schema isolation, it also makes the schema the user's search path,
+// so that the app doesn't need to qualify its tables.
+func (ns instanceNamespace) grant(crdb *sql.DB, user, role string) error {
+	if ns.schema == "" {
+		return grantDatabase(crdb, ns.database, user, role)
+	}
+	if _, err := execWithRetry(crdb,
+		fmt.Sprintf("GRANT %s ON SCHEMA %s TO %s", schemaPrivileges[role], ns, user),
+	); err != nil {
+		return err
+	}
+	_, err := execWithRetry(crdb, fmt.Sprintf("ALTER ROLE %s SET search_path = %s", user, sqlString(ns.schema)))
+	return err
+}
+
+// grantTables grants the privileges of the given role on all the tables of
+// the namespace to user, and on the ones created later.
+func (ns instanceNamespace) grantTables(crdb *sql.DB, user, role string) error {
+	if ns.schema == "" {
+		return grantTables(crdb, ns.database, user, role)
+	}
+	_, err := execWithRetry(crdb,
+		fmt.Sprintf("GRANT %s ON ALL TABLES IN SCHEMA %s TO %s", bindingRoles[role], ns, user),
+	)
+	if err := ignoreNoObjectMatched(crdb, err, user); err != nil {
+		return err
+	}
+	return grantDefaultPrivileges(crdb, ns.String(), user, role)
+}
+
+// revoke revokes all privileges on the namespace from user. A user or
+// namespace that doesn't exist has no privileges to revoke.
+func (ns instanceNamespace) revoke(crdb *sql.DB, user string) error {
+	if ns.schema == "" {
+		return revokeDatabase(crdb, ns.database, user)
+	}
+	if _, err := execWithRetry(crdb, fmt.Sprintf("REVOKE ALL ON SCHEMA %s FROM %s", ns, user)); err != nil {
+		if isNotFound(err, objectRole) || ns.isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("revoking grants from schema for user: %s", err)
+	}
+	return nil
+}
+
+// revokeTables revokes all privileges on the tables of the namespace, and on
+// the ones created later, from user.
+func (ns instanceNamespace) revokeTables(crdb *sql.DB, user string) error {
+	if ns.schema == "" {
+		return revokeTables(crdb, ns.database, user)
+	}
+	if _, err := execWithRetry(crdb,
+		fmt.Sprintf("REVOKE ALL ON ALL TABLES IN SCHEMA %s FROM %s", ns, user),
+	); err != nil {
+		if isNotFound(err, objectRole) || ns.isNotFound(err) {
+			return nil
+		}
+		if !isNoObjectMatched(err) {
+			return fmt.Errorf("revoking grants from tables for user: %s", err)
+		}
+	}
+	if err := revokeDefaultPrivileges(crdb, ns.String(), user); err != nil {
+		if isNotFound(err, objectRole) || ns.isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("revoking default privileges for user: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestSchemaIsolation(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.Isolation = isolationSchema
+	ctx := context.Background()
+	sharedDB := sharedDBNameFromPlanID(b.plan.ID)
+	inst1 := sharedDB + "." + schemaNameFromInstanceID("inst1")
+	inst2 := sharedDB + "." + schemaNameFromInstanceID("inst2")
+
+	for _, id := range []string{"inst1", "inst2"} {
+		if _, err := b.sb.Provision(ctx, id, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !b.cluster.databases[sharedDB] || !b.cluster.schemas[inst1] || !b.cluster.schemas[inst2] {
+		t.Fatalf("expected schemas %s and %s, got %v", inst1, inst2, b.cluster.schemas)
+	}
+	if b.cluster.databases[dbNameFromInstanceID("inst1")] {
+		t.Error("instance database created")
+	}
+	c, err := databaseComment(b.plan.crdb, b.plan.namespace("inst1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.InstanceID != "inst1" {
+		t.Errorf("unexpected schema comment %+v", c)
+	}
+
+	// Provisioning an instance whose schema exists fails.
+	if _, err := b.sb.Provision(ctx, "inst3", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sb.state.DeleteInstance("inst3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Provision(ctx, "inst3", b.provisionDetails(""), false); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Errorf("expected %v, got %v", brokerapi.ErrInstanceAlreadyExists, err)
+	}
+
+	binding, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := binding.Credentials.(map[string]interface{})
+	user := userNameFromBinding("inst1", "bind1")
+	if creds["database"] != sharedDB || creds["schema"] != schemaNameFromInstanceID("inst1") {
+		t.Errorf("unexpected credentials %v", creds)
+	}
+	if role := b.cluster.grants[inst1][user]; role != "ALL" {
+		t.Errorf("expected ALL on %s, got %q", inst1, role)
+	}
+
+	// The binding's tables are created in its instance's schema.
+	db, err := sql.Open("fakecrdb", fmt.Sprintf("%s/%s/%s", b.cluster.name, sharedDB, user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE t (value STRING PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, ok := b.cluster.tables[inst1]["t"]; !ok {
+		t.Errorf("expected table t in %s, got %v", inst1, b.cluster.tables)
+	}
+
+	if err := b.sb.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.hasUser(user) {
+		t.Error("user not dropped")
+	}
+	if owner := b.cluster.owners[inst1]["t"]; owner != ownerRoleFromInstanceID("inst1") {
+		t.Errorf("expected table t to be owned by the owner role, got %q", owner)
+	}
+
+	// The broker loses its state; the instances are rebuilt from the schema
+	// comments.
+	b.sb.state = newBrokerState(newMemKVStore())
+	res, err := b.sb.rebuildState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"inst1", "inst2", "inst3"}; !reflect.DeepEqual(res.Instances, expected) {
+		t.Errorf("expected rebuilt instances %v, got %v", expected, res.Instances)
+	}
+	orphans, err := b.sb.findOrphans(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("unexpected orphans %v", orphans)
+	}
+
+	if _, err := b.sb.Deprovision(ctx, "inst1", brokerapi.DeprovisionDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.schemas[inst1] || b.cluster.tables[inst1] != nil {
+		t.Error("schema not dropped")
+	}
+	if !b.cluster.databases[sharedDB] || !b.cluster.schemas[inst2] {
+		t.Error("other instances dropped")
+	}
+	if b.cluster.hasUser(ownerRoleFromInstanceID("inst1")) {
+		t.Error("owner role not dropped")
+	}
+}
+
+func TestSchemaIsolationRejectsRegions(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	useRegions(b, regionConfig{})
+	b.plan.Isolation = isolationSchema
+
+	_, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(`{"primary_region": "us-east1"}`), false)
+	if status := statusCode(err); status != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d (%v)", http.StatusBadRequest, status, err)
+	}
+	if len(b.cluster.schemas) != 0 {
+		t.Errorf("schemas created: %v", b.cluster.schemas)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// kubeManager is the app.kubernetes.io/managed-by label of the objects the
+// broker creates.
+const kubeManager = "cockroachdb-service-broker"
+
+// crdbClusterResource is the resource of the CockroachDB operator's
+// CrdbClusters, which client-go has no types for.
+var crdbClusterResource = schema.GroupVersionResource{
+	Group: "crdb.cockroachlabs.com", Version: "v1alpha1", Resource: "crdbclusters",
+}
+
+// Defaults of kubernetesConfig.
+const (
+	defaultDedicatedNodes        = 3
+	defaultDedicatedStorageSize  = "10Gi"
+	defaultDedicatedReadyTimeout = 15 * time.Minute
+)
+
+// kubernetesConfig is the configuration of a plan with dedicated isolation,
+// whose instances get a CockroachDB cluster of their own on Kubernetes.
+type kubernetesConfig struct {
+	// APIServer is the URL of the Kubernetes API server, which the broker
+	// authenticates to with the bearer token in TokenFile and whose
+	// certificate is checked against the CA in CAFile, if set. If APIServer
+	// is empty, the broker uses the cluster it runs on and its service
+	// account.
+	APIServer string `json:"apiServer,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+	CAFile    string `json:"caFile,omitempty"`
+	// Namespace is where the instances' clusters are created. The broker
+	// needs to manage StatefulSets, Services, Secrets, Jobs and
+	// PersistentVolumeClaims there, or CrdbClusters with Operator.
+	Namespace string `json:"namespace"`
+	// Operator makes the broker create CrdbCluster resources for the
+	// CockroachDB operator, which must be installed, instead of StatefulSets
+	// and their Services.
+	Operator bool `json:"operator,omitempty"`
+	// Image is the CockroachDB image, e.g. cockroachdb/cockroach:v23.1.11.
+	Image string `json:"image"`
+	// Nodes is the number of nodes of each cluster. Defaults to
+	// defaultDedicatedNodes.
+	Nodes int `json:"nodes,omitempty"`
+	// StorageSize is the size of each node's volume, e.g. "100Gi", and
+	// StorageClass its storage class (the namespace's default if empty).
+	StorageSize  string `json:"storageSize,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	// ReadyTimeout is how long a new cluster may take to be ready, e.g.
+	// "30m". Defaults to defaultDedicatedReadyTimeout.
+	ReadyTimeout string `json:"readyTimeout,omitempty"`
+
+	readyTimeout time.Duration
+}
+
+func (c *kubernetesConfig) validate() error {
+	if c.Namespace == "" {
+		return errors.New("kubernetes namespace required")
+	}
+	if c.Image == "" {
+		return errors.New("kubernetes image required")
+	}
+	if c.Nodes < 0 {
+		return errors.New("kubernetes nodes cannot be negative")
+	}
+	if c.Nodes == 0 {
+		c.Nodes = defaultDedicatedNodes
+	}
+	if c.StorageSize == "" {
+		c.StorageSize = defaultDedicatedStorageSize
+	}
+	if _, err := resource.ParseQuantity(c.StorageSize); err != nil {
+		return fmt.Errorf("invalid kubernetes storageSize: %s", err)
+	}
+	c.readyTimeout = defaultDedicatedReadyTimeout
+	if c.ReadyTimeout != "" {
+		d, err := time.ParseDuration(c.ReadyTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid kubernetes readyTimeout: %s", err)
+		}
+		c.readyTimeout = d
+	}
+	return nil
+}
+
+// kubeClient creates and deletes the objects of dedicated clusters in the
+// namespace of a plan: the built-in kinds through the typed clientset, and
+// CrdbClusters through the dynamic client.
+type kubeClient struct {
+	namespace string
+	core      kubernetes.Interface
+	dynamic   dynamic.Interface
+}
+
+func newKubeClient(c *kubernetesConfig) (*kubeClient, error) {
+	config, err := kubeRESTConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	core, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeClient{namespace: c.Namespace, core: core, dynamic: dyn}, nil
+}
+
+// kubeRESTConfig returns the client configuration of a plan's Kubernetes
+// cluster: the one the broker runs on, with its service account, if the plan
+// has no APIServer.
+func kubeRESTConfig(c *kubernetesConfig) (*rest.Config, error) {
+	if c.APIServer == "" {
+		config, err := rest.InClusterConfig()
+		if err == rest.ErrNotInCluster {
+			return nil, errors.New("kubernetes apiServer required when not running on Kubernetes")
+		} else if err != nil {
+			return nil, fmt.Errorf("reading kubernetes service account: %s", err)
+		}
+		config.Timeout = 30 * time.Second
+		return config, nil
+	}
+	config := &rest.Config{
+		Host:            c.APIServer,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: c.CAFile},
+		Timeout:         30 * time.Second,
+	}
+	if c.TokenFile != "" {
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &tokenFileTransport{file: c.TokenFile, base: rt}
+		}
+	}
+	return config, nil
+}
+
+// tokenFileTransport authenticates requests with the bearer token in a file.
+// Service account tokens are rotated, so it reads the token every time.
+type tokenFileTransport struct {
+	file string
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubernetes token: %s", err)
+	}
+	// Round trippers must not modify the request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return t.base.RoundTrip(r)
+}
+
+// create creates an object, unless it exists already, e.g. because an
+// interrupted operation created it; existing objects are left as they are.
+func (k *kubeClient) create(obj runtime.Object) error {
+	var kind, name string
+	var err error
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		kind, name = "Secret", o.Name
+		_, err = k.core.CoreV1().Secrets(k.namespace).Create(o)
+	case *corev1.Service:
+		kind, name = "Service", o.Name
+		_, err = k.core.CoreV1().Services(k.namespace).Create(o)
+	case *appsv1.StatefulSet:
+		kind, name = "StatefulSet", o.Name
+		_, err = k.core.AppsV1().StatefulSets(k.namespace).Create(o)
+	case *batchv1.Job:
+		kind, name = "Job", o.Name
+		_, err = k.core.BatchV1().Jobs(k.namespace).Create(o)
+	case *unstructured.Unstructured:
+		kind, name = o.GetKind(), o.GetName()
+		_, err = k.dynamic.Resource(crdbClusterResource).Namespace(k.namespace).Create(o, metav1.CreateOptions{})
+	default:
+		return fmt.Errorf("unsupported kubernetes object %T", obj)
+	}
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating %s %s: %s", kind, name, err)
+	}
+	return nil
+}
+
+// secret returns a Secret, or an error for which apierrors.IsNotFound is
+// true.
+func (k *kubeClient) secret(name string) (*corev1.Secret, error) {
+	return k.core.CoreV1().Secrets(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+// statefulSet returns a StatefulSet, or an error for which
+// apierrors.IsNotFound is true.
+func (k *kubeClient) statefulSet(name string) (*appsv1.StatefulSet, error) {
+	return k.core.AppsV1().StatefulSets(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+// job returns a Job, or an error for which apierrors.IsNotFound is true.
+func (k *kubeClient) job(name string) (*batchv1.Job, error) {
+	return k.core.BatchV1().Jobs(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+// crdbCluster returns a CrdbCluster, or an error for which
+// apierrors.IsNotFound is true.
+func (k *kubeClient) crdbCluster(name string) (*unstructured.Unstructured, error) {
+	return k.dynamic.Resource(crdbClusterResource).Namespace(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+// delete deletes an object of the given kind, along with its dependents.
+// Objects that don't exist are ignored.
+func (k *kubeClient) delete(kind, name string) error {
+	policy := metav1.DeletePropagationBackground
+	options := &metav1.DeleteOptions{PropagationPolicy: &policy}
+	var err error
+	switch kind {
+	case "Secret":
+		err = k.core.CoreV1().Secrets(k.namespace).Delete(name, options)
+	case "Service":
+		err = k.core.CoreV1().Services(k.namespace).Delete(name, options)
+	case "PersistentVolumeClaim":
+		err = k.core.CoreV1().PersistentVolumeClaims(k.namespace).Delete(name, options)
+	case "StatefulSet":
+		err = k.core.AppsV1().StatefulSets(k.namespace).Delete(name, options)
+	case "Job":
+		err = k.core.BatchV1().Jobs(k.namespace).Delete(name, options)
+	case "CrdbCluster":
+		err = k.dynamic.Resource(crdbClusterResource).Namespace(k.namespace).Delete(name, options)
+	default:
+		return fmt.Errorf("unsupported kubernetes kind %s", kind)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting %s %s: %s", kind, name, err)
+	}
+	return nil
+}
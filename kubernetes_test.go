@@ -0,0 +1,449 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+// fakeKube is a fake Kubernetes cluster made of client-go's fake clientsets.
+// Its reactors play the part of the controllers too: StatefulSets get ready
+// (registering a fake cluster for their public Service), initialization
+// Jobs succeed and CrdbClusters get a StatefulSet and a root certificate.
+type fakeKube struct {
+	core    *fake.Clientset
+	dynamic *dynamicfake.FakeDynamicClient
+	// tracker stores the objects of the typed clientset, and crdbClusters
+	// the CrdbClusters, keyed by name.
+	tracker      kubetesting.ObjectTracker
+	crdbClusters map[string]*unstructured.Unstructured
+
+	mu sync.Mutex
+	// clusters maps the hosts of public Services to the fake clusters
+	// standing in for the dedicated clusters.
+	clusters map[string]*fakeCluster
+	// stuck keeps StatefulSets, Jobs and CrdbClusters from getting ready.
+	stuck bool
+}
+
+func newFakeKube() *fakeKube {
+	k := &fakeKube{
+		core:         fake.NewSimpleClientset(),
+		dynamic:      dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		tracker:      kubetesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder()),
+		crdbClusters: make(map[string]*unstructured.Unstructured),
+		clusters:     make(map[string]*fakeCluster),
+	}
+	// The fake clientsets don't let reactors reach their trackers, so the
+	// typed one gets a tracker of ours. Reactors get copies of the actions,
+	// whose objects they may change before storing them.
+	k.core.PrependReactor("*", "*", k.react)
+	k.dynamic.PrependReactor("*", "crdbclusters", k.reactCrdbCluster)
+	return k
+}
+
+// client returns a kubeClient for the crdb namespace of the fake.
+func (k *fakeKube) client() *kubeClient {
+	return &kubeClient{namespace: "crdb", core: k.core, dynamic: k.dynamic}
+}
+
+// useDedicated sets up the plan for dedicated isolation on the fake. The
+// returned function restores the package's variables.
+func (k *fakeKube) useDedicated(t *testing.T, plan *Plan, operator bool) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fakekube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan.Isolation = isolationDedicated
+	plan.Kubernetes = &kubernetesConfig{
+		Namespace: "crdb",
+		Operator:  operator,
+		Image:     "cockroachdb/cockroach:v23.1.11",
+	}
+	if err := plan.Kubernetes.validate(); err != nil {
+		t.Fatal(err)
+	}
+	plan.kube = k.client()
+
+	oldConnect, oldInterval, oldCertsDir := instanceConnect, dedicatedPollInterval, dedicatedCertsDir
+	instanceConnect = k.connect
+	dedicatedPollInterval = 0
+	dedicatedCertsDir = filepath.Join(dir, "certs")
+	return func() {
+		instanceConnect, dedicatedPollInterval, dedicatedCertsDir = oldConnect, oldInterval, oldCertsDir
+		os.RemoveAll(dir)
+	}
+}
+
+// connect opens a connection to the fake cluster of the URI's host. Root
+// connections must use the root certificate, which must have been written.
+func (k *fakeKube) connect(uri string) (*sql.DB, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	c, ok := k.clusters[u.Hostname()]
+	k.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fakekube: no cluster at %s", u.Hostname())
+	}
+	user := u.User.Username()
+	if user == "root" {
+		q := u.Query()
+		if q.Get("sslmode") != "verify-full" {
+			return nil, fmt.Errorf("fakekube: root connection with sslmode %q", q.Get("sslmode"))
+		}
+		for _, param := range []string{"sslrootcert", "sslcert", "sslkey"} {
+			if _, err := os.Stat(q.Get(param)); err != nil {
+				return nil, fmt.Errorf("fakekube: %s: %s", param, err)
+			}
+		}
+	} else if _, ok := u.User.Password(); !ok {
+		return nil, fmt.Errorf("fakekube: no password for %s", user)
+	}
+	return sql.Open("fakecrdb", fmt.Sprintf("%s%s/%s", c.name, u.Path, user))
+}
+
+// fakeKubeResources are the resources of the typed clientset that names
+// lists, along with their kinds.
+var fakeKubeResources = map[string]schema.GroupVersionKind{
+	"jobs":                   batchv1.SchemeGroupVersion.WithKind("Job"),
+	"persistentvolumeclaims": corev1.SchemeGroupVersion.WithKind("PersistentVolumeClaim"),
+	"secrets":                corev1.SchemeGroupVersion.WithKind("Secret"),
+	"services":               corev1.SchemeGroupVersion.WithKind("Service"),
+	"statefulsets":           appsv1.SchemeGroupVersion.WithKind("StatefulSet"),
+}
+
+// names returns the sorted namespace/plural/name keys of the stored objects.
+func (k *fakeKube) names(t *testing.T) []string {
+	t.Helper()
+	var names []string
+	for plural, gvk := range fakeKubeResources {
+		list, err := k.tracker.List(gvk.GroupVersion().WithResource(plural), gvk, "crdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs, err := meta.ExtractList(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objs {
+			o, err := meta.Accessor(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, o.GetNamespace()+"/"+plural+"/"+o.GetName())
+		}
+	}
+	k.mu.Lock()
+	for name := range k.crdbClusters {
+		names = append(names, "crdb/crdbclusters/"+name)
+	}
+	k.mu.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// react plays the controllers' part for the objects created through the
+// typed clientset, then lets the tracker handle the action.
+func (k *fakeKube) react(action kubetesting.Action) (bool, runtime.Object, error) {
+	if a, ok := action.(kubetesting.CreateActionImpl); ok {
+		switch o := a.GetObject().(type) {
+		case *appsv1.StatefulSet:
+			if err := k.startStatefulSet(o); err != nil {
+				return true, nil, err
+			}
+		case *batchv1.Job:
+			if !k.stuck {
+				o.Status.Succeeded = 1
+			}
+		}
+	}
+	return kubetesting.ObjectReaction(k.tracker)(action)
+}
+
+// startStatefulSet registers a fake cluster for the public Service of a
+// StatefulSet, adds the volumes of its replicas and makes them ready, unless
+// k.stuck.
+func (k *fakeKube) startStatefulSet(sts *appsv1.StatefulSet) error {
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	host := fmt.Sprintf("%s-public.%s.svc", sts.Name, sts.Namespace)
+	k.mu.Lock()
+	if _, ok := k.clusters[host]; !ok {
+		k.clusters[host] = registerFakeCluster()
+	}
+	k.mu.Unlock()
+	for i := int32(0); i < replicas; i++ {
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("datadir-%s-%d", sts.Name, i), Namespace: sts.Namespace,
+		}}
+		if err := k.tracker.Add(pvc); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	if !k.stuck {
+		sts.Status.ReadyReplicas = replicas
+	}
+	return nil
+}
+
+// reactCrdbCluster stores the CrdbClusters and plays the operator's part:
+// it creates their StatefulSet and root certificate, and deletes them along
+// with the CrdbCluster.
+func (k *fakeKube) reactCrdbCluster(action kubetesting.Action) (bool, runtime.Object, error) {
+	gr := crdbClusterResource.GroupResource()
+	// As in kubetesting.ObjectReaction, the actions' implementations tell
+	// them apart: a DeleteAction is a GetAction too.
+	switch a := action.(type) {
+	case kubetesting.CreateActionImpl:
+		obj := a.GetObject().(*unstructured.Unstructured)
+		name, namespace := obj.GetName(), obj.GetNamespace()
+		k.mu.Lock()
+		_, exists := k.crdbClusters[name]
+		k.mu.Unlock()
+		if exists {
+			return true, nil, apierrors.NewAlreadyExists(gr, name)
+		}
+		if !k.stuck {
+			conditions := []interface{}{
+				map[string]interface{}{"type": "Initialized", "status": "True"},
+			}
+			if err := unstructured.SetNestedSlice(obj.Object, conditions, "status", "conditions"); err != nil {
+				return true, nil, err
+			}
+		}
+		nodes, _, _ := unstructured.NestedInt64(obj.Object, "spec", "nodes")
+		replicas := int32(nodes)
+		sts := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		}
+		if err := k.startStatefulSet(sts); err != nil {
+			return true, nil, err
+		}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-root", Namespace: namespace},
+			Data: map[string][]byte{
+				"ca.crt": []byte("ca"), "tls.crt": []byte("cert"), "tls.key": []byte("key"),
+			},
+		}
+		for _, o := range []runtime.Object{sts, secret} {
+			if err := k.tracker.Add(o); err != nil {
+				return true, nil, err
+			}
+		}
+		k.mu.Lock()
+		k.crdbClusters[name] = obj
+		k.mu.Unlock()
+		return true, obj.DeepCopy(), nil
+	case kubetesting.GetActionImpl:
+		k.mu.Lock()
+		obj, ok := k.crdbClusters[a.GetName()]
+		k.mu.Unlock()
+		if !ok {
+			return true, nil, apierrors.NewNotFound(gr, a.GetName())
+		}
+		return true, obj.DeepCopy(), nil
+	case kubetesting.DeleteActionImpl:
+		name := a.GetName()
+		k.mu.Lock()
+		_, ok := k.crdbClusters[name]
+		delete(k.crdbClusters, name)
+		k.mu.Unlock()
+		if !ok {
+			return true, nil, apierrors.NewNotFound(gr, name)
+		}
+		// The operator's objects are dependents of the CrdbCluster.
+		_ = k.tracker.Delete(appsv1.SchemeGroupVersion.WithResource("statefulsets"), a.GetNamespace(), name)
+		_ = k.tracker.Delete(corev1.SchemeGroupVersion.WithResource("secrets"), a.GetNamespace(), name+"-root")
+		return true, nil, nil
+	}
+	return false, nil, nil
+}
+
+func TestKubeClient(t *testing.T) {
+	k := newFakeKube()
+	client := k.client()
+
+	if _, err := client.secret("s1"); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "crdb"},
+		Data:       map[string][]byte{"key": []byte("value")},
+	}
+	if err := client.create(secret); err != nil {
+		t.Fatal(err)
+	}
+	// Creating is idempotent and leaves existing objects as they are.
+	if err := client.create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "crdb"},
+		Data:       map[string][]byte{"key": []byte("other")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.secret("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data["key"]) != "value" {
+		t.Errorf("unexpected secret %v", got)
+	}
+
+	replicas := int32(2)
+	if err := client.create(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "crdb"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sts, err := client.statefulSet("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sts.Status.ReadyReplicas != 2 {
+		t.Errorf("expected 2 ready replicas, got %d", sts.Status.ReadyReplicas)
+	}
+
+	if err := client.delete("Secret", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting is idempotent.
+	if err := client.delete("Secret", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.secret("s1"); !apierrors.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if err := client.delete("Pod", "s1"); err == nil || !strings.Contains(err.Error(), "unsupported kubernetes kind") {
+		t.Errorf("expected an unsupported kind error, got %v", err)
+	}
+
+	// Errors other than conflicts carry the API server's.
+	k.core.PrependReactor("create", "services", func(kubetesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("services"), "s1", fmt.Errorf("denied"))
+	})
+	err = client.create(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "crdb"}})
+	if err == nil || !strings.Contains(err.Error(), "creating Service s1") || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("expected a forbidden error, got %v", err)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestTokenFileTransport checks that rotated tokens are picked up and that
+// the caller's request is left alone.
+func TestTokenFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubetoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	var auth string
+	transport := &tokenFileTransport{file: file, base: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		auth = r.Header.Get("Authorization")
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})}
+
+	for _, token := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", "https://kube/api", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if auth != "Bearer "+token {
+			t.Errorf("expected token %s, got %q", token, auth)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Error("the request was modified")
+		}
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://kube/api", nil)
+	if _, err := transport.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "reading kubernetes token") {
+		t.Errorf("expected a token error, got %v", err)
+	}
+}
+
+func TestKubernetesConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config kubernetesConfig
+		err    string
+	}{
+		{"defaults", kubernetesConfig{Namespace: "crdb", Image: "img"}, ""},
+		{"no namespace", kubernetesConfig{Image: "img"}, "namespace required"},
+		{"no image", kubernetesConfig{Namespace: "crdb"}, "image required"},
+		{"negative nodes", kubernetesConfig{Namespace: "crdb", Image: "img", Nodes: -1}, "cannot be negative"},
+		{"bad timeout", kubernetesConfig{Namespace: "crdb", Image: "img", ReadyTimeout: "soon"}, "invalid kubernetes readyTimeout"},
+		{"bad storage size", kubernetesConfig{Namespace: "crdb", Image: "img", StorageSize: "10 gigs"}, "invalid kubernetes storageSize"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.config.Nodes != defaultDedicatedNodes || tc.config.StorageSize != defaultDedicatedStorageSize ||
+					tc.config.readyTimeout != defaultDedicatedReadyTimeout {
+					t.Errorf("defaults not set: %+v", tc.config)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
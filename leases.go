@@ -0,0 +1,162 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/dchest/uniuri"
+)
+
+// defaultLeaseTimeout is how long a lease lasts. Leases are released when
+// the request holding them finishes, so this only matters if a broker dies
+// in the middle of a request.
+const defaultLeaseTimeout = 5 * time.Minute
+
+// errLeaseHeld is returned by leaser.Acquire when someone else holds the
+// lease.
+var errLeaseHeld = errors.New("lease held by another request")
+
+// leaser hands out exclusive leases, which the broker uses to keep requests
+// for the same instance from running concurrently, to keep track of who runs
+// asynchronous operations and to pick the replica that runs periodic tasks.
+// Leases expire after a timeout, so that the leases of brokers that died are
+// reclaimed.
+type leaser interface {
+	// Acquire takes the lease on key for holder, until ttl from now. It fails
+	// with errLeaseHeld if another holder has a lease that hasn't expired.
+	Acquire(key, holder string, ttl time.Duration) error
+	// Release gives up the lease on key if holder still holds it.
+	Release(key, holder string) error
+}
+
+// memLeaser is an in-memory leaser, for brokers that keep their state in
+// memory.
+type memLeaser struct {
+	mu     sync.Mutex
+	leases map[string]memLease
+}
+
+type memLease struct {
+	holder  string
+	expires time.Time
+}
+
+func newMemLeaser() *memLeaser {
+	return &memLeaser{leases: make(map[string]memLease)}
+}
+
+// Acquire is part of the leaser interface.
+func (m *memLeaser) Acquire(key, holder string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if l, ok := m.leases[key]; ok && l.holder != holder && now.Before(l.expires) {
+		return errLeaseHeld
+	}
+	m.leases[key] = memLease{holder: holder, expires: now.Add(ttl)}
+	return nil
+}
+
+// Release is part of the leaser interface.
+func (m *memLeaser) Release(key, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.leases[key]; ok && l.holder == holder {
+		delete(m.leases, key)
+	}
+	return nil
+}
+
+// sqlLeaser is a leaser backed by a table in the broker's metadata database,
+// shared by all the broker's replicas. Expiration uses the database's clock,
+// so that the replicas' clocks don't need to agree.
+type sqlLeaser struct {
+	db *sql.DB
+}
+
+func newSQLLeaser(db *sql.DB) (*sqlLeaser, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS broker_leases (
+		key STRING PRIMARY KEY,
+		holder STRING NOT NULL,
+		expires TIMESTAMPTZ NOT NULL
+	)`); err != nil {
+		return nil, fmt.Errorf("creating broker_leases table: %s", err)
+	}
+	return &sqlLeaser{db: db}, nil
+}
+
+// Acquire is part of the leaser interface.
+func (s *sqlLeaser) Acquire(key, holder string, ttl time.Duration) error {
+	// Retrying is safe: if the lease was taken by an attempt whose result was
+	// lost, holder renews it.
+	res, err := execWithRetry(s.db, `INSERT INTO broker_leases (key, holder, expires)
+		VALUES ($1, $2, now() + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (key) DO UPDATE SET holder = excluded.holder, expires = excluded.expires
+		WHERE broker_leases.holder = excluded.holder OR broker_leases.expires < now()`,
+		key, holder, int64(ttl/time.Millisecond),
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errLeaseHeld
+	}
+	return nil
+}
+
+// Release is part of the leaser interface.
+func (s *sqlLeaser) Release(key, holder string) error {
+	_, err := execWithRetry(s.db, "DELETE FROM broker_leases WHERE key = $1 AND holder = $2", key, holder)
+	return err
+}
+
+// lockInstance takes the lease on an instance for the duration of a request.
+// It fails with errConcurrentOperation if another request holds it. The
+// returned function releases the lease.
+func (sb *crdbServiceBroker) lockInstance(instanceID string) (func(), error) {
+	holder := uniuri.New()
+	if err := sb.state.leases.Acquire("instance/"+instanceID, holder, sb.leaseTimeout); err == errLeaseHeld {
+		return nil, errConcurrentOperation
+	} else if err != nil {
+		log.Error("acquire-lease", err)
+		return nil, fmt.Errorf("locking instance: %s", err)
+	}
+	return func() {
+		if err := sb.state.leases.Release("instance/"+instanceID, holder); err != nil {
+			log.Error("release-lease", err)
+		}
+	}, nil
+}
+
+// isLeader reports whether this replica is the one that should run the given
+// periodic task. The leader keeps its lease by calling isLeader at least once
+// per ttl; if it stops, another replica takes over once the lease expires.
+func (sb *crdbServiceBroker) isLeader(task string, ttl time.Duration) bool {
+	err := sb.state.leases.Acquire("leader/"+task, sb.replicaID, ttl)
+	if err != nil && err != errLeaseHeld {
+		log.Error("acquire-leader-lease", err, lager.Data{"task": task})
+	}
+	return err == nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestMemLeaser(t *testing.T) {
+	l := newMemLeaser()
+	steps := []struct {
+		release     bool
+		holder      string
+		ttl         time.Duration
+		expectedErr error
+	}{
+		{holder: "h1", ttl: time.Hour},
+		{holder: "h2", ttl: time.Hour, expectedErr: errLeaseHeld},
+		// Holders can renew their lease, here to make it expire soon.
+		{holder: "h1", ttl: time.Millisecond},
+		// Only the holder can release a lease.
+		{release: true, holder: "h2"},
+		{release: true, holder: "h1"},
+		{holder: "h2", ttl: time.Millisecond},
+		// Expired leases are reclaimed.
+		{holder: "h1", ttl: time.Hour},
+	}
+	for i, s := range steps {
+		var err error
+		if s.release {
+			err = l.Release("key", s.holder)
+		} else {
+			err = l.Acquire("key", s.holder, s.ttl)
+		}
+		if err != s.expectedErr {
+			t.Fatalf("%d: expected %v, got %v", i, s.expectedErr, err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestInstanceLeases(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   func(b *fakeBroker) interface{}
+		// expectedStatus is the status once the lease has expired.
+		expectedStatus int
+	}{
+		{
+			name:   "provision",
+			method: "PUT",
+			path:   "/v2/service_instances/inst2",
+			body: func(b *fakeBroker) interface{} {
+				return b.provisionBody(nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "update",
+			method: "PATCH",
+			path:   "/v2/service_instances/inst1",
+			body: func(b *fakeBroker) interface{} {
+				return map[string]interface{}{
+					"service_id": b.plan.ServiceID,
+					"parameters": map[string]interface{}{"deletion_protection": true},
+				}
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "bind",
+			method: "PUT",
+			path:   "/v2/service_instances/inst1/service_bindings/bind2",
+			body: func(b *fakeBroker) interface{} {
+				return map[string]interface{}{
+					"service_id": b.plan.ServiceID, "plan_id": b.plan.ID, "app_guid": "app2",
+				}
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "unbind",
+			method:         "DELETE",
+			path:           "/v2/service_instances/inst1/service_bindings/bind1?service_id=%s&plan_id=%s",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "deprovision",
+			method:         "DELETE",
+			path:           "/v2/service_instances/inst1?service_id=%s&plan_id=%s",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			ctx := context.Background()
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			path := tc.path
+			if tc.body == nil {
+				path = fmt.Sprintf(path, b.plan.ServiceID, b.plan.ID)
+			}
+			request := func() (int, string) {
+				var body interface{}
+				if tc.body != nil {
+					body = tc.body(b)
+				}
+				var res struct {
+					Error string `json:"error"`
+				}
+				return adminRequest(t, b.server, tc.method, path, body, &res), res.Error
+			}
+
+			// Another request (or a broker that died) holds the lease.
+			lease := "instance/inst1"
+			if tc.name == "provision" {
+				lease = "instance/inst2"
+			}
+			if err := b.sb.state.leases.Acquire(lease, "other", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if status, errKey := request(); status != http.StatusUnprocessableEntity || errKey != "ConcurrencyError" {
+				t.Errorf("expected %d ConcurrencyError, got %d %q", http.StatusUnprocessableEntity, status, errKey)
+			}
+
+			// The lease is reclaimed once it has expired.
+			if err := b.sb.state.leases.Acquire(lease, "other", time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+			if status, _ := request(); status != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, status)
+			}
+			// The request released its lease.
+			if err := b.sb.state.leases.Acquire(lease, "next", time.Hour); err != nil {
+				t.Errorf("lease not released: %v", err)
+			}
+		})
+	}
+}
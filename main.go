@@ -15,10 +15,15 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/pivotal-cf/brokerapi"
 
@@ -31,6 +36,15 @@ const brokerPort = 8080
 var log = lager.NewLogger("cockroachdb-broker")
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "conformance":
+			os.Exit(conformanceMain(os.Args[2:], os.Stdout, os.Stderr))
+		case "smoke-test":
+			os.Exit(smokeTestMain(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	log.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
 	log.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
 
@@ -38,7 +52,14 @@ func main() {
 
 	InitServicesAndPlans()
 
-	serviceBroker := newCRDBServiceBroker()
+	serviceBroker := newCRDBServiceBroker(initState())
+	serviceBroker.dashboard = initDashboard()
+	serviceBroker.cc = initCloudController()
+	serviceBroker.orphans = initOrphans()
+	serviceBroker.leaseTimeout = initLeaseTimeout()
+	if err := serviceBroker.sealStoredSecrets(); err != nil {
+		log.Error("seal-secrets", err)
+	}
 
 	brokerCredentials := brokerapi.BrokerCredentials{
 		Username: os.Getenv("SECURITY_USER_NAME"),
@@ -48,7 +69,149 @@ func main() {
 		log.Fatal("initializing-service", errors.New("SECURITY_USER_NAME/PASSWORD not set"))
 	}
 
-	brokerAPI := brokerapi.New(serviceBroker, log, brokerCredentials)
-	http.Handle("/", brokerAPI)
-	log.Fatal("http-listen", http.ListenAndServe(fmt.Sprintf(":%d", brokerPort), nil))
+	stop := make(chan struct{})
+	go serviceBroker.runBackupScheduler(time.Minute, stop)
+	go serviceBroker.runReaper(time.Minute, stop)
+	go serviceBroker.runReconciler(time.Hour, stop)
+	go serviceBroker.runOperationResumer(time.Minute, stop)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", brokerPort),
+		Handler: newBrokerHandler(serviceBroker, brokerCredentials),
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal("http-listen", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	log.Info("shutting-down", lager.Data{"signal": (<-signals).String()})
+
+	// Stop accepting requests and let the running ones and the background
+	// operations finish, within the time the platform gives us.
+	ctx, cancel := context.WithTimeout(context.Background(), initShutdownTimeout())
+	defer cancel()
+	close(stop)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("drain-requests", err)
+	}
+	serviceBroker.shutdown(ctx)
+	closePlans()
+	log.Info("stopped")
+}
+
+// initShutdownTimeout returns how long to wait for requests and operations to
+// finish on shutdown, from SHUTDOWN_TIMEOUT.
+func initShutdownTimeout() time.Duration {
+	s := os.Getenv("SHUTDOWN_TIMEOUT")
+	if s == "" {
+		return defaultShutdownTimeout
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatal("init-shutdown", fmt.Errorf("invalid SHUTDOWN_TIMEOUT: %s", err))
+	}
+	return d
+}
+
+// initState sets up the broker state. It is stored in the metadata database
+// given by METADATA_DB_URI, with the passwords it holds encrypted with
+// STATE_ENCRYPTION_KEY; if that is not set, the state is kept in memory and
+// lost on restart.
+func initState() *brokerState {
+	uri := os.Getenv("METADATA_DB_URI")
+	if uri == "" {
+		log.Info("METADATA_DB_URI not set, keeping broker state in memory")
+		return newBrokerState(newMemKVStore())
+	}
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		log.Fatal("init-metadata-db", err)
+	}
+	kv, err := newSQLKVStore(db)
+	if err != nil {
+		log.Fatal("init-metadata-db", err)
+	}
+	state := newBrokerState(kv)
+	// Leases must be shared by all the broker's replicas.
+	if state.leases, err = newSQLLeaser(db); err != nil {
+		log.Fatal("init-metadata-db", err)
+	}
+	key := os.Getenv("STATE_ENCRYPTION_KEY")
+	if key == "" {
+		log.Fatal("init-metadata-db", errors.New("STATE_ENCRYPTION_KEY not set"))
+	}
+	if state.secrets, err = newSecretBox(key); err != nil {
+		log.Fatal("init-metadata-db", fmt.Errorf("STATE_ENCRYPTION_KEY: %s", err))
+	}
+	return state
+}
+
+// initDashboard sets up instance dashboards if DASHBOARD_URL (the external
+// URL of the broker) and DASHBOARD_SECRET (used to sign dashboard tokens) are
+// set.
+func initDashboard() *dashboardConfig {
+	baseURL := os.Getenv("DASHBOARD_URL")
+	secret := os.Getenv("DASHBOARD_SECRET")
+	if baseURL == "" {
+		log.Info("DASHBOARD_URL not set, instance dashboards disabled")
+		return nil
+	}
+	if secret == "" {
+		log.Fatal("init-dashboard", errors.New("DASHBOARD_SECRET not set"))
+	}
+	return &dashboardConfig{baseURL: baseURL, secret: []byte(secret)}
+}
+
+// initCloudController sets up a Cloud Controller client if CF_API_URL is set,
+// using the UAA client given by CF_CLIENT_ID and CF_CLIENT_SECRET.
+func initCloudController() *ccClient {
+	apiURL := os.Getenv("CF_API_URL")
+	if apiURL == "" {
+		return nil
+	}
+	clientID := os.Getenv("CF_CLIENT_ID")
+	clientSecret := os.Getenv("CF_CLIENT_SECRET")
+	if clientID == "" || clientSecret == "" {
+		log.Fatal("init-cloud-controller", errors.New("CF_CLIENT_ID/SECRET not set"))
+	}
+	return newCCClient(apiURL, clientID, clientSecret)
+}
+
+// initLeaseTimeout returns how long instance leases last, from
+// LEASE_TIMEOUT.
+func initLeaseTimeout() time.Duration {
+	s := os.Getenv("LEASE_TIMEOUT")
+	if s == "" {
+		return defaultLeaseTimeout
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatal("init-leases", fmt.Errorf("invalid LEASE_TIMEOUT: %s", err))
+	}
+	return d
+}
+
+// initOrphans configures the orphan reconciler from DROP_ORPHANS and
+// ORPHAN_GRACE_PERIOD. Dropping orphans requires METADATA_DB_URI.
+func initOrphans() orphanConfig {
+	c := orphanConfig{
+		gracePeriod: defaultOrphanGracePeriod,
+		drop:        os.Getenv("DROP_ORPHANS") == "true",
+	}
+	if c.drop && os.Getenv("METADATA_DB_URI") == "" {
+		// Without the state, every database would look orphaned after a
+		// restart.
+		log.Fatal("init-orphans", errors.New("DROP_ORPHANS requires METADATA_DB_URI"))
+	}
+	if s := os.Getenv("ORPHAN_GRACE_PERIOD"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatal("init-orphans", fmt.Errorf("invalid ORPHAN_GRACE_PERIOD: %s", err))
+		}
+		c.gracePeriod = d
+	}
+	return c
 }
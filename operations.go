@@ -0,0 +1,298 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/dchest/uniuri"
+	"github.com/pivotal-cf/brokerapi"
+	uuid "github.com/satori/go.uuid"
+)
+
+const kindOperation = "operation"
+
+// operationRecord tracks an asynchronous operation run by the broker on
+// behalf of an instance. It holds everything needed to run the operation, so
+// that another replica can resume it if the broker running it dies.
+type operationRecord struct {
+	ID          string                       `json:"id"`
+	InstanceID  string                       `json:"instanceID"`
+	Type        string                       `json:"type"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description,omitempty"`
+	Started     time.Time                    `json:"started"`
+	Finished    *time.Time                   `json:"finished,omitempty"`
+
+	// Scheduled is set for backups started by the backup scheduler.
+	Scheduled bool `json:"scheduled,omitempty"`
+	// SourceInstanceID and BackupID identify the backup a restore restores.
+	SourceInstanceID string `json:"sourceInstanceID,omitempty"`
+	BackupID         string `json:"backupID,omitempty"`
+	// Comment is the comment a provision operation gives the instance.
+	Comment *instanceComment `json:"comment,omitempty"`
+
+	// Attempts counts the times a broker started working on the operation.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// maxOperationAttempts is how many times an operation is started before the
+// broker gives up on it, in case it is what makes brokers crash.
+const maxOperationAttempts = 3
+
+// Operation returns the record for the given operation, or errStateNotFound.
+func (s *brokerState) Operation(instanceID, operationID string) (*operationRecord, error) {
+	var r operationRecord
+	if err := s.get(kindOperation, instanceID+"/"+operationID, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *brokerState) PutOperation(r *operationRecord) error {
+	return s.put(kindOperation, r.InstanceID+"/"+r.ID, r)
+}
+
+// Operations returns the operations of an instance, oldest first.
+func (s *brokerState) Operations(instanceID string) ([]*operationRecord, error) {
+	return s.operations(instanceID + "/")
+}
+
+// AllOperations returns the operations of all instances, oldest first.
+func (s *brokerState) AllOperations() ([]*operationRecord, error) {
+	return s.operations("")
+}
+
+func (s *brokerState) operations(prefix string) ([]*operationRecord, error) {
+	var res []*operationRecord
+	err := s.list(kindOperation, prefix, func(data []byte) error {
+		var r operationRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		res = append(res, &r)
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Started.Before(res[j].Started) })
+	return res, err
+}
+
+func operationLease(op *operationRecord) string {
+	return "operation/" + op.InstanceID + "/" + op.ID
+}
+
+// startOperation records a new in-progress operation of the given type and
+// runs it in the background; see runOperation. The operation gets a new ID
+// unless it has one.
+func (sb *crdbServiceBroker) startOperation(op *operationRecord) (*operationRecord, error) {
+	if op.ID == "" {
+		op.ID = uuid.NewV4().String()
+	}
+	op.State = brokerapi.InProgress
+	op.Started = time.Now().UTC()
+
+	// Take the lease before the record exists, so that no other replica
+	// mistakes the operation for an abandoned one.
+	holder := sb.replicaID + "/" + uniuri.New()
+	if err := sb.state.leases.Acquire(operationLease(op), holder, sb.leaseTimeout); err != nil {
+		return nil, err
+	}
+	if err := sb.state.PutOperation(op); err != nil {
+		_ = sb.state.leases.Release(operationLease(op), holder)
+		return nil, err
+	}
+
+	res := *op
+	go sb.runOperation(op, holder)
+	return &res, nil
+}
+
+// operationFunc returns the function that carries out an operation. The
+// string returned by the function becomes the description of the operation
+// once it succeeds; an error fails the operation.
+func (sb *crdbServiceBroker) operationFunc(op *operationRecord) (func() (string, error), error) {
+	switch op.Type {
+	case opBackup:
+		return func() (string, error) {
+			instance, plan, err := sb.instancePlan(op.InstanceID)
+			if err != nil {
+				return "", err
+			}
+			if plan.Backups == nil {
+				return "", fmt.Errorf("plan '%s' does not support backups", plan.Name)
+			}
+			b, err := sb.backup(instance, plan, op.Scheduled)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("created backup %s", b.ID), nil
+		}, nil
+	case opRestore:
+		return func() (string, error) {
+			b, err := sb.state.Backup(op.SourceInstanceID, op.BackupID)
+			if err != nil {
+				return "", fmt.Errorf("looking up backup: %s", err)
+			}
+			srcPlan, err := findPlan(b.ServiceID, b.PlanID)
+			if err != nil {
+				return "", err
+			}
+			if srcPlan.Backups == nil {
+				return "", fmt.Errorf("plan '%s' does not support backups", srcPlan.Name)
+			}
+			_, targetPlan, err := sb.instancePlan(op.InstanceID)
+			if err != nil {
+				return "", err
+			}
+			collection := srcPlan.Backups.collection(b.InstanceID)
+			if err := sb.restore(b, collection, op.InstanceID, targetPlan); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("restored backup %s of instance %s", b.ID, b.InstanceID), nil
+		}, nil
+	case opProvision, opDeprovision:
+		return sb.instanceOperationFunc(op), nil
+	default:
+		return nil, fmt.Errorf("unknown operation type '%s'", op.Type)
+	}
+}
+
+// runOperation runs an operation whose lease is held by holder, renewing the
+// lease until the operation is done, and records the outcome.
+func (sb *crdbServiceBroker) runOperation(op *operationRecord, holder string) {
+	logger := log.Session("operation", lager.Data{
+		"instance-id": op.InstanceID, "operation-id": op.ID, "type": op.Type,
+	})
+
+	sb.opsMu.Lock()
+	if sb.stopping {
+		sb.opsMu.Unlock()
+		// Leave the operation to another replica or the next start.
+		_ = sb.state.leases.Release(operationLease(op), holder)
+		return
+	}
+	op.Attempts++
+	sb.running[op] = holder
+	sb.opsWG.Add(1)
+	sb.opsMu.Unlock()
+	defer sb.opsWG.Done()
+	logger.Info("starting", lager.Data{"attempt": op.Attempts})
+	if err := sb.state.PutOperation(op); err != nil {
+		logger.Error("store-operation", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(sb.leaseTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := sb.state.leases.Acquire(operationLease(op), holder, sb.leaseTimeout); err != nil {
+					logger.Error("renew-lease", err)
+				}
+			}
+		}
+	}()
+
+	var desc string
+	fn, err := sb.operationFunc(op)
+	if err == nil && op.Attempts > maxOperationAttempts {
+		err = fmt.Errorf("gave up after %d interrupted attempts", op.Attempts-1)
+	} else if err == nil {
+		desc, err = fn()
+	}
+
+	sb.opsMu.Lock()
+	defer sb.opsMu.Unlock()
+	if _, ok := sb.running[op]; !ok {
+		// The broker is shutting down and checkpointed the operation, which
+		// may have been resumed elsewhere already.
+		logger.Info("finished-after-checkpoint")
+		return
+	}
+	delete(sb.running, op)
+	finished := time.Now().UTC()
+	op.Finished = &finished
+	if err != nil {
+		logger.Error("failed", err)
+		op.State = brokerapi.Failed
+		op.Description = err.Error()
+	} else {
+		logger.Info("succeeded")
+		op.State = brokerapi.Succeeded
+		op.Description = desc
+	}
+	if err := sb.state.PutOperation(op); err != nil {
+		logger.Error("store-operation", err)
+		// Keep the lease, so that another replica retries the operation
+		// once it expires.
+		return
+	}
+	if err := sb.state.leases.Release(operationLease(op), holder); err != nil {
+		logger.Error("release-lease", err)
+	}
+}
+
+// resumeOperations runs the in-progress operations that no broker is working
+// on, i.e. the operations whose broker died (or was restarted) before they
+// finished.
+func (sb *crdbServiceBroker) resumeOperations() error {
+	ops, err := sb.state.AllOperations()
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.State != brokerapi.InProgress {
+			continue
+		}
+		holder := sb.replicaID + "/" + uniuri.New()
+		if err := sb.state.leases.Acquire(operationLease(op), holder, sb.leaseTimeout); err == errLeaseHeld {
+			continue
+		} else if err != nil {
+			return err
+		}
+		log.Info("resuming-operation", lager.Data{"instance-id": op.InstanceID, "operation-id": op.ID})
+		go sb.runOperation(op, holder)
+	}
+	return nil
+}
+
+// runOperationResumer resumes abandoned operations and rolls back abandoned
+// requests every checkInterval until stop is closed.
+func (sb *crdbServiceBroker) runOperationResumer(checkInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		if err := sb.resumeOperations(); err != nil {
+			log.Error("resume-operations", err)
+		}
+		if err := sb.recoverRequests(); err != nil {
+			log.Error("recover-requests", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// newReplica starts another broker process sharing the fake broker's state
+// and leases.
+func (b *fakeBroker) newReplica() (*crdbServiceBroker, *httptest.Server) {
+	sb := newCRDBServiceBroker(&brokerState{kv: b.sb.state.kv, leases: b.sb.state.leases})
+	server := httptest.NewServer(newBrokerHandler(sb, brokerapi.BrokerCredentials{
+		Username: "user", Password: "pass",
+	}))
+	return sb, server
+}
+
+func TestReplicasShareLeases(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	other, server := b.newReplica()
+	defer server.Close()
+	ctx := context.Background()
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold a bind on the first replica in the middle of granting privileges.
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	b.cluster.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "GRANT") {
+			close(blocked)
+			<-unblock
+			b.cluster.fail = nil
+		}
+		return nil
+	}
+	bindErr := make(chan error)
+	go func() {
+		_, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+			ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+		})
+		bindErr <- err
+	}()
+	<-blocked
+
+	// The second replica can't delete the instance meanwhile.
+	deprovisionPath := fmt.Sprintf("/v2/service_instances/inst1?service_id=%s&plan_id=%s", b.plan.ServiceID, b.plan.ID)
+	var res struct {
+		Error string `json:"error"`
+	}
+	status := adminRequest(t, server, "DELETE", deprovisionPath, nil, &res)
+	if status != http.StatusUnprocessableEntity || res.Error != "ConcurrencyError" {
+		t.Errorf("expected %d ConcurrencyError, got %d %q", http.StatusUnprocessableEntity, status, res.Error)
+	}
+
+	close(unblock)
+	if err := <-bindErr; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.state.Binding("inst1", "bind1"); err != nil {
+		t.Errorf("binding not visible to the other replica: %v", err)
+	}
+	if err := other.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status := adminRequest(t, server, "DELETE", deprovisionPath, nil, nil); status != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, status)
+	}
+}
+
+func TestReplicasLeaderElection(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	other, server := b.newReplica()
+	defer server.Close()
+
+	const ttl = 20 * time.Millisecond
+	if !b.sb.isLeader("task", ttl) {
+		t.Fatal("expected the first replica to become the leader")
+	}
+	if other.isLeader("task", ttl) {
+		t.Fatal("expected a single leader")
+	}
+	// Leaders keep their lease, and other tasks have their own.
+	if !b.sb.isLeader("task", ttl) {
+		t.Fatal("expected the leader to keep its lease")
+	}
+	if !other.isLeader("other-task", ttl) {
+		t.Fatal("expected the second replica to lead another task")
+	}
+
+	// The leader dies.
+	time.Sleep(2 * ttl)
+	if !other.isLeader("task", ttl) {
+		t.Fatal("expected the second replica to take over")
+	}
+	if b.sb.isLeader("task", ttl) {
+		t.Fatal("expected a single leader")
+	}
+}
+
+func TestResumeOperations(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	other, server := b.newReplica()
+	defer server.Close()
+	b.plan.Backups = &backupConfig{URI: "nodelocal://1/backups"}
+	ctx := context.Background()
+
+	for _, id := range []string{"inst1", "inst2"} {
+		if _, err := b.sb.Provision(ctx, id, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A replica started a backup of inst1 and died, while another replica is
+	// still working on a backup of inst2.
+	abandoned := &operationRecord{
+		ID: "op1", InstanceID: "inst1", Type: opBackup, State: brokerapi.InProgress, Started: time.Now(),
+	}
+	running := &operationRecord{
+		ID: "op2", InstanceID: "inst2", Type: opBackup, State: brokerapi.InProgress, Started: time.Now(),
+	}
+	for _, op := range []*operationRecord{abandoned, running} {
+		if err := b.sb.state.PutOperation(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.sb.state.leases.Acquire(operationLease(abandoned), "dead", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sb.state.leases.Acquire(operationLease(running), "alive", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// Both surviving replicas look for abandoned operations; only one of them
+	// resumes op1.
+	for _, sb := range []*crdbServiceBroker{b.sb, other} {
+		if err := sb.resumeOperations(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if op := waitForOperation(t, server, abandoned); op.State != brokerapi.Succeeded {
+		t.Fatalf("expected op1 to succeed, got %s: %s", op.State, op.Description)
+	}
+	backups, err := other.state.Backups("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("expected a single backup of inst1, got %d", len(backups))
+	}
+	if op, err := other.state.Operation("inst2", "op2"); err != nil {
+		t.Fatal(err)
+	} else if op.State != brokerapi.InProgress {
+		t.Errorf("expected op2 to be left alone, got %s", op.State)
+	}
+	// The lease of op1 was released.
+	if err := b.sb.state.leases.Acquire(operationLease(abandoned), "next", time.Hour); err != nil {
+		t.Errorf("lease not released: %v", err)
+	}
+
+	// Operations started through the admin API run on the replica that
+	// started them, and aren't resumed by the others.
+	var op operationRecord
+	if status := adminRequest(t, server, "POST", "/admin/instances/inst2/backups", nil, &op); status != http.StatusConflict {
+		t.Errorf("expected status %d while op2 is running, got %d", http.StatusConflict, status)
+	}
+	if status := adminRequest(t, server, "POST", "/admin/instances/inst1/backups", nil, &op); status != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, status)
+	}
+	if err := b.sb.resumeOperations(); err != nil {
+		t.Fatal(err)
+	}
+	if r := waitForOperation(t, server, &op); r.State != brokerapi.Succeeded {
+		t.Fatalf("expected backup to succeed, got %s: %s", r.State, r.Description)
+	}
+	if backups, err := other.state.Backups("inst1"); err != nil {
+		t.Fatal(err)
+	} else if len(backups) != 2 {
+		t.Errorf("expected 2 backups of inst1, got %d", len(backups))
+	}
+}
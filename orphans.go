@@ -0,0 +1,532 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const kindOrphan = "orphan"
+
+// Kinds of orphans. Databases and users are objects on a cluster that no
+// instance or binding refers to; instances and bindings are broker records
+// that the Cloud Controller doesn't know about. Only the former are ever
+// dropped.
+const (
+	orphanDatabase = "database"
+	orphanUser     = "user"
+	orphanInstance = "instance"
+	orphanBinding  = "binding"
+)
+
+// orphanConfig configures the orphan reconciler.
+type orphanConfig struct {
+	// gracePeriod is how long an orphaned database or user has to be seen
+	// before it can be dropped.
+	gracePeriod time.Duration
+	// drop enables dropping orphans from the periodic reconciler. Orphans
+	// can always be dropped explicitly through the admin API.
+	drop bool
+}
+
+const defaultOrphanGracePeriod = 24 * time.Hour
+
+// orphanRecord describes an orphan found by the reconciler.
+type orphanRecord struct {
+	// Cluster is the host:port of the cluster holding the orphaned database
+	// or user; it is empty for instances and bindings.
+	Cluster string `json:"cluster,omitempty"`
+	// InstanceID is set for users left on the cluster of an instance that
+	// has one of its own (see Plan.clusterPerInstance), which the reconciler
+	// reaches through the instance rather than a plan; virtual clusters
+	// share their host's address.
+	InstanceID string    `json:"instanceID,omitempty"`
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	// DropAfter is when a database or user becomes eligible for dropping.
+	DropAfter *time.Time `json:"dropAfter,omitempty"`
+	// Reason explains how the orphan came about, if the broker knows; see
+	// recordLeftoverUser.
+	Reason string `json:"reason,omitempty"`
+	// Unproven is set for users that only look like the broker created them
+	// by their name: neither the comment of an instance nor a failed request
+	// says it did. They are reported but never dropped.
+	Unproven bool `json:"unproven,omitempty"`
+	// Owner is the owner role of the instance a user was created for, which
+	// takes over what the user owns when it is dropped, as on unbind.
+	Owner string `json:"owner,omitempty"`
+}
+
+func (r *orphanRecord) key() string {
+	if r.InstanceID != "" {
+		return r.Cluster + "/" + r.InstanceID + "/" + r.Kind + "/" + r.Name
+	}
+	return r.Cluster + "/" + r.Kind + "/" + r.Name
+}
+
+func (r *orphanRecord) droppable() bool {
+	return r.Kind == orphanDatabase || r.Kind == orphanUser && !r.Unproven
+}
+
+func (s *brokerState) Orphans() ([]*orphanRecord, error) {
+	var res []*orphanRecord
+	err := s.list(kindOrphan, "", func(data []byte) error {
+		var r orphanRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		res = append(res, &r)
+		return nil
+	})
+	return res, err
+}
+
+func (s *brokerState) PutOrphan(r *orphanRecord) error {
+	return s.put(kindOrphan, r.key(), r)
+}
+
+func (s *brokerState) DeleteOrphan(r *orphanRecord) error {
+	return s.kv.Delete(kindOrphan, r.key())
+}
+
+// generatedUserRegexp matches the user names generated by
+// userNameFromBinding.
+var generatedUserRegexp = regexp.MustCompile("^[a-p]{32}$")
+
+// ownerRoleRegexp matches the roles generated by ownerRoleFromInstanceID.
+var ownerRoleRegexp = regexp.MustCompile("^cf_[a-p]{32}_owner$")
+
+// queryStrings runs a query returning a single string column.
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// findOrphans compares the broker-generated databases and users on every
+// plan's cluster (and, if configured, the Cloud Controller's view) with the
+// broker state. The orphans are remembered along with when they were first
+// seen, so that they can be given a grace period before they are dropped.
+func (sb *crdbServiceBroker) findOrphans(now time.Time) ([]*orphanRecord, error) {
+	instances, err := sb.state.Instances()
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := sb.state.AllBindings()
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := sb.state.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+	previous, err := sb.state.Orphans()
+	if err != nil {
+		return nil, err
+	}
+	// Users that a failed request left behind are known to be the broker's.
+	recorded := make(map[string]bool)
+	for _, r := range previous {
+		if r.Kind == orphanUser && r.Reason != "" {
+			recorded[r.key()] = true
+		}
+	}
+	knownDatabases := make(map[string]bool)
+	knownInstances := make(map[string]bool)
+	for _, r := range instances {
+		knownDatabases[dbNameFromInstanceID(r.ID)] = true
+		knownInstances[r.ID] = true
+	}
+	for _, r := range tombstones {
+		knownDatabases[r.Database] = true
+		knownInstances[r.InstanceID] = true
+	}
+	// The instances of plans with schema isolation share a database.
+	for _, s := range Services {
+		for _, p := range s.Plans {
+			if p.Isolation == isolationSchema {
+				knownDatabases[sharedDBNameFromPlanID(p.ID)] = true
+			}
+		}
+	}
+	knownUsers := make(map[string]bool)
+	for _, r := range bindings {
+		knownUsers[userNameFromBinding(r.InstanceID, r.ID)] = true
+	}
+	// Restores work on temporary databases named after the instance's.
+	isKnownDatabase := func(name string) bool {
+		if knownDatabases[name] {
+			return true
+		}
+		if i := strings.LastIndex(name, "_"); i > 0 {
+			return knownDatabases[name[:i]]
+		}
+		return false
+	}
+
+	found := []*orphanRecord{}
+	// Several plans can share a cluster.
+	clusters := make(map[string]bool)
+	for _, s := range Services {
+		for i := range s.Plans {
+			plan := &s.Plans[i]
+			// Dedicated and Cloud clusters are deleted along with their
+			// instances.
+			if !plan.usesPlanCluster() {
+				continue
+			}
+			cluster := net.JoinHostPort(plan.CRDBHost, plan.CRDBPort)
+			if clusters[cluster] {
+				continue
+			}
+			clusters[cluster] = true
+
+			databases, err := queryStrings(plan.crdb, "SELECT database_name FROM [SHOW DATABASES]")
+			if err != nil {
+				return nil, fmt.Errorf("listing databases on %s: %s", cluster, err)
+			}
+			for _, name := range databases {
+				if !strings.HasPrefix(name, "cf_") || isKnownDatabase(name) {
+					continue
+				}
+				forgotten, err := forgottenInstanceDatabase(plan.crdb, name, knownInstances)
+				if err != nil {
+					return nil, fmt.Errorf("reading comment of %s on %s: %s", name, cluster, err)
+				}
+				if forgotten {
+					found = append(found, &orphanRecord{Cluster: cluster, Kind: orphanDatabase, Name: name})
+				}
+			}
+			created, err := createdUsers(plan.crdb, databases)
+			if err != nil {
+				return nil, fmt.Errorf("reading comments on %s: %s", cluster, err)
+			}
+			users, err := queryStrings(plan.crdb, "SELECT username FROM [SHOW USERS]")
+			if err != nil {
+				return nil, fmt.Errorf("listing users on %s: %s", cluster, err)
+			}
+			for _, name := range users {
+				orphan := generatedUserRegexp.MatchString(name) && !knownUsers[name] ||
+					ownerRoleRegexp.MatchString(name) && !isKnownDatabase(strings.TrimSuffix(name, "_owner"))
+				if !orphan {
+					continue
+				}
+				r := &orphanRecord{Cluster: cluster, Kind: orphanUser, Name: name}
+				owner, ok := created[name]
+				r.Unproven = !ok && !recorded[r.key()]
+				r.Owner = owner
+				found = append(found, r)
+			}
+		}
+	}
+
+	// Users left on the clusters of instances are only known from
+	// recordLeftoverUser, as these clusters aren't listed.
+	for _, r := range previous {
+		if r.InstanceID == "" || r.Kind != orphanUser || knownUsers[r.Name] {
+			continue
+		}
+		exists, err := sb.instanceUserExists(r.InstanceID, r.Name)
+		if err != nil {
+			// The instance's cluster may be down; keep the user until it
+			// can be checked.
+			log.Error("list-instance-users", err, lager.Data{"instance-id": r.InstanceID})
+		}
+		if exists || err != nil {
+			found = append(found, &orphanRecord{
+				Cluster: r.Cluster, InstanceID: r.InstanceID, Kind: orphanUser, Name: r.Name, Owner: r.Owner,
+			})
+		}
+	}
+
+	if sb.cc != nil {
+		for _, r := range instances {
+			exists, err := sb.cc.ServiceInstanceExists(r.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				found = append(found, &orphanRecord{Kind: orphanInstance, Name: r.ID})
+			}
+		}
+		for _, r := range bindings {
+			exists, err := sb.cc.ServiceBindingExists(r.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				found = append(found, &orphanRecord{Kind: orphanBinding, Name: bindingKey(r.InstanceID, r.ID)})
+			}
+		}
+	}
+
+	// Merge with what we found before: keep the time each orphan was first
+	// seen, and forget the ones that are gone or were adopted.
+	seen := make(map[string]*orphanRecord)
+	for _, r := range previous {
+		seen[r.key()] = r
+	}
+	current := make(map[string]bool)
+	for _, r := range found {
+		current[r.key()] = true
+		if prev, ok := seen[r.key()]; ok {
+			r.FirstSeen = prev.FirstSeen
+			r.Reason = prev.Reason
+			if r.Owner == "" {
+				r.Owner = prev.Owner
+			}
+		} else {
+			r.FirstSeen = now
+		}
+		if r.droppable() {
+			dropAfter := r.FirstSeen.Add(sb.orphans.gracePeriod)
+			r.DropAfter = &dropAfter
+		}
+		if err := sb.state.PutOrphan(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range previous {
+		if !current[r.key()] {
+			if err := sb.state.DeleteOrphan(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].key() < found[j].key() })
+	return found, nil
+}
+
+// forgottenInstanceDatabase returns whether the comment of a database says
+// that the broker created it for an instance that it has no record or
+// tombstone of. Databases without such a comment, e.g. created by hand with a
+// cf_ name, are never orphans.
+func forgottenInstanceDatabase(crdb *sql.DB, name string, knownInstances map[string]bool) (bool, error) {
+	c, err := databaseComment(crdb, instanceNamespace{database: name})
+	if err != nil || c == nil || c.InstanceID == "" {
+		return false, err
+	}
+	return ownService(c.ServiceID) && !knownInstances[c.InstanceID], nil
+}
+
+// createdUsers returns the users that the comments of the instances on a
+// cluster say the broker created: the users of their bindings, mapped to the
+// owner role of their instance, and the owner roles themselves, mapped to
+// nothing.
+func createdUsers(crdb *sql.DB, databases []string) (map[string]string, error) {
+	namespaces, err := instanceNamespaces(crdb, databases)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]string)
+	for _, ns := range namespaces {
+		c, err := databaseComment(crdb, ns)
+		if err != nil {
+			return nil, fmt.Errorf("reading comment of %s: %s", ns, err)
+		}
+		if c == nil || c.InstanceID == "" || !ownService(c.ServiceID) {
+			continue
+		}
+		owner := ownerRoleFromInstanceID(c.InstanceID)
+		created[owner] = ""
+		for user := range c.Bindings {
+			created[user] = owner
+		}
+	}
+	return created, nil
+}
+
+// ownService returns whether a service is one of the broker's.
+func ownService(serviceID string) bool {
+	for _, s := range Services {
+		if s.ID == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// dropOrphans finds orphans and drops the databases and users whose grace
+// period has passed. It returns the dropped orphans. It refuses to drop
+// anything if the broker state is kept in memory: after a restart, every
+// database and user would look orphaned.
+func (sb *crdbServiceBroker) dropOrphans(now time.Time) ([]*orphanRecord, error) {
+	if sb.state.volatile() {
+		return nil, newStatusError(http.StatusUnprocessableEntity,
+			"orphans can't be dropped while the broker state is kept in memory; set METADATA_DB_URI")
+	}
+	orphans, err := sb.findOrphans(now)
+	if err != nil {
+		return nil, err
+	}
+	dropped := []*orphanRecord{}
+	for _, r := range orphans {
+		if !r.droppable() || now.Before(*r.DropAfter) {
+			continue
+		}
+		crdb := clusterConn(r.Cluster)
+		if r.InstanceID != "" {
+			if crdb, err = sb.orphanInstanceDB(r.InstanceID); err != nil {
+				return dropped, fmt.Errorf("dropping %s %s of instance %s: %s", r.Kind, r.Name, r.InstanceID, err)
+			}
+		}
+		if crdb == nil {
+			continue
+		}
+		if err := dropOrphan(crdb, r); err != nil {
+			return dropped, fmt.Errorf("dropping %s %s on %s: %s", r.Kind, r.Name, r.Cluster, err)
+		}
+		if err := sb.state.DeleteOrphan(r); err != nil {
+			return dropped, err
+		}
+		log.Info("dropped-orphan", lager.Data{"cluster": r.Cluster, "kind": r.Kind, "name": r.Name})
+		dropped = append(dropped, r)
+	}
+	return dropped, nil
+}
+
+// clusterConn returns the connection of a plan on the given cluster, or nil
+// if no plan uses it anymore.
+func clusterConn(cluster string) *sql.DB {
+	for _, s := range Services {
+		for _, p := range s.Plans {
+			if net.JoinHostPort(p.CRDBHost, p.CRDBPort) == cluster {
+				return p.crdb
+			}
+		}
+	}
+	return nil
+}
+
+// orphanInstanceDB returns the connection to the cluster of an instance that
+// has one of its own, or nil if the instance or its plan is gone, and its
+// cluster with it.
+func (sb *crdbServiceBroker) orphanInstanceDB(instanceID string) (*sql.DB, error) {
+	instance, err := sb.state.Instance(instanceID)
+	if err == errStateNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	plan, err := findPlan(instance.ServiceID, instance.PlanID)
+	if err != nil {
+		return nil, nil
+	}
+	return sb.instanceDB(plan, instanceID)
+}
+
+// instanceUserExists returns whether a user exists on the cluster of an
+// instance that has one of its own.
+func (sb *crdbServiceBroker) instanceUserExists(instanceID, user string) (bool, error) {
+	crdb, err := sb.orphanInstanceDB(instanceID)
+	if err != nil || crdb == nil {
+		return false, err
+	}
+	return userExists(crdb, user)
+}
+
+// userExists returns whether a user exists on a cluster.
+func userExists(crdb *sql.DB, user string) (bool, error) {
+	users, err := queryStrings(crdb, "SELECT username FROM [SHOW USERS]")
+	if err != nil {
+		return false, err
+	}
+	for _, name := range users {
+		if name == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func dropOrphan(crdb *sql.DB, r *orphanRecord) error {
+	if r.Kind == orphanDatabase {
+		_, err := execWithRetry(crdb, "DROP DATABASE IF EXISTS "+r.Name+" CASCADE")
+		return err
+	}
+	databases, err := queryStrings(crdb, fmt.Sprintf(
+		"SELECT DISTINCT database_name FROM [SHOW GRANTS FOR %s]", r.Name,
+	))
+	if err != nil {
+		return fmt.Errorf("listing grants: %s", err)
+	}
+	for _, db := range databases {
+		// CockroachDB refuses to drop users that own objects.
+		if r.Owner != "" {
+			if err := reassignOwned(context.Background(), crdb, db, r.Name, r.Owner); err != nil {
+				return fmt.Errorf("transferring ownership: %s", err)
+			}
+		}
+		if err := revokeAll(crdb, db, r.Name); err != nil {
+			return err
+		}
+	}
+	_, err = execWithRetry(crdb, "DROP USER IF EXISTS "+r.Name)
+	return err
+}
+
+// runReconciler looks for orphans every interval until stop is closed,
+// dropping them if the broker is configured to. Only one replica looks for
+// orphans at a time; see isLeader.
+func (sb *crdbServiceBroker) runReconciler(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !sb.isLeader("reconciler", 3*interval) {
+				continue
+			}
+			if sb.orphans.drop {
+				if _, err := sb.dropOrphans(time.Now()); err != nil {
+					log.Error("drop-orphans", err)
+				}
+				continue
+			}
+			orphans, err := sb.findOrphans(time.Now())
+			if err != nil {
+				log.Error("find-orphans", err)
+			} else if len(orphans) > 0 {
+				log.Info("found-orphans", lager.Data{"count": len(orphans)})
+			}
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// fakeCloudController serves the parts of the Cloud Controller and UAA APIs
+// used by ccClient.
+type fakeCloudController struct {
+	*httptest.Server
+	mu        sync.Mutex
+	instances map[string]bool
+	bindings  map[string]bool
+	// tokens counts the tokens handed out.
+	tokens int
+}
+
+func newFakeCloudController() *fakeCloudController {
+	cc := &fakeCloudController{instances: make(map[string]bool), bindings: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"links": map[string]interface{}{
+				"uaa": map[string]string{"href": cc.URL + "/uaa"},
+			},
+		})
+	})
+	mux.HandleFunc("/uaa/oauth/token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "broker" || secret != "secret" || req.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		cc.mu.Lock()
+		cc.tokens++
+		cc.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token", "expires_in": 3600,
+		})
+	})
+	lookup := func(m map[string]bool, prefix string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") != "bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			cc.mu.Lock()
+			defer cc.mu.Unlock()
+			if !m[strings.TrimPrefix(req.URL.Path, prefix)] {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write([]byte("{}"))
+		}
+	}
+	mux.HandleFunc("/v3/service_instances/", lookup(cc.instances, "/v3/service_instances/"))
+	mux.HandleFunc("/v3/service_credential_bindings/",
+		lookup(cc.bindings, "/v3/service_credential_bindings/"))
+	cc.Server = httptest.NewServer(mux)
+	return cc
+}
+
+func TestCCClient(t *testing.T) {
+	cc := newFakeCloudController()
+	defer cc.Close()
+	cc.instances["inst1"] = true
+	cc.bindings["bind1"] = true
+
+	client := newCCClient(cc.URL, "broker", "secret")
+	for _, tc := range []struct {
+		lookup   func(string) (bool, error)
+		guid     string
+		expected bool
+	}{
+		{client.ServiceInstanceExists, "inst1", true},
+		{client.ServiceInstanceExists, "inst2", false},
+		{client.ServiceBindingExists, "bind1", true},
+		{client.ServiceBindingExists, "bind2", false},
+	} {
+		exists, err := tc.lookup(tc.guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.guid, tc.expected, exists)
+		}
+	}
+	if cc.tokens != 1 {
+		t.Errorf("expected the token to be reused, got %d tokens", cc.tokens)
+	}
+
+	bad := newCCClient(cc.URL, "broker", "wrong")
+	if _, err := bad.ServiceInstanceExists("inst1"); err == nil {
+		t.Errorf("expected an error with bad client credentials")
+	}
+}
+
+// durableKVStore stands in for a kvStore that survives restarts, which
+// dropping orphans requires.
+type durableKVStore struct {
+	*memKVStore
+}
+
+// commentDatabase gives a database on the fake cluster the comment the
+// broker would have given it.
+func commentDatabase(t *testing.T, c *fakeCluster, name string, comment *instanceComment) {
+	data, err := json.Marshal(comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.comments[name] = string(data)
+}
+
+func TestOrphans(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.sb.state.kv = durableKVStore{newMemKVStore()}
+	cc := newFakeCloudController()
+	defer cc.Close()
+	b.sb.cc = newCCClient(cc.URL, "broker", "secret")
+	b.sb.orphans.gracePeriod = time.Hour
+
+	ctx := context.Background()
+	for _, id := range []string{"inst1", "inst2"} {
+		if _, err := b.sb.Provision(ctx, id, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.sb.Bind(ctx, id, "bind-"+id, brokerapi.BindDetails{
+			ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cc.instances["inst1"] = true
+	cc.bindings["bind-inst1"] = true
+	cc.instances["inst2"] = true
+	// The Cloud Controller lost bind-inst2.
+
+	// Leftovers of failed requests, a temporary restore database (not an
+	// orphan) and a user the broker didn't generate (ignored). Databases
+	// whose comment doesn't say the broker created them, such as a cf_
+	// database created by hand, are ignored too. Users are only dropped if
+	// the comment of an instance lists them; others with a generated name
+	// are only reported.
+	orphanDB := dbNameFromInstanceID("inst3")
+	orphanUser := userNameFromBinding("inst1", "bind2")
+	unprovenUser := userNameFromBinding("inst1", "bind3")
+	var c instanceComment
+	if err := json.Unmarshal([]byte(b.cluster.comments[dbNameFromInstanceID("inst1")]), &c); err != nil {
+		t.Fatal(err)
+	}
+	c.Bindings[orphanUser] = &bindingComment{BindingID: "bind2"}
+	commentDatabase(t, b.cluster, dbNameFromInstanceID("inst1"), &c)
+	b.cluster.databases[orphanDB] = true
+	commentDatabase(t, b.cluster, orphanDB, &instanceComment{InstanceID: "inst3", ServiceID: b.plan.ServiceID})
+	b.cluster.databases["cf_baseline"] = true
+	b.cluster.databases["cf_other_broker"] = true
+	commentDatabase(t, b.cluster, "cf_other_broker", &instanceComment{InstanceID: "inst9", ServiceID: "other"})
+	b.cluster.databases[dbNameFromInstanceID("inst1")+"_restore"] = true
+	b.cluster.users[orphanUser] = true
+	b.cluster.users[unprovenUser] = true
+	b.cluster.users["someone"] = true
+	b.cluster.grants[dbNameFromInstanceID("inst1")][orphanUser] = "ALL"
+	// The orphaned user created a table, which CockroachDB won't drop it
+	// with.
+	b.cluster.owners[dbNameFromInstanceID("inst1")] = map[string]string{"public.albums": orphanUser}
+
+	start := time.Now()
+	orphans, err := b.sb.findOrphans(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summarize := func(orphans []*orphanRecord) []string {
+		var res []string
+		for _, r := range orphans {
+			res = append(res, r.Kind+" "+r.Name)
+		}
+		return res
+	}
+	expected := []string{
+		"binding inst2/bind-inst2",
+		"database " + orphanDB,
+		"user " + orphanUser,
+		"user " + unprovenUser,
+	}
+	if orphanUser > unprovenUser {
+		expected[2], expected[3] = expected[3], expected[2]
+	}
+	if s := summarize(orphans); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("expected orphans %v, got %v", expected, s)
+	}
+	for _, r := range orphans {
+		if r.Unproven != (r.Name == unprovenUser) {
+			t.Errorf("%s %s: expected unproven to be %t", r.Kind, r.Name, !r.Unproven)
+		}
+	}
+
+	// Nothing is dropped during the grace period, and the orphans keep the
+	// time they were first seen.
+	dropped, err := b.sb.dropOrphans(start.Add(30 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 0 {
+		t.Fatalf("expected nothing to be dropped, got %v", summarize(dropped))
+	}
+
+	// Orphans that are adopted in the meantime are forgotten.
+	delete(b.cluster.databases, orphanDB)
+	if _, err := b.sb.Provision(ctx, "inst3", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	cc.instances["inst3"] = true
+
+	var res []*orphanRecord
+	if status := adminRequest(t, b.server, "POST", "/admin/orphans/drop", nil, &res); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected nothing to be dropped yet, got %v", summarize(res))
+	}
+
+	dropped, err = b.sb.dropOrphans(start.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := summarize(dropped); !reflect.DeepEqual(s, []string{"user " + orphanUser}) {
+		t.Fatalf("unexpected dropped orphans %v", s)
+	}
+	if b.cluster.hasUser(orphanUser) {
+		t.Errorf("orphaned user not dropped")
+	}
+	owner := ownerRoleFromInstanceID("inst1")
+	if o := b.cluster.owners[dbNameFromInstanceID("inst1")]["public.albums"]; o != owner {
+		t.Errorf("expected the orphaned user's table to be owned by %s, got %q", owner, o)
+	}
+	if !b.cluster.hasUser("someone") || !b.cluster.hasUser(unprovenUser) ||
+		!b.cluster.hasUser(userNameFromBinding("inst2", "bind-inst2")) {
+		t.Errorf("dropped a user that isn't an orphan")
+	}
+	if !b.cluster.databases["cf_baseline"] || !b.cluster.databases["cf_other_broker"] {
+		t.Errorf("dropped a database the broker didn't create")
+	}
+
+	if status := adminRequest(t, b.server, "GET", "/admin/orphans", nil, &res); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if s := summarize(res); !reflect.DeepEqual(s, []string{"binding inst2/bind-inst2", "user " + unprovenUser}) {
+		t.Fatalf("unexpected remaining orphans %v", s)
+	}
+}
+
+// TestOrphansMemoryState checks that a broker that lost its state in memory
+// when it restarted doesn't drop the databases and users of the instances it
+// forgot.
+func TestOrphansMemoryState(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.sb.orphans.gracePeriod = 0
+	ctx := context.Background()
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broker restarts.
+	b.sb.state = newBrokerState(newMemKVStore())
+	orphans, err := b.sb.findOrphans(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 2 {
+		t.Errorf("expected the database and user to look orphaned, got %d orphans", len(orphans))
+	}
+	if _, err := b.sb.dropOrphans(time.Now().Add(time.Hour)); err == nil {
+		t.Error("expected dropping orphans to fail")
+	}
+	var res brokerapi.ErrorResponse
+	if status := adminRequest(t, b.server, "POST", "/admin/orphans/drop", nil, &res); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", status)
+	}
+	if !b.cluster.databases[dbNameFromInstanceID("inst1")] || !b.cluster.hasUser(userNameFromBinding("inst1", "bind1")) {
+		t.Error("dropped the database or user of a forgotten instance")
+	}
+}
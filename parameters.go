@@ -0,0 +1,66 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// provisionParameters are the parameters accepted by Provision and Update
+// (e.g. with `cf create-service -c`). Parameters that aren't given are nil.
+type provisionParameters struct {
+	// TerminateSessions overrides the plan's terminateSessions setting.
+	TerminateSessions *bool `json:"terminate_sessions"`
+	// DeletionProtection makes Deprovision fail while it is set.
+	DeletionProtection *bool `json:"deletion_protection"`
+	// Labels are recorded in the comment of the instance's database. On
+	// update, they replace the previous labels.
+	Labels map[string]string `json:"labels"`
+	// PrimaryRegion, Regions and SurvivalGoal override the plan's
+	// multi-region settings; see regionConfig. On update, Regions replaces
+	// the database's other regions.
+	PrimaryRegion *string  `json:"primary_region"`
+	Regions       []string `json:"regions"`
+	SurvivalGoal  *string  `json:"survival_goal"`
+	// RestoreFrom creates the instance's database from a backup, or from
+	// the database of a deleted instance, instead of creating an empty one.
+	// Only Provision accepts it.
+	RestoreFrom *restoreSource `json:"restore_from"`
+}
+
+// restoreSource identifies a backup to restore; see the admin API. Without a
+// backup ID, it identifies a deleted instance whose database is kept; see
+// Plan.DeletionRetention.
+type restoreSource struct {
+	InstanceID string `json:"instance_id"`
+	BackupID   string `json:"backup_id"`
+}
+
+func parseProvisionParameters(raw json.RawMessage) (provisionParameters, error) {
+	var params provisionParameters
+	if len(raw) == 0 {
+		return params, nil
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return params, brokerapi.NewFailureResponse(
+			fmt.Errorf("invalid parameters: %s", err), http.StatusBadRequest, "parse-parameters",
+		)
+	}
+	return params, nil
+}
@@ -19,10 +19,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pivotal-cf/brokerapi"
 
@@ -39,13 +42,88 @@ type Plan struct {
 	CRDBPort      string `json:"crdbPort"`
 	CRDBAdminUser string `json:"crdbAdminUser"`
 
-	crdb        *sql.DB
+	// SharedBindingRole is the role given to bindings created from a space
+	// other than the instance's own space. Defaults to
+	// defaultSharedBindingRole.
+	SharedBindingRole string `json:"sharedBindingRole,omitempty"`
+
+	// Backups enables backups of the plan's instances through the admin API.
+	Backups *backupConfig `json:"backups,omitempty"`
+
+	// DeletionRetention, if set, makes Deprovision keep the instance's
+	// database (renamed and inaccessible) for this long before dropping it,
+	// e.g. "72h".
+	DeletionRetention string `json:"deletionRetention,omitempty"`
+
+	// TerminateSessions makes Unbind and Deprovision cancel the sessions of
+	// the users they are about to drop. Instances can override it with the
+	// terminate_sessions provision parameter.
+	TerminateSessions bool `json:"terminateSessions,omitempty"`
+	// SessionTerminationTimeout is how long to wait for cancelled sessions
+	// to end before going ahead anyway, e.g. "30s". Defaults to
+	// defaultSessionTerminationTimeout.
+	SessionTerminationTimeout string `json:"sessionTerminationTimeout,omitempty"`
+
+	// PrimaryRegion makes the plan's databases multi-region, with this
+	// primary region. Regions are added to them as well, and SurvivalGoal
+	// ("zone", the default, or "region") sets the failures they survive.
+	// Instances can override them with the primary_region, regions and
+	// survival_goal provision parameters.
+	PrimaryRegion string   `json:"primaryRegion,omitempty"`
+	Regions       []string `json:"regions,omitempty"`
+	SurvivalGoal  string   `json:"survivalGoal,omitempty"`
+
+	// Isolation is "database" (the default), which gives each instance a
+	// database of its own, "schema", which gives each instance a schema in a
+	// database shared by the plan's instances, "tenant", which gives each
+	// instance a virtual cluster of its own, "dedicated", which gives each
+	// instance a cluster of its own on Kubernetes, or "cloud", which gives
+	// each instance a CockroachDB Cloud cluster of its own or a database in
+	// an existing one. Only database isolation supports backups and
+	// regions, and only database and tenant isolation deletion retention.
+	// The isolation selects the Backend of the plan's instances; see
+	// backends.
+	Isolation string `json:"isolation,omitempty"`
+	// Kubernetes configures the clusters of plans with dedicated isolation,
+	// and Cloud those of plans with cloud isolation. Such plans don't use
+	// CRDBHost, CRDBPort and CRDBAdminUser.
+	Kubernetes *kubernetesConfig `json:"kubernetes,omitempty"`
+	Cloud      *cloudConfig      `json:"cloud,omitempty"`
+
+	// crdb is nil for plans with dedicated or cloud isolation; kube and
+	// cloud are only set for plans with dedicated and cloud isolation,
+	// respectively.
+	crdb                      *sql.DB
+	kube                      *kubeClient
+	cloud                     cloudClient
+	deletionRetention         time.Duration
+	sessionTerminationTimeout time.Duration
+}
+
+// sessionTimeout returns how long to wait for cancelled sessions to end.
+func (p *Plan) sessionTimeout() time.Duration {
+	if p.sessionTerminationTimeout != 0 {
+		return p.sessionTerminationTimeout
+	}
+	return defaultSessionTerminationTimeout
+}
+
+// sharedBindingRole returns the role for bindings from other spaces.
+func (p *Plan) sharedBindingRole() string {
+	if p.SharedBindingRole != "" {
+		return p.SharedBindingRole
+	}
+	return defaultSharedBindingRole
 }
 
 type Service struct {
 	// Note that the Plans field is not populated in this structure.
 	brokerapi.Service
 	Plans []Plan `json:"-"`
+
+	// Shareable is set from metadata.shareable in the service configuration
+	// and allows Cloud Foundry to share instances across spaces.
+	Shareable bool `json:"-"`
 }
 
 var Services []Service
@@ -56,7 +134,9 @@ func findService(serviceID string) (*Service, error) {
 			return &Services[i], nil
 		}
 	}
-	return nil, fmt.Errorf("unknown service ID '%s'", serviceID)
+	return nil, brokerapi.NewFailureResponse(
+		fmt.Errorf("unknown service ID '%s'", serviceID), http.StatusBadRequest, "find-service",
+	)
 }
 
 func findPlan(serviceID, planID string) (*Plan, error) {
@@ -69,7 +149,9 @@ func findPlan(serviceID, planID string) (*Plan, error) {
 			return &s.Plans[i], nil
 		}
 	}
-	return nil, fmt.Errorf("unknown plan ID '%s'", planID)
+	return nil, brokerapi.NewFailureResponse(
+		fmt.Errorf("unknown plan ID '%s'", planID), http.StatusBadRequest, "find-plan",
+	)
 }
 
 func addService(svc Service) {
@@ -110,10 +192,84 @@ func addPlan(p Plan) {
 		}
 	}
 
-	if p.CRDBHost == "" || p.CRDBPort == "" {
+	if (p.CRDBHost == "" || p.CRDBPort == "") && p.usesPlanCluster() {
 		log.Fatal("init", fmt.Errorf("plan '%s' does not specify a CockroachDB host/port", p.Name))
 	}
 
+	if _, ok := bindingRoles[p.SharedBindingRole]; p.SharedBindingRole != "" && !ok {
+		log.Fatal("init", fmt.Errorf("plan '%s' has unknown sharedBindingRole '%s'", p.Name, p.SharedBindingRole))
+	}
+
+	if p.Backups != nil {
+		if err := p.Backups.validate(); err != nil {
+			log.Fatal("init", fmt.Errorf("plan '%s': %s", p.Name, err))
+		}
+	}
+
+	if p.DeletionRetention != "" {
+		p.deletionRetention, err = time.ParseDuration(p.DeletionRetention)
+		if err != nil {
+			log.Fatal("init", fmt.Errorf("plan '%s' has invalid deletionRetention: %s", p.Name, err))
+		}
+	}
+
+	if p.SessionTerminationTimeout != "" {
+		p.sessionTerminationTimeout, err = time.ParseDuration(p.SessionTerminationTimeout)
+		if err != nil {
+			log.Fatal("init", fmt.Errorf("plan '%s' has invalid sessionTerminationTimeout: %s", p.Name, err))
+		}
+	}
+
+	if p.PrimaryRegion == "" && (len(p.Regions) > 0 || p.SurvivalGoal != "") {
+		log.Fatal("init", fmt.Errorf("plan '%s' sets regions or survivalGoal without primaryRegion", p.Name))
+	}
+	if err := p.regionConfig().validate(); err != nil {
+		log.Fatal("init", fmt.Errorf("plan '%s': %s", p.Name, err))
+	}
+
+	switch p.Isolation {
+	case "", isolationDatabase:
+	case isolationSchema, isolationTenant, isolationDedicated, isolationCloud:
+		if p.Backups != nil || p.PrimaryRegion != "" {
+			log.Fatal("init", fmt.Errorf(
+				"plan '%s' has %s isolation, which doesn't support backups or regions", p.Name, p.Isolation,
+			))
+		}
+		if p.DeletionRetention != "" && p.Isolation != isolationTenant {
+			log.Fatal("init", fmt.Errorf(
+				"plan '%s' has %s isolation, which doesn't support deletionRetention", p.Name, p.Isolation,
+			))
+		}
+	default:
+		log.Fatal("init", fmt.Errorf("plan '%s' has unknown isolation '%s'", p.Name, p.Isolation))
+	}
+
+	switch p.Isolation {
+	case isolationDedicated:
+		if p.Kubernetes == nil {
+			log.Fatal("init", fmt.Errorf("plan '%s' has dedicated isolation but no kubernetes configuration", p.Name))
+		}
+		if err := p.Kubernetes.validate(); err != nil {
+			log.Fatal("init", fmt.Errorf("plan '%s': %s", p.Name, err))
+		}
+		if p.kube, err = newKubeClient(p.Kubernetes); err != nil {
+			log.Fatal("init", fmt.Errorf("plan '%s': %s", p.Name, err))
+		}
+	case isolationCloud:
+		if p.Cloud == nil {
+			log.Fatal("init", fmt.Errorf("plan '%s' has cloud isolation but no cloud configuration", p.Name))
+		}
+		if err := p.Cloud.validate(); err != nil {
+			log.Fatal("init", fmt.Errorf("plan '%s': %s", p.Name, err))
+		}
+		p.cloud = newCloudREST(p.Cloud)
+	}
+
+	if !p.usesPlanCluster() {
+		s.Plans = append(s.Plans, p)
+		return
+	}
+
 	if p.CRDBAdminUser == "" {
 		p.CRDBAdminUser = "root"
 	}
@@ -140,6 +296,34 @@ type customPlanSpec struct {
 	ServiceID   string `json:"service"`
 	DBHost      string `json:"host"`
 	DBPort      int    `json:"port"`
+
+	SharedBindingRole string `json:"shared_binding_role"`
+	TerminateSessions bool   `json:"terminate_sessions"`
+
+	PrimaryRegion string     `json:"primary_region"`
+	Regions       regionList `json:"regions"`
+	SurvivalGoal  string     `json:"survival_goal"`
+
+	Isolation string `json:"isolation"`
+}
+
+// regionList is a list of regions, which the tile's plan form passes as a
+// comma-separated string.
+type regionList []string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (l *regionList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return json.Unmarshal(b, (*[]string)(l))
+	}
+	*l = nil
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			*l = append(*l, r)
+		}
+	}
+	return nil
 }
 
 func createCustomPlans(customPlansJSON string) ([]Plan, error) {
@@ -172,6 +356,15 @@ func createCustomPlans(customPlansJSON string) ([]Plan, error) {
 			ServiceID: p.ServiceID,
 			CRDBHost:  p.DBHost,
 			CRDBPort:  strconv.Itoa(p.DBPort),
+
+			SharedBindingRole: p.SharedBindingRole,
+			TerminateSessions: p.TerminateSessions,
+
+			PrimaryRegion: p.PrimaryRegion,
+			Regions:       p.Regions,
+			SurvivalGoal:  p.SurvivalGoal,
+
+			Isolation: p.Isolation,
 		})
 	}
 	return plans, nil
@@ -190,6 +383,24 @@ func InitServicesAndPlans() {
 	if len(services) == 0 {
 		log.Fatal("init", errors.New("no services"))
 	}
+	// brokerapi.ServiceMetadata has no shareable field; decode it separately.
+	var shareable []struct {
+		Metadata struct {
+			Shareable bool `json:"shareable"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal([]byte(servicesJSON), &shareable); err != nil {
+		log.Fatal("init-unmarshal-services", err)
+	}
+	for i := range services {
+		services[i].Shareable = shareable[i].Metadata.Shareable
+	}
+	if role := os.Getenv("SHARED_BINDING_ROLE"); role != "" {
+		if _, ok := bindingRoles[role]; !ok {
+			log.Fatal("init", fmt.Errorf("unknown SHARED_BINDING_ROLE '%s'", role))
+		}
+		defaultSharedBindingRole = role
+	}
 	for _, s := range services {
 		addService(s)
 	}
@@ -216,4 +427,3 @@ func InitServicesAndPlans() {
 		addPlan(p)
 	}
 }
-
@@ -35,7 +35,8 @@ func TestInit(t *testing.T) {
         "longDescription": "desc",
         "documentationUrl": "https://www.cockroachlabs.com/docs/",
         "supportUrl": "https://www.cockroachlabs.com/community/",
-        "imageUrl": "https://www.cockroachlabs.com/images/CockroachLabs_Logo_Mark-lightbackground.svg"
+        "imageUrl": "https://www.cockroachlabs.com/images/CockroachLabs_Logo_Mark-lightbackground.svg",
+        "shareable": true
       },
       "tags": ["cockroachdb", "relational"]
     }
@@ -70,7 +71,9 @@ func TestInit(t *testing.T) {
       "description":"plan2 desc",
       "service":"e2e250b5-73f8-45fd-9a7f-93c8dddc5f00",
       "host":"5.6.7.8",
-      "port":26257
+      "port":26257,
+      "shared_binding_role":"readwrite",
+      "terminate_sessions":true
     }
   }`)
 
@@ -136,8 +139,12 @@ func TestInit(t *testing.T) {
 					CRDBHost:      "5.6.7.8",
 					CRDBPort:      "26257",
 					CRDBAdminUser: "root",
+
+					SharedBindingRole: "readwrite",
+					TerminateSessions: true,
 				},
 			},
+			Shareable: true,
 		},
 	}
 
@@ -152,3 +159,25 @@ func TestInit(t *testing.T) {
 		t.Errorf("Expected\n%+v\ngot\n%+v", expected, Services)
 	}
 }
+
+func TestCreateCustomPlansRegions(t *testing.T) {
+	testCases := []struct {
+		regions  string
+		expected []string
+	}{
+		{`null`, nil},
+		{`""`, nil},
+		{`"us-west1, europe-west1"`, []string{"us-west1", "europe-west1"}},
+		{`["us-west1", "europe-west1"]`, []string{"us-west1", "europe-west1"}},
+	}
+	for _, tc := range testCases {
+		plans, err := createCustomPlans(`{"plan1": {"primary_region": "us-east1", "regions": ` + tc.regions + `}}`)
+		if err != nil {
+			t.Errorf("%s: %s", tc.regions, err)
+			continue
+		}
+		if !reflect.DeepEqual(plans[0].Regions, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.regions, tc.expected, plans[0].Regions)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Survival goals of multi-region databases.
+const (
+	survivalZone   = "zone"
+	survivalRegion = "region"
+)
+
+// minRegionSurvivalRegions is how many regions a database needs to survive
+// the failure of one.
+const minRegionSurvivalRegions = 3
+
+// regionConfig is the multi-region configuration of a database. A nil
+// *regionConfig is a database that isn't multi-region.
+type regionConfig struct {
+	PrimaryRegion string `json:"primary_region"`
+	// Regions are the database's regions other than the primary one.
+	Regions []string `json:"regions,omitempty"`
+	// SurvivalGoal is survivalZone (if empty) or survivalRegion.
+	SurvivalGoal string `json:"survival_goal,omitempty"`
+}
+
+// regionConfig returns the multi-region configuration of the plan's
+// databases, or nil if they aren't multi-region.
+func (p *Plan) regionConfig() *regionConfig {
+	if p.PrimaryRegion == "" {
+		return nil
+	}
+	return &regionConfig{
+		PrimaryRegion: p.PrimaryRegion,
+		Regions:       p.Regions,
+		SurvivalGoal:  p.SurvivalGoal,
+	}
+}
+
+// withParameters returns c (which may be nil) with the region parameters
+// applied. An empty primary_region makes the database single-region.
+func (c *regionConfig) withParameters(params provisionParameters) *regionConfig {
+	res := &regionConfig{}
+	if c != nil {
+		*res = *c
+	}
+	if params.PrimaryRegion != nil {
+		if *params.PrimaryRegion == "" {
+			res = &regionConfig{}
+		}
+		res.PrimaryRegion = *params.PrimaryRegion
+	}
+	if params.Regions != nil {
+		res.Regions = params.Regions
+	}
+	if params.SurvivalGoal != nil {
+		res.SurvivalGoal = *params.SurvivalGoal
+	}
+	if res.PrimaryRegion == "" && len(res.Regions) == 0 && res.SurvivalGoal == "" {
+		return nil
+	}
+	// Listing the primary region among the others is harmless.
+	var regions []string
+	for _, r := range res.Regions {
+		if r != res.PrimaryRegion && !containsString(regions, r) {
+			regions = append(regions, r)
+		}
+	}
+	res.Regions = regions
+	return res
+}
+
+// all returns the primary region followed by the others.
+func (c *regionConfig) all() []string {
+	if c == nil {
+		return nil
+	}
+	return append([]string{c.PrimaryRegion}, c.Regions...)
+}
+
+// survivalGoal returns the survival goal, or "" if the database isn't
+// multi-region.
+func (c *regionConfig) survivalGoal() string {
+	if c == nil {
+		return ""
+	}
+	if c.SurvivalGoal == "" {
+		return survivalZone
+	}
+	return c.SurvivalGoal
+}
+
+// validate checks that the configuration can be applied, without looking at
+// the cluster.
+func (c *regionConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.PrimaryRegion == "" {
+		return errors.New("regions and survival_goal require a primary_region")
+	}
+	switch c.SurvivalGoal {
+	case "", survivalZone:
+	case survivalRegion:
+		if n := len(c.all()); n < minRegionSurvivalRegions {
+			return fmt.Errorf(
+				"survival_goal %s requires at least %d regions, got %d", survivalRegion, minRegionSurvivalRegions, n,
+			)
+		}
+	default:
+		return fmt.Errorf("unknown survival_goal '%s' (must be %s or %s)", c.SurvivalGoal, survivalZone, survivalRegion)
+	}
+	return nil
+}
+
+// checkRegions validates c and checks that its regions exist on the plan's
+// cluster. Invalid configurations are the user's fault and fail with 400.
+func checkRegions(plan *Plan, c *regionConfig) error {
+	invalid := func(err error) error {
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("invalid regions: %s", err), http.StatusBadRequest, "check-regions",
+		)
+	}
+	if err := c.validate(); err != nil {
+		return invalid(err)
+	}
+	if c == nil {
+		return nil
+	}
+	if plan.Isolation == isolationSchema || plan.clusterPerInstance() {
+		return invalid(fmt.Errorf("plan %s has %s isolation", plan.Name, plan.Isolation))
+	}
+	available, err := queryStrings(plan.crdb, "SELECT region FROM [SHOW REGIONS FROM CLUSTER]")
+	if err != nil {
+		log.Error("list-regions", err)
+		return fmt.Errorf("listing regions: %s", err)
+	}
+	if len(available) == 0 {
+		return invalid(fmt.Errorf("the cluster of plan %s has no regions", plan.Name))
+	}
+	for _, r := range c.all() {
+		if !containsString(available, r) {
+			return invalid(fmt.Errorf(
+				"unknown region '%s' (available: %s)", r, strings.Join(available, ", "),
+			))
+		}
+	}
+	return nil
+}
+
+// setRegions changes the multi-region configuration of a database from old to
+// c. The statements are idempotent, so a failed change can be retried, and
+// ordered so that the database never has fewer regions than its survival
+// goal needs.
+func setRegions(crdb execer, dbName string, old, c *regionConfig) error {
+	alter := func(format string, args ...interface{}) error {
+		_, err := execWithRetry(crdb, fmt.Sprintf("ALTER DATABASE %s ", dbName)+fmt.Sprintf(format, args...))
+		return err
+	}
+	if c != nil {
+		if old == nil {
+			// Setting the primary region makes the database multi-region.
+			if err := alter("SET PRIMARY REGION %s", sqlIdent(c.PrimaryRegion)); err != nil {
+				return fmt.Errorf("setting primary region: %s", err)
+			}
+		}
+		for _, r := range c.all() {
+			if old == nil && r == c.PrimaryRegion || containsString(old.all(), r) {
+				continue
+			}
+			if err := alter("ADD REGION IF NOT EXISTS %s", sqlIdent(r)); err != nil {
+				return fmt.Errorf("adding region %s: %s", r, err)
+			}
+		}
+		if old != nil && c.PrimaryRegion != old.PrimaryRegion {
+			if err := alter("SET PRIMARY REGION %s", sqlIdent(c.PrimaryRegion)); err != nil {
+				return fmt.Errorf("setting primary region: %s", err)
+			}
+		}
+	}
+	if old.survivalGoal() == survivalRegion && c.survivalGoal() != survivalRegion {
+		if err := alter("SURVIVE ZONE FAILURE"); err != nil {
+			return fmt.Errorf("setting survival goal: %s", err)
+		}
+	}
+	// A database's primary region can only be dropped last.
+	var drop []string
+	if old != nil {
+		drop = append(append(drop, old.Regions...), old.PrimaryRegion)
+	}
+	for _, r := range drop {
+		if containsString(c.all(), r) {
+			continue
+		}
+		if err := alter("DROP REGION IF EXISTS %s", sqlIdent(r)); err != nil {
+			return fmt.Errorf("dropping region %s: %s", r, err)
+		}
+	}
+	if c.survivalGoal() == survivalRegion && old.survivalGoal() != survivalRegion {
+		if err := alter("SURVIVE REGION FAILURE"); err != nil {
+			return fmt.Errorf("setting survival goal: %s", err)
+		}
+	}
+	return nil
+}
+
+// sqlIdent quotes s as a SQL identifier.
+func sqlIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
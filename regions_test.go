@@ -0,0 +1,230 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// useRegions gives the fake cluster regions and makes the fake broker's plan
+// multi-region.
+func useRegions(b *fakeBroker, plan regionConfig) {
+	b.cluster.regions = []string{"europe-west1", "us-east1", "us-west1"}
+	b.plan.PrimaryRegion = plan.PrimaryRegion
+	b.plan.Regions = plan.Regions
+	b.plan.SurvivalGoal = plan.SurvivalGoal
+}
+
+// statusCode returns the status code of a broker error.
+func statusCode(err error) int {
+	if f, ok := err.(*brokerapi.FailureResponse); ok {
+		return f.ValidatedStatusCode(nil)
+	}
+	return http.StatusInternalServerError
+}
+
+func TestProvisionRegions(t *testing.T) {
+	testCases := []struct {
+		name   string
+		plan   regionConfig
+		params string
+		// expectedStatus is the status of the error, if any.
+		expectedStatus int
+		// expectedRegions are the database's regions, the primary first.
+		expectedRegions []string
+		expectedGoal    string
+	}{
+		{
+			name: "single region",
+		},
+		{
+			name:            "plan",
+			plan:            regionConfig{PrimaryRegion: "us-east1", Regions: []string{"us-west1"}},
+			expectedRegions: []string{"us-east1", "us-west1"},
+			expectedGoal:    survivalZone,
+		},
+		{
+			name: "parameters override plan",
+			plan: regionConfig{PrimaryRegion: "us-east1"},
+			params: `{"primary_region": "us-west1", "regions": ["us-east1", "europe-west1"],
+				"survival_goal": "region"}`,
+			expectedRegions: []string{"us-west1", "us-east1", "europe-west1"},
+			expectedGoal:    survivalRegion,
+		},
+		{
+			name:            "parameters on single region plan",
+			params:          `{"primary_region": "europe-west1"}`,
+			expectedRegions: []string{"europe-west1"},
+			expectedGoal:    survivalZone,
+		},
+		{
+			name:   "parameters disable regions",
+			plan:   regionConfig{PrimaryRegion: "us-east1", Regions: []string{"us-west1"}},
+			params: `{"primary_region": ""}`,
+		},
+		{
+			name:           "unknown region",
+			params:         `{"primary_region": "us-east1", "regions": ["asia-east1"]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "regions without primary region",
+			params:         `{"regions": ["us-east1"]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "region survival with two regions",
+			plan:           regionConfig{PrimaryRegion: "us-east1", Regions: []string{"us-west1"}},
+			params:         `{"survival_goal": "region"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unknown survival goal",
+			plan:           regionConfig{PrimaryRegion: "us-east1"},
+			params:         `{"survival_goal": "node"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			useRegions(b, tc.plan)
+			dbName := dbNameFromInstanceID("inst1")
+
+			_, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(tc.params), false)
+			if tc.expectedStatus != 0 {
+				if status := statusCode(err); status != tc.expectedStatus {
+					t.Fatalf("expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+				}
+				if b.cluster.databases[dbName] {
+					t.Error("database created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if regions := b.cluster.dbRegions[dbName]; !reflect.DeepEqual(regions, tc.expectedRegions) {
+				t.Errorf("expected regions %v, got %v", tc.expectedRegions, regions)
+			}
+			if goal := b.cluster.survivalGoals[dbName]; goal != tc.expectedGoal {
+				t.Errorf("expected survival goal %q, got %q", tc.expectedGoal, goal)
+			}
+			c, err := databaseComment(b.plan.crdb, b.plan.namespace("inst1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.Regions.all(), tc.expectedRegions) {
+				t.Errorf("expected regions %v in comment, got %v", tc.expectedRegions, c.Regions)
+			}
+		})
+	}
+}
+
+func TestUpdateRegions(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	useRegions(b, regionConfig{PrimaryRegion: "us-east1"})
+	ctx := context.Background()
+	dbName := dbNameFromInstanceID("inst1")
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	// Each update starts from the result of the previous one.
+	updates := []struct {
+		params         string
+		expectedStatus int
+		// expectedRegions are the database's regions, the primary first.
+		expectedRegions []string
+		expectedGoal    string
+	}{
+		{
+			params:          `{"regions": ["us-west1", "europe-west1"]}`,
+			expectedRegions: []string{"us-east1", "us-west1", "europe-west1"},
+			expectedGoal:    survivalZone,
+		},
+		{
+			params:          `{"survival_goal": "region"}`,
+			expectedRegions: []string{"us-east1", "us-west1", "europe-west1"},
+			expectedGoal:    survivalRegion,
+		},
+		{
+			// Region survival needs three regions.
+			params:          `{"regions": ["us-west1"]}`,
+			expectedStatus:  http.StatusBadRequest,
+			expectedRegions: []string{"us-east1", "us-west1", "europe-west1"},
+			expectedGoal:    survivalRegion,
+		},
+		{
+			params:          `{"regions": ["us-east1"], "primary_region": "europe-west1", "survival_goal": "zone"}`,
+			expectedRegions: []string{"europe-west1", "us-east1"},
+			expectedGoal:    survivalZone,
+		},
+		{
+			params:          `{"primary_region": "asia-east1"}`,
+			expectedStatus:  http.StatusBadRequest,
+			expectedRegions: []string{"europe-west1", "us-east1"},
+			expectedGoal:    survivalZone,
+		},
+		{
+			params:          `{"deletion_protection": false}`,
+			expectedRegions: []string{"europe-west1", "us-east1"},
+			expectedGoal:    survivalZone,
+		},
+		{
+			params: `{"primary_region": ""}`,
+		},
+		{
+			params:          `{"primary_region": "us-west1"}`,
+			expectedRegions: []string{"us-west1"},
+			expectedGoal:    survivalZone,
+		},
+	}
+	for _, u := range updates {
+		_, err := b.sb.Update(ctx, "inst1", brokerapi.UpdateDetails{
+			ServiceID:     b.plan.ServiceID,
+			PlanID:        b.plan.ID,
+			RawParameters: json.RawMessage(u.params),
+		}, false)
+		if u.expectedStatus != 0 {
+			if status := statusCode(err); status != u.expectedStatus {
+				t.Fatalf("%s: expected status %d, got %d (%v)", u.params, u.expectedStatus, status, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %s", u.params, err)
+		}
+		if regions := b.cluster.dbRegions[dbName]; !reflect.DeepEqual(regions, u.expectedRegions) {
+			t.Errorf("%s: expected regions %v, got %v", u.params, u.expectedRegions, regions)
+		}
+		if goal := b.cluster.survivalGoals[dbName]; goal != u.expectedGoal {
+			t.Errorf("%s: expected survival goal %q, got %q", u.params, u.expectedGoal, goal)
+		}
+		instance, err := b.sb.state.Instance("inst1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if regions := instance.Regions.all(); !reflect.DeepEqual(regions, u.expectedRegions) {
+			t.Errorf("%s: expected regions %v in record, got %v", u.params, u.expectedRegions, regions)
+		}
+	}
+}
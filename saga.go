@@ -0,0 +1,420 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Names of the sagas recorded in binding records.
+const (
+	sagaBind   = "bind"
+	sagaUnbind = "unbind"
+)
+
+// compensationAttempts is how many times a failed step is compensated before
+// the broker gives up on it; a variable for testing.
+var compensationAttempts = 3
+
+// sagaStep is a step of a saga.
+type sagaStep struct {
+	name string
+	do   func() error
+	// undo compensates do. It is called for steps that completed, but also
+	// for the step that was running when a broker died, so it must succeed
+	// if do had no effect. It is nil for steps with nothing to compensate.
+	undo func() error
+	// pivot is set for steps that can't be compensated. Once a pivot has
+	// completed, the saga can only go forward: later failures leave the
+	// completed steps in place, and the request has to be retried.
+	pivot bool
+}
+
+// sagaLog records the steps of a saga that have completed.
+type sagaLog struct {
+	Name  string   `json:"name"`
+	Steps []string `json:"steps"`
+}
+
+// saga runs a request that takes several statements as a sequence of steps
+// that are compensated if a later one fails, so that a failed request doesn't
+// leave half its changes behind.
+type saga struct {
+	name  string
+	steps []sagaStep
+	// record, if set, stores the log of the saga after each step (but the
+	// last) completes, so that the completed steps can be compensated if the
+	// broker dies.
+	record func(log *sagaLog) error
+	// compensationFailed, if set, is called with the first step that
+	// couldn't be compensated, if any.
+	compensationFailed func(step string, err error)
+}
+
+// run runs the steps of the saga in order. If one fails, the steps that
+// completed are compensated in reverse order and its error is returned. A
+// step whose error leaves it unknown whether it took effect (see isAmbiguous)
+// is compensated too, as when the broker dies while running it.
+func (s *saga) run() error {
+	l := &sagaLog{Name: s.name, Steps: []string{}}
+	for i, step := range s.steps {
+		if err := step.do(); err != nil {
+			if isAmbiguous(err) {
+				s.rollback(i + 1)
+			} else {
+				s.rollback(i)
+			}
+			return err
+		}
+		l.Steps = append(l.Steps, step.name)
+		if s.record == nil || i == len(s.steps)-1 {
+			continue
+		}
+		if err := s.record(l); err != nil {
+			log.Error("record-saga", err, lager.Data{"saga": s.name, "step": step.name})
+			s.rollback(i + 1)
+			return fmt.Errorf("recording %s: %s", step.name, err)
+		}
+	}
+	return nil
+}
+
+// rollback compensates the first n steps.
+func (s *saga) rollback(n int) {
+	if errs := s.compensate(n); len(errs) > 0 && s.compensationFailed != nil {
+		s.compensationFailed(errs[0].step, errs[0].err)
+	}
+}
+
+// compensationError is a step that couldn't be compensated.
+type compensationError struct {
+	step string
+	err  error
+}
+
+// compensate compensates the first n steps in reverse order, up to the last
+// pivot, trying each compensation compensationAttempts times. The steps that
+// couldn't be compensated are returned; later ones are compensated anyway.
+func (s *saga) compensate(n int) []compensationError {
+	var errs []compensationError
+	for i := n - 1; i >= 0 && !s.steps[i].pivot; i-- {
+		step := s.steps[i]
+		if step.undo == nil {
+			continue
+		}
+		delay := retryInitialDelay
+		var err error
+		for attempt := 1; ; attempt++ {
+			if err = step.undo(); err == nil || attempt == compensationAttempts {
+				break
+			}
+			retrySleep(delay)
+			delay *= 2
+		}
+		if err != nil {
+			log.Error("compensate-step", err, lager.Data{"saga": s.name, "step": step.name})
+			errs = append(errs, compensationError{step: step.name, err: err})
+		}
+	}
+	return errs
+}
+
+// bindSaga creates the user of a binding and grants it its role. The last
+// step marks the binding record ready.
+func (sb *crdbServiceBroker) bindSaga(plan *Plan, crdb *sql.DB, record *bindingRecord) *saga {
+	ns := plan.namespace(record.InstanceID)
+	user := userNameFromBinding(record.InstanceID, record.ID)
+	return &saga{
+		name: sagaBind,
+		steps: []sagaStep{
+			{
+				name: "create-user",
+				do: func() error {
+					// Not idempotent: if the result is lost, the saga
+					// compensates the step; see run.
+					_, err := execWithSafeRetry(crdb,
+						fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s'", user, record.Password),
+					)
+					if isAlreadyExists(err, objectRole) {
+						// The user wasn't created by a request we know
+						// about, so leave it alone.
+						return brokerapi.ErrBindingAlreadyExists
+					} else if err != nil {
+						log.Error("create-user", err)
+						if isPermissionDenied(err) {
+							return fmt.Errorf(
+								"creating user: %s (user %s needs the CREATEROLE privilege)", err, plan.CRDBAdminUser,
+							)
+						}
+						// Keep the kind of the error, which run looks at.
+						return &crdbError{kind: classifyError(err).kind, err: fmt.Errorf("creating user: %s", err)}
+					}
+					return nil
+				},
+				undo: func() error {
+					_, err := execWithRetry(crdb, "DROP USER IF EXISTS "+user)
+					return err
+				},
+			},
+			{
+				// The admin user of an instance in a shared Cloud cluster
+				// isn't an admin of the cluster; it needs the user's
+				// privileges to grant access to the tables the user
+				// creates, and to reassign them on unbind.
+				name: "grant-membership",
+				do: func() error {
+					if !plan.sharesCloudCluster() {
+						return nil
+					}
+					if _, err := execWithRetry(crdb,
+						fmt.Sprintf("GRANT %s TO %s", user, adminUserFromInstanceID(record.InstanceID)),
+					); err != nil {
+						log.Error("grant-membership", err)
+						return fmt.Errorf("granting membership: %s", err)
+					}
+					return nil
+				},
+			},
+			{
+				name: "grant-database",
+				do: func() error {
+					err := ns.grant(crdb, user, record.Role)
+					if ns.isNotFound(err) {
+						return brokerapi.ErrInstanceDoesNotExist
+					} else if err != nil {
+						log.Error("grant-privileges", err)
+						return fmt.Errorf("granting privileges: %s", err)
+					}
+					return nil
+				},
+				undo: func() error { return ns.revoke(crdb, user) },
+			},
+			{
+				name: "grant-tables",
+				do: func() error {
+					if err := ns.grantTables(crdb, user, record.Role); err != nil {
+						log.Error("grant-privileges", err)
+						return fmt.Errorf("granting privileges: %s", err)
+					}
+					return nil
+				},
+				undo: func() error { return ns.revokeTables(crdb, user) },
+			},
+			{
+				name: "comment-database",
+				do: func() error {
+					if err := updateDatabaseComment(crdb, ns, func(c *instanceComment) {
+						if c.Bindings == nil {
+							c.Bindings = make(map[string]*bindingComment)
+						}
+						c.Bindings[user] = &bindingComment{
+							BindingID: record.ID,
+							AppGUID:   record.AppGUID,
+							SpaceGUID: record.SpaceGUID,
+							Shared:    record.Shared,
+							Role:      record.Role,
+							CreatedAt: time.Now().UTC(),
+						}
+					}); err != nil {
+						log.Error("comment-database", err)
+						return fmt.Errorf("commenting database: %s", err)
+					}
+					return nil
+				},
+				undo: func() error {
+					return updateDatabaseComment(crdb, ns, func(c *instanceComment) {
+						delete(c.Bindings, user)
+					})
+				},
+			},
+			{
+				name: "store-binding",
+				do: func() error {
+					ready := *record
+					ready.State = stateReady
+					ready.Saga = nil
+					if err := sb.state.PutBinding(&ready); err != nil {
+						log.Error("store-binding", err)
+						return fmt.Errorf("storing binding: %s", err)
+					}
+					return nil
+				},
+			},
+		},
+		record: func(l *sagaLog) error {
+			record.Saga = l
+			return sb.state.PutBinding(record)
+		},
+		compensationFailed: func(step string, err error) {
+			sb.recordLeftoverUser(plan, record.InstanceID, user, fmt.Sprintf("compensating %s of bind %s: %s", step, record.ID, err))
+		},
+	}
+}
+
+// unbindSaga drops the user of a binding. record may be nil if the broker
+// doesn't know the binding. Privileges revoked before the user couldn't be
+// dropped are granted again; dropping the user is the pivot.
+func (sb *crdbServiceBroker) unbindSaga(
+	ctx context.Context, plan *Plan, crdb *sql.DB, instanceID, bindingID string, record *bindingRecord,
+) *saga {
+	ns := plan.namespace(instanceID)
+	user := userNameFromBinding(instanceID, bindingID)
+	// Privileges can only be granted again if we know the binding's role.
+	var regrant, regrantDatabase, regrantTables func() error
+	if record != nil {
+		regrant = func() error { return ns.grantRole(crdb, user, record.Role) }
+		regrantDatabase = func() error { return ns.grant(crdb, user, record.Role) }
+		regrantTables = func() error { return ns.grantTables(crdb, user, record.Role) }
+	}
+	s := &saga{
+		name: sagaUnbind,
+		steps: []sagaStep{
+			{
+				name: "terminate-sessions",
+				do: func() error {
+					if !sb.terminateSessions(plan, instanceID) {
+						return nil
+					}
+					if err := cancelSessions(crdb, plan.sessionTimeout(), userSessionsQuery, user); err != nil {
+						log.Error("cancel-sessions", err)
+						return fmt.Errorf("terminating sessions: %s", err)
+					}
+					return nil
+				},
+			},
+			{
+				// CockroachDB refuses to drop users that own objects, such
+				// as the tables the app created. The objects stay with
+				// their new owner, the instance's owner role, but DROP
+				// OWNED also revokes the user's privileges.
+				name: "reassign-owned",
+				do: func() error {
+					if err := reassignOwned(ctx, crdb, ns.database, user, ownerRoleFromInstanceID(instanceID)); err != nil {
+						log.Error("reassign-owned", err)
+						return fmt.Errorf("transferring ownership: %s", err)
+					}
+					return nil
+				},
+				undo: regrant,
+			},
+			{
+				name: "revoke-tables",
+				do: func() error {
+					err := ns.revokeTables(crdb, user)
+					if err != nil {
+						log.Error("revoke-grants", err)
+					}
+					return err
+				},
+				undo: regrantTables,
+			},
+			{
+				name: "revoke-database",
+				do: func() error {
+					err := ns.revoke(crdb, user)
+					if err != nil {
+						log.Error("revoke-grants", err)
+					}
+					return err
+				},
+				undo: regrantDatabase,
+			},
+			{
+				name: "drop-user",
+				do: func() error {
+					if _, err := execWithRetry(crdb, "DROP USER IF EXISTS "+user); err != nil {
+						log.Error("drop-user", err)
+						return fmt.Errorf("deleting user: %s", err)
+					}
+					return nil
+				},
+				pivot: true,
+			},
+			{
+				name: "comment-database",
+				do: func() error {
+					if err := updateDatabaseComment(crdb, ns, func(c *instanceComment) {
+						delete(c.Bindings, user)
+					}); err != nil {
+						log.Error("comment-database", err)
+						return fmt.Errorf("commenting database: %s", err)
+					}
+					return nil
+				},
+			},
+			{
+				name: "delete-binding",
+				do: func() error {
+					if record == nil {
+						return nil
+					}
+					if err := sb.state.DeleteBinding(record); err != nil && err != errStateNotFound {
+						log.Error("delete-binding", err)
+						return fmt.Errorf("deleting binding: %s", err)
+					}
+					return nil
+				},
+			},
+		},
+		compensationFailed: func(step string, err error) {
+			sb.recordLeftoverUser(plan, instanceID, user, fmt.Sprintf("compensating %s of unbind %s: %s", step, bindingID, err))
+		},
+	}
+	if record != nil {
+		s.record = func(l *sagaLog) error {
+			record.Saga = l
+			return sb.state.PutBinding(record)
+		}
+	}
+	return s
+}
+
+// recordLeftoverUser records a user that a failed saga couldn't clean up as
+// an orphan, so that the reconciler drops it once it no longer belongs to a
+// binding. If the instance has a cluster of its own, the user is recorded
+// against that cluster and the instance; see orphanRecord.InstanceID.
+func (sb *crdbServiceBroker) recordLeftoverUser(plan *Plan, instanceID, user, reason string) {
+	now := time.Now()
+	dropAfter := now.Add(sb.orphans.gracePeriod)
+	r := &orphanRecord{
+		Cluster:   net.JoinHostPort(plan.CRDBHost, plan.CRDBPort),
+		Kind:      orphanUser,
+		Name:      user,
+		FirstSeen: now,
+		DropAfter: &dropAfter,
+		Reason:    reason,
+		Owner:     ownerRoleFromInstanceID(instanceID),
+	}
+	if plan.clusterPerInstance() {
+		r.InstanceID = instanceID
+		instance, err := sb.state.Instance(instanceID)
+		if err != nil {
+			log.Error("store-orphan", err, lager.Data{"user": user, "instance-id": instanceID})
+			return
+		}
+		conn := plan.instanceConn(instance)
+		r.Cluster = net.JoinHostPort(conn.host, conn.port)
+	}
+	if err := sb.state.PutOrphan(r); err != nil {
+		log.Error("store-orphan", err, lager.Data{"user": user})
+	}
+}
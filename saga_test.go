@@ -0,0 +1,397 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// faultyKVStore is a kvStore whose writes fail when fail returns an error.
+type faultyKVStore struct {
+	kvStore
+	fail func(kind string, value []byte) error
+}
+
+func (s *faultyKVStore) Put(kind, key string, value []byte) error {
+	if err := s.fail(kind, value); err != nil {
+		return err
+	}
+	return s.kvStore.Put(kind, key, value)
+}
+
+var errFault = &pq.Error{Code: "XX000", Message: "injected fault"}
+
+func TestSagaCompensation(t *testing.T) {
+	var undone []string
+	step := func(name string, fail bool, pivot bool) sagaStep {
+		return sagaStep{
+			name: name,
+			do: func() error {
+				if fail {
+					return errors.New(name + " failed")
+				}
+				return nil
+			},
+			undo:  func() error { undone = append(undone, name); return nil },
+			pivot: pivot,
+		}
+	}
+	testCases := []struct {
+		name           string
+		steps          []sagaStep
+		expectedUndone []string
+	}{
+		{
+			name:           "success",
+			steps:          []sagaStep{step("a", false, false), step("b", false, false)},
+			expectedUndone: nil,
+		},
+		{
+			name:           "failure",
+			steps:          []sagaStep{step("a", false, false), step("b", false, false), step("c", true, false)},
+			expectedUndone: []string{"b", "a"},
+		},
+		{
+			name:           "failure after pivot",
+			steps:          []sagaStep{step("a", false, false), step("b", false, true), step("c", true, false)},
+			expectedUndone: nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			undone = nil
+			var logs [][]string
+			s := &saga{name: "test", steps: tc.steps, record: func(l *sagaLog) error {
+				logs = append(logs, append([]string(nil), l.Steps...))
+				return nil
+			}}
+			err := s.run()
+			if (err != nil) != (tc.expectedUndone != nil || tc.name == "failure after pivot") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(undone, tc.expectedUndone) {
+				t.Fatalf("expected %v to be compensated, got %v", tc.expectedUndone, undone)
+			}
+			if len(logs) == 0 || logs[0][0] != "a" {
+				t.Fatalf("expected completed steps to be recorded, got %v", logs)
+			}
+		})
+	}
+}
+
+func TestBindSagaFaults(t *testing.T) {
+	// Each case makes a step of the bind fail.
+	testCases := []struct {
+		step string
+		// pattern matches the statements to fail; if empty, the binding
+		// record is the one to fail to be stored.
+		pattern string
+		// storeFault fails storing binding records containing it.
+		storeFault    string
+		expectedError error
+	}{
+		{step: "create-user", pattern: `^CREATE USER`},
+		{step: "grant-database", pattern: `^GRANT \w+ ON DATABASE`},
+		{step: "grant-database (instance deleted)", pattern: `^GRANT \w+ ON DATABASE`,
+			expectedError: brokerapi.ErrInstanceDoesNotExist},
+		{step: "grant-tables", pattern: `^GRANT \w+ ON TABLE`},
+		{step: "comment-database", pattern: `^COMMENT ON DATABASE`},
+		{step: "record-step", storeFault: `"steps":["create-user"]`},
+		{step: "store-binding", storeFault: `"state":"ready"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.step, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			_, restore := stubRetrySleep()
+			defer restore()
+			ctx := context.Background()
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+				t.Fatal(err)
+			}
+			dbName := dbNameFromInstanceID("inst1")
+			user := userNameFromBinding("inst1", "bind1")
+
+			if tc.pattern != "" {
+				err := error(errFault)
+				if tc.expectedError != nil {
+					err = &pq.Error{Code: "3D000", Message: "database does not exist"}
+				}
+				b.cluster.injectFault(tc.pattern, err, 1)
+			}
+			b.sb.state.kv = &faultyKVStore{kvStore: b.sb.state.kv, fail: func(kind string, value []byte) error {
+				if tc.storeFault != "" && kind == kindBinding && bytes.Contains(value, []byte(tc.storeFault)) {
+					return errFault
+				}
+				return nil
+			}}
+
+			_, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			})
+			if err == nil {
+				t.Fatal("expected bind to fail")
+			}
+			if tc.expectedError != nil && err != tc.expectedError {
+				t.Fatalf("expected %v, got %v", tc.expectedError, err)
+			}
+
+			if b.cluster.hasUser(user) {
+				t.Errorf("user not dropped")
+			}
+			if _, ok := b.cluster.grants[dbName][user]; ok {
+				t.Errorf("privileges not revoked")
+			}
+			if strings.Contains(b.cluster.comments[dbName], "bind1") {
+				t.Errorf("binding left in comment: %s", b.cluster.comments[dbName])
+			}
+			if _, err := b.sb.state.Binding("inst1", "bind1"); err != errStateNotFound {
+				t.Errorf("expected binding record to be deleted, got %v", err)
+			}
+			if orphans, err := b.sb.state.Orphans(); err != nil || len(orphans) != 0 {
+				t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+			}
+
+			// The bind can be retried once the fault is gone.
+			b.sb.state.kv = b.sb.state.kv.(*faultyKVStore).kvStore
+			if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if b.cluster.grants[dbName][user] != "ALL" {
+				t.Errorf("privileges not granted on retry")
+			}
+		})
+	}
+}
+
+func TestBindSagaCompensationFails(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.sb.state.kv = durableKVStore{newMemKVStore()}
+	_, restore := stubRetrySleep()
+	defer restore()
+	ctx := context.Background()
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	user := userNameFromBinding("inst1", "bind1")
+
+	b.cluster.injectFault(`^COMMENT ON DATABASE`, errFault, 1)
+	// The privileges on the database can't be revoked, so the user can't be
+	// dropped either.
+	b.cluster.injectFault(`^REVOKE ALL ON DATABASE`, errFault, -1)
+	if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	}); err == nil {
+		t.Fatal("expected bind to fail")
+	}
+	if !b.cluster.hasUser(user) {
+		t.Fatal("expected user to be left behind")
+	}
+	orphans, err := b.sb.state.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].Name != user || orphans[0].Kind != orphanUser ||
+		!strings.Contains(orphans[0].Reason, "grant-database") {
+		t.Fatalf("expected user to be recorded as an orphan, got %+v", orphans)
+	}
+
+	// The reconciler keeps the reason and drops the user once the faults
+	// are gone.
+	b.cluster.clearFaults()
+	b.sb.orphans.gracePeriod = 0
+	dropped, err := b.sb.dropOrphans(orphans[0].FirstSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 1 || dropped[0].Reason != orphans[0].Reason {
+		t.Fatalf("expected the user to be dropped, got %+v", dropped)
+	}
+	if b.cluster.hasUser(user) {
+		t.Fatal("user not dropped")
+	}
+}
+
+func TestBindSagaCompensationFailsTenant(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	defer useFakeInstanceConnect(b.cluster)()
+	b.plan.Isolation = isolationTenant
+	b.sb.state.kv = durableKVStore{newMemKVStore()}
+	_, restore := stubRetrySleep()
+	defer restore()
+	ctx := context.Background()
+	spec, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData); res.State != brokerapi.Succeeded {
+		t.Fatalf("provision %s: %s", res.State, res.Description)
+	}
+	tenant := b.cluster.tenants[clusterNameFromInstanceID("inst1")]
+	user := userNameFromBinding("inst1", "bind1")
+
+	tenant.injectFault(`^COMMENT ON DATABASE`, errFault, 1)
+	tenant.injectFault(`^REVOKE ALL ON DATABASE`, errFault, -1)
+	if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	}); err == nil {
+		t.Fatal("expected bind to fail")
+	}
+	if !tenant.hasUser(user) {
+		t.Fatal("expected user to be left behind in the virtual cluster")
+	}
+	// The user is recorded against the instance, as the host cluster's
+	// address doesn't tell virtual clusters apart.
+	orphans, err := b.sb.findOrphans(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].Name != user || orphans[0].InstanceID != "inst1" ||
+		!strings.Contains(orphans[0].Reason, "grant-database") {
+		t.Fatalf("expected user to be recorded as an orphan of inst1, got %+v", orphans)
+	}
+
+	tenant.clearFaults()
+	b.sb.orphans.gracePeriod = 0
+	dropped, err := b.sb.dropOrphans(orphans[0].FirstSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 1 {
+		t.Fatalf("expected the user to be dropped, got %+v", dropped)
+	}
+	if tenant.hasUser(user) {
+		t.Fatal("user not dropped from the virtual cluster")
+	}
+	if orphans, err := b.sb.state.Orphans(); err != nil || len(orphans) != 0 {
+		t.Fatalf("expected no orphans left, got %+v (%v)", orphans, err)
+	}
+}
+
+func TestUnbindSagaFaults(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pattern string
+		// expectBound is set if the binding should still work after the
+		// failure.
+		expectBound bool
+	}{
+		{name: "reassign-owned", pattern: `^REASSIGN OWNED`, expectBound: true},
+		{name: "revoke-database", pattern: `^REVOKE ALL ON DATABASE`, expectBound: true},
+		{name: "drop-user", pattern: `^DROP USER`, expectBound: true},
+		// Once the user is dropped, the unbind can only go forward.
+		{name: "comment-database", pattern: `^COMMENT ON DATABASE`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			_, restore := stubRetrySleep()
+			defer restore()
+			ctx := context.Background()
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+				ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			dbName := dbNameFromInstanceID("inst1")
+			user := userNameFromBinding("inst1", "bind1")
+			details := brokerapi.UnbindDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID}
+
+			b.cluster.injectFault(tc.pattern, errFault, 1)
+			if err := b.sb.Unbind(ctx, "inst1", "bind1", details); err == nil {
+				t.Fatal("expected unbind to fail")
+			}
+			bound := b.cluster.hasUser(user) && b.cluster.grants[dbName][user] == "ALL"
+			if bound != tc.expectBound {
+				t.Fatalf("expected binding to work: %t, got %t", tc.expectBound, bound)
+			}
+			r, err := b.sb.state.Binding("inst1", "bind1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Saga == nil || r.Saga.Name != sagaUnbind {
+				t.Fatalf("expected unbind steps to be recorded, got %+v", r.Saga)
+			}
+			if orphans, err := b.sb.state.Orphans(); err != nil || len(orphans) != 0 {
+				t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+			}
+
+			// The platform retries the unbind.
+			if err := b.sb.Unbind(ctx, "inst1", "bind1", details); err != nil {
+				t.Fatal(err)
+			}
+			if b.cluster.hasUser(user) {
+				t.Errorf("user not dropped")
+			}
+			if _, err := b.sb.state.Binding("inst1", "bind1"); err != errStateNotFound {
+				t.Errorf("expected binding record to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRecoverBindSaga(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	dbName := dbNameFromInstanceID("inst1")
+	user := userNameFromBinding("inst1", "bind1")
+
+	// The broker died while granting privileges on the database, after
+	// recording that it had created the user: the grant went through.
+	record := &bindingRecord{
+		ID: "bind1", InstanceID: "inst1", Role: roleReadWrite, State: statePending,
+		Saga: &sagaLog{Name: sagaBind, Steps: []string{"create-user", "grant-membership"}},
+	}
+	if err := b.sb.state.PutBinding(record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.plan.crdb.Exec("CREATE USER " + user + " WITH PASSWORD 'x'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := grantDatabase(b.plan.crdb, dbName, user, roleReadWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.sb.recoverRequests(); err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.hasUser(user) {
+		t.Errorf("user not dropped")
+	}
+	if _, err := b.sb.state.Binding("inst1", "bind1"); err != errStateNotFound {
+		t.Errorf("expected binding record to be deleted, got %v", err)
+	}
+}
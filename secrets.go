@@ -0,0 +1,194 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// sealedPrefix marks the secrets encrypted by a secretBox. Records written
+// before the broker had a key hold their secrets in plain text.
+const sealedPrefix = "sealed:v1:"
+
+// secretBox encrypts the secrets the broker keeps in its state (binding and
+// admin passwords) with AES-256-GCM, so that reading the metadata database
+// isn't enough to connect to the instances. A nil secretBox leaves secrets
+// in plain text, which is only used when the state is kept in memory.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+// newSecretBox returns a secretBox using the given base64-encoded 32-byte
+// key.
+func newSecretBox(encodedKey string) (*secretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key: expected 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+// seal encrypts a secret. Empty secrets stay empty.
+func (b *secretBox) seal(s string) (string, error) {
+	if b == nil || s == "" {
+		return s, nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(s), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a secret returned by seal. Secrets stored in plain text are
+// returned as they are.
+func (b *secretBox) open(s string) (string, error) {
+	if !isSealed(s) {
+		return s, nil
+	}
+	if b == nil {
+		return "", errors.New("found an encrypted secret, but STATE_ENCRYPTION_KEY is not set")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("decoding secret: %s", err)
+	}
+	n := b.aead.NonceSize()
+	if len(data) < n {
+		return "", errors.New("decoding secret: too short")
+	}
+	plain, err := b.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting secret: %s", err)
+	}
+	return string(plain), nil
+}
+
+func isSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix)
+}
+
+// plaintextSecrets returns the IDs of the instances whose record, or the
+// record of one of whose bindings, holds a secret in plain text.
+func (s *brokerState) plaintextSecrets() ([]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	err := s.list(kindInstance, "", func(data []byte) error {
+		var r instanceRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if r.AdminPassword != "" && !isSealed(r.AdminPassword) {
+			add(r.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range []string{kindBinding, kindSharedBinding} {
+		err := s.list(kind, "", func(data []byte) error {
+			var r bindingRecord
+			if err := json.Unmarshal(data, &r); err != nil {
+				return err
+			}
+			if r.Password != "" && !isSealed(r.Password) {
+				add(r.InstanceID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// sealStoredSecrets encrypts the secrets that records written before the
+// broker had a key hold in plain text, by writing these records again.
+// Instances that are locked by a request are skipped, and logged; their
+// records are encrypted the next time they are written, or when the broker
+// restarts.
+func (sb *crdbServiceBroker) sealStoredSecrets() error {
+	if sb.state.secrets == nil {
+		return nil
+	}
+	ids, err := sb.state.plaintextSecrets()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := sb.sealInstanceSecrets(id); err != nil {
+			log.Error("seal-secrets", err, lager.Data{"instance-id": id})
+		}
+	}
+	return nil
+}
+
+func (sb *crdbServiceBroker) sealInstanceSecrets(instanceID string) error {
+	unlock, err := sb.lockInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	instance, err := sb.state.Instance(instanceID)
+	if err == nil {
+		if err := sb.state.PutInstance(instance); err != nil {
+			return err
+		}
+	} else if err != errStateNotFound {
+		return err
+	}
+	for _, shared := range []bool{false, true} {
+		bindings, err := sb.state.Bindings(instanceID, shared)
+		if err != nil {
+			return err
+		}
+		for _, b := range bindings {
+			if err := sb.state.PutBinding(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
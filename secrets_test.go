@@ -0,0 +1,131 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+const testStateKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSecretBox(t *testing.T) {
+	for _, key := range []string{"", "not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := newSecretBox(key); err == nil {
+			t.Errorf("%q: expected error", key)
+		}
+	}
+	box, err := newSecretBox(testStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.seal("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || bytes.Contains([]byte(sealed), []byte("pass")) {
+		t.Errorf("expected an encrypted secret, got %q", sealed)
+	}
+	if opened, err := box.open(sealed); err != nil || opened != "pass" {
+		t.Errorf("expected pass, got %q (%v)", opened, err)
+	}
+	// Secrets stored before the broker had a key are read as they are.
+	if opened, err := box.open("pass"); err != nil || opened != "pass" {
+		t.Errorf("expected pass, got %q (%v)", opened, err)
+	}
+	// Without the key, or with another one, encrypted secrets can't be read.
+	var noKey *secretBox
+	if _, err := noKey.open(sealed); err == nil {
+		t.Error("expected error without a key")
+	}
+	other, err := newSecretBox(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.open(sealed); err == nil {
+		t.Error("expected error with another key")
+	}
+}
+
+func TestSealStoredSecrets(t *testing.T) {
+	kv := newMemKVStore()
+	// Records written without a key, as by earlier versions of the broker.
+	plain := newBrokerState(kv)
+	if err := plain.PutInstance(&instanceRecord{ID: "inst1", AdminPassword: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.PutBinding(&bindingRecord{ID: "bind1", InstanceID: "inst1", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.PutBinding(&bindingRecord{ID: "bind2", InstanceID: "inst2", Shared: true, Password: "pass2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	state := newBrokerState(kv)
+	var err error
+	if state.secrets, err = newSecretBox(testStateKey); err != nil {
+		t.Fatal(err)
+	}
+	sb := newCRDBServiceBroker(state)
+	// inst2 is busy; its records are left for later.
+	unlock, err := sb.lockInstance("inst2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.sealStoredSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := state.plaintextSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "inst2" {
+		t.Errorf("expected inst2 left in plain text, got %v", ids)
+	}
+	unlock()
+	if err := sb.sealStoredSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	for kind, values := range kv.data {
+		for key, value := range values {
+			for _, secret := range []string{"admin", "pass", "pass2"} {
+				if bytes.Contains(value, []byte(`"`+secret+`"`)) {
+					t.Errorf("%s/%s: %s stored in plain text: %s", kind, key, secret, value)
+				}
+			}
+		}
+	}
+
+	// The records still hold the passwords.
+	instance, err := state.Instance("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.AdminPassword != "admin" {
+		t.Errorf("expected admin password admin, got %q", instance.AdminPassword)
+	}
+	bindings, err := state.AllBindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 2 || bindings[0].Password != "pass" || bindings[1].Password != "pass2" {
+		t.Errorf("unexpected bindings %+v", bindings)
+	}
+	// Without the key, the broker refuses to use them.
+	if _, err := plain.Binding("inst1", "bind1"); err == nil {
+		t.Error("expected error without a key")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const defaultSessionTerminationTimeout = 10 * time.Second
+
+// sessionPollInterval is how often cancelSessions checks whether the
+// cancelled sessions are gone.
+var sessionPollInterval = 250 * time.Millisecond
+
+// terminateSessions reports whether the sessions of an instance's users
+// should be cancelled before the users or the database are dropped.
+func (sb *crdbServiceBroker) terminateSessions(plan *Plan, instanceID string) bool {
+	instance, err := sb.state.Instance(instanceID)
+	if err == nil && instance.TerminateSessions != nil {
+		return *instance.TerminateSessions
+	}
+	return plan.TerminateSessions
+}
+
+// userSessionsQuery lists the sessions of a user.
+const userSessionsQuery = "SELECT session_id FROM [SHOW CLUSTER SESSIONS] WHERE user_name = $1"
+
+// instanceSessionsQuery returns a query listing all the sessions that can
+// reach an instance's objects, whoever their user, along with its
+// arguments: in a cluster of the instance's own, every session; otherwise,
+// the sessions on the instance's database, limited under schema isolation
+// to the users with privileges on its schema. The broker's own sessions are
+// left alone.
+func instanceSessionsQuery(plan *Plan, ns instanceNamespace) (string, []interface{}) {
+	if plan.clusterPerInstance() && !plan.sharesCloudCluster() {
+		return "SELECT session_id FROM [SHOW CLUSTER SESSIONS] WHERE user_name != current_user()", nil
+	}
+	query := "SELECT session_id FROM crdb_internal.cluster_sessions WHERE database = $1 AND user_name != current_user()"
+	if ns.schema != "" {
+		query += fmt.Sprintf(" AND user_name IN (SELECT grantee FROM [SHOW GRANTS ON SCHEMA %s])", ns)
+	}
+	return query, []interface{}{ns.database}
+}
+
+// cancelSessions cancels the sessions the query lists on every node of the
+// cluster and waits up to timeout for them to end. Sessions that survive
+// are logged, not treated as errors: dropping the users or database is what
+// the caller is about to do regardless.
+func cancelSessions(crdb *sql.DB, timeout time.Duration, query string, args ...interface{}) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		sessions, err := queryStrings(crdb, query, args...)
+		if err != nil {
+			return fmt.Errorf("listing sessions: %s", err)
+		}
+		if len(sessions) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			log.Info("sessions-not-terminated", lager.Data{"sessions": sessions})
+			return nil
+		}
+		for _, id := range sessions {
+			if _, err := crdb.Exec("CANCEL SESSION IF EXISTS $1", id); err != nil {
+				log.Error("cancel-session", err, lager.Data{"session": id})
+			}
+		}
+		time.Sleep(sessionPollInterval)
+	}
+}
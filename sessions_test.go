@@ -0,0 +1,159 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestTerminateSessions(t *testing.T) {
+	defer func(d time.Duration) { sessionPollInterval = d }(sessionPollInterval)
+	sessionPollInterval = time.Millisecond
+
+	testCases := []struct {
+		name string
+		// isolation is the plan's isolation, database if empty.
+		isolation string
+		// planSetting is the plan's terminateSessions.
+		planSetting bool
+		// params are the provision parameters.
+		params string
+		// ignoreCancel makes CANCEL SESSION fail.
+		ignoreCancel bool
+		// deprovision deprovisions the instance instead of unbinding bind1.
+		deprovision bool
+		// expected lists the sessions that remain, among those of bind1
+		// (s1), bind2 (s2), the broker (s3) and a user the broker doesn't
+		// know (s4) on the instance's namespace, and of a user of
+		// another namespace (s5).
+		expected []string
+	}{
+		{
+			name:     "disabled",
+			expected: []string{"s1", "s2", "s3", "s4", "s5"},
+		},
+		{
+			name:        "enabled by plan",
+			planSetting: true,
+			expected:    []string{"s2", "s3", "s4", "s5"},
+		},
+		{
+			name:     "enabled by parameter",
+			params:   `{"terminate_sessions": true}`,
+			expected: []string{"s2", "s3", "s4", "s5"},
+		},
+		{
+			name:        "disabled by parameter",
+			planSetting: true,
+			params:      `{"terminate_sessions": false}`,
+			expected:    []string{"s1", "s2", "s3", "s4", "s5"},
+		},
+		{
+			name:        "deprovision",
+			planSetting: true,
+			deprovision: true,
+			expected:    []string{"s3", "s5"},
+		},
+		{
+			name:        "deprovision schema",
+			isolation:   isolationSchema,
+			planSetting: true,
+			deprovision: true,
+			expected:    []string{"s3", "s5"},
+		},
+		{
+			// Unbind goes ahead after the timeout.
+			name:         "sessions survive",
+			planSetting:  true,
+			ignoreCancel: true,
+			expected:     []string{"s1", "s2", "s3", "s4", "s5"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			if tc.isolation != "" {
+				b.plan.Isolation = tc.isolation
+			}
+			b.plan.TerminateSessions = tc.planSetting
+			b.plan.sessionTerminationTimeout = 20 * time.Millisecond
+			ctx := context.Background()
+
+			if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(tc.params), false); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"bind1", "bind2"} {
+				if _, err := b.sb.Bind(ctx, "inst1", id, brokerapi.BindDetails{
+					ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app-" + id,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ns := b.plan.namespace("inst1")
+			otherDB := "otherdb"
+			if ns.schema != "" {
+				// Users of other schemas share the database.
+				otherDB = ns.database
+				b.cluster.grants[ns.String()]["stranger"] = "SELECT"
+			}
+			b.cluster.sessions["s1"] = fakeSession{userNameFromBinding("inst1", "bind1"), ns.database}
+			b.cluster.sessions["s2"] = fakeSession{userNameFromBinding("inst1", "bind2"), ns.database}
+			b.cluster.sessions["s3"] = fakeSession{"root", ns.database}
+			b.cluster.sessions["s4"] = fakeSession{"stranger", ns.database}
+			b.cluster.sessions["s5"] = fakeSession{"neighbour", otherDB}
+			if tc.ignoreCancel {
+				b.cluster.fail = func(stmt string) error {
+					if strings.HasPrefix(stmt, "CANCEL") {
+						return errors.New("cannot cancel session")
+					}
+					return nil
+				}
+			}
+
+			if tc.deprovision {
+				if _, err := b.sb.Deprovision(ctx, "inst1", brokerapi.DeprovisionDetails{
+					ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err := b.sb.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+					ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var remaining []string
+			for id := range b.cluster.sessions {
+				remaining = append(remaining, id)
+			}
+			sort.Strings(remaining)
+			if fmt.Sprint(remaining) != fmt.Sprint(tc.expected) {
+				t.Errorf("expected sessions %v to remain, got %v", tc.expected, remaining)
+			}
+		})
+	}
+}
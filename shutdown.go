@@ -0,0 +1,221 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// defaultShutdownTimeout is how long the broker waits for requests and
+// operations to finish when it is told to stop. Cloud Foundry kills apps 10s
+// after asking them to stop.
+const defaultShutdownTimeout = 8 * time.Second
+
+// interruptedProvisionReason is reported by LastOperation for instances whose
+// provisioning was interrupted.
+const interruptedProvisionReason = "provisioning was interrupted by a broker restart; please retry"
+
+// shutdown keeps the broker from starting operations and waits until ctx is
+// done for the running ones. Operations still running then are checkpointed:
+// their leases are released so that another replica, or the broker once it
+// restarts, resumes them right away.
+func (sb *crdbServiceBroker) shutdown(ctx context.Context) {
+	sb.opsMu.Lock()
+	sb.stopping = true
+	sb.opsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sb.opsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	sb.opsMu.Lock()
+	defer sb.opsMu.Unlock()
+	for op, holder := range sb.running {
+		checkpoint := *op
+		checkpoint.Description = "interrupted by a broker shutdown; will be resumed"
+		if err := sb.state.PutOperation(&checkpoint); err != nil {
+			log.Error("checkpoint-operation", err, lager.Data{"operation-id": op.ID})
+			continue
+		}
+		if err := sb.state.leases.Release(operationLease(op), holder); err != nil {
+			log.Error("release-lease", err, lager.Data{"operation-id": op.ID})
+		}
+		delete(sb.running, op)
+	}
+}
+
+// closePlans closes the connection pools of all plans.
+func closePlans() {
+	for _, s := range Services {
+		for i := range s.Plans {
+			if db := s.Plans[i].crdb; db != nil {
+				if err := db.Close(); err != nil {
+					log.Error("close-plan", err, lager.Data{"plan": s.Plans[i].ID})
+				}
+			}
+		}
+	}
+}
+
+// recoverRequests cleans up after the provision and bind requests that were
+// interrupted, i.e. whose records are still pending although no request holds
+// the lease on their instance. Half-created databases and users are dropped;
+// interrupted provisions are marked failed so that LastOperation can tell the
+// platform, and interrupted bindings are forgotten. Instances with a cluster
+// of their own whose operation failed without cleaning up are recovered too;
+// see recoverInstanceOperation.
+func (sb *crdbServiceBroker) recoverRequests() error {
+	instances, err := sb.state.Instances()
+	if err != nil {
+		return err
+	}
+	for _, r := range instances {
+		var recover func() error
+		switch r.State {
+		case statePending:
+			recover = func() error { return sb.failProvision(r.ID) }
+		case stateProvisioning, stateDeprovisioning:
+			recover = func() error { return sb.recoverInstanceOperation(r.ID) }
+		default:
+			continue
+		}
+		if err := sb.withInstanceLock(r.ID, recover); err != nil {
+			return fmt.Errorf("recovering instance %s: %s", r.ID, err)
+		}
+	}
+
+	bindings, err := sb.state.AllBindings()
+	if err != nil {
+		return err
+	}
+	for _, r := range bindings {
+		if r.State != statePending {
+			continue
+		}
+		if err := sb.withInstanceLock(r.InstanceID, func() error {
+			return sb.rollbackBinding(r.InstanceID, r.ID)
+		}); err != nil {
+			return fmt.Errorf("recovering binding %s: %s", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// withInstanceLock runs fn with the lease on an instance. Nothing is done if
+// a request holds the lease.
+func (sb *crdbServiceBroker) withInstanceLock(instanceID string, fn func() error) error {
+	unlock, err := sb.lockInstance(instanceID)
+	if err == errConcurrentOperation {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+func (sb *crdbServiceBroker) failProvision(instanceID string) error {
+	// Look again now that we hold the lease.
+	r, err := sb.state.Instance(instanceID)
+	if err == errStateNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if r.State != statePending {
+		return nil
+	}
+	plan, err := findPlan(r.ServiceID, r.PlanID)
+	if err != nil {
+		return err
+	}
+
+	ns := plan.namespace(instanceID)
+	comment, err := databaseComment(plan.crdb, ns)
+	if err != nil {
+		return err
+	}
+	// Only drop the database if its comment says it is this instance's. The
+	// broker may have died between creating the database and commenting
+	// it, but an uncommented database may as well be someone else's, so it
+	// is left for an operator to look at.
+	switch {
+	case comment == nil:
+	case comment.InstanceID == instanceID:
+		if err := ns.drop(plan.crdb); err != nil {
+			return fmt.Errorf("dropping database: %s", err)
+		}
+		if _, err := execWithRetry(plan.crdb, "DROP ROLE IF EXISTS "+ownerRoleFromInstanceID(instanceID)); err != nil {
+			return fmt.Errorf("dropping owner role: %s", err)
+		}
+	default:
+		log.Info("interrupted-provision-kept-database", lager.Data{
+			"instance-id": instanceID, "database": ns.String(), "comment-instance-id": comment.InstanceID,
+		})
+	}
+
+	log.Info("interrupted-provision", lager.Data{"instance-id": instanceID})
+	r.State = stateFailed
+	r.FailureReason = interruptedProvisionReason
+	return sb.state.PutInstance(r)
+}
+
+func (sb *crdbServiceBroker) rollbackBinding(instanceID, bindingID string) error {
+	r, err := sb.state.Binding(instanceID, bindingID)
+	if err == errStateNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if r.State != statePending {
+		return nil
+	}
+
+	_, plan, err := sb.instancePlan(instanceID)
+	if err == nil {
+		// Compensate the steps that completed and the one that was running,
+		// which may have completed too. Records written before sagas were
+		// recorded get all their steps compensated.
+		crdb, err := sb.instanceDB(plan, instanceID)
+		if err != nil {
+			return err
+		}
+		s := sb.bindSaga(plan, crdb, r)
+		n := len(s.steps)
+		if r.Saga != nil && r.Saga.Name == sagaBind && len(r.Saga.Steps) < n {
+			n = len(r.Saga.Steps) + 1
+		}
+		if errs := s.compensate(n); len(errs) > 0 {
+			return fmt.Errorf("compensating %s: %s", errs[0].step, errs[0].err)
+		}
+	} else if err != brokerapi.ErrInstanceDoesNotExist {
+		return err
+	}
+
+	log.Info("interrupted-bind", lager.Data{"instance-id": instanceID, "binding-id": bindingID})
+	return sb.state.DeleteBinding(r)
+}
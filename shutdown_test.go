@@ -0,0 +1,253 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestRecoverRequests(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, id := range []string{"inst1", "inst2", "inst3"} {
+		if _, err := b.sb.Provision(ctx, id, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.sb.Bind(ctx, "inst3", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The broker died while provisioning inst1 and inst2 and binding bind1,
+	// but another replica is still working on inst2.
+	for _, id := range []string{"inst1", "inst2"} {
+		r, err := b.sb.state.Instance(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.State = statePending
+		if err := b.sb.state.PutInstance(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	binding, err := b.sb.state.Binding("inst3", "bind1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding.State = statePending
+	if err := b.sb.state.PutBinding(binding); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sb.state.leases.Acquire("instance/inst2", "other", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.sb.recoverRequests(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.cluster.databases[dbNameFromInstanceID("inst1")] {
+		t.Errorf("database of inst1 not dropped")
+	}
+	op, err := b.sb.LastOperation(ctx, "inst1", operationProvision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != brokerapi.Failed || op.Description != interruptedProvisionReason {
+		t.Errorf("expected inst1 to have failed, got %+v", op)
+	}
+	if op, err := b.sb.LastOperation(ctx, "inst2", operationProvision); err != nil {
+		t.Fatal(err)
+	} else if op.State != brokerapi.InProgress || !b.cluster.databases[dbNameFromInstanceID("inst2")] {
+		t.Errorf("expected inst2 to be left alone, got %+v", op)
+	}
+	user := userNameFromBinding("inst3", "bind1")
+	if b.cluster.hasUser(user) {
+		t.Errorf("user of bind1 not dropped")
+	}
+	if _, err := b.sb.state.Binding("inst3", "bind1"); err != errStateNotFound {
+		t.Errorf("expected bind1 to be forgotten, got %v", err)
+	}
+	if c := b.cluster.comments[dbNameFromInstanceID("inst3")]; strings.Contains(c, user) {
+		t.Errorf("bind1 still in database comment: %s", c)
+	}
+
+	// The platform retries the failed provision.
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if op, err := b.sb.LastOperation(ctx, "inst1", operationProvision); err != nil {
+		t.Fatal(err)
+	} else if op.State != brokerapi.Succeeded {
+		t.Errorf("expected inst1 to be provisioned, got %+v", op)
+	}
+}
+
+// TestRecoverProvisionKeepsDatabases checks that recovering an interrupted
+// provision leaves databases that aren't commented as the instance's alone.
+func TestRecoverProvisionKeepsDatabases(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	ctx := context.Background()
+
+	testCases := []struct {
+		instanceID, comment string
+	}{
+		{"inst1", ""},
+		{"inst2", `{"instance_id":"other"}`},
+	}
+	for _, tc := range testCases {
+		// The platform retries the provision while the broker is down, and
+		// another request creates a database with the same name.
+		if err := b.sb.state.PutInstance(&instanceRecord{
+			ID: tc.instanceID, ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, State: statePending,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		dbName := dbNameFromInstanceID(tc.instanceID)
+		b.cluster.databases[dbName] = true
+		b.cluster.comments[dbName] = tc.comment
+	}
+
+	if err := b.sb.recoverRequests(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		if !b.cluster.databases[dbNameFromInstanceID(tc.instanceID)] {
+			t.Errorf("%s: database dropped", tc.instanceID)
+		}
+		op, err := b.sb.LastOperation(ctx, tc.instanceID, operationProvision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op.State != brokerapi.Failed {
+			t.Errorf("%s: expected the provision to have failed, got %+v", tc.instanceID, op)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	other, server := b.newReplica()
+	defer server.Close()
+	b.plan.Backups = &backupConfig{URI: "nodelocal://1/backups"}
+	ctx := context.Background()
+
+	for _, id := range []string{"inst1", "inst2"} {
+		if _, err := b.sb.Provision(ctx, id, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hold the first backup until the broker has shut down.
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	b.cluster.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "BACKUP") {
+			b.cluster.fail = nil
+			close(blocked)
+			<-unblock
+		}
+		return nil
+	}
+	op, err := b.sb.startBackup("inst1", false /* scheduled */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-blocked
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	b.sb.shutdown(shutdownCtx)
+	// Operations aren't started once the broker is shutting down.
+	op2, err := b.sb.startBackup("inst2", false /* scheduled */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(unblock)
+
+	r, err := other.state.Operation("inst1", op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != brokerapi.InProgress || !strings.Contains(r.Description, "interrupted") {
+		t.Errorf("expected a checkpoint, got %+v", r)
+	}
+
+	// Another replica (or the broker once it restarts) resumes both
+	// operations without waiting for their leases to expire. The lease of
+	// the operation that wasn't started is released in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if err := other.resumeOperations(); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := other.state.Operation("inst2", op2.ID); err != nil {
+			t.Fatal(err)
+		} else if r.Attempts > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, op := range []*operationRecord{op, op2} {
+		if r := waitForOperation(t, server, op); r.State != brokerapi.Succeeded {
+			t.Errorf("expected %s to succeed, got %s: %s", op.ID, r.State, r.Description)
+		}
+	}
+	if r, err := other.state.Operation("inst1", op.ID); err != nil {
+		t.Fatal(err)
+	} else if r.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", r.Attempts)
+	}
+}
+
+func TestOperationAttempts(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.Backups = &backupConfig{URI: "nodelocal://1/backups"}
+	if _, err := b.sb.Provision(context.Background(), "inst1", b.provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operation crashed the broker every time it ran.
+	op := &operationRecord{
+		ID:         "op1",
+		InstanceID: "inst1",
+		Type:       opBackup,
+		State:      brokerapi.InProgress,
+		Started:    time.Now(),
+		Attempts:   maxOperationAttempts,
+	}
+	if err := b.sb.state.PutOperation(op); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sb.resumeOperations(); err != nil {
+		t.Fatal(err)
+	}
+	r := waitForOperation(t, b.server, op)
+	if r.State != brokerapi.Failed || !strings.Contains(r.Description, "gave up") {
+		t.Errorf("expected the operation to be given up, got %s: %s", r.State, r.Description)
+	}
+	if len(b.cluster.backups) != 0 {
+		t.Errorf("expected no backup, got %v", b.cluster.backups)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/dchest/uniuri"
+	"github.com/pivotal-cf/brokerapi"
+	uuid "github.com/satori/go.uuid"
+)
+
+// smokeTestGUID is used as the org, space and app GUID of the smoke test's
+// instances and bindings.
+const smokeTestGUID = "smoke-test"
+
+// smokeTestPollInterval is how often the smoke test checks whether an
+// asynchronous provision or deprovision is done.
+var smokeTestPollInterval = time.Second
+
+// smokeTestTimeout and smokeTestAsyncTimeout are the default timeouts of the
+// smoke test of a plan. Creating a cluster for an instance takes much longer
+// than creating a database.
+const (
+	smokeTestTimeout      = time.Minute
+	smokeTestAsyncTimeout = 15 * time.Minute
+)
+
+// smokeTestConnect opens a connection with the URI of a binding; a variable
+// for testing.
+var smokeTestConnect = func(uri string) (*sql.DB, error) {
+	return sql.Open("postgres", uri)
+}
+
+// smokeTestResult is the outcome of the smoke test of a plan.
+type smokeTestResult struct {
+	service, plan string
+	duration      time.Duration
+	// errs are the steps that failed. Cleanup steps run even if an earlier
+	// step failed, so there may be several.
+	errs []error
+}
+
+// smokeTest provisions a temporary instance of the plan, binds it, checks
+// that the binding's credentials can be used to create and query a table,
+// then unbinds and deprovisions the instance. timeout bounds the queries and
+// each asynchronous operation.
+func (sb *crdbServiceBroker) smokeTest(service *Service, plan *Plan, timeout time.Duration) smokeTestResult {
+	res := smokeTestResult{service: service.Name, plan: plan.Name}
+	start := time.Now()
+	ctx := context.Background()
+	instanceID := "smoke-test-" + uuid.NewV4().String()
+	bindingID := uuid.NewV4().String()
+	check := func(step string, err error) bool {
+		if err != nil {
+			res.errs = append(res.errs, fmt.Errorf("%s: %s", step, err))
+		}
+		return err == nil
+	}
+
+	spec, err := sb.Provision(ctx, instanceID, brokerapi.ProvisionDetails{
+		ServiceID:        service.ID,
+		PlanID:           plan.ID,
+		OrganizationGUID: smokeTestGUID,
+		SpaceGUID:        smokeTestGUID,
+	}, true /* asyncAllowed */)
+	if err == nil && spec.IsAsync {
+		err = sb.smokeTestWait(instanceID, spec.OperationData, timeout)
+	}
+	if check("provision", err) {
+		binding, err := sb.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{
+			ServiceID: service.ID,
+			PlanID:    plan.ID,
+			AppGUID:   smokeTestGUID,
+		})
+		if check("bind", err) {
+			creds, _ := binding.Credentials.(map[string]interface{})
+			uri, _ := creds["uri"].(string)
+			check("query", smokeTestQuery(uri, timeout))
+			check("unbind", sb.Unbind(ctx, instanceID, bindingID, brokerapi.UnbindDetails{
+				ServiceID: service.ID,
+				PlanID:    plan.ID,
+			}))
+		}
+		dspec, err := sb.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{
+			ServiceID: service.ID,
+			PlanID:    plan.ID,
+		}, true /* asyncAllowed */)
+		if err == nil && dspec.IsAsync {
+			err = sb.smokeTestWait(instanceID, dspec.OperationData, timeout)
+		}
+		if check("deprovision", err) && plan.deletionRetention > 0 {
+			// Don't keep the database of a test instance around; the state
+			// only has this instance's tombstone.
+			check("drop tombstone", sb.reap(time.Now().Add(plan.deletionRetention)))
+		}
+	}
+	res.duration = time.Since(start)
+	return res
+}
+
+// smokeTestWait polls the last operation of an instance until it is over,
+// failing if it fails or takes longer than timeout.
+func (sb *crdbServiceBroker) smokeTestWait(instanceID, operationData string, timeout time.Duration) error {
+	for deadline := time.Now().Add(timeout); ; {
+		op, err := sb.LastOperation(context.Background(), instanceID, operationData)
+		if err != nil {
+			return err
+		}
+		switch op.State {
+		case brokerapi.Succeeded:
+			return nil
+		case brokerapi.Failed:
+			return errors.New(op.Description)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		time.Sleep(smokeTestPollInterval)
+	}
+}
+
+// smokeTestQuery connects with the given URI, creates a table, writes a row
+// and reads it back.
+func smokeTestQuery(uri string, timeout time.Duration) error {
+	if uri == "" {
+		return errors.New("no uri in credentials")
+	}
+	db, err := smokeTestConnect(uri)
+	if err != nil {
+		return err
+	}
+	// Close the connection before unbinding, which may wait for the
+	// binding's sessions to end.
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "CREATE TABLE smoke_test (value STRING PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("creating table: %s", err)
+	}
+	value := uniuri.New()
+	if _, err := db.ExecContext(ctx, "INSERT INTO smoke_test (value) VALUES ($1)", value); err != nil {
+		return fmt.Errorf("inserting row: %s", err)
+	}
+	var read string
+	if err := db.QueryRowContext(ctx, "SELECT value FROM smoke_test").Scan(&read); err != nil {
+		return fmt.Errorf("reading row: %s", err)
+	}
+	if read != value {
+		return fmt.Errorf("read %q, expected %q", read, value)
+	}
+	return nil
+}
+
+// runSmokeTests runs the smoke test of every plan, or only of the plan with
+// the given name or ID. A zero timeout means the default of each plan.
+func (sb *crdbServiceBroker) runSmokeTests(planFilter string, timeout time.Duration) ([]smokeTestResult, error) {
+	var results []smokeTestResult
+	for i := range Services {
+		s := &Services[i]
+		for j := range s.Plans {
+			p := &s.Plans[j]
+			if planFilter != "" && p.Name != planFilter && p.ID != planFilter {
+				continue
+			}
+			t := timeout
+			if t == 0 {
+				t = sb.smokeTestTimeout(p)
+			}
+			results = append(results, sb.smokeTest(s, p, t))
+		}
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no plan named '%s'", planFilter)
+	}
+	return results, nil
+}
+
+// smokeTestTimeout returns the default timeout of the smoke test of a plan,
+// which is longer for plans whose instances are created by an asynchronous
+// operation.
+func (sb *crdbServiceBroker) smokeTestTimeout(plan *Plan) time.Duration {
+	if sb.backend(plan).Async() {
+		return smokeTestAsyncTimeout
+	}
+	return smokeTestTimeout
+}
+
+// printSmokeTestReport writes the results of a smoke test run to w and
+// returns the number of plans that failed.
+func printSmokeTestReport(w io.Writer, results []smokeTestResult) int {
+	failed := 0
+	for _, res := range results {
+		name := res.service + "/" + res.plan
+		if len(res.errs) == 0 {
+			fmt.Fprintf(w, "PASS  %s (%s)\n", name, res.duration.Round(time.Millisecond))
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL  %s (%s)\n", name, res.duration.Round(time.Millisecond))
+		for _, err := range res.errs {
+			fmt.Fprintf(w, "      %s\n", err)
+		}
+	}
+	fmt.Fprintf(w, "\n%d plans: %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	return failed
+}
+
+// smokeTestMain implements the smoke-test subcommand, which runs the smoke
+// test of the configured plans and prints a report. It reads the same
+// configuration as the broker but keeps its own state in memory. It returns
+// the exit status.
+func smokeTestMain(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("smoke-test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	plan := flags.String("plan", "", "name or ID of the plan to test (default: all plans)")
+	timeout := flags.Duration("timeout", 0, fmt.Sprintf(
+		"how long the queries and operations of each plan may take (default: %s, or %s for plans with asynchronous provisions)",
+		smokeTestTimeout, smokeTestAsyncTimeout,
+	))
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	log.RegisterSink(lager.NewWriterSink(stderr, lager.ERROR))
+
+	InitServicesAndPlans()
+	defer closePlans()
+	sb := newCRDBServiceBroker(newBrokerState(newMemKVStore()))
+	results, err := sb.runSmokeTests(*plan, *timeout)
+	if err != nil {
+		fmt.Fprintf(stderr, "smoke-test: %s\n", err)
+		return 2
+	}
+	if printSmokeTestReport(stdout, results) > 0 {
+		return 1
+	}
+	return 0
+}
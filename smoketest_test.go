@@ -0,0 +1,185 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeSmokeTestConnect makes the smoke test connect to the fake cluster,
+// or the virtual cluster the options route to, as the binding's user.
+func useFakeSmokeTestConnect(c *fakeCluster) func() {
+	old, oldInterval := smokeTestConnect, smokeTestPollInterval
+	smokeTestPollInterval = time.Millisecond
+	smokeTestConnect = func(uri string) (*sql.DB, error) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		name := c.name
+		if options := u.Query().Get("options"); options != "" {
+			c.mu.Lock()
+			if tenant, ok := c.tenants[strings.TrimPrefix(options, "-ccluster=")]; ok {
+				name = tenant.name
+			}
+			c.mu.Unlock()
+		}
+		return sql.Open("fakecrdb", fmt.Sprintf("%s%s/%s", name, u.Path, u.User.Username()))
+	}
+	return func() { smokeTestConnect, smokeTestPollInterval = old, oldInterval }
+}
+
+func TestSmokeTest(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(b *fakeBroker)
+		// expectedErrs are prefixes of the expected errors; none if the plan
+		// passes.
+		expectedErrs []string
+	}{
+		{
+			name: "pass",
+		},
+		{
+			name: "deletion retention",
+			setup: func(b *fakeBroker) {
+				b.plan.deletionRetention = time.Hour
+			},
+		},
+		{
+			name: "schema isolation",
+			setup: func(b *fakeBroker) {
+				b.plan.Isolation = isolationSchema
+			},
+		},
+		{
+			name: "tenant isolation",
+			setup: func(b *fakeBroker) {
+				b.plan.Isolation = isolationTenant
+			},
+		},
+		{
+			name: "provision fails",
+			setup: func(b *fakeBroker) {
+				b.cluster.injectFault(`^CREATE DATABASE`, errFault, 1)
+			},
+			expectedErrs: []string{"provision: "},
+		},
+		{
+			name: "bind fails",
+			setup: func(b *fakeBroker) {
+				b.cluster.injectFault(`^CREATE USER`, errFault, 1)
+			},
+			expectedErrs: []string{"bind: "},
+		},
+		{
+			name: "query fails",
+			setup: func(b *fakeBroker) {
+				b.cluster.injectFault(`^INSERT INTO`, errFault, 1)
+			},
+			expectedErrs: []string{"query: inserting row: "},
+		},
+		{
+			name: "cleanup fails",
+			setup: func(b *fakeBroker) {
+				b.cluster.injectFault(`^DROP USER`, errFault, 1)
+				b.cluster.injectFault(`^DROP DATABASE`, errFault, 1)
+			},
+			expectedErrs: []string{"unbind: ", "deprovision: "},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, cleanup := newFakeBroker()
+			defer cleanup()
+			defer useFakeSmokeTestConnect(b.cluster)()
+			defer useFakeInstanceConnect(b.cluster)()
+			_, restore := stubRetrySleep()
+			defer restore()
+			if tc.setup != nil {
+				tc.setup(b)
+			}
+
+			results, err := b.sb.runSmokeTests("", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report bytes.Buffer
+			failed := printSmokeTestReport(&report, results)
+			if len(results) != 1 || len(results[0].errs) != len(tc.expectedErrs) {
+				t.Fatalf("unexpected report:\n%s", report.String())
+			}
+			for i, err := range results[0].errs {
+				if !strings.HasPrefix(err.Error(), tc.expectedErrs[i]) {
+					t.Errorf("expected error %q, got %q", tc.expectedErrs[i], err)
+				}
+			}
+			if expected := len(tc.expectedErrs) > 0; (failed > 0) != expected {
+				t.Errorf("expected failure %t, got report:\n%s", expected, report.String())
+			}
+			if len(tc.expectedErrs) > 0 {
+				return
+			}
+			if len(b.cluster.comments) != 0 || len(b.cluster.tables) != 0 {
+				t.Errorf("instance left behind: %v", b.cluster.comments)
+			}
+			if len(b.cluster.users) != 2 {
+				t.Errorf("users left behind: %v", b.cluster.users)
+			}
+		})
+	}
+}
+
+func TestSmokeTestPlanFilter(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	defer useFakeSmokeTestConnect(b.cluster)()
+
+	for _, filter := range []string{b.plan.Name, b.plan.ID} {
+		if results, err := b.sb.runSmokeTests(filter, time.Second); err != nil || len(results) != 1 {
+			t.Errorf("%s: expected 1 result, got %v (%v)", filter, results, err)
+		}
+	}
+	if _, err := b.sb.runSmokeTests("unknown", time.Second); err == nil {
+		t.Error("expected an error for an unknown plan")
+	}
+}
+
+func TestSmokeTestTimeout(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+
+	for _, tc := range []struct {
+		isolation string
+		expected  time.Duration
+	}{
+		{"", smokeTestTimeout},
+		{isolationSchema, smokeTestTimeout},
+		{isolationTenant, smokeTestAsyncTimeout},
+		{isolationDedicated, smokeTestAsyncTimeout},
+		{isolationCloud, smokeTestAsyncTimeout},
+	} {
+		b.plan.Isolation = tc.isolation
+		if timeout := b.sb.smokeTestTimeout(b.plan); timeout != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.isolation, tc.expected, timeout)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// errStateNotFound is returned by kvStore.Get when there is no such key.
+var errStateNotFound = errors.New("not found in broker state")
+
+// errStateExists is returned by kvStore.Insert when the key already exists.
+var errStateExists = errors.New("already exists in broker state")
+
+// kvStore is the storage underneath brokerState. Values are opaque blobs,
+// grouped by kind.
+type kvStore interface {
+	Get(kind, key string) ([]byte, error)
+	Put(kind, key string, value []byte) error
+	// Insert is like Put but fails with errStateExists if the key exists.
+	Insert(kind, key string, value []byte) error
+	Delete(kind, key string) error
+	// List returns all the values of the given kind whose key starts with the
+	// given prefix, keyed by the full key.
+	List(kind, keyPrefix string) (map[string][]byte, error)
+}
+
+// memKVStore is an in-memory kvStore. Its contents are lost when the broker
+// restarts, so it is only suitable for tests and single-instance deployments
+// that can tolerate that.
+type memKVStore struct {
+	mu   sync.Mutex
+	data map[string]map[string][]byte
+}
+
+func newMemKVStore() *memKVStore {
+	return &memKVStore{data: make(map[string]map[string][]byte)}
+}
+
+// Get is part of the kvStore interface.
+func (m *memKVStore) Get(kind, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.data[kind][key]
+	if !ok {
+		return nil, errStateNotFound
+	}
+	return v, nil
+}
+
+// Put is part of the kvStore interface.
+func (m *memKVStore) Put(kind, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data[kind] == nil {
+		m.data[kind] = make(map[string][]byte)
+	}
+	m.data[kind][key] = value
+	return nil
+}
+
+// Insert is part of the kvStore interface.
+func (m *memKVStore) Insert(kind, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[kind][key]; ok {
+		return errStateExists
+	}
+	if m.data[kind] == nil {
+		m.data[kind] = make(map[string][]byte)
+	}
+	m.data[kind][key] = value
+	return nil
+}
+
+// Delete is part of the kvStore interface.
+func (m *memKVStore) Delete(kind, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data[kind], key)
+	return nil
+}
+
+// List is part of the kvStore interface.
+func (m *memKVStore) List(kind, keyPrefix string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string][]byte)
+	for k, v := range m.data[kind] {
+		if strings.HasPrefix(k, keyPrefix) {
+			res[k] = v
+		}
+	}
+	return res, nil
+}
+
+// sqlKVStore is a kvStore backed by a table in the broker's metadata
+// database, which is typically a database on one of the plans' CockroachDB
+// clusters.
+type sqlKVStore struct {
+	db *sql.DB
+}
+
+func newSQLKVStore(db *sql.DB) (*sqlKVStore, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS broker_state (
+		kind STRING NOT NULL,
+		key STRING NOT NULL,
+		value BYTES NOT NULL,
+		PRIMARY KEY (kind, key)
+	)`); err != nil {
+		return nil, fmt.Errorf("creating broker_state table: %s", err)
+	}
+	return &sqlKVStore{db: db}, nil
+}
+
+// Get is part of the kvStore interface.
+func (s *sqlKVStore) Get(kind, key string) ([]byte, error) {
+	var v []byte
+	err := withRetry(func() error {
+		return s.db.QueryRow(
+			"SELECT value FROM broker_state WHERE kind = $1 AND key = $2", kind, key,
+		).Scan(&v)
+	})
+	if err == sql.ErrNoRows {
+		return nil, errStateNotFound
+	}
+	return v, err
+}
+
+// Put is part of the kvStore interface.
+func (s *sqlKVStore) Put(kind, key string, value []byte) error {
+	_, err := execWithRetry(s.db,
+		"UPSERT INTO broker_state (kind, key, value) VALUES ($1, $2, $3)", kind, key, value,
+	)
+	return err
+}
+
+// Insert is part of the kvStore interface. It isn't retried if its result is
+// lost with the connection, as the retry would report errStateExists; the
+// caller gets the connection error, as if the broker had died after the
+// insert.
+func (s *sqlKVStore) Insert(kind, key string, value []byte) error {
+	_, err := execWithSafeRetry(s.db,
+		"INSERT INTO broker_state (kind, key, value) VALUES ($1, $2, $3)", kind, key, value,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == codeUniqueViolation {
+		return errStateExists
+	}
+	return err
+}
+
+// Delete is part of the kvStore interface.
+func (s *sqlKVStore) Delete(kind, key string) error {
+	_, err := execWithRetry(s.db, "DELETE FROM broker_state WHERE kind = $1 AND key = $2", kind, key)
+	return err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// List is part of the kvStore interface.
+func (s *sqlKVStore) List(kind, keyPrefix string) (map[string][]byte, error) {
+	var res map[string][]byte
+	err := withRetry(func() error {
+		var err error
+		res, err = s.list(kind, keyPrefix)
+		return err
+	})
+	return res, err
+}
+
+func (s *sqlKVStore) list(kind, keyPrefix string) (map[string][]byte, error) {
+	rows, err := s.db.Query(
+		"SELECT key, value FROM broker_state WHERE kind = $1 AND key LIKE $2",
+		kind, likeEscaper.Replace(keyPrefix)+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string][]byte)
+	for rows.Next() {
+		var k string
+		var v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		res[k] = v
+	}
+	return res, rows.Err()
+}
+
+// Kinds of records in the broker state.
+const (
+	kindInstance      = "instance"
+	kindBinding       = "binding"
+	kindSharedBinding = "shared-binding"
+)
+
+// States of instance and binding records. Records are created in the pending
+// state before the broker starts working on the cluster, so that concurrent
+// and repeated requests can be told apart.
+const (
+	statePending = "pending"
+	stateReady   = "ready"
+	// stateFailed marks instances whose provisioning was interrupted; see
+	// recoverRequests. They can be provisioned again.
+	stateFailed = "failed"
+	// stateProvisioning and stateDeprovisioning mark instances that an
+	// asynchronous operation is creating or dropping; see OperationID.
+	stateProvisioning   = "provisioning"
+	stateDeprovisioning = "deprovisioning"
+)
+
+// instanceRecord is what the broker remembers about a service instance.
+type instanceRecord struct {
+	ID        string `json:"id"`
+	ServiceID string `json:"serviceID"`
+	PlanID    string `json:"planID"`
+	OrgGUID   string `json:"orgGUID"`
+	SpaceGUID string `json:"spaceGUID"`
+	State     string `json:"state,omitempty"`
+	// Fingerprint identifies the provision request that created the
+	// instance; see provisionFingerprint.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// TerminateSessions, if set, overrides the plan's setting.
+	TerminateSessions *bool `json:"terminateSessions,omitempty"`
+	// DeletionProtection makes Deprovision fail. It is mirrored in the
+	// database comment; see instanceComment.
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+	// Regions is the multi-region configuration of the instance's database,
+	// if any. It is mirrored in the database comment.
+	Regions *regionConfig `json:"regions,omitempty"`
+	// FailureReason explains why a failed instance failed.
+	FailureReason string `json:"failureReason,omitempty"`
+	// OperationID is the last provision or deprovision operation of an
+	// instance with a cluster of its own; see Plan.clusterPerInstance.
+	OperationID string `json:"operationID,omitempty"`
+	// AdminPassword is the password of the admin user the broker creates in
+	// the cluster of an instance that has one of its own. It is stored
+	// encrypted; see secretBox.
+	AdminPassword string `json:"adminPassword,omitempty"`
+	// ClusterID, ClusterHost and ClusterPort identify the CockroachDB Cloud
+	// cluster of an instance of a plan with cloud isolation, as the Cloud
+	// API reports them.
+	ClusterID   string `json:"clusterID,omitempty"`
+	ClusterHost string `json:"clusterHost,omitempty"`
+	ClusterPort string `json:"clusterPort,omitempty"`
+}
+
+// inProgress returns whether a request or an operation is creating or
+// dropping the instance.
+func (r *instanceRecord) inProgress() bool {
+	return r.State == statePending || r.State == stateProvisioning || r.State == stateDeprovisioning
+}
+
+// bindingRecord is what the broker remembers about a binding.
+type bindingRecord struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"instanceID"`
+	AppGUID    string `json:"appGUID,omitempty"`
+	SpaceGUID  string `json:"spaceGUID,omitempty"`
+	// Shared is set if the binding was created from a space other than the
+	// one owning the instance (see Cloud Foundry instance sharing).
+	Shared bool   `json:"shared,omitempty"`
+	Role   string `json:"role"`
+	State  string `json:"state,omitempty"`
+	// Fingerprint identifies the bind request that created the binding; see
+	// bindFingerprint.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Password is kept, encrypted (see secretBox), so that repeated bind
+	// requests can return the same credentials.
+	Password string `json:"password,omitempty"`
+	// Saga records the progress of the bind or unbind request working on the
+	// binding; see saga.
+	Saga *sagaLog `json:"saga,omitempty"`
+}
+
+// brokerState provides typed access to the records stored in a kvStore.
+type brokerState struct {
+	kv kvStore
+	// leases are held by requests working on an instance. They are kept in
+	// memory unless set otherwise.
+	leases leaser
+	// secrets encrypts the passwords of the records; see secretBox.
+	secrets *secretBox
+}
+
+func newBrokerState(kv kvStore) *brokerState {
+	return &brokerState{kv: kv, leases: newMemLeaser()}
+}
+
+// volatile returns whether the state is lost when the broker restarts.
+func (s *brokerState) volatile() bool {
+	_, ok := s.kv.(*memKVStore)
+	return ok
+}
+
+func (s *brokerState) get(kind, key string, v interface{}) error {
+	data, err := s.kv.Get(kind, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *brokerState) put(kind, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.kv.Put(kind, key, data)
+}
+
+func (s *brokerState) insert(kind, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.kv.Insert(kind, key, data)
+}
+
+// list decodes all records of the given kind and key prefix, calling fn for
+// each of them in key order.
+func (s *brokerState) list(kind, keyPrefix string, fn func(data []byte) error) error {
+	m, err := s.kv.List(kind, keyPrefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bindingKey(instanceID, bindingID string) string {
+	return instanceID + "/" + bindingID
+}
+
+// Instance returns the record for the given instance, or errStateNotFound.
+func (s *brokerState) Instance(instanceID string) (*instanceRecord, error) {
+	var r instanceRecord
+	if err := s.get(kindInstance, instanceID, &r); err != nil {
+		return nil, err
+	}
+	return s.openInstance(&r)
+}
+
+func (s *brokerState) PutInstance(r *instanceRecord) error {
+	sealed, err := s.sealInstance(r)
+	if err != nil {
+		return err
+	}
+	return s.put(kindInstance, r.ID, sealed)
+}
+
+// InsertInstance stores a new instance record, failing with errStateExists if
+// there already is one.
+func (s *brokerState) InsertInstance(r *instanceRecord) error {
+	sealed, err := s.sealInstance(r)
+	if err != nil {
+		return err
+	}
+	return s.insert(kindInstance, r.ID, sealed)
+}
+
+// sealInstance returns a copy of an instance record with its admin password
+// encrypted.
+func (s *brokerState) sealInstance(r *instanceRecord) (*instanceRecord, error) {
+	c := *r
+	var err error
+	if c.AdminPassword, err = s.secrets.seal(r.AdminPassword); err != nil {
+		return nil, fmt.Errorf("encrypting admin password: %s", err)
+	}
+	return &c, nil
+}
+
+func (s *brokerState) openInstance(r *instanceRecord) (*instanceRecord, error) {
+	var err error
+	if r.AdminPassword, err = s.secrets.open(r.AdminPassword); err != nil {
+		return nil, fmt.Errorf("instance %s: %s", r.ID, err)
+	}
+	return r, nil
+}
+
+func (s *brokerState) DeleteInstance(instanceID string) error {
+	return s.kv.Delete(kindInstance, instanceID)
+}
+
+func (s *brokerState) Instances() ([]*instanceRecord, error) {
+	var res []*instanceRecord
+	err := s.list(kindInstance, "", func(data []byte) error {
+		var r instanceRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if _, err := s.openInstance(&r); err != nil {
+			return err
+		}
+		res = append(res, &r)
+		return nil
+	})
+	return res, err
+}
+
+func bindingKind(shared bool) string {
+	if shared {
+		return kindSharedBinding
+	}
+	return kindBinding
+}
+
+// Binding returns the record for the given binding, or errStateNotFound.
+// Bindings from the owning space and shared bindings are stored separately;
+// both are looked up.
+func (s *brokerState) Binding(instanceID, bindingID string) (*bindingRecord, error) {
+	for _, kind := range []string{kindBinding, kindSharedBinding} {
+		var r bindingRecord
+		err := s.get(kind, bindingKey(instanceID, bindingID), &r)
+		if err == nil {
+			return s.openBinding(&r)
+		}
+		if err != errStateNotFound {
+			return nil, err
+		}
+	}
+	return nil, errStateNotFound
+}
+
+func (s *brokerState) PutBinding(r *bindingRecord) error {
+	sealed, err := s.sealBinding(r)
+	if err != nil {
+		return err
+	}
+	return s.put(bindingKind(r.Shared), bindingKey(r.InstanceID, r.ID), sealed)
+}
+
+// InsertBinding stores a new binding record, failing with errStateExists if
+// there already is one (shared or not).
+func (s *brokerState) InsertBinding(r *bindingRecord) error {
+	if err := s.get(bindingKind(!r.Shared), bindingKey(r.InstanceID, r.ID), &bindingRecord{}); err == nil {
+		return errStateExists
+	} else if err != errStateNotFound {
+		return err
+	}
+	sealed, err := s.sealBinding(r)
+	if err != nil {
+		return err
+	}
+	return s.insert(bindingKind(r.Shared), bindingKey(r.InstanceID, r.ID), sealed)
+}
+
+// sealBinding returns a copy of a binding record with its password
+// encrypted.
+func (s *brokerState) sealBinding(r *bindingRecord) (*bindingRecord, error) {
+	c := *r
+	var err error
+	if c.Password, err = s.secrets.seal(r.Password); err != nil {
+		return nil, fmt.Errorf("encrypting password: %s", err)
+	}
+	return &c, nil
+}
+
+func (s *brokerState) openBinding(r *bindingRecord) (*bindingRecord, error) {
+	var err error
+	if r.Password, err = s.secrets.open(r.Password); err != nil {
+		return nil, fmt.Errorf("binding %s: %s", r.ID, err)
+	}
+	return r, nil
+}
+
+func (s *brokerState) DeleteBinding(r *bindingRecord) error {
+	return s.kv.Delete(bindingKind(r.Shared), bindingKey(r.InstanceID, r.ID))
+}
+
+// Bindings returns the bindings of an instance; if shared is set, it returns
+// the bindings created from other spaces instead of those from the owning
+// space.
+func (s *brokerState) Bindings(instanceID string, shared bool) ([]*bindingRecord, error) {
+	return s.bindings(bindingKind(shared), instanceID+"/")
+}
+
+// AllBindings returns the bindings of all instances, shared or not.
+func (s *brokerState) AllBindings() ([]*bindingRecord, error) {
+	res, err := s.bindings(kindBinding, "")
+	if err != nil {
+		return nil, err
+	}
+	shared, err := s.bindings(kindSharedBinding, "")
+	return append(res, shared...), err
+}
+
+func (s *brokerState) bindings(kind, keyPrefix string) ([]*bindingRecord, error) {
+	var res []*bindingRecord
+	err := s.list(kind, keyPrefix, func(data []byte) error {
+		var r bindingRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if _, err := s.openBinding(&r); err != nil {
+			return err
+		}
+		res = append(res, &r)
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// tenantOptions returns the connection options that route a connection to the
+// host cluster's SQL port to the given virtual cluster.
+func tenantOptions(name string) url.Values {
+	options := make(url.Values)
+	options.Add("sslmode", "require")
+	options.Add("options", "-ccluster="+name)
+	return options
+}
+
+// createTenant creates the virtual cluster of an instance, starts its SQL
+// service and creates the instance's admin user in it.
+func (sb *crdbServiceBroker) createTenant(plan *Plan, instance *instanceRecord) error {
+	name := clusterNameFromInstanceID(instance.ID)
+	if _, err := execWithRetry(plan.crdb, "CREATE VIRTUAL CLUSTER IF NOT EXISTS "+sqlIdent(name)); err != nil {
+		if isPermissionDenied(err) {
+			return fmt.Errorf(
+				"creating virtual cluster: %s (user %s needs the MANAGEVIRTUALCLUSTER privilege)", err, plan.CRDBAdminUser,
+			)
+		}
+		return fmt.Errorf("creating virtual cluster: %s", err)
+	}
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER VIRTUAL CLUSTER %s START SERVICE SHARED", sqlIdent(name))); err != nil {
+		return fmt.Errorf("starting virtual cluster: %s", err)
+	}
+	return sb.bootstrapTenant(plan, instance)
+}
+
+// bootstrapTenant creates the admin user of an instance in its (started)
+// virtual cluster.
+func (sb *crdbServiceBroker) bootstrapTenant(plan *Plan, instance *instanceRecord) error {
+	name := clusterNameFromInstanceID(instance.ID)
+	// A new virtual cluster has no users the broker knows the password of,
+	// so the plan's admin user (whose client certificate is valid for every
+	// virtual cluster) creates the one the broker uses from then on.
+	bootstrap, err := instanceConnect(dbURI(
+		plan.CRDBHost, plan.CRDBPort, plan.CRDBAdminUser, "" /* pass */, clusterDatabase, tenantOptions(name),
+	))
+	if err != nil {
+		return fmt.Errorf("connecting to virtual cluster: %s", err)
+	}
+	defer bootstrap.Close()
+	return createAdminUser(bootstrap, instance)
+}
+
+// dropTenant stops the SQL service of an instance's virtual cluster and
+// drops it, along with everything in it. It does nothing if the virtual
+// cluster doesn't exist.
+func (sb *crdbServiceBroker) dropTenant(plan *Plan, instanceID string) error {
+	name := clusterNameFromInstanceID(instanceID)
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER VIRTUAL CLUSTER %s STOP SERVICE", sqlIdent(name))); err != nil &&
+		!isNotFound(err, objectVirtualCluster) {
+		return fmt.Errorf("stopping virtual cluster: %s", err)
+	}
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("DROP VIRTUAL CLUSTER IF EXISTS %s IMMEDIATE", sqlIdent(name))); err != nil {
+		return fmt.Errorf("dropping virtual cluster: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// useFakeInstanceConnect makes the broker connect to the fake clusters standing
+// in for the virtual clusters of c that connection options route to.
+func useFakeInstanceConnect(c *fakeCluster) func() {
+	old := instanceConnect
+	instanceConnect = func(uri string) (*sql.DB, error) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(u.Query().Get("options"), "-ccluster=")
+		c.mu.Lock()
+		tenant, ok := c.tenants[name]
+		started := c.tenantsStarted[name]
+		c.mu.Unlock()
+		if !ok || !started {
+			return nil, fmt.Errorf("fakecrdb: virtual cluster %q is not serving", name)
+		}
+		return sql.Open("fakecrdb", fmt.Sprintf("%s%s/%s", tenant.name, u.Path, u.User.Username()))
+	}
+	return func() { instanceConnect = old }
+}
+
+// waitForLastOperation polls LastOperation until the operation is over.
+func waitForLastOperation(t *testing.T, sb *crdbServiceBroker, instanceID, operationData string) brokerapi.LastOperation {
+	t.Helper()
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); {
+		res, err := sb.LastOperation(context.Background(), instanceID, operationData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.State != brokerapi.InProgress {
+			return res
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for operation %s", operationData)
+	return brokerapi.LastOperation{}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	defer useFakeInstanceConnect(b.cluster)()
+	b.plan.Isolation = isolationTenant
+	ctx := context.Background()
+	name := clusterNameFromInstanceID("inst1")
+
+	if _, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), false); err != brokerapi.ErrAsyncRequired {
+		t.Fatalf("expected %v, got %v", brokerapi.ErrAsyncRequired, err)
+	}
+	spec, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.IsAsync || spec.OperationData == "" {
+		t.Fatalf("expected an asynchronous provision, got %+v", spec)
+	}
+	if res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData); res.State != brokerapi.Succeeded {
+		t.Fatalf("provision %s: %s", res.State, res.Description)
+	}
+	tenant := b.cluster.tenants[name]
+	if tenant == nil || !b.cluster.tenantsStarted[name] {
+		t.Fatalf("expected virtual cluster %s to be started, got %v", name, b.cluster.tenantsStarted)
+	}
+	if !tenant.hasUser(adminUserFromInstanceID("inst1")) {
+		t.Error("admin user not created")
+	}
+	if b.cluster.databases[dbNameFromInstanceID("inst1")] {
+		t.Error("instance database created on the host cluster")
+	}
+	crdb, err := b.sb.instanceDB(b.plan, "inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := databaseComment(crdb, b.plan.namespace("inst1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.InstanceID != "inst1" {
+		t.Errorf("unexpected database comment %+v", c)
+	}
+
+	binding, err := b.sb.Bind(ctx, "inst1", "bind1", brokerapi.BindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID, AppGUID: "app1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := binding.Credentials.(map[string]interface{})
+	user := userNameFromBinding("inst1", "bind1")
+	if creds["virtual_cluster"] != name || creds["database"] != clusterDatabase {
+		t.Errorf("unexpected credentials %v", creds)
+	}
+	u, err := url.Parse(creds["uri"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options := u.Query().Get("options"); options != "-ccluster="+name {
+		t.Errorf("expected options -ccluster=%s, got %q", name, options)
+	}
+	if !tenant.hasUser(user) || b.cluster.hasUser(user) {
+		t.Error("expected the binding's user in the virtual cluster only")
+	}
+	if role := tenant.grants[clusterDatabase][user]; role != "ALL" {
+		t.Errorf("expected ALL on %s, got %q", clusterDatabase, role)
+	}
+
+	if err := b.sb.Unbind(ctx, "inst1", "bind1", brokerapi.UnbindDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.hasUser(user) {
+		t.Error("user not dropped")
+	}
+
+	details := brokerapi.DeprovisionDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID}
+	if _, err := b.sb.Deprovision(ctx, "inst1", details, false); err != brokerapi.ErrAsyncRequired {
+		t.Fatalf("expected %v, got %v", brokerapi.ErrAsyncRequired, err)
+	}
+	dspec, err := b.sb.Deprovision(ctx, "inst1", details, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dspec.IsAsync {
+		t.Fatalf("expected an asynchronous deprovision, got %+v", dspec)
+	}
+	if res := waitForLastOperation(t, b.sb, "inst1", dspec.OperationData); res.State != brokerapi.Succeeded {
+		t.Fatalf("deprovision %s: %s", res.State, res.Description)
+	}
+	if _, ok := b.cluster.tenants[name]; ok {
+		t.Error("virtual cluster not dropped")
+	}
+	if _, err := b.sb.state.Instance("inst1"); err != errStateNotFound {
+		t.Errorf("expected the instance to be forgotten, got %v", err)
+	}
+}
+
+func TestTenantProvisionFailure(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	defer useFakeInstanceConnect(b.cluster)()
+	b.plan.Isolation = isolationTenant
+	ctx := context.Background()
+	b.cluster.injectFault(`START SERVICE`, &pq.Error{Code: "XX000", Message: "injected"}, -1)
+
+	spec, err := b.sb.Provision(ctx, "inst1", b.provisionDetails(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := waitForLastOperation(t, b.sb, "inst1", spec.OperationData)
+	if res.State != brokerapi.Failed || !strings.Contains(res.Description, "injected") {
+		t.Fatalf("expected the provision to fail, got %+v", res)
+	}
+	instance, err := b.sb.state.Instance("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.State != stateFailed {
+		t.Errorf("expected instance state %s, got %s", stateFailed, instance.State)
+	}
+	if len(b.cluster.tenants) != 0 {
+		t.Errorf("virtual clusters not dropped: %v", b.cluster.tenants)
+	}
+
+	// The failed instance is deprovisioned right away.
+	spec2, err := b.sb.Deprovision(ctx, "inst1", brokerapi.DeprovisionDetails{
+		ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec2.IsAsync {
+		t.Error("expected a synchronous deprovision")
+	}
+	if _, err := b.sb.state.Instance("inst1"); err != errStateNotFound {
+		t.Errorf("expected the instance to be forgotten, got %v", err)
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const kindTombstone = "tombstone"
+
+// tombstoneRecord describes the database of a deprovisioned instance that is
+// kept around until its plan's deletion retention period has passed. Under
+// tenant isolation, the whole virtual cluster of the instance is kept.
+type tombstoneRecord struct {
+	InstanceID string    `json:"instanceID"`
+	ServiceID  string    `json:"serviceID"`
+	PlanID     string    `json:"planID"`
+	OrgGUID    string    `json:"orgGUID"`
+	SpaceGUID  string    `json:"spaceGUID"`
+	Database   string    `json:"database,omitempty"`
+	Deleted    time.Time `json:"deleted"`
+	DropAfter  time.Time `json:"dropAfter"`
+	// VirtualCluster is the name the virtual cluster of an instance with
+	// tenant isolation is renamed to; such tombstones have no Database.
+	VirtualCluster string `json:"virtualCluster,omitempty"`
+}
+
+func (s *brokerState) Tombstone(instanceID string) (*tombstoneRecord, error) {
+	var r tombstoneRecord
+	if err := s.get(kindTombstone, instanceID, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *brokerState) PutTombstone(r *tombstoneRecord) error {
+	return s.put(kindTombstone, r.InstanceID, r)
+}
+
+func (s *brokerState) DeleteTombstone(instanceID string) error {
+	return s.kv.Delete(kindTombstone, instanceID)
+}
+
+// Tombstones returns all tombstones, oldest first.
+func (s *brokerState) Tombstones() ([]*tombstoneRecord, error) {
+	var res []*tombstoneRecord
+	err := s.list(kindTombstone, "", func(data []byte) error {
+		var r tombstoneRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		res = append(res, &r)
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Deleted.Before(res[j].Deleted) })
+	return res, err
+}
+
+// tombstoneName returns the name a deprovisioned instance's database is
+// renamed to.
+func tombstoneName(instanceID string, deleted time.Time) string {
+	return fmt.Sprintf("%s_deleted_%d", dbNameFromInstanceID(instanceID), deleted.Unix())
+}
+
+// tombstoneClusterName returns the name a deprovisioned instance's virtual
+// cluster is renamed to.
+func tombstoneClusterName(instanceID string, deleted time.Time) string {
+	return fmt.Sprintf("%s-deleted-%d", clusterNameFromInstanceID(instanceID), deleted.Unix())
+}
+
+// softDeleteDatabase renames the database of an instance to a tombstone name
+// and revokes everyone's access to it, leaving it to be dropped by the reaper
+// once the plan's deletion retention has passed.
+//
+// The tombstone is stored before the rename, so that a retry, or a rename
+// whose result was lost, finds the renamed database instead of leaking it.
+func (sb *crdbServiceBroker) softDeleteDatabase(plan *Plan, instanceID string) error {
+	r, err := sb.tombstone(plan, instanceID, false)
+	if err != nil {
+		return err
+	}
+
+	crdb, err := sb.instanceDB(plan, instanceID)
+	if err != nil {
+		return err
+	}
+	if _, err := execWithRetry(crdb,
+		fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", dbNameFromInstanceID(instanceID), r.Database),
+	); err != nil {
+		if !isNotFound(err, objectDatabase) {
+			return fmt.Errorf("renaming database: %s", err)
+		}
+		// Either there is nothing to keep, or the database was renamed by
+		// a previous attempt.
+		if c, err := databaseComment(crdb, instanceNamespace{database: r.Database}); err != nil {
+			return fmt.Errorf("reading database comment: %s", err)
+		} else if c == nil {
+			return sb.state.DeleteTombstone(instanceID)
+		}
+	}
+	return revokeGrantees(plan, r.Database)
+}
+
+// tombstone returns the tombstone of an instance being deprovisioned,
+// storing a new one, for its database or its virtual cluster, if it has
+// none yet.
+func (sb *crdbServiceBroker) tombstone(plan *Plan, instanceID string, virtualCluster bool) (*tombstoneRecord, error) {
+	r, err := sb.state.Tombstone(instanceID)
+	if err == errStateNotFound {
+		r, err = sb.putTombstone(plan, instanceID, virtualCluster)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storing tombstone: %s", err)
+	}
+	return r, nil
+}
+
+// putTombstone stores a new tombstone for an instance being deprovisioned.
+func (sb *crdbServiceBroker) putTombstone(
+	plan *Plan, instanceID string, virtualCluster bool,
+) (*tombstoneRecord, error) {
+	now := time.Now().UTC()
+	r := &tombstoneRecord{
+		InstanceID: instanceID,
+		ServiceID:  plan.ServiceID,
+		PlanID:     plan.ID,
+		Database:   tombstoneName(instanceID, now),
+		Deleted:    now,
+		DropAfter:  now.Add(plan.deletionRetention),
+	}
+	if instance, err := sb.state.Instance(instanceID); err == nil {
+		r.OrgGUID = instance.OrgGUID
+		r.SpaceGUID = instance.SpaceGUID
+	} else if err != errStateNotFound {
+		return nil, fmt.Errorf("looking up instance: %s", err)
+	}
+	if virtualCluster {
+		r.Database = ""
+		r.VirtualCluster = tombstoneClusterName(instanceID, now)
+	}
+	if err := sb.state.PutTombstone(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// softDeleteTenant stops the SQL service of an instance's virtual cluster,
+// which ends everyone's access to it, and renames it to its tombstone name,
+// like softDeleteDatabase.
+func (sb *crdbServiceBroker) softDeleteTenant(plan *Plan, instanceID string) error {
+	r, err := sb.tombstone(plan, instanceID, true)
+	if err != nil {
+		return err
+	}
+	sb.closeInstanceDB(r.InstanceID)
+	name := clusterNameFromInstanceID(r.InstanceID)
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER VIRTUAL CLUSTER %s STOP SERVICE", sqlIdent(name))); err != nil {
+		if !isNotFound(err, objectVirtualCluster) {
+			return fmt.Errorf("stopping virtual cluster: %s", err)
+		}
+		// Either there is nothing to keep, or the virtual cluster was
+		// renamed by a previous attempt.
+		if _, err := execWithRetry(plan.crdb,
+			fmt.Sprintf("ALTER VIRTUAL CLUSTER %s STOP SERVICE", sqlIdent(r.VirtualCluster)),
+		); isNotFound(err, objectVirtualCluster) {
+			return sb.state.DeleteTombstone(r.InstanceID)
+		} else if err != nil {
+			return fmt.Errorf("stopping virtual cluster: %s", err)
+		}
+		return nil
+	}
+	if _, err := execWithRetry(plan.crdb,
+		fmt.Sprintf("ALTER VIRTUAL CLUSTER %s RENAME TO %s", sqlIdent(name), sqlIdent(r.VirtualCluster)),
+	); err != nil {
+		return fmt.Errorf("renaming virtual cluster: %s", err)
+	}
+	return nil
+}
+
+// restoreTombstone replaces the database of a provisioned instance with the
+// tombstoned database of a deprovisioned one. New instances are restored
+// into by Provision; see restoreTombstoneInstance.
+func (sb *crdbServiceBroker) restoreTombstone(instanceID, targetInstanceID string) error {
+	r, err := sb.state.Tombstone(instanceID)
+	if err != nil {
+		if err == errStateNotFound {
+			return newStatusError(http.StatusNotFound, "no deleted database for instance '%s'", instanceID)
+		}
+		return err
+	}
+	if r.VirtualCluster != "" {
+		return newStatusError(http.StatusUnprocessableEntity,
+			"a deleted virtual cluster can only be restored by provisioning a new instance from it")
+	}
+	plan, err := findPlan(r.ServiceID, r.PlanID)
+	if err != nil {
+		return err
+	}
+	_, targetPlan, err := sb.instancePlan(targetInstanceID)
+	if err != nil {
+		return err
+	}
+	if targetPlan.CRDBHost != plan.CRDBHost || targetPlan.CRDBPort != plan.CRDBPort {
+		return newStatusError(http.StatusUnprocessableEntity,
+			"instance '%s' is not on the same cluster as the deleted database", targetInstanceID)
+	}
+	if !targetPlan.databasePerInstance() {
+		return newStatusError(http.StatusUnprocessableEntity,
+			"instance '%s' does not have a database of its own", targetInstanceID)
+	}
+
+	if err := sb.replaceInstanceDatabase(targetPlan, r.Database, targetInstanceID); err != nil {
+		return err
+	}
+	if err := adoptOwnedObjects(targetPlan.crdb, dbNameFromInstanceID(targetInstanceID), instanceID, targetInstanceID); err != nil {
+		return err
+	}
+	return sb.state.DeleteTombstone(instanceID)
+}
+
+// adoptOwnedObjects makes the objects left behind in a database by the
+// bindings of a deleted instance belong to the instance that got the
+// database.
+func adoptOwnedObjects(crdb *sql.DB, dbName, instanceID, targetInstanceID string) error {
+	if err := reassignOwned(
+		context.Background(), crdb, dbName,
+		ownerRoleFromInstanceID(instanceID), ownerRoleFromInstanceID(targetInstanceID),
+	); err != nil {
+		return fmt.Errorf("transferring ownership: %s", err)
+	}
+	if _, err := execWithRetry(crdb, "DROP ROLE IF EXISTS "+ownerRoleFromInstanceID(instanceID)); err != nil {
+		return fmt.Errorf("dropping owner role: %s", err)
+	}
+	return nil
+}
+
+// tombstoneSource returns the tombstone of a deleted instance that a new
+// instance of the plan is restored from, or a status error if it can't be.
+func (sb *crdbServiceBroker) tombstoneSource(plan *Plan, instanceID string) (*tombstoneRecord, error) {
+	r, err := sb.state.Tombstone(instanceID)
+	if err != nil {
+		if err == errStateNotFound {
+			return nil, newStatusError(http.StatusNotFound, "no deleted database for instance '%s'", instanceID)
+		}
+		return nil, err
+	}
+	srcPlan, err := findPlan(r.ServiceID, r.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.CRDBHost != srcPlan.CRDBHost || plan.CRDBPort != srcPlan.CRDBPort {
+		return nil, newStatusError(http.StatusUnprocessableEntity,
+			"plan '%s' is not on the same cluster as the deleted instance", plan.Name)
+	}
+	if r.VirtualCluster != "" && plan.Isolation != isolationTenant {
+		return nil, newStatusError(http.StatusUnprocessableEntity,
+			"plan '%s' doesn't give instances a virtual cluster of their own to restore into", plan.Name)
+	}
+	if r.VirtualCluster == "" && !plan.databasePerInstance() {
+		return nil, newStatusError(http.StatusUnprocessableEntity,
+			"plan '%s' doesn't give instances a database of their own to restore into", plan.Name)
+	}
+	return r, nil
+}
+
+// restoreTombstoneInstance gives an instance being provisioned the
+// tombstoned database (or virtual cluster) of the deleted instance the
+// operation restores. The tombstone is deleted last, so that an interrupted
+// operation can be resumed, or aborted by returnTombstone.
+func (sb *crdbServiceBroker) restoreTombstoneInstance(plan *Plan, instance *instanceRecord, op *operationRecord) error {
+	r, err := sb.state.Tombstone(op.SourceInstanceID)
+	if err == errStateNotFound {
+		// A previous attempt may have got as far as deleting it.
+		crdb, err := sb.instanceDB(plan, instance.ID)
+		if err != nil {
+			return err
+		}
+		if c, err := databaseComment(crdb, plan.namespace(instance.ID)); err != nil {
+			return fmt.Errorf("reading database comment: %s", err)
+		} else if c == nil || c.InstanceID != instance.ID {
+			return fmt.Errorf("no deleted database for instance '%s'", op.SourceInstanceID)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if r.VirtualCluster != "" {
+		if err := sb.restoreTombstoneTenant(plan, instance, r); err != nil {
+			return err
+		}
+	} else if err := sb.restoreTombstoneDatabase(plan, instance, r); err != nil {
+		return err
+	}
+	crdb, err := sb.instanceDB(plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	if err := setDatabaseComment(crdb, plan.namespace(instance.ID), op.Comment); err != nil {
+		return fmt.Errorf("commenting database: %s", err)
+	}
+	return sb.state.DeleteTombstone(r.InstanceID)
+}
+
+// restoreTombstoneDatabase renames a tombstoned database to the database of
+// an instance being provisioned and resets its privileges.
+func (sb *crdbServiceBroker) restoreTombstoneDatabase(plan *Plan, instance *instanceRecord, r *tombstoneRecord) error {
+	dbName := dbNameFromInstanceID(instance.ID)
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", r.Database, dbName)); err != nil {
+		if !isNotFound(err, objectDatabase) {
+			return fmt.Errorf("renaming database: %s", err)
+		}
+		// A previous attempt may have renamed it already.
+		if c, err := databaseComment(plan.crdb, instanceNamespace{database: dbName}); err != nil {
+			return fmt.Errorf("reading database comment: %s", err)
+		} else if c == nil || c.InstanceID != r.InstanceID && c.InstanceID != instance.ID {
+			return fmt.Errorf("deleted database %s not found", r.Database)
+		}
+	}
+	if err := sb.resetGrants(plan, dbName, instance.ID); err != nil {
+		return err
+	}
+	if err := setRegions(plan.crdb, dbName, nil, instance.Regions); err != nil {
+		return fmt.Errorf("configuring regions: %s", err)
+	}
+	return adoptOwnedObjects(plan.crdb, dbName, r.InstanceID, instance.ID)
+}
+
+// restoreTombstoneTenant renames a tombstoned virtual cluster to the virtual
+// cluster of an instance being provisioned, starts it and replaces the
+// deleted instance's admin user with the new instance's.
+func (sb *crdbServiceBroker) restoreTombstoneTenant(plan *Plan, instance *instanceRecord, r *tombstoneRecord) error {
+	name := clusterNameFromInstanceID(instance.ID)
+	if _, err := execWithRetry(plan.crdb,
+		fmt.Sprintf("ALTER VIRTUAL CLUSTER %s RENAME TO %s", sqlIdent(r.VirtualCluster), sqlIdent(name)),
+	); err != nil && !isNotFound(err, objectVirtualCluster) {
+		// If it isn't found, a previous attempt renamed it, and starting
+		// it fails if it didn't.
+		return fmt.Errorf("renaming virtual cluster: %s", err)
+	}
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER VIRTUAL CLUSTER %s START SERVICE SHARED", sqlIdent(name))); err != nil {
+		return fmt.Errorf("starting virtual cluster: %s", err)
+	}
+	if err := sb.bootstrapTenant(plan, instance); err != nil {
+		return err
+	}
+	crdb, err := sb.instanceDB(plan, instance.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := execWithRetry(crdb, "DROP USER IF EXISTS "+adminUserFromInstanceID(r.InstanceID)); err != nil {
+		return fmt.Errorf("dropping admin user: %s", err)
+	}
+	return adoptOwnedObjects(crdb, clusterDatabase, r.InstanceID, instance.ID)
+}
+
+// returnTombstone undoes restoreTombstoneInstance for an instance whose
+// provisioning failed, renaming the restored database (or virtual cluster)
+// back to its tombstone name so that it is dropped by the reaper, or can be
+// restored again, instead of being dropped with the failed instance. A
+// database is only renamed if it is the restored one.
+func (sb *crdbServiceBroker) returnTombstone(plan *Plan, instance *instanceRecord, sourceInstanceID string) error {
+	r, err := sb.state.Tombstone(sourceInstanceID)
+	if err == errStateNotFound {
+		// The restore completed; the instance's database is its own.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if r.VirtualCluster != "" {
+		sb.closeInstanceDB(instance.ID)
+		name := clusterNameFromInstanceID(instance.ID)
+		if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER VIRTUAL CLUSTER %s STOP SERVICE", sqlIdent(name))); err != nil {
+			if isNotFound(err, objectVirtualCluster) {
+				return nil
+			}
+			return fmt.Errorf("stopping virtual cluster: %s", err)
+		}
+		if _, err := execWithRetry(plan.crdb,
+			fmt.Sprintf("ALTER VIRTUAL CLUSTER %s RENAME TO %s", sqlIdent(name), sqlIdent(r.VirtualCluster)),
+		); err != nil {
+			return fmt.Errorf("renaming virtual cluster: %s", err)
+		}
+		return nil
+	}
+
+	dbName := dbNameFromInstanceID(instance.ID)
+	c, err := databaseComment(plan.crdb, instanceNamespace{database: dbName})
+	if err != nil {
+		return fmt.Errorf("reading database comment: %s", err)
+	}
+	if c == nil || c.InstanceID != r.InstanceID && c.InstanceID != instance.ID {
+		return nil
+	}
+	if _, err := execWithRetry(plan.crdb, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", dbName, r.Database)); err != nil &&
+		!isNotFound(err, objectDatabase) {
+		return fmt.Errorf("renaming database: %s", err)
+	}
+	return revokeGrantees(plan, r.Database)
+}
+
+// runReaper drops tombstoned databases whose retention period has passed,
+// checking every checkInterval until stop is closed. Only one replica reaps at
+// a time; see isLeader.
+func (sb *crdbServiceBroker) runReaper(checkInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !sb.isLeader("reaper", 3*checkInterval) {
+				continue
+			}
+			if err := sb.reap(time.Now()); err != nil {
+				log.Error("reap", err)
+			}
+		}
+	}
+}
+
+// reap drops the tombstoned databases that expired before now.
+func (sb *crdbServiceBroker) reap(now time.Time) error {
+	tombstones, err := sb.state.Tombstones()
+	if err != nil {
+		return err
+	}
+	for _, r := range tombstones {
+		if now.Before(r.DropAfter) {
+			continue
+		}
+		plan, err := findPlan(r.ServiceID, r.PlanID)
+		if err != nil {
+			log.Error("reap-find-plan", err)
+			continue
+		}
+		if r.VirtualCluster != "" {
+			// Its service was stopped when it was deleted.
+			if _, err := execWithRetry(plan.crdb,
+				fmt.Sprintf("DROP VIRTUAL CLUSTER IF EXISTS %s IMMEDIATE", sqlIdent(r.VirtualCluster)),
+			); err != nil {
+				log.Error("reap-drop-virtual-cluster", err)
+				continue
+			}
+		} else if _, err := execWithRetry(plan.crdb, "DROP DATABASE IF EXISTS "+r.Database+" CASCADE"); err != nil {
+			log.Error("reap-drop-database", err)
+			continue
+		}
+		// Keep the owner role if the instance ID was reused. Virtual
+		// clusters take theirs with them.
+		if _, err := sb.state.Instance(r.InstanceID); err == errStateNotFound && r.VirtualCluster == "" {
+			if _, err := plan.crdb.Exec(
+				"DROP ROLE IF EXISTS " + ownerRoleFromInstanceID(r.InstanceID),
+			); err != nil {
+				log.Error("reap-drop-owner-role", err)
+			}
+		}
+		if err := sb.state.DeleteTombstone(r.InstanceID); err != nil {
+			return err
+		}
+		log.Info("reaped-database", lager.Data{
+			"database": r.Database, "virtual-cluster": r.VirtualCluster, "instance-id": r.InstanceID,
+		})
+	}
+	return nil
+}
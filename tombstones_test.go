@@ -0,0 +1,276 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestSoftDelete(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.DeletionRetention, b.plan.deletionRetention = "1h", time.Hour
+	sb := b.sb
+
+	ctx := context.Background()
+	dbExists := func(name string) bool {
+		b.cluster.mu.Lock()
+		defer b.cluster.mu.Unlock()
+		return b.cluster.databases[name]
+	}
+	hasTable := func(db string) bool {
+		b.cluster.mu.Lock()
+		defer b.cluster.mu.Unlock()
+		_, ok := b.cluster.tables[db]["t"]
+		return ok
+	}
+	provision := func(instanceID string) {
+		t.Helper()
+		if _, err := sb.Provision(ctx, instanceID, b.provisionDetails(""), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deprovision := func(instanceID string) {
+		t.Helper()
+		if _, err := sb.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{
+			ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+		}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	provision("inst1")
+	db1 := dbNameFromInstanceID("inst1")
+	b.cluster.mu.Lock()
+	b.cluster.tables[db1] = map[string][]string{"t": nil}
+	b.cluster.mu.Unlock()
+	deprovision("inst1")
+	if dbExists(db1) {
+		t.Fatalf("database still exists after deprovision")
+	}
+	tomb, err := sb.state.Tombstone("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dbExists(tomb.Database) {
+		t.Fatalf("tombstoned database %s does not exist", tomb.Database)
+	}
+	// Nothing is dropped before the retention period has passed.
+	if err := sb.reap(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !dbExists(tomb.Database) {
+		t.Fatalf("tombstoned database dropped too early")
+	}
+
+	// Restore the deleted database into a new instance.
+	provision("inst2")
+	body := map[string]string{"target_instance_id": "inst2"}
+	if status := adminRequest(t, b.server, "POST", "/admin/tombstones/inst1/restore", body, nil); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if !hasTable(dbNameFromInstanceID("inst2")) {
+		t.Fatalf("restored table missing")
+	}
+	if _, err := sb.state.Tombstone("inst1"); err != errStateNotFound {
+		t.Errorf("expected tombstone to be gone, got %v", err)
+	}
+
+	// Provision a new instance from the deleted database.
+	deprovision("inst2")
+	spec, err := sb.Provision(ctx, "inst3", b.provisionDetails(`{"restore_from": {"instance_id": "inst2"}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := waitForLastOperation(t, sb, "inst3", spec.OperationData); res.State != brokerapi.Succeeded {
+		t.Fatalf("provision failed: %s", res.Description)
+	}
+	if !hasTable(dbNameFromInstanceID("inst3")) {
+		t.Fatalf("restored table missing")
+	}
+
+	// Once the retention period has passed, the reaper drops the database.
+	deprovision("inst3")
+	tomb, err = sb.state.Tombstone("inst3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.reap(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if dbExists(tomb.Database) {
+		t.Errorf("tombstoned database not dropped by the reaper")
+	}
+	if _, err := sb.state.Tombstone("inst3"); err != errStateNotFound {
+		t.Errorf("expected tombstone to be gone, got %v", err)
+	}
+}
+
+func TestSoftDeleteRestoreFrom(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	b.plan.DeletionRetention, b.plan.deletionRetention = "1h", time.Hour
+	ctx := context.Background()
+	details := brokerapi.DeprovisionDetails{ServiceID: b.plan.ServiceID, PlanID: b.plan.ID}
+	provision := func(instanceID, params string) brokerapi.LastOperation {
+		t.Helper()
+		spec, err := b.sb.Provision(ctx, instanceID, b.provisionDetails(params), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !spec.IsAsync {
+			return brokerapi.LastOperation{State: brokerapi.Succeeded}
+		}
+		return waitForLastOperation(t, b.sb, instanceID, spec.OperationData)
+	}
+
+	provision("inst1", "")
+	// The rename takes effect, but its result is lost.
+	b.cluster.injectLostResult(`^ALTER DATABASE \w+ RENAME`, driver.ErrBadConn, 1)
+	if _, err := b.sb.Deprovision(ctx, "inst1", details, false); err != nil {
+		t.Fatal(err)
+	}
+	tomb, err := b.sb.state.Tombstone("inst1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.cluster.databases[dbNameFromInstanceID("inst1")] || !b.cluster.databases[tomb.Database] {
+		t.Fatalf("expected the database to be renamed to %s", tomb.Database)
+	}
+
+	// If restoring fails, the database goes back to its tombstone.
+	b.cluster.injectFault(`^COMMENT ON DATABASE`, &pq.Error{Code: "XX000", Message: "injected"}, 1)
+	if res := provision("inst2", `{"restore_from": {"instance_id": "inst1"}}`); res.State != brokerapi.Failed {
+		t.Fatalf("expected the provision to fail, got %+v", res)
+	}
+	if b.cluster.databases[dbNameFromInstanceID("inst2")] || !b.cluster.databases[tomb.Database] {
+		t.Fatalf("expected the database to be renamed back to %s", tomb.Database)
+	}
+
+	if res := provision("inst3", `{"restore_from": {"instance_id": "inst1"}}`); res.State != brokerapi.Succeeded {
+		t.Fatalf("provision %s: %s", res.State, res.Description)
+	}
+	db3 := dbNameFromInstanceID("inst3")
+	if !b.cluster.databases[db3] || b.cluster.databases[tomb.Database] {
+		t.Errorf("expected database %s to be renamed to %s", tomb.Database, db3)
+	}
+	if c, err := databaseComment(b.plan.crdb, b.plan.namespace("inst3")); err != nil || c == nil || c.InstanceID != "inst3" {
+		t.Errorf("unexpected database comment %+v (%v)", c, err)
+	}
+	if _, err := b.sb.state.Tombstone("inst1"); err != errStateNotFound {
+		t.Errorf("expected tombstone to be gone, got %v", err)
+	}
+
+	// Only deleted instances can be restored.
+	_, err = b.sb.Provision(ctx, "inst4", b.provisionDetails(`{"restore_from": {"instance_id": "inst1"}}`), true)
+	if e, ok := err.(*brokerapi.FailureResponse); !ok || e.ValidatedStatusCode(nil) != http.StatusBadRequest {
+		t.Errorf("expected a bad request, got %v", err)
+	}
+}
+
+func TestSoftDeleteTenant(t *testing.T) {
+	b, cleanup := newFakeBroker()
+	defer cleanup()
+	defer useFakeInstanceConnect(b.cluster)()
+	b.plan.Isolation = isolationTenant
+	b.plan.DeletionRetention, b.plan.deletionRetention = "1h", time.Hour
+	ctx := context.Background()
+
+	provision := func(instanceID, params string) {
+		t.Helper()
+		spec, err := b.sb.Provision(ctx, instanceID, b.provisionDetails(params), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := waitForLastOperation(t, b.sb, instanceID, spec.OperationData); res.State != brokerapi.Succeeded {
+			t.Fatalf("provision %s: %s", res.State, res.Description)
+		}
+	}
+	deprovision := func(instanceID string) *tombstoneRecord {
+		t.Helper()
+		spec, err := b.sb.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{
+			ServiceID: b.plan.ServiceID, PlanID: b.plan.ID,
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := waitForLastOperation(t, b.sb, instanceID, spec.OperationData); res.State != brokerapi.Succeeded {
+			t.Fatalf("deprovision %s: %s", res.State, res.Description)
+		}
+		tomb, err := b.sb.state.Tombstone(instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := b.cluster.tenants[clusterNameFromInstanceID(instanceID)]; ok {
+			t.Errorf("virtual cluster of %s not renamed", instanceID)
+		}
+		if _, ok := b.cluster.tenants[tomb.VirtualCluster]; !ok || b.cluster.tenantsStarted[tomb.VirtualCluster] {
+			t.Errorf("expected virtual cluster %s to be kept without its service", tomb.VirtualCluster)
+		}
+		if _, err := b.sb.state.Instance(instanceID); err != errStateNotFound {
+			t.Errorf("expected the instance to be forgotten, got %v", err)
+		}
+		return tomb
+	}
+
+	provision("inst1", "")
+	tomb := deprovision("inst1")
+	if err := b.sb.reap(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.cluster.tenants[tomb.VirtualCluster]; !ok {
+		t.Fatal("virtual cluster dropped too early")
+	}
+	// A deleted virtual cluster can't replace another instance's.
+	if err := b.sb.restoreTombstone("inst1", "inst2"); err == nil {
+		t.Error("expected error")
+	}
+
+	provision("inst2", `{"restore_from": {"instance_id": "inst1"}}`)
+	tenant := b.cluster.tenants[clusterNameFromInstanceID("inst2")]
+	if tenant == nil || !b.cluster.tenantsStarted[clusterNameFromInstanceID("inst2")] {
+		t.Fatal("virtual cluster not restored")
+	}
+	if !tenant.hasUser(adminUserFromInstanceID("inst2")) || tenant.hasUser(adminUserFromInstanceID("inst1")) {
+		t.Error("expected the admin user to be replaced")
+	}
+	crdb, err := b.sb.instanceDB(b.plan, "inst2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := databaseComment(crdb, b.plan.namespace("inst2")); err != nil || c == nil || c.InstanceID != "inst2" {
+		t.Errorf("unexpected database comment %+v (%v)", c, err)
+	}
+
+	// Once the retention period has passed, the reaper drops the virtual
+	// cluster.
+	deprovision("inst2")
+	if err := b.sb.reap(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.cluster.tenants) != 0 {
+		t.Errorf("virtual clusters not dropped: %v", b.cluster.tenants)
+	}
+	if _, err := b.sb.state.Tombstone("inst2"); err != errStateNotFound {
+		t.Errorf("expected tombstone to be gone, got %v", err)
+	}
+}
@@ -17,8 +17,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"os"
+	"strings"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -51,49 +51,45 @@ func dbNameFromInstanceID(instanceID string) string {
 	return "cf_" + uuidToChars(uuid.NewV5(namespaceInstances, instanceID))
 }
 
-func userNameFromBinding(instanceID, bindingID string) string {
-	return uuidToChars(uuid.NewV5(namespaceUsernames, fmt.Sprintf("%s/%s", instanceID, bindingID)))
+// schemaNameFromInstanceID returns the schema of an instance of a plan with
+// schema isolation, which is named like the instance's database would be.
+func schemaNameFromInstanceID(instanceID string) string {
+	return dbNameFromInstanceID(instanceID)
 }
 
-// dbURI creates a URI that can be used to connect to CockroachDB;
-// user, pass, and db are optional.
-func dbURI(host, port, user, pass, db string, options url.Values) string {
-	if host == "" || port == "" {
-		panic("host/port not passed")
-	}
+// sharedDBNameFromPlanID returns the database holding the schemas of the
+// instances of a plan with schema isolation.
+func sharedDBNameFromPlanID(planID string) string {
+	return "cf_shared_" + uuidToChars(uuid.NewV5(namespacePlans, planID))
+}
 
-	u := url.URL{
-		Scheme:   "postgres",
-		Host:     fmt.Sprintf("%s:%s", host, port),
-		Path:     db,
-		RawQuery: options.Encode(),
-	}
+// clusterNameFromInstanceID returns the name of the cluster of an instance of
+// a plan that gives each instance one: its virtual cluster, or the Kubernetes
+// objects of its dedicated cluster. Neither can have underscores.
+func clusterNameFromInstanceID(instanceID string) string {
+	return strings.Replace(dbNameFromInstanceID(instanceID), "_", "-", -1)
+}
 
-	if user != "" {
-		if pass != "" {
-			u.User = url.UserPassword(user, pass)
-		} else {
-			u.User = url.User(user)
-		}
-	}
-	return u.String()
+// cloudClusterNameFromInstanceID returns the name of the CockroachDB Cloud
+// cluster of an instance, which Cloud limits to 20 characters.
+func cloudClusterNameFromInstanceID(instanceID string) string {
+	return clusterNameFromInstanceID(instanceID)[:20]
 }
 
-func jdbcURL(host, port, user, pass, db string, options url.Values) string {
-	if host == "" || port == "" {
-		panic("host/port not passed")
-	}
-	url := fmt.Sprintf("jdbc:postgresql://%s:%s/%s", host, port, db)
-	if user != "" {
-		url = url + fmt.Sprintf("&user=%s", user)
-		if pass != "" {
-			url = url + fmt.Sprintf("&password=%s", pass)
-		}
-	}
-	if len(options) > 0 {
-		url = url + "?" + options.Encode()
-	}
-	return url
+// adminUserFromInstanceID returns the admin user the broker creates in the
+// cluster of an instance that has one of its own.
+func adminUserFromInstanceID(instanceID string) string {
+	return dbNameFromInstanceID(instanceID) + "_admin"
+}
+
+// ownerRoleFromInstanceID returns the role that takes over the objects created
+// by an instance's binding users when they are unbound.
+func ownerRoleFromInstanceID(instanceID string) string {
+	return dbNameFromInstanceID(instanceID) + "_owner"
+}
+
+func userNameFromBinding(instanceID, bindingID string) string {
+	return uuidToChars(uuid.NewV5(namespaceUsernames, fmt.Sprintf("%s/%s", instanceID, bindingID)))
 }
 
 // createTempFile creates a temporary file and populates it with the given